@@ -117,6 +117,8 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser '((define a psql_expression3) ">=" (define b psql_expression2)) '((quote >=) a b))
 		(parser '((define a psql_expression3) "<" (define b psql_expression2)) '((quote <) a b))
 		(parser '((define a psql_expression3) ">" (define b psql_expression2)) '((quote >) a b))
+		(parser '((define a psql_expression3) (atom "COLLATE" true) (define collation psql_identifier) (atom "LIKE" true) (define b psql_expression2) (atom "ESCAPE" true) (define e psql_expression2)) '('strlike a b collation e))
+		(parser '((define a psql_expression3) (atom "LIKE" true) (define b psql_expression2) (atom "ESCAPE" true) (define e psql_expression2)) '('strlike a b nil e))
 		(parser '((define a psql_expression3) (atom "COLLATE" true) (define collation psql_identifier) (atom "LIKE" true) (define b psql_expression2)) '('strlike a b collation))
 		(parser '((define a psql_expression3) (atom "LIKE" true) (define b psql_expression2)) '('strlike a b))
 		(parser '((define a psql_expression3) (atom "IN" true) "(" (define b (+ psql_expression ",")) ")") '('contains? (cons list b) a))
@@ -159,6 +161,9 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser '((atom "PASSWORD" true) "(" (define p psql_expression) ")") '('password p))
 		(parser '((atom "UNIX_TIMESTAMP" true) "(" ")") '('now))
 		(parser '((atom "UNIX_TIMESTAMP" true) "(" (define p psql_expression) ")") '('parse_date p))
+		(parser '((atom "DATE_ADD" true) "(" (define p psql_expression) "," (atom "INTERVAL" true) (define n psql_expression) (define unit (regex "(?i)SECOND|MINUTE|HOUR|DAY|MONTH|YEAR")) ")") '('date-add p n unit))
+		(parser '((atom "DATE_SUB" true) "(" (define p psql_expression) "," (atom "INTERVAL" true) (define n psql_expression) (define unit (regex "(?i)SECOND|MINUTE|HOUR|DAY|MONTH|YEAR")) ")") '('date-add p '('- 0 n) unit))
+		(parser '((atom "TIMESTAMPDIFF" true) "(" (define unit (regex "(?i)SECOND|MINUTE|HOUR|DAY|MONTH|YEAR")) "," (define a psql_expression) "," (define b psql_expression) ")") '('date-diff a b unit))
 		(parser '((atom "FLOOR" true) "(" (define p psql_expression) ")") '('floor p))
 		(parser '((atom "CEIL" true) "(" (define p psql_expression) ")") '('ceil p))
 		(parser '((atom "CEILING" true) "(" (define p psql_expression) ")") '('ceil p))
@@ -488,6 +493,7 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 			) (lambda (id) '((quote createcolumn) schema id col type dimensions typeparams)))
 			(parser '((atom "OWNER" true) (atom "TO" true) (define owner psql_identifier)) (lambda (id) '((quote altertable) schema id "owner" owner)))
 			(parser '((atom "DROP" true) (? (atom "COLUMN" true)) (define col psql_identifier)) (lambda (id) '((quote altertable) schema id "drop" col)))
+			(parser '((atom "RENAME" true) (atom "COLUMN" true) (define col psql_identifier) (atom "TO" true) (define newname psql_identifier)) (lambda (id) '((quote altercolumn) schema id col "rename" newname)))
 			(parser '((atom "ENGINE" true) "=" (atom "MEMORY" true)) (lambda (id) '((quote altertable) schema id "engine" "memory")))
 			(parser '((atom "ENGINE" true) "=" (atom "SLOPPY" true)) (lambda (id) '((quote altertable) schema id "engine" "sloppy")))
 			(parser '((atom "ENGINE" true) "=" (atom "LOGGING" true)) (lambda (id) '((quote altertable) schema id "engine" "logging")))
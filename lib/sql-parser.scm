@@ -112,6 +112,8 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser '((define a sql_expression3) ">=" (define b sql_expression2)) '((quote >=) a b))
 		(parser '((define a sql_expression3) "<" (define b sql_expression2)) '((quote <) a b))
 		(parser '((define a sql_expression3) ">" (define b sql_expression2)) '((quote >) a b))
+		(parser '((define a sql_expression3) (atom "COLLATE" true) (define collation sql_identifier) (atom "LIKE" true) (define b sql_expression2) (atom "ESCAPE" true) (define e sql_expression2)) '('strlike a b collation e))
+		(parser '((define a sql_expression3) (atom "LIKE" true) (define b sql_expression2) (atom "ESCAPE" true) (define e sql_expression2)) '('strlike a b nil e))
 		(parser '((define a sql_expression3) (atom "COLLATE" true) (define collation sql_identifier) (atom "LIKE" true) (define b sql_expression2)) '('strlike a b collation))
 		(parser '((define a sql_expression3) (atom "LIKE" true) (define b sql_expression2)) '('strlike a b))
 		(parser '((define a sql_expression3) (atom "IN" true) "(" (define b (+ sql_expression ",")) ")") '('contains? (cons list b) a))
@@ -155,12 +157,16 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser '((atom "UNIX_TIMESTAMP" true) "(" ")") '('now))
 		(parser '((atom "UNIX_TIMESTAMP" true) "(" (define p sql_expression) ")") '('parse_date p))
 		(parser '((atom "CURRENT_TIMESTAMP" true) "(" (? sql_expression /* ignore precision */) ")") '('now))
+		(parser '((atom "DATE_ADD" true) "(" (define p sql_expression) "," (atom "INTERVAL" true) (define n sql_expression) (define unit (regex "(?i)SECOND|MINUTE|HOUR|DAY|MONTH|YEAR")) ")") '('date-add p n unit))
+		(parser '((atom "DATE_SUB" true) "(" (define p sql_expression) "," (atom "INTERVAL" true) (define n sql_expression) (define unit (regex "(?i)SECOND|MINUTE|HOUR|DAY|MONTH|YEAR")) ")") '('date-add p '('- 0 n) unit))
+		(parser '((atom "TIMESTAMPDIFF" true) "(" (define unit (regex "(?i)SECOND|MINUTE|HOUR|DAY|MONTH|YEAR")) "," (define a sql_expression) "," (define b sql_expression) ")") '('date-diff a b unit))
 		(parser '((atom "FLOOR" true) "(" (define p sql_expression) ")") '('floor p))
 		(parser '((atom "CEIL" true) "(" (define p sql_expression) ")") '('ceil p))
 		(parser '((atom "CEILING" true) "(" (define p sql_expression) ")") '('ceil p))
 		(parser '((atom "ROUND" true) "(" (define p sql_expression) ")") '('round p))
 		(parser '((atom "UPPER" true) "(" (define p sql_expression) ")") '('toUpper p))
 		(parser '((atom "LOWER" true) "(" (define p sql_expression) ")") '('toLower p))
+		(parser '((atom "REGEXP_REPLACE" true) "(" (define p sql_expression) "," (define pattern sql_expression) "," (define replacement sql_expression) ")") '('regexp_replace p pattern replacement))
 		(parser '((atom "CAST" true) "(" (define p sql_expression) (atom "AS" true) (atom "UNSIGNED" true) ")") '('simplify p)) /* TODO: proper implement CAST; for now make vscode work */
 		(parser '((atom "CAST" true) "(" (define p sql_expression) (atom "AS" true) (atom "INTEGER" true) ")") '('simplify p)) /* TODO: proper implement CAST; for now make vscode work */
 		(parser '((atom "CAST" true) "(" (define p sql_expression) (atom "AS" true) (atom "CHAR" true) (atom "CHARACTER" true) (atom "SET" true) (atom "utf8" true) ")") '('concat p)) /* TODO: proper implement CAST; for now make vscode work */
@@ -481,6 +487,7 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 				(define typeparams (regex "[^,)]*")) /* TODO: rest */
 			) (lambda (id) '((quote createcolumn) schema id col type dimensions typeparams)))
 			(parser '((atom "DROP" true) (? (atom "COLUMN" true)) (define col sql_identifier)) (lambda (id) '((quote altertable) schema id "drop" col)))
+			(parser '((atom "RENAME" true) (atom "COLUMN" true) (define col sql_identifier) (atom "TO" true) (define newname sql_identifier)) (lambda (id) '((quote altercolumn) schema id col "rename" newname)))
 			(parser '((atom "ENGINE" true) "=" (atom "MEMORY" true)) (lambda (id) '((quote altertable) schema id "engine" "memory")))
 			(parser '((atom "ENGINE" true) "=" (atom "SLOPPY" true)) (lambda (id) '((quote altertable) schema id "engine" "sloppy")))
 			(parser '((atom "ENGINE" true) "=" (atom "LOGGING" true)) (lambda (id) '((quote altertable) schema id "engine" "logging")))
@@ -524,7 +531,7 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser '((atom "DROP" true) (atom "DATABASE" true) (define id sql_identifier)) '((quote dropdatabase) id))
 		(parser '((atom "DROP" true) (atom "TABLE" true) (define if_exists (? (atom "IF" true) (atom "EXISTS" true))) (define schema sql_identifier) (atom "." true) (define id sql_identifier)) '((quote droptable) schema id (if if_exists true false)))
 		(parser '((atom "DROP" true) (atom "TABLE" true) (define if_exists (? (atom "IF" true) (atom "EXISTS" true))) (define id sql_identifier)) '((quote droptable) schema id (if if_exists true false)))
-		(parser '((atom "SET" true) (? (atom "SESSION" true)) (define vars (* (parser '((? "@") (define key sql_identifier) "=" (define value sql_expression)) '((quote session) key value)) ","))) (cons '!begin vars))
+		(parser '((atom "SET" true) (? (atom "SESSION" true)) (define vars (* (parser '((? "@") (define key sql_identifier) "=" (define value sql_expression)) '((quote session) '((quote toLower) key) value)) ","))) (cons '!begin vars))
 
 		(parser '((atom "LOCK" true) (or (atom "TABLES" true) (atom "TABLE" true)) (+ (or sql_identifier '(sql_identifier (atom "AS" true) sql_identifier)) ",") (? (atom "READ" true)) (? (atom "LOCAL" true)) (? (atom "LOW_PRIORITY" true)) (? (atom "WRITE" true))) "ignore")
 		(parser '((atom "UNLOCK" true) (or (atom "TABLES" true) (atom "TABLE" true))) "ignore")
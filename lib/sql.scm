@@ -33,6 +33,67 @@ Copyright (C) 2023  Carl-Philip Hänsch
 
 (set globalvars '("lower_case_table_names" 0))
 
+/* import a SQL dump (e.g. from mysqldump) into schema; unsupported statements are skipped with a warning
+foreign keys are not checked during the import since dumps contain the tables in arbitrary order */
+(define loadSQL (lambda (schema stream) (begin
+	(set importstat (newsession))
+	(importstat "statements" 0)
+	(importstat "rows" 0)
+	(importstat "skipped" 0)
+	(foreign-key-checks false (lambda () (sql-statements stream (lambda (sql) (begin
+		(define resultrow (lambda (item) true))
+		(define session (newsession))
+		(try (lambda () (begin
+			(define result (eval (source "SQL import" 1 1 (parse_sql schema sql))))
+			(importstat "statements" (+ (importstat "statements") 1))
+			(if (number? result) (importstat "rows" (+ (importstat "rows") result)))
+		)) (lambda (e) (begin
+			(print "loadSQL: skipping statement " (if (> (strlen sql) 80) (concat (substr sql 0 80) "...") sql) ": " e)
+			(importstat "skipped" (+ (importstat "skipped") 1))
+		)))
+	)))))
+	(list "statements" (importstat "statements") "rows" (importstat "rows") "skipped" (importstat "skipped"))
+)))
+
+/* run SQL statements (separated by ;) from a string, e.g. to seed data in setup scripts; resultrow is called with each result row (may be nil)
+returns the number of affected or returned rows */
+(define sql (lambda (schema query resultrow_) (begin
+	(define sqlstat (newsession))
+	(sqlstat "rows" 0)
+	(define session (newsession))
+	(sql-statements query (lambda (stmt) (begin
+		(define resultrow (lambda (item) (begin
+			(sqlstat "rows" (+ (sqlstat "rows") 1))
+			(if (nil? resultrow_) true (resultrow_ item))
+		)))
+		(define result (foreign-key-checks (session "foreign_key_checks") (lambda () (eval (source "SQL" 1 1 (parse_sql schema stmt)))))) /* SET FOREIGN_KEY_CHECKS = 0 holds for the rest of the session */
+		(if (number? result) (sqlstat "rows" (+ (sqlstat "rows") result)))
+	)))
+	(sqlstat "rows")
+)))
+
+/* test (sql): a SELECT must deliver the same rows as the equivalent direct scan */
+(createdatabase "memcp-tests" true)
+(sql "memcp-tests" "CREATE TABLE sqltest(id int, v text) ENGINE=MEMORY; INSERT INTO sqltest VALUES (1, 'a'), (2, 'b'), (3, 'c'), (4, 'd')" nil)
+(define sqltest (newsession))
+(sqltest "sql" '())
+(sqltest "scan" '())
+(assert (sql "memcp-tests" "SELECT v FROM sqltest WHERE id > 1 ORDER BY id DESC" (lambda (row) (sqltest "sql" (append (sqltest "sql") (row "v"))))) 3 "sql returns the number of rows")
+(scan_order "memcp-tests" "sqltest" '("id") (lambda (id) (> id 1)) '("id") '(>) 0 -1 '("v") (lambda (v) (sqltest "scan" (append (sqltest "scan") v))))
+(assert (sqltest "sql") (sqltest "scan") "sql SELECT equals direct scan")
+(assert (sqltest "sql") '("d" "c" "b") "sql SELECT with WHERE and ORDER BY")
+(dropdatabase "memcp-tests")
+
+/* test: SET FOREIGN_KEY_CHECKS only affects its own session, loadSQL imports without foreign key checks */
+(createdatabase "memcp-tests" true)
+(sql "memcp-tests" "CREATE TABLE fkp(id int, PRIMARY KEY(id)) ENGINE=MEMORY; CREATE TABLE fkc(id int, p int, FOREIGN KEY (p) REFERENCES fkp(id)) ENGINE=MEMORY" nil)
+(assert (try (lambda () (sql "memcp-tests" "INSERT INTO fkc VALUES (1, 99)" nil)) (lambda (e) "rejected")) "rejected" "foreign keys are checked by default")
+(sql "memcp-tests" "SET FOREIGN_KEY_CHECKS = 0; INSERT INTO fkc VALUES (1, 99)" nil)
+(assert (try (lambda () (sql "memcp-tests" "INSERT INTO fkc VALUES (2, 98)" nil)) (lambda (e) "rejected")) "rejected" "SET FOREIGN_KEY_CHECKS does not leak into other sessions")
+(loadSQL "memcp-tests" "INSERT INTO fkc VALUES (3, 97); INSERT INTO fkp VALUES (97)")
+(assert (scan "memcp-tests" "fkc" '() (lambda () true) '("id") (lambda (id) id) + 0) 4 "unchecked inserts of the session and the import")
+(dropdatabase "memcp-tests")
+
 /* http hook for handling SQL */
 (define http_handler (begin
 	(set old_handler http_handler)
@@ -45,7 +106,7 @@ Copyright (C) 2023  Carl-Philip Hänsch
 			(define formula (parse_sql schema query))
 			(define resultrow (res "jsonl"))
 			(define session (context "session"))
-			(try (lambda () (eval (source "SQL Query" 1 1 formula))) (lambda(e) (begin
+			(try (lambda () (foreign-key-checks (session "foreign_key_checks") (lambda () (eval (source "SQL Query" 1 1 formula))))) (lambda(e) (begin
 				(print "SQL query: " query)
 				(print "execution plan: " formula)
 				(print "error: " e)
@@ -67,7 +128,7 @@ Copyright (C) 2023  Carl-Philip Hänsch
 			(define formula (parse_psql schema query))
 			(define resultrow (res "jsonl"))
 			(define session (context "session"))
-			(try (lambda () (eval (source "SQL Query" 1 1 formula))) (lambda(e) (begin
+			(try (lambda () (foreign-key-checks (session "foreign_key_checks") (lambda () (eval (source "SQL Query" 1 1 formula))))) (lambda(e) (begin
 				(print "SQL query: " query)
 				(print "execution plan: " formula)
 				(print "error: " e)
@@ -130,7 +191,7 @@ Copyright (C) 2023  Carl-Philip Hänsch
 					(print "error: " e)
 					(error e)
 				))))
-				(try (lambda () (eval (source "SQL Query" 1 1 formula))) (lambda(e) (begin
+				(try (lambda () (foreign-key-checks (session "foreign_key_checks") (lambda () (eval (source "SQL Query" 1 1 formula))))) (lambda(e) (begin
 					(print "SQL query: " sql)
 					(print "execution plan: " formula)
 					(print "error: " e)
@@ -42,6 +42,22 @@ Copyright (C) 2024  Carl-Philip Hänsch
 (assert (strlike "asdfm" "%df") false "!strlike postfix")
 (assert (strlike "masdf" "a%f") false "!strlike infix")
 (assert (strlike "asd whatever mif" "a%ever%f") true "two infix")
+(assert (strlike "abc" "%_c") true "strlike wildcard after wildcard")
+(assert (strlike "abc" "abc%%") true "strlike double wildcard")
+(assert (strlike "100%" "100\\%" nil "\\") true "strlike escaped percent")
+(assert (strlike "1000" "100\\%" nil "\\") false "!strlike escaped percent")
+(assert (strlike "a_b" "a\\_b" nil "\\") true "strlike escaped underscore")
+(assert (strlike "axb" "a\\_b" nil "\\") false "!strlike escaped underscore")
+(assert (strlike "a\\b" "a\\\\b" nil "\\") true "strlike escaped escape")
+(assert (strlike "50% off" "%\\%%" nil "\\") true "strlike escaped percent after wildcard")
+(assert (strlike "50 off" "%\\%%" nil "\\") false "!strlike escaped percent after wildcard")
+(assert (strlike "ab\\" "ab\\" nil "\\") true "strlike trailing lone escape")
+(assert (strlike "ab\\" "ab\\") true "strlike backslash without escape")
+(assert (strlike "5%" "5%%" nil "%") true "strlike escape is percent")
+(assert (strlike "5x" "5%%" nil "%") false "!strlike escape is percent")
+(assert (strlike "5xy" "5%x%" nil "%") true "strlike escape is percent, wildcard")
+(assert (strlike "5xy" "5%_" nil "%") false "!strlike percent escapes underscore")
+(assert (strlike "5_" "5%_" nil "%") true "strlike percent escapes underscore literal")
 
 /* match */
 (assert (match '(1 2 3 5 6) (merge '(a b) rest) (concat "a=" a ", b=" b ", rest=" rest)) "a=1, b=2, rest=(3 5 6)" "match merge")
@@ -133,6 +149,889 @@ Copyright (C) 2024  Carl-Philip Hänsch
 (assert (equal? (round 3.7) 4) true "round of 3.7 should be 4")
 (assert (equal? (round 3.2) 3) true "round of 3.2 should be 3")
 
+/* Test for date-add and date-diff */
+(assert (date-add "2024-01-31" 1 "month") "2024-02-29" "date-add clamps to leap day")
+(assert (date-add "2023-01-31" 1 "month") "2023-02-28" "date-add clamps to end of february")
+(assert (date-add "2024-02-29" 1 "year") "2025-02-28" "date-add year from leap day")
+(assert (date-add "2024-03-31" -1 "month") "2024-02-29" "date-add negative month")
+(assert (date-add "2024-01-01 00:00:10" -20 "second") "2023-12-31 23:59:50" "date-add negative seconds")
+(assert (date-add "2024-12-31" 1 "day") "2025-01-01" "date-add day")
+(assert (date-add 86400 1 "hour") 90000 "date-add timestamp")
+(assert (date-diff "2024-01-31" "2024-02-29" "month") 0 "date-diff incomplete month")
+(assert (date-diff "2024-01-31" "2024-03-31" "month") 2 "date-diff months")
+(assert (date-diff "2024-03-31" "2024-01-31" "month") -2 "date-diff negative months")
+(assert (date-diff "2024-02-29" "2025-02-28" "year") 0 "date-diff incomplete year")
+(assert (date-diff "2024-03-01" "2024-02-28" "day") -2 "date-diff negative days over leap day")
+(assert (date-diff "2024-01-01 10:00" "2024-01-01 12:30" "minute") 150 "date-diff minutes")
+(assert (parse_date "1970-01-02") 86400 "parse_date")
+
+/* Test for collate */
+(assert (serialize (collate "de_ci" true)) "(collate \"de_ci\" true)" "serialize collate")
+(assert ((lambda (original reparsed) (equal?
+	(map '('("a" "B") '("B" "a") '("ä" "b") '("Z" "ä") '("x10" "x9")) (lambda (p) (original (car p) (car (cdr p)))))
+	(map '('("a" "B") '("B" "a") '("ä" "b") '("Z" "ä") '("x10" "x9")) (lambda (p) (reparsed (car p) (car (cdr p)))))
+)) (collate "de_ci" true) (eval (scheme (serialize (collate "de_ci" true))))) true "reparsed collate compares like the original")
+
+/* Test for column rename */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "rename" '('("column" "id" "int" '() '()) '("column" "name" "text" '() '()) '("unique" "u" '("name"))) '("engine" "memory") true)
+(insert "memcp-tests" "rename" '("id" "name") '('(1 "a") '(2 "b")))
+(altercolumn "memcp-tests" "rename" "name" "rename" "title")
+(assert (scan "memcp-tests" "rename" '("title") (lambda (title) (equal? title "b")) '("id") (lambda (id) id) + 0) 2 "scan renamed column")
+(assert (insert "memcp-tests" "rename" '("id" "title") '('(3 "a")) '() (lambda () true)) 0 "unique key follows renamed column")
+(dropdatabase "memcp-tests")
+
+/* Test for explain */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "explain" '('("column" "id" "int" '() '()) '("column" "name" "text" '() '()) '("unique" "PRIMARY" '("id"))) '("engine" "memory") true)
+(insert "memcp-tests" "explain" '("id" "name") '('(1 "a") '(5 "bcdef")))
+(assert ((explain "memcp-tests" "explain" '("id") (lambda (id) (equal? id 5))) "access") "indexed" "explain equality on indexed column")
+(assert ((explain "memcp-tests" "explain" '("name") (lambda (name) (> (strlen name) 3))) "access") "full scan" "explain computed condition")
+(dropdatabase "memcp-tests")
+
+/* Test for delta-of-delta column storage: increasing, constant and with NULLs */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "delta" '('("column" "inc" "int" '() '("storage" "delta")) '("column" "const" "int" '() '("storage" "delta")) '("column" "nulls" "int" '() '("storage" "delta"))) '("engine" "memory") true)
+(insert "memcp-tests" "delta" '("inc" "const" "nulls") (map (produceN 1000) (lambda (i) (list (+ 1000 (* i 3)) 42 (if (equal? (floor (/ i 7)) (/ i 7)) nil (* i i))))))
+(rebuild false false)
+(assert (scan "memcp-tests" "delta" '() (lambda () true) '("inc") (lambda (inc) inc) + 0) 2498500 "delta storage increasing column")
+(assert (scan "memcp-tests" "delta" '() (lambda () true) '("const") (lambda (c) c) + 0) 42000 "delta storage constant column")
+(assert (scan "memcp-tests" "delta" '() (lambda () true) '("nulls") (lambda (n) (if (nil? n) 1 0)) + 0) 143 "delta storage NULLs")
+(assert (scan "memcp-tests" "delta" '("inc") (lambda (inc) (equal? inc 2998)) '("nulls") (lambda (n) n) + 0) 443556 "delta storage random access")
+(dropdatabase "memcp-tests")
+
+/* Test for storage hints that do not fit the values */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "hint" '('("column" "id" "int" '() '()) '("column" "f" "any" '() '("storage" "int")) '("column" "s" "any" '() '("storage" "int")) '("column" "b" "any" '() '("storage" "bits")) '("column" "m" "any" '() '("storage" "int"))) '("engine" "memory") true)
+(insert "memcp-tests" "hint" '("id" "f" "s" "b" "m") '('(1 2.5 "abc" "hello" 1.5) '(2 7 "x" "world" "abc") '(3 nil nil nil true)))
+(rebuild true false)
+(assert (scan "memcp-tests" "hint" '() (lambda () true) '("id" "f" "s" "b" "m") (lambda (id f s b m) (list (list id f s b m))) merge '()) '('(1 2.5 "abc" "hello" 1.5) '(2 7 "x" "world" "abc") '(3 nil nil nil true)) "values survive a rebuild of columns forced to a storage they do not fit")
+(dropdatabase "memcp-tests")
+
+/* Test for table-swap */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "swapa" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(createtable "memcp-tests" "swapb" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(createtable "memcp-tests" "swapm" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "swapa" '("v") '('(1)))
+(insert "memcp-tests" "swapb" '("v") '('(2) '(3)))
+(define swapCount (lambda (tbl) (scan "memcp-tests" tbl '() (lambda () true) '("v") (lambda (v) v) + 0)))
+(table-swap "memcp-tests" "swapa" "swapb")
+(assert (list (swapCount "swapa") (swapCount "swapb") (swapCount "swapm")) '(5 1 0) "table-swap exchanges the tables")
+(table-swap "memcp-tests" "swapb" "swapa")
+(assert (list (swapCount "swapa") (swapCount "swapb")) '(1 5) "swapping back")
+(assert (filter (show "memcp-tests") (lambda (t) (strlike t "swap%"))) '("swapa" "swapb" "swapm") "table list stays sorted after swapping")
+(dropdatabase "memcp-tests")
+
+/* Test for computed columns in delta storage */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "comp" '('("column" "a" "int" '() '()) '("column" "b" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "comp" '("a" "b") '('(1 2) '(3 nil)))
+(createcolumn "memcp-tests" "comp" "total" "any" '() '() '("a" "b") (lambda (a b) (if (nil? b) -1 (+ a b))))
+(insert "memcp-tests" "comp" '("a" "b") '('(10 20) '(30 nil)))
+(assert (scan "memcp-tests" "comp" '() (lambda () true) '("a" "total") (lambda (a total) (list (list a total))) merge '()) '('(1 3) '(3 -1) '(10 30) '(30 -1)) "computed column with a NULL source in main and delta storage")
+(dropdatabase "memcp-tests")
+
+/* Test for foreign key checks on insert */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "fkparent" '('("column" "id" "int" '() '()) '("unique" "PRIMARY" '("id"))) '("engine" "memory") true)
+(createtable "memcp-tests" "fkchild" '('("column" "id" "int" '() '()) '("column" "parent" "int" '() '()) '("foreign" "fk_parent" '("parent") "fkparent" '("id"))) '("engine" "memory") true)
+(insert "memcp-tests" "fkparent" '("id") '('(1) '(2)))
+(assert (insert "memcp-tests" "fkchild" '("id" "parent") '('(1 1) '(2 2) '(3 1))) 3 "foreign key: valid insert")
+(assert (try (lambda () (insert "memcp-tests" "fkchild" '("id" "parent") '('(4 3)))) (lambda (e) "rejected")) "rejected" "foreign key: orphan insert is rejected")
+(assert (insert "memcp-tests" "fkchild" '("id" "parent") '('(5 nil))) 1 "foreign key: NULL references nothing")
+(dropdatabase "memcp-tests")
+
+/* Test for ON DELETE CASCADE / SET NULL / RESTRICT */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "fka" '('("column" "id" "int" '() '())) '("engine" "memory") true)
+(createtable "memcp-tests" "fkb" '('("column" "id" "int" '() '()) '("column" "a" "int" '() '()) '("foreign" "fk_b" '("a") "fka" '("id") "cascade" "cascade")) '("engine" "memory") true)
+(createtable "memcp-tests" "fkc" '('("column" "id" "int" '() '()) '("column" "b" "int" '() '()) '("foreign" "fk_c" '("b") "fkb" '("id") "cascade" "cascade")) '("engine" "memory") true)
+(createtable "memcp-tests" "fkn" '('("column" "id" "int" '() '()) '("column" "a" "int" '() '()) '("foreign" "fk_n" '("a") "fka" '("id") "set null" "set null")) '("engine" "memory") true)
+(insert "memcp-tests" "fka" '("id") '('(1) '(2)))
+(insert "memcp-tests" "fkb" '("id" "a") '('(10 1) '(11 1) '(12 2)))
+(insert "memcp-tests" "fkc" '("id" "b") '('(100 10) '(101 11) '(102 12)))
+(insert "memcp-tests" "fkn" '("id" "a") '('(1000 1) '(1001 2)))
+(define fkdelete (lambda (tbl id) (scan "memcp-tests" tbl '("id") (lambda (x) (equal? x id)) '("$update") (lambda ($update) (if ($update) 1 0)) + 0)))
+(assert (fkdelete "fka" 1) 1 "ON DELETE CASCADE deletes the parent")
+(assert (scan "memcp-tests" "fkb" '() (lambda () true) '("id") (lambda (id) id) + 0) 12 "ON DELETE CASCADE first level")
+(assert (scan "memcp-tests" "fkc" '() (lambda () true) '("id") (lambda (id) id) + 0) 102 "ON DELETE CASCADE second level")
+(assert (scan "memcp-tests" "fkn" '("a") (lambda (a) (nil? a)) '("id") (lambda (id) id) + 0) 1000 "ON DELETE SET NULL")
+(createtable "memcp-tests" "fkr" '('("column" "id" "int" '() '()) '("column" "a" "int" '() '()) '("foreign" "fk_r" '("a") "fka" '("id") "restrict" "restrict")) '("engine" "memory") true)
+(insert "memcp-tests" "fkr" '("id" "a") '('(1 2)))
+(assert (fkdelete "fka" 2) 0 "ON DELETE RESTRICT blocks the deletion")
+(assert (scan "memcp-tests" "fkb" '() (lambda () true) '("id") (lambda (id) id) + 0) 12 "RESTRICT does not cascade")
+(assert (table-foreign-key-index "memcp-tests" "fkb") '('("a")) "foreign key columns are indexed")
+(assert (table-foreign-key-index "memcp-tests" "fka") '() "a referenced table has no foreign key index")
+(define fkShardIndexes (lambda (tbl) (apply_assoc (lambda (indexes) (map indexes (lambda (index) (apply_assoc (lambda (cols) cols) index)))) (inspect-shard "memcp-tests" tbl 0))))
+(assert (has? (fkShardIndexes "fkr") '("a")) true "the foreign key index exists in the shard")
+(rebuild true false)
+(assert (has? (fkShardIndexes "fkr") '("a")) true "the foreign key index is rebuilt with the table")
+(dropdatabase "memcp-tests")
+
+/* Test for vector-map and vector-reduce */
+(assert (vector-reduce (vector 1 2 3 4) (lambda (acc v i) (+ acc v)) 0) 10 "vector-reduce sum")
+(assert (vector-reduce (vector 5 7) (lambda (acc v i) (+ acc i)) 0) 1 "vector-reduce passes the index")
+(assert (vector-reduce (vector) (lambda (acc v i) (+ acc v)) 42) 42 "vector-reduce of an empty vector is neutral")
+(assert (vector-reduce (vector-map (vector 3 4) (lambda (v i) (/ v 5))) (lambda (acc v i) (+ acc (* v v))) 0) 1 "vector-map normalization has length 1")
+(assert (vector-dot (vector-map (vector 1 1 1) (lambda (v i) (* v i))) (vector 1 1 1)) 3 "vector-map passes the index")
+(assert (vector-dot (vector-map (vector) (lambda (v i) v)) (vector)) 0 "vector-map of an empty vector")
+
+/* Test for vector-dot and vector-add */
+(define vectorList (lambda (v) (vector-reduce v (lambda (acc x i) (append acc x)) '())))
+(assert (vector-dot (vector 1 2 3) (vector 4 5 6)) 32 "vector-dot")
+(assert (vector-dot (vector) (vector)) 0 "vector-dot of empty vectors")
+(assert (try (lambda () (vector-dot (vector 1 2) (vector 1))) (lambda (e) "rejected")) "rejected" "vector-dot rejects a length mismatch")
+(assert (vectorList (vector-add (vector 1 2 3) (vector 10 20 30))) '(11 22 33) "vector-add")
+(assert (vectorList (vector-add (vector) (vector))) '() "vector-add of empty vectors")
+(assert (try (lambda () (vector-add (vector 1 2) (vector 1))) (lambda (e) "rejected")) "rejected" "vector-add rejects a length mismatch")
+(assert (try (lambda () (vector-add (vector 1 2) (vector 1 2) (vector 0))) (lambda (e) "rejected")) "rejected" "vector-add rejects an into of the wrong length")
+(define vectorAcc (vector 1 2 3))
+(define vectorOther (vector 1 1 1))
+(vector-add vectorAcc vectorOther vectorAcc)
+(vector-add vectorAcc vectorOther vectorAcc)
+(assert (vectorList vectorAcc) '(3 4 5) "vector-add into a accumulates in place")
+(assert (vectorList vectorOther) '(1 1 1) "vector-add into a leaves b unchanged")
+
+/* Test for settings validation and ShardSize */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "shards" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "shards" '("v") (map (produceN 1000) (lambda (i) (list i))))
+(rebuild false false) /* pivots are sampled from main storage */
+(set oldShardSize (settings "ShardSize"))
+(assert (count (shardcolumn "memcp-tests" "shards" "v")) 0 "default ShardSize gives one partition")
+(settings "ShardSize" 400)
+(assert (settings "ShardSize") 400 "ShardSize is read back")
+(assert (count (shardcolumn "memcp-tests" "shards" "v")) 5 "ShardSize is honored by shardcolumn")
+(assert (try (lambda () (settings "ShardSize" 0)) (lambda (e) "rejected")) "rejected" "ShardSize must be positive")
+(assert (try (lambda () (settings "PartitionMaxDimensions" 0)) (lambda (e) "rejected")) "rejected" "PartitionMaxDimensions must be positive")
+(assert (try (lambda () (settings "MemoryBudget" 1000)) (lambda (e) "rejected")) "rejected" "there is no MemoryBudget setting")
+(assert (try (lambda () (settings "NoSuchSetting" 1)) (lambda (e) "rejected")) "rejected" "unknown settings are rejected")
+(settings "ShardSize" oldShardSize)
+(dropdatabase "memcp-tests")
+
+/* Test for table-snapshot and table-restore */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "snap" '('("column" "id" "int" '() '()) '("column" "v" "text" '() '())) '("engine" "safe") true)
+(insert "memcp-tests" "snap" '("id" "v") (map (produceN 100) (lambda (i) (list i (concat "v" i)))))
+(rebuild false false)
+(insert "memcp-tests" "snap" '("id" "v") (map (produceN 10) (lambda (i) (list (+ 100 i) "delta"))))
+(scan "memcp-tests" "snap" '("id") (lambda (id) (< id 5)) '("$update") (lambda ($update) ($update)) + 0)
+(assert (table-snapshot "memcp-tests" "snap" "memcp-tests/snapshot") 105 "snapshot row count")
+(insert "memcp-tests" "snap" '("id" "v") '('(1000 "after snapshot")))
+(assert (table-restore "memcp-tests" "snap2" "memcp-tests/snapshot") 105 "restored row count")
+(assert (scan "memcp-tests" "snap2" '() (lambda () true) '("id") (lambda (id) id) + 0) 5985 "restored rows")
+(assert (scan "memcp-tests" "snap2" '("v") (lambda (v) (equal? v "delta")) '("id") (lambda (id) 1) + 0) 10 "restored delta")
+(dropdatabase "memcp-tests")
+
+/* Test for compressed column files */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "packed" '('("column" "s" "text" '() '())) '("engine" "safe" "compress" "xz") true)
+(insert "memcp-tests" "packed" '("s") (map (produceN 100000) (lambda (i) (list (concat "customer-" (floor (/ i 7)) "-entry")))))
+(rebuild false false)
+(assert (table-snapshot "memcp-tests" "packed" "memcp-tests/packed") 100000 "snapshot of a compressed table")
+(assert (table-restore "memcp-tests" "unpacked" "memcp-tests/packed") 100000 "compressed column files are read back")
+(assert (scan "memcp-tests" "unpacked" '("s") (lambda (s) (equal? s "customer-777-entry")) '("s") (lambda (s) 1) + 0) 7 "decompressed values are identical")
+(createtable "memcp-tests" "zpacked" '('("column" "s" "text" '() '())) '("engine" "safe" "compress" "zstd") true)
+(insert "memcp-tests" "zpacked" '("s") (map (produceN 100000) (lambda (i) (list (concat "customer-" (floor (/ i 7)) "-entry")))))
+(rebuild false false)
+(assert (table-snapshot "memcp-tests" "zpacked" "memcp-tests/zpacked") 100000 "snapshot of a zstd compressed table")
+(assert (table-restore "memcp-tests" "zunpacked" "memcp-tests/zpacked") 100000 "zstd column files are read back")
+(assert (scan "memcp-tests" "zunpacked" '("s") (lambda (s) (equal? s "customer-777-entry")) '("s") (lambda (s) 1) + 0) 7 "zstd decompressed values are identical")
+(assert (try (lambda () (createtable "memcp-tests" "badpacked" '('("column" "s" "text" '() '())) '("engine" "safe" "compress" "lz77") true)) (lambda (e) "rejected")) "rejected" "unknown compression")
+(dropdatabase "memcp-tests")
+
+/* Test for sampled scans */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "sample" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "sample" '("v") (map (produceN 100000) (lambda (i) (list i))))
+(set sampleCount (scan "memcp-tests" "sample" '() (lambda () true) '() (lambda () 1) + 0 nil false '("sample" 0.1)))
+(assert (and (> sampleCount 9500) (< sampleCount 10500)) true "10% sample has ~10000 rows")
+(assert (scan "memcp-tests" "sample" '() (lambda () true) '() (lambda () 1) + 0 nil false '("sample" 0.1)) sampleCount "sample is reproducible")
+(assert (equal? (scan "memcp-tests" "sample" '() (lambda () true) '() (lambda () 1) + 0 nil false '("sample" 0.1 "sampleSeed" 42)) sampleCount) false "sampleSeed draws another sample")
+(assert (scan "memcp-tests" "sample" '() (lambda () true) '() (lambda () 1) + 0 nil false '("sample" 1.0)) 100000 "sample 1.0 is a full scan")
+(assert (scan "memcp-tests" "sample" '() (lambda () true) '() (lambda () 1) + 0 nil false '("sample" 0.1 "sampleScale" true)) (* 10 sampleCount) "sampleScale extrapolates counts")
+(define scansTotal (lambda () (simplify (nth (split (nth (filter (split (metrics) "\n") (lambda (line) (strlike line "memcp_scans_total %"))) 0) " ") 1))))
+(set scansBefore (scansTotal))
+(scan "memcp-tests" "sample" '() (lambda () true) '() (lambda () 1) + 0 nil false '("sample" 0.1 "sampleScale" true))
+(assert (- (scansTotal) scansBefore) 1 "sampleScale counts as one scan")
+(dropdatabase "memcp-tests")
+
+/* Test for triggers */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "orders" '('("column" "id" "int" '() '()) '("column" "amount" "int" '() '())) '("engine" "memory") true)
+(createtable "memcp-tests" "audit" '('("column" "what" "text" '() '()) '("column" "ref" "int" '() '())) '("engine" "memory") true)
+(createtrigger "memcp-tests" "orders" "after" "insert" '() (lambda (NEW) (apply_assoc (lambda (id) (insert "memcp-tests" "audit" '("what" "ref") (list (list "insert" id)))) NEW)))
+(createtrigger "memcp-tests" "orders" "before" "insert" '() (lambda (NEW) (apply_assoc (lambda (amount) (if (< amount 0) false (set_assoc NEW "amount" (* amount 100)))) NEW)))
+(createtrigger "memcp-tests" "orders" "after" "update" '("amount") (lambda (OLD NEW) (apply_assoc (lambda (id) (insert "memcp-tests" "audit" '("what" "ref") (list (list "update" id)))) NEW)))
+(createtrigger "memcp-tests" "orders" "after" "delete" '() (lambda (OLD) (apply_assoc (lambda (id) (insert "memcp-tests" "audit" '("what" "ref") (list (list "delete" id)))) OLD)))
+(insert "memcp-tests" "orders" '("id" "amount") '('(1 5) '(2 7)))
+(assert (scan "memcp-tests" "audit" '("what") (lambda (what) (equal? what "insert")) '("ref") (lambda (ref) ref) + 0) 3 "after insert trigger writes audit rows")
+(assert (scan "memcp-tests" "orders" '() (lambda () true) '("amount") (lambda (amount) amount) + 0) 1200 "before insert trigger modifies NEW")
+(assert (try (lambda () (insert "memcp-tests" "orders" '("id" "amount") '('(3 -1)))) (lambda (e) "aborted")) "aborted" "before insert trigger aborts")
+(scan "memcp-tests" "orders" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update '("id" 10))))
+(assert (scan "memcp-tests" "audit" '("what") (lambda (what) (equal? what "update")) '() (lambda () 1) + 0) 0 "update trigger only fires for its columns")
+(scan "memcp-tests" "orders" '("id") (lambda (id) (equal? id 10)) '("$update") (lambda ($update) ($update '("amount" 1))))
+(assert (scan "memcp-tests" "audit" '("what") (lambda (what) (equal? what "update")) '("ref") (lambda (ref) ref) + 0) 10 "after update trigger")
+(scan "memcp-tests" "orders" '("id") (lambda (id) (equal? id 2)) '("$update") (lambda ($update) ($update)))
+(assert (scan "memcp-tests" "audit" '("what") (lambda (what) (equal? what "delete")) '("ref") (lambda (ref) ref) + 0) 2 "after delete trigger")
+(createtrigger "memcp-tests" "audit" "after" "insert" '() (lambda (NEW) (insert "memcp-tests" "audit" '("what" "ref") '('("loop" 0)))))
+(assert (try (lambda () (insert "memcp-tests" "audit" '("what" "ref") '('("x" 0)))) (lambda (e) "too deep")) "too deep" "trigger recursion is limited")
+(createtable "memcp-tests" "partial" '('("column" "id" "int" '() '("auto_increment" true)) '("column" "x" "int" '() '()) '("column" "d" "int" '() '("default" 5))) '("engine" "memory") true)
+(createtrigger "memcp-tests" "partial" "before" "insert" '() (lambda (NEW) (apply_assoc (lambda (x) (if (equal? x 1) (set_assoc NEW "d" 7) (if (equal? x 3) (set_assoc NEW "id" 50) NEW))) NEW)))
+(assert (insert "memcp-tests" "partial" '("x") '('(1) '(2) '(3)) '() nil false true) '(1 2 50) "before insert trigger sets the id of one row of a batch")
+(assert (scan "memcp-tests" "partial" '() (lambda () true) '("x" "d") (lambda (x d) (* x d)) + 0) 32 "a column that the trigger sets on one row keeps its default on the other rows")
+(assert (scan "memcp-tests" "partial" '("x") (lambda (x) (equal? x 2)) '("id") (lambda (id) id) + 0) 2 "rows without the trigger's column get a generated id")
+(dropdatabase "memcp-tests")
+
+/* Test for flatmap scans */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "tags" '('("column" "id" "int" '() '()) '("column" "tags" "text" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "tags" '("id" "tags") '('(1 "a,b,c") '(2 "d") '(3 "")))
+(define explode (lambda (tags) (if (equal? tags "") '() (split tags ","))))
+(assert (scan "memcp-tests" "tags" '() (lambda () true) '("tags") explode (lambda (acc v) (+ acc 1)) 0 + false '("flatmap" true)) 4 "flatmap emits one row per element")
+(assert (scan "memcp-tests" "tags" '() (lambda () true) '("tags") explode (lambda (acc v) (concat acc v)) "" nil false '("flatmap" true "deterministicOrder" true)) "abcd" "flatmap in deterministic order")
+(assert (scan "memcp-tests" "tags" '("id") (lambda (id) (equal? id 3)) '("tags") explode (lambda (acc v) (+ acc 1)) 0 nil true '("flatmap" true)) 1 "flatmap with only empty lists emits one NULL row for isOuter")
+(assert (scan "memcp-tests" "tags" '() (lambda () true) '("tags") (lambda (tags) 1) + 0) 3 "without flatmap one value per row")
+(assert (scan nil '('("tags" "x,y") '("tags" "")) '() (lambda () true) '("tags") explode (lambda (acc v) (+ acc 1)) 0 nil false '("flatmap" true)) 2 "flatmap on lists")
+(dropdatabase "memcp-tests")
+
+/* Test for hash */
+(assert (hash "abc") "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" "sha256 is the default")
+(assert (hash "abc" "sha1") "a9993e364706816aba3e25717850c26c9cd0d89d" "sha1")
+(assert (hash "abc" "md5") "900150983cd24fb0d6963f7d28e17f72" "md5")
+(assert (hexdump "hello\n") "00000000  68 65 6c 6c 6f 0a                                 |hello.|\n00000006\n" "hexdump pads a short line so the ascii column stays aligned")
+(assert (hexdump "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA") "00000000  41 41 41 41 41 41 41 41  41 41 41 41 41 41 41 41  |AAAAAAAAAAAAAAAA|\n*\n00000030\n" "hexdump collapses repeated lines into *")
+(assert (hexdump "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAB") "00000000  41 41 41 41 41 41 41 41  41 41 41 41 41 41 41 41  |AAAAAAAAAAAAAAAA|\n*\n00000030  42                                                |B|\n00000031\n" "hexdump prints the line after a collapsed run")
+(assert (hexdump "") "" "hexdump of empty data is empty")
+(assert (hash "" "xxhash") "ef46db3751d8e999" "xxhash of empty string")
+(assert (hash "abc" "xxhash") "44bc2cf5ad770999" "xxhash")
+(assert (hash "Nobody inspects the spammish repetition" "xxhash") "fbcea83c8a378bf1" "xxhash of more than 32 bytes")
+(assert (hash '("a" 1 "b" 2)) (hash (list "a" 1 "b" (+ 1 1))) "equal assoc lists hash equally")
+(assert (equal? (hash '("a" 1 "b" 2)) (hash '("b" 2 "a" 1))) false "the order of assoc lists matters")
+
+/* Test for HyperLogLog */
+(define hllMod (lambda (i) (- i (* 200000 (floor (/ i 200000))))))
+(set hll1 (reduce (produceN 500000) (lambda (h i) (hll-add h (hllMod i))) nil))
+(set hll2 (reduce (produceN 500000) (lambda (h i) (hll-add h (hllMod (+ i 500000)))) nil))
+(set hllEstimate (hll-count (hll-merge hll1 hll2)))
+(assert (and (> hllEstimate 194000) (< hllEstimate 206000)) true "hll counts 1000000 values with 200000 distinct values within 3%")
+(assert (hll-count (reduce (produceN 200000) hll-add nil)) hllEstimate "merged sketches count like a sketch of the union")
+(assert (hll-count (hll-new)) 0 "empty sketch")
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "hll" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "hll" '("v") (map (produceN 10000) (lambda (i) (list (floor (/ i 10))))))
+(set hllEstimate (hll-count (scan "memcp-tests" "hll" '() (lambda () true) '("v") (lambda (v) v) hll-add nil hll-merge)))
+(assert (and (> hllEstimate 970) (< hllEstimate 1030)) true "count distinct in a scan")
+(assert (column-approx-distinct "memcp-tests" "hll" "v") hllEstimate "column statistics use the same sketch as hll-add")
+(dropdatabase "memcp-tests")
+
+/* Test for scan limit/offset */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "lim" '('("column" "id" "int" '() '())) '("engine" "memory") true)
+(settings "ShardSize" 1000)
+(map (produceN 10) (lambda (j) (insert "memcp-tests" "lim" '("id") (map (produceN 1000) (lambda (i) (list (+ i (* j 1000))))))))
+(settings "ShardSize" 60000)
+(assert (scan "memcp-tests" "lim" '() (lambda () true) '("id") (lambda (id) 1) + 0 nil false '("limit" 10)) 10 "scan limit over several shards")
+(assert (scan "memcp-tests" "lim" '() (lambda () true) '("id") (lambda (id) 1) + 0 nil false '("limit" 10 "offset" 9995)) 5 "scan offset")
+(assert (scan "memcp-tests" "lim" '() (lambda () true) '("id") (lambda (id) 1) + 0 nil false '("limit" 0)) 10000 "limit 0 is unlimited")
+(assert (scan "memcp-tests" "lim" '() (lambda () true) '("id") (lambda (id) id) + 0 nil false '("limit" 3 "offset" 2 "deterministicOrder" true)) 9 "deterministic limit follows record order")
+(assert (scan nil '('("a" 1) '("a" 2) '("a" 3) '("a" 4)) '() (lambda () true) '("a") (lambda (a) a) + 0 nil false '("limit" 2 "offset" 1)) 5 "limit on lists")
+(dropdatabase "memcp-tests")
+
+/* Test for ENUM columns */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "enum" '('("column" "id" "int" '() '()) '("column" "color" "enum" '() '("enum" '("red" "green" "blue"))) '("column" "size" "enum" '() '("enum" '("S" "M" "L") "enumInvalidNull" true))) '("engine" "memory") true)
+(insert "memcp-tests" "enum" '("id" "color" "size") (map (produceN 999) (lambda (i) (list i (nth '("red" "green" "blue") (- i (* 3 (floor (/ i 3))))) "XL"))))
+(rebuild false false)
+(assert (scan "memcp-tests" "enum" '("color") (lambda (color) (equal? color "green")) '("color") (lambda (color) 1) + 0) 333 "ENUM values are read back")
+(assert (scan "memcp-tests" "enum" '() (lambda () true) '("size") (lambda (size) (if (nil? size) 1 0)) + 0) 999 "values outside the set become NULL with enumInvalidNull")
+(assert (try (lambda () (insert "memcp-tests" "enum" '("id" "color") '('(5 "purple")))) (lambda (e) "rejected")) "rejected" "values outside the set are rejected")
+(scan "memcp-tests" "enum" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update '("size" "M"))) + 0)
+(assert (scan "memcp-tests" "enum" '("id") (lambda (id) (equal? id 1)) '("color" "size") (lambda (color size) (list color size)) merge '()) '("green" "M") "update of an ENUM column")
+(dropdatabase "memcp-tests")
+
+/* Test for merge_assoc */
+(assert (merge_assoc '("a" 1 "b" 2) '("b" 3 "c" 4)) '("a" 1 "b" 3 "c" 4) "shallow merge overwrites")
+(assert (merge_assoc '("a" '("x" 1 "y" 2)) '("a" '("y" 3))) '("a" '("y" 3)) "shallow merge replaces nested dictionaries")
+(assert (merge_assoc '("a" '("x" 1 "y" 2) "b" 1) '("a" '("y" 3 "z" 4) "b" 2) nil true) '("a" '("x" 1 "y" 3 "z" 4) "b" 2) "deep merge")
+(assert (merge_assoc '("a" 1 "b" 2) '("a" 10 "c" 5) (lambda (old new key) (concat key (+ old new)))) '("a" "a11" "b" 2 "c" 5) "merge callback gets the key")
+(assert (merge_assoc '("a" '("n" 1)) '("a" '("n" 2)) (lambda (old new) (+ old new)) true) '("a" '("n" 3)) "deep merge calls merge for the leaves")
+(assert (try (lambda () (merge_assoc '("a" 1 "b") '("a" 2))) (lambda (e) "rejected")) "rejected" "malformed dictionaries are rejected")
+
+/* Test for table metadata */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "meta" '('("column" "id" "int" '() '())) '("engine" "memory" "collation" "utf8mb4_general_ci") true)
+(insert "memcp-tests" "meta" '("id") (map (produceN 100) (lambda (i) (list i))))
+(assert (show "memcp-tests" "meta" "meta") '("rows" 100 "shards" 1 "dimensions" '() "engine" "memory" "collation" "utf8mb4_general_ci" "auto_increment" 0) "metadata of a memory table")
+(partitiontable "memcp-tests" "meta" '("id" '(25 50 75)))
+(assert ((show "memcp-tests" "meta" "meta") "shards") 4 "shard count of a partitioned table")
+(assert ((show "memcp-tests" "meta" "meta") "dimensions") '("id") "partition dimensions")
+(assert ((show "memcp-tests" "meta" "meta") "rows") 100 "row count of a partitioned table")
+(dropdatabase "memcp-tests")
+
+/* Test for snapshot scans */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "iso" '('("column" "id" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "iso" '("id") (map (produceN 100) (lambda (i) (list i))))
+(assert (scan "memcp-tests" "iso" '() (lambda () true) '("id") (lambda (id) (begin (insert "memcp-tests" "iso" '("id") '('(1000))) 1)) + 0 nil false '("snapshot" true)) 100 "snapshot scan ignores rows inserted during the scan")
+(assert (scan "memcp-tests" "iso" '() (lambda () true) '("id") (lambda (id) (begin (if (equal? id 0) (scan "memcp-tests" "iso" '("id") (lambda (id) (> id 0)) '("$update") (lambda ($update) ($update)) + 0)) 1)) + 0 nil false '("snapshot" true "orderedWithinShard" true)) 200 "snapshot scan still sees rows deleted during the scan")
+(assert (scan "memcp-tests" "iso" '() (lambda () true) '() (lambda () 1) + 0) 1 "rows were deleted")
+(createtable "memcp-tests" "iso2" '('("column" "id" "int" '() '())) '("engine" "memory") true)
+(set oldShardSize (settings "ShardSize"))
+(settings "ShardSize" 40)
+(map (produceN 5) (lambda (b) (insert "memcp-tests" "iso2" '("id") (map (produceN 20) (lambda (i) (list (+ (* b 20) i)))))))
+(settings "ShardSize" oldShardSize)
+(assert (scan "memcp-tests" "iso2" '() (lambda () true) '("id") (lambda (id) (begin (if (equal? id 0) (begin
+	(scan "memcp-tests" "iso2" '("id") (lambda (id) (>= id 50)) '("$update") (lambda ($update) ($update)) + 0)
+	(rebuild true false)
+	(scan "memcp-tests" "iso2" '("id") (lambda (id) (and (>= id 10) (< id 20))) '("$update") (lambda ($update) ($update)) + 0)
+	(insert "memcp-tests" "iso2" '("id") (map (produceN 10) (lambda (i) (list (+ 1000 i))))))) id)) + 0 nil false '("snapshot" true)) 4950 "snapshot scan over several shards is not affected by a rebuild during the scan")
+(assert (scan "memcp-tests" "iso2" '() (lambda () true) '() (lambda () 1) + 0) 50 "rows were deleted and inserted during the snapshot scan")
+(dropdatabase "memcp-tests")
+
+/* Test for ON DUPLICATE KEY UPDATE */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "upsert" '('("column" "k" "text" '() '()) '("column" "count" "int" '() '()) '("unique" "PRIMARY" '("k"))) '("engine" "memory") true)
+(assert (insert "memcp-tests" "upsert" '("k" "count") '('("a" 1) '("b" 1) '("a" 1) '("c" 1) '("a" 1) '("b" 1)) '("count" (lambda (old.count) (+ old.count 1))) 'update) 3 "repeated keys in one batch are updated")
+(assert (scan "memcp-tests" "upsert" '() (lambda () true) '("k" "count") (lambda (k count) (list k count)) merge '()) '("c" 1 "a" 3 "b" 2) "count = count + 1 for repeated keys")
+(insert "memcp-tests" "upsert" '("k" "count") '('("a" 10)) '("count" (lambda (old.count NEW.count) (+ old.count NEW.count))) 'update)
+(assert (scan "memcp-tests" "upsert" '("k") (lambda (k) (equal? k "a")) '("count") (lambda (count) count) + 0) 13 "update expressions can use NEW values")
+(dropdatabase "memcp-tests")
+
+/* Test for infix parsers */
+(define infixCalc (parser (infix (regex "[0-9]+") '("+" 1 "-" 1 "*" 2 "/" 2 "^" '(3 "right")) (lambda (a op b) (list op a b)) '("-") (lambda (op a) (list op a)))))
+(assert (infixCalc "1+2*3-4") '("-" '("+" "1" '("*" "2" "3")) "4") "infix respects precedence and left associativity")
+(assert (infixCalc "2^3^2") '("^" "2" '("^" "3" "2")) "infix right associativity")
+(assert (infixCalc "-2 * 3") '("*" '("-" "2") "3") "infix prefix operators")
+(assert (infixCalc "7") "7" "infix with a single operand")
+
+/* Test for transactions */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "tx" '('("column" "id" "int" '() '()) '("column" "v" "text" '() '()) '("unique" "PRIMARY" '("id"))) '("engine" "memory") true)
+(insert "memcp-tests" "tx" '("id" "v") '('(1 "a") '(2 "b")))
+(assert (try (lambda () (transaction "memcp-tests" (lambda () (begin
+	(insert "memcp-tests" "tx" '("id" "v") '('(3 "c") '(4 "d")))
+	(scan "memcp-tests" "tx" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update '("v" "changed"))) + 0)
+	(scan "memcp-tests" "tx" '("id") (lambda (id) (equal? id 2)) '("$update") (lambda ($update) ($update)) + 0)
+	(error "fail"))))) (lambda (e) "rolled back")) "rolled back" "transaction passes on the error")
+(assert (scan "memcp-tests" "tx" '() (lambda () true) '("id" "v") (lambda (id v) (list id v)) merge '()) '(1 "a" 2 "b") "failed transaction undoes inserts, updates and deletes")
+(assert (transaction "memcp-tests" (lambda () (insert "memcp-tests" "tx" '("id" "v") '('(3 "c"))))) 1 "transaction returns the result of body")
+(assert (scan "memcp-tests" "tx" '() (lambda () true) '("id") (lambda (id) 1) + 0) 3 "successful transaction keeps its rows")
+(createtable "memcp-tests" "txchild" '('("column" "id" "int" '() '()) '("column" "parent" "int" '() '()) '("foreign" "fk_tx" '("parent") "tx" '("id") "cascade" "cascade")) '("engine" "memory") true)
+(createtable "memcp-tests" "txnull" '('("column" "id" "int" '() '()) '("column" "parent" "int" '() '()) '("foreign" "fk_txnull" '("parent") "tx" '("id") "set null" "set null")) '("engine" "memory") true)
+(insert "memcp-tests" "txchild" '("id" "parent") '('(10 1) '(11 1) '(12 2)))
+(insert "memcp-tests" "txnull" '("id" "parent") '('(20 1)))
+(assert (try (lambda () (transaction "memcp-tests" (lambda () (begin
+	(scan "memcp-tests" "tx" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update)) + 0)
+	(assert (scan "memcp-tests" "txchild" '() (lambda () true) '("id") (lambda (id) 1) + 0) 1 "the cascade happens inside the transaction")
+	(error "fail"))))) (lambda (e) "rolled back")) "rolled back" "transaction with cascading delete fails")
+(assert (scan "memcp-tests" "tx" '() (lambda () true) '("id") (lambda (id) 1) + 0) 3 "rollback restores the parent")
+(assert (scan "memcp-tests" "txchild" '() (lambda () true) '("id") (lambda (id) 1) + 0) 3 "rollback restores the cascaded children")
+(assert (scan "memcp-tests" "txnull" '("parent") (lambda (parent) (equal? parent 1)) '("id") (lambda (id) 1) + 0) 1 "rollback restores SET NULL columns")
+(createtable "memcp-tests" "txr" '('("column" "id" "int" '() '()) '("column" "v" "text" '() '()) '("unique" "PRIMARY" '("id"))) '("engine" "memory") true)
+(insert "memcp-tests" "txr" '("id" "v") '('(1 "a") '(2 "b") '(3 "c")))
+(assert (try (lambda () (transaction "memcp-tests" (lambda () (begin
+	(scan "memcp-tests" "txr" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update '("v" "x"))) + 0)
+	(scan "memcp-tests" "txr" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update '("v" "y"))) + 0)
+	(error "fail"))))) (lambda (e) "rolled back")) "rolled back" "transaction that updates a row twice fails")
+(assert (scan "memcp-tests" "txr" '("id") (lambda (id) (equal? id 1)) '("v") (lambda (v) (list v)) merge '()) '("a") "rollback of two updates leaves the original row only")
+(assert (try (lambda () (transaction "memcp-tests" (lambda () (begin
+	(scan "memcp-tests" "txr" '("id") (lambda (id) (equal? id 2)) '("$update") (lambda ($update) ($update)) + 0)
+	(rebuild true false)
+	(error "fail"))))) (lambda (e) "rolled back")) "rolled back" "transaction with a delete and a rebuild fails")
+(assert (scan "memcp-tests" "txr" '() (lambda () true) '("id") (lambda (id) 1) + 0) 3 "rollback after a rebuild restores the deleted row")
+(assert (scan "memcp-tests" "txr" '("id") (lambda (id) (equal? id 2)) '("v") (lambda (v) (list v)) merge '()) '("b") "restored row keeps its values")
+(assert (try (lambda () (insert "memcp-tests" "txr" '("id" "v") '('(2 "z")))) (lambda (e) "rejected")) "rejected" "restored row is still unique")
+(dropdatabase "memcp-tests")
+
+/* Test for sort */
+(define people '('("last" "Miller" "first" "Tom") '("last" "Adams" "first" "Zoe") '("last" "Miller" "first" "Anna") '("last" "Adams" "first" "Bob")))
+(assert (map (sort people '('((lambda (p) (p "last")) <) '((lambda (p) (p "first")) <))) (lambda (p) (p "first"))) '("Bob" "Zoe" "Anna" "Tom") "sort by last name then first name")
+(assert (map (sort people '('((lambda (p) (p "last")) >) '((lambda (p) (p "first")) <))) (lambda (p) (p "first"))) '("Anna" "Tom" "Bob" "Zoe") "sort descending then ascending")
+(assert (map (sort people (lambda (p) (p "last"))) (lambda (p) (p "first"))) '("Zoe" "Bob" "Tom" "Anna") "sort is stable and accepts a bare key function")
+(assert (sort '("file10" "file2" "file1") '('((lambda (x) x) (collate "en_US")))) '("file1" "file2" "file10") "sort with a collation")
+(assert (sort '() '('((lambda (x) x) <))) '() "sort an empty list")
+
+/* Test for diff and patch */
+(define docOld '("name" "Alice" "age" 30 "address" '("city" "Berlin" "zip" "10115" "geo" '("lat" 52 "lon" 13)) "tags" '(1 2)))
+(define docNew '("name" "Alice" "age" 31 "address" '("city" "Berlin" "zip" "10117" "geo" '("lat" 52 "lon" 13)) "tags" '(1 2 3) "email" "a@example.com"))
+(assert (diff docOld docNew) '('("set" "age" 31) '("diff" "address" '('("set" "zip" "10117"))) '("set" "tags" '(1 2 3)) '("set" "email" "a@example.com")) "diff leaves out unchanged subtrees")
+(assert (patch docOld (diff docOld docNew)) docNew "patch reconstructs changed and added keys")
+(define docRemoved '("name" "Alice" "address" '("city" "Berlin" "geo" '("lat" 52 "lon" 13)) "tags" '(1 2)))
+(assert (patch docOld (diff docOld docRemoved)) docRemoved "patch reconstructs removed keys")
+(define docRetyped '("name" '("first" "Alice" "last" "Smith") "age" 30 "address" "Berlin" "tags" '(1 2)))
+(assert (diff docOld docRetyped) '('("set" "name" '("first" "Alice" "last" "Smith")) '("set" "address" "Berlin")) "type changes are full replaces")
+(assert (patch docOld (diff docOld docRetyped)) docRetyped "patch reconstructs type changes")
+(assert (diff docNew docNew) '() "equal documents give an empty patch")
+(assert docOld '("name" "Alice" "age" 30 "address" '("city" "Berlin" "zip" "10115" "geo" '("lat" 52 "lon" 13)) "tags" '(1 2)) "patch leaves the input unharmed")
+
+/* Test for base32 and base64url */
+(assert (base32_encode "foobar") "MZXW6YTBOI======" "base32 encode with padding")
+(assert (base32_encode "foobar" true) "MZXW6YTBOI" "base32 encode without padding")
+(assert (base32_decode "MZXW6YTBOI") "foobar" "base32 decode without padding")
+(assert (base32_decode (base32_encode "TOTP secret!")) "TOTP secret!" "base32 round-trip")
+(assert (try (lambda () (base32_decode "M1!")) (lambda (e) "rejected")) "rejected" "invalid base32 panics")
+(assert (base64url_encode "{\"alg\":\"HS256\",\"typ\":\"JWT\"}" true) "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9" "base64url encodes a JWT header")
+(assert (base64url_decode "eyJzdWIiOiIxMjM0NTY3ODkwIiwibmFtZSI6IkpvaG4gRG9lIiwiaWF0IjoxNTE2MjM5MDIyfQ") "{\"sub\":\"1234567890\",\"name\":\"John Doe\",\"iat\":1516239022}" "base64url decodes a JWT payload")
+(assert (base64url_encode "??>???") "Pz8-Pz8_" "base64url uses - and _")
+(assert (base64url_encode "?>") "Pz4=" "base64url encode with padding")
+(assert (base64url_decode (base64url_encode "?>" true)) "?>" "base64url round-trip without padding")
+(assert (try (lambda () (base64url_decode "Pz8+")) (lambda (e) "rejected")) "rejected" "invalid base64url panics")
+
+/* Test for stable scans */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "stable" '('("column" "id" "int" '() '())) '("engine" "memory") true)
+(settings "ShardSize" 100)
+(map (produceN 5) (lambda (j) (insert "memcp-tests" "stable" '("id") (map (produceN 100) (lambda (i) (list (+ i (* j 100))))))))
+(settings "ShardSize" 60000)
+(define stableRun (lambda () (scan "memcp-tests" "stable" '() (lambda () true) '("id") (lambda (id) (concat id ",")) concat "" nil false '("stable" true))))
+(assert (equal? (stableRun) (stableRun)) true "two stable scans give identical output")
+(assert (stableRun) (reduce (produceN 500) (lambda (acc i) (concat acc i ",")) "") "stable scan reduces in shard and record order")
+(assert (scan "memcp-tests" "stable" '() (lambda () true) '("id") (lambda (id) id) + 0 nil false '("stable" true "limit" 3 "offset" 2)) 9 "stable limit follows record order")
+(assert (scan "memcp-tests" "stable" '() (lambda () true) '("id") (lambda (id) (concat id ",")) concat "" nil false '("associative" true "orderedWithinShard" true)) (stableRun) "associative reduce keeps the shard order")
+(assert (scan "memcp-tests" "stable" '() (lambda () true) '("id") (lambda (id) id) + 0 nil false '("associative" true)) 124750 "associative sum matches the serial sum")
+(assert (scan "memcp-tests" "stable" '() (lambda () true) '("id") (lambda (id) id) max 0 nil false '("associative" true)) 499 "associative max")
+(dropdatabase "memcp-tests")
+
+/* Test for analyze histograms */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "hist" '('("column" "v" "int" '() '()) '("column" "s" "text" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "hist" '("v" "s") (map (produceN 1000) (lambda (i) (list (if (< i 900) 0 (- i 899)) (if (< i 10) nil (concat "k" (floor (/ i 10))))))))
+(column-approx-distinct "memcp-tests" "hist" "v")
+(define histEstimate (lambda (cond) ((scan "memcp-tests" "hist" '("v") cond '() (lambda () 1) + 0 nil false '("explainOnly" true)) "estimatedOutput")))
+(assert (< (histEstimate (lambda (v) (equal? v 0))) 100) true "without histogram, equality assumes uniform values")
+(define histV (analyze "memcp-tests" "hist" "v" 10))
+(assert (reduce (histV "buckets") (lambda (acc b) (+ acc (b "count"))) 0) 1000 "histogram buckets sum to the row count")
+(assert (list (histV "min") (histV "max") (histV "distinct") (histV "nulls")) '(0 100 101 0) "histogram min max distinct nulls")
+(assert (histEstimate (lambda (v) (equal? v 0))) 900 "histogram estimates skewed equality")
+(define histRange (histEstimate (lambda (v) (> v 50))))
+(assert (and (> histRange 40) (< histRange 60)) true "histogram estimates ranges")
+(define histS (analyze "memcp-tests" "hist" "s" 7))
+(assert (+ (histS "nulls") (reduce (histS "buckets") (lambda (acc b) (+ acc (b "count"))) 0)) 1000 "string histogram buckets and nulls sum to the row count")
+(assert (list (histS "min") (histS "max") (count (histS "buckets"))) '("k1" "k99" 7) "string histogram is ordered by collation")
+(dropdatabase "memcp-tests")
+
+/* Test for spawn and await */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "jobs" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "jobs" '("v") (map (produceN 100) (lambda (i) (list i))))
+(define jobs (map '(10 50 90) (lambda (limit) (spawn (lambda (limit) (scan "memcp-tests" "jobs" '("v") (lambda (v) (< v limit)) '("v") (lambda (v) v) + 0)) limit))))
+(assert (reduce jobs (lambda (acc job) (+ acc (await job))) 0) 5275 "spawned scans are awaited and summed")
+(assert (await (car jobs)) 45 "awaiting twice returns the cached result")
+(define failingJob (spawn (lambda () (error "job failed"))))
+(assert (try (lambda () (await failingJob)) (lambda (e) "rejected")) "rejected" "a panic in the body surfaces at await")
+(dropdatabase "memcp-tests")
+
+/* Test for rounding */
+(assert (list (floor -2.5) (ceil -2.5) (trunc -2.5) (round -2.5)) '(-3 -2 -2 -3) "rounding negative numbers")
+(assert (list (floor 7) (ceil 7) (trunc 7) (round 7)) '(7 7 7 7) "integers pass through")
+(assert (round 19.995 2) 20 "currency rounding")
+(assert (round 1.005 2) 1.01 "round uses the decimal representation")
+(assert (round -1.2345 3) -1.235 "round negative numbers to digits")
+(assert (round 1250 -2) 1300 "negative digits round to hundreds")
+(assert (round 1234.5 -1) 1230 "negative digits round to tens")
+(assert (list (round 2.5 0 "half-even") (round 3.5 0 "half-even") (round 0.125 2 "half-even")) '(2 4 0.12) "half-even rounding")
+(assert (round 1250 -2 "half-even") 1200 "half-even with negative digits")
+
+/* Test for group commit */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "gc" '('("column" "v" "int" '() '())) '("engine" "safe") true)
+(settings "SyncInterval" 5)
+(map (map (produceN 4) (lambda (w) (spawn (lambda (w) (map (produceN 25) (lambda (i) (insert "memcp-tests" "gc" '("v") (list (list (+ i (* w 25)))))))) w))) await)
+(settings "SyncInterval" 0)
+(assert (scan "memcp-tests" "gc" '() (lambda () true) '("v") (lambda (v) v) + 0) 4950 "group commit inserts")
+(assert (recover "memcp-tests" "gc" (+ (now) 10) "gc_replayed") 100 "group committed rows are replayed from the log")
+(assert (scan "memcp-tests" "gc_replayed" '() (lambda () true) '("v") (lambda (v) v) + 0) 4950 "replayed rows")
+(dropdatabase "memcp-tests")
+
+/* Test for point-in-time recover */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "pitr" '('("column" "id" "int" '() '()) '("column" "v" "int" '() '())) '("engine" "safe") true)
+(define pitrStart (now))
+(context (lambda () (sleep 1))) /* (now) has a resolution of seconds */
+(insert "memcp-tests" "pitr" '("id" "v") '('(1 10) '(2 20)))
+(context (lambda () (sleep 1)))
+(define pitrMid (now))
+(context (lambda () (sleep 1)))
+(insert "memcp-tests" "pitr" '("id" "v") '('(3 30)))
+(scan "memcp-tests" "pitr" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update '("v" 11))) + 0)
+(assert (recover "memcp-tests" "pitr" pitrMid) 2 "recover to the midpoint")
+(assert (scan "memcp-tests" "pitr_recovered" '() (lambda () true) '("v") (lambda (v) v) + 0) 30 "writes after the midpoint are undone")
+(assert (recover "memcp-tests" "pitr" pitrStart "pitr_empty") 0 "recover to before the first write")
+(assert (recover "memcp-tests" "pitr" (+ (now) 10) "pitr_now") 3 "recover to the present")
+(assert (scan "memcp-tests" "pitr_now" '() (lambda () true) '("v") (lambda (v) v) + 0) 61 "recover to the present keeps all writes")
+(dropdatabase "memcp-tests")
+
+/* Test for change history across rebuild */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "cdc" '('("column" "id" "int" '() '()) '("column" "v" "int" '() '())) '("engine" "safe") true)
+(insert "memcp-tests" "cdc" '("id" "v") '('(1 10) '(2 20) '(3 30)))
+(define cdcfirst (nth (car (changes-since "memcp-tests" "cdc" 0)) 1))
+(context (lambda () (sleep 1))) /* (now) has a resolution of seconds */
+(define cdcbefore (now))
+(scan "memcp-tests" "cdc" '("id") (lambda (id) (equal? id 2)) '("$update") (lambda ($update) ($update)) + 0)
+(rebuild true false)
+(assert (map (changes-since "memcp-tests" "cdc" 0) (lambda (e) (nth e 3))) '("insert" "insert" "insert" "delete") "changes before the rebuild are still available")
+(assert (map (changes-since "memcp-tests" "cdc" cdcfirst) (lambda (e) (nth e 5))) '('("id" 2 "v" 20)) "checkpoint from before the rebuild")
+(assert (recover "memcp-tests" "cdc" cdcbefore "cdc_recovered") 3 "recover undoes a deletion that was merged by rebuild")
+(assert (scan "memcp-tests" "cdc_recovered" '() (lambda () true) '("v") (lambda (v) v) + 0) 60 "recovered rows")
+(dropdatabase "memcp-tests")
+
+/* Test for cached lookups */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "emp" '('("column" "id" "int" '() '()) '("column" "dept" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "emp" '("id" "dept") (map (produceN 200) (lambda (i) (list i (floor (/ i 20))))))
+(define lookups (newsession))
+(lookups "n" 0)
+(define deptSize (lambda (dept) (begin
+	(lookups "n" (+ (lookups "n") 1))
+	(scan "memcp-tests" "emp" '("dept") (lambda (d) (equal? d dept)) '() (lambda () 1) + 0))))
+(assert (scan "memcp-tests" "emp" '() (lambda () true) '("dept") (lambda (dept) (deptSize dept)) + 0) 4000 "uncached self-join")
+(define uncachedLookups (lookups "n"))
+(lookups "n" 0)
+(define cachedDeptSize (cached deptSize))
+(assert (scan "memcp-tests" "emp" '() (lambda () true) '("dept") (lambda (dept) (cachedDeptSize dept)) + 0) 4000 "cached self-join gives the same result")
+(assert (list uncachedLookups (< (lookups "n") 50)) '(200 true) "cached lookups are computed once per key")
+(lookups "n" 0)
+(scan "memcp-tests" "emp" '() (lambda () true) '("dept") (lambda (dept) (cachedDeptSize dept)) + 0)
+(assert (>= (lookups "n") 10) true "the cache is freed after the scan")
+(dropdatabase "memcp-tests")
+
+/* Test for loadCSV type coercion and NULL tokens */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "csvsrc" '('("column" "name" "text" '() '()) '("column" "qty" "text" '() '()) '("column" "price" "text" '() '()) '("column" "note" "text" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "csvsrc" '("name" "qty" "price" "note") '('("apple" "3" "1.5" "") '("pear" "\\N" "" "\\N") '("plum" "x" "2" "ok")))
+(exportCSV "memcp-tests" "csvsrc" "/tmp/memcp-tests-load.csv")
+(createtable "memcp-tests" "csvdst" '('("column" "name" "text" '() '()) '("column" "qty" "int" '() '()) '("column" "price" "double" '() '()) '("column" "note" "text" '() '())) '("engine" "memory") true)
+(assert (try (lambda () (loadCSV "memcp-tests" "csvdst" "/tmp/memcp-tests-load.csv" ";" "\\N" false true)) (lambda (e) "rejected")) "rejected" "malformed numbers fail without lenient")
+(loadCSV "memcp-tests" "csvdst" "/tmp/memcp-tests-load.csv" ";" "\\N" true true)
+(define csvRow (lambda (n) (scan "memcp-tests" "csvdst" '("name") (lambda (name) (equal? name n)) '("qty" "price" "note") (lambda (qty price note) (list qty price note)) merge '())))
+(assert (csvRow "apple") '(3 1.5 "") "numeric columns are parsed, empty strings stay")
+(assert (list (int? (nth (csvRow "apple") 0)) (number? (nth (csvRow "apple") 1)) (string? (nth (csvRow "apple") 2))) '(true true true) "stored types follow the column types")
+(assert (csvRow "pear") '(nil nil nil) "NULL token and empty numeric fields become NULL")
+(assert (csvRow "plum") '(nil 2 "ok") "lenient turns malformed numbers into NULL")
+(assert (scan "memcp-tests" "csvdst" '() (lambda () true) '() (lambda () 1) + 0) 3 "the header is not loaded as a row")
+(createtable "memcp-tests" "csvquote" '('("column" "id" "int" '() '()) '("column" "s" "text" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "csvquote" '("id" "s") '('(1 "a;b") '(2 "say \"hi\"") '(3 "two\nlines") '(4 "plain")))
+(exportCSV "memcp-tests" "csvquote" "/tmp/memcp-tests-quote.csv")
+(createtable "memcp-tests" "csvquote2" '('("column" "s" "text" '() '()) '("column" "id" "int" '() '())) '("engine" "memory") true)
+(loadCSV "memcp-tests" "csvquote2" "/tmp/memcp-tests-quote.csv" ";" nil false true)
+(assert (scan "memcp-tests" "csvquote2" '() (lambda () true) '("id" "s") (lambda (id s) (list (list id s))) merge '()) '('(1 "a;b") '(2 "say \"hi\"") '(3 "two\nlines") '(4 "plain")) "exportCSV and loadCSV round trip quoted fields")
+(dropdatabase "memcp-tests")
+
+/* Test for regexp_replace */
+(assert (regexp_replace "2024-03-15" "(\\d+)-(\\d+)-(\\d+)" "$3.$2.$1") "15.03.2024" "regexp_replace reorders capture groups")
+(assert (regexp_replace "John Smith" "(?P<first>\\w+) (?P<last>\\w+)" "${last}, ${first}") "Smith, John" "regexp_replace with named groups")
+(assert (regexp_replace "Hello hello HELLO" "hello" "bye" "i") "bye bye bye" "regexp_replace case-insensitive flag")
+(assert (regexp_replace "Hello hello" "hello" "bye") "Hello bye" "regexp_replace is case-sensitive by default")
+(assert (try (lambda () (regexp_replace "x" "(" "y")) (lambda (e) "rejected")) "rejected" "invalid patterns fail")
+
+/* Test for UUIDs */
+(define uuidFormat (lambda (u version) (match u (regex "^[0-9a-f]{8}-[0-9a-f]{4}-([0-9a-f])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$" _ v) (equal? v version) false)))
+(assert (uuidFormat (uuid) "4") true "uuid is a version 4 UUID")
+(assert (uuidFormat (uuid-v7) "7") true "uuid-v7 is a version 7 UUID")
+(assert (equal? (uuid) (uuid)) false "uuids are unique")
+(define uuids (map (produceN 1000) (lambda (i) (uuid-v7))))
+(assert (sort uuids '('((lambda (u) u) <))) uuids "uuid-v7 values sort by creation time")
+(define parallelUuids (map (map (produceN 4) (lambda (w) (spawn (lambda () (map (produceN 250) (lambda (i) (uuid-v7))))))) await))
+(assert (count (merge_unique parallelUuids)) 1000 "uuid-v7 is unique across threads")
+(assert (uuid-parse "{6BA7B810-9DAD-11D1-80B4-00C04FD430C8}") "6ba7b810-9dad-11d1-80b4-00c04fd430c8" "uuid-parse normalizes")
+(assert (list (uuid-parse "urn:uuid:6ba7b810-9dad-11d1-80b4-00c04fd430c8") (uuid-parse "6ba7b8109dad11d180b400c04fd430c8")) (list "6ba7b810-9dad-11d1-80b4-00c04fd430c8" "6ba7b810-9dad-11d1-80b4-00c04fd430c8") "uuid-parse accepts urn and no hyphens")
+(assert (try (lambda () (uuid-parse "6ba7b810-9dad-11d1-80b4")) (lambda (e) "rejected")) "rejected" "uuid-parse rejects invalid input")
+
+/* Test for MaxScanParallelism */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "par" '('("column" "id" "int" '() '())) '("engine" "memory") true)
+(settings "ShardSize" 20)
+(map (produceN 8) (lambda (j) (insert "memcp-tests" "par" '("id") (map (produceN 20) (lambda (i) (list (+ i (* j 20))))))))
+(settings "ShardSize" 60000)
+(settings "MaxScanParallelism" 2)
+(assert (settings "MaxScanParallelism") 2 "MaxScanParallelism is read back")
+(define workers (newsession))
+(workers "running" 0)
+(workers "peak" 0)
+(define workersMutex (mutex))
+(define enterWorker (lambda () (workersMutex (lambda () (begin (workers "running" (+ (workers "running") 1)) (workers "peak" (max (workers "peak") (workers "running"))))))))
+(define leaveWorker (lambda () (workersMutex (lambda () (workers "running" (- (workers "running") 1))))))
+(assert (context (lambda () (scan "memcp-tests" "par" '() (lambda () true) '("id") (lambda (id) (begin (enterWorker) (sleep 0.002) (leaveWorker) id)) + 0))) 12720 "capped scan returns all rows")
+(assert (<= (workers "peak") 2) true "no more than MaxScanParallelism shards run concurrently")
+(settings "MaxScanParallelism" 1)
+(assert (scan "memcp-tests" "par" '("id") (lambda (id) (< id 3)) '("id") (lambda (id) (scan "memcp-tests" "par" '("id") (lambda (x) (equal? x id)) '("id") (lambda (x) 1) + 0)) + 0) 3 "nested scans do not wait for a worker slot")
+(settings "MaxScanParallelism" 0)
+(dropdatabase "memcp-tests")
+
+/* Test for export-schema */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "dept" '('("column" "id" "int" '() '("auto_increment" true)) '("column" "name" "varchar" '(40) '("null" false "comment" "department")) '("unique" "PRIMARY" '("id")) '("unique" "dept_name" '("name"))) '("engine" "memory" "collation" "utf8mb4_general_ci" "auto_increment" 7) true)
+(createtable "memcp-tests" "emp" '('("column" "id" "int" '() '("primary" true)) '("column" "dept" "int" '() '()) '("column" "salary" "decimal" '(10 2) '("default" 1.5)) '("foreign" "emp_dept" '("dept") "dept" '("id") "cascade" "set null")) '("engine" "safe") true)
+(define exportedSchema (export-schema "memcp-tests"))
+(define showSchema (lambda () (map '("dept" "emp") (lambda (tbl) (list (show "memcp-tests" tbl) (show "memcp-tests" tbl "meta") (table-foreign-key-index "memcp-tests" tbl))))))
+(define schemaBefore (showSchema))
+(assert (strlike (export-schema "memcp-tests" true) "%CONSTRAINT `emp_dept` FOREIGN KEY (`dept`) REFERENCES `dept` (`id`) ON DELETE SET NULL ON UPDATE CASCADE%") true "export-schema as SQL")
+(dropdatabase "memcp-tests")
+(createdatabase "memcp-tests" true)
+(eval (scheme exportedSchema))
+(assert (showSchema) schemaBefore "export-schema reproduces the tables")
+(assert (export-schema "memcp-tests") exportedSchema "export-schema round-trips")
+(dropdatabase "memcp-tests")
+
+/* Test for retry */
+(define retryCalls (newsession))
+(retryCalls "n" 0)
+(assert (retry (lambda (attempt) (begin (retryCalls "n" attempt) (if (< attempt 3) (error "transient") (concat "ok after " attempt)))) 5 1) "ok after 3" "retry succeeds after two failures")
+(assert (retryCalls "n") 3 "retry stops after the first success")
+(assert (try (lambda () (retry (lambda (attempt) (begin (retryCalls "n" attempt) (error (concat "failed attempt " attempt)))) 4 0)) (lambda (e) (string e))) "failed attempt 4" "retry rethrows the last error")
+(assert (retryCalls "n") 4 "retry gives up after all attempts")
+(assert (retry (lambda (attempt) attempt) 1) 1 "a single attempt is a plain call")
+
+/* Test for metrics */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "m" '('("column" "id" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "m" '("id") (map (produceN 150) (lambda (i) (list i))))
+(define metricLines (lambda () (filter (split (metrics) "\n") (lambda (line) (not (equal? line ""))))))
+(define metricValue (lambda (sample) (reduce (metricLines) (lambda (acc line) (if (strlike line (concat sample " %")) (simplify (nth (split line " ") 1)) acc)) nil)))
+(assert (filter (metricLines) (lambda (line) (not (or (strlike line "# HELP % %") (strlike line "# TYPE % gauge") (strlike line "# TYPE % counter") (and (equal? (count (split line " ")) 2) (number? (simplify (nth (split line " ") 1)))))))) '() "metrics are in the Prometheus text format")
+(assert (metricValue "memcp_table_rows{database=\"memcp-tests\",table=\"m\"}") ((show "memcp-tests" "m" "meta") "rows") "row gauge matches the table")
+(assert (metricValue "memcp_tables{database=\"memcp-tests\"}") 1 "table count gauge")
+(define scannedRows (metricValue "memcp_scanned_rows_total"))
+(scan "memcp-tests" "m" '() (lambda () true) '("id") (lambda (id) id) + 0)
+(assert (>= (- (metricValue "memcp_scanned_rows_total") scannedRows) 150) true "scans count the visited rows")
+(dropdatabase "memcp-tests")
+
+/* Test for inserts during repartitioning */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "rp" '('("column" "id" "int" '() '()) '("column" "v" "int" '() '())) '("engine" "memory") true)
+(set oldShardSize (settings "ShardSize"))
+(settings "ShardSize" 2000)
+(insert "memcp-tests" "rp" '("id" "v") '('(-1 0)))
+(scan "memcp-tests" "rp" '("id") (lambda (id) (< id 100)) '("v") (lambda (v) v) + 0) /* makes id a partitioning candidate */
+(define rpInserter (spawn (lambda () (map (produceN 300) (lambda (j) (insert "memcp-tests" "rp" '("id" "v") (map (produceN 100) (lambda (i) (list (+ i (* j 100)) 1)))))))))
+(define rpRebuilder (spawn (lambda () (map (produceN 10) (lambda (i) (rebuild true true))))))
+(await rpInserter)
+(await rpRebuilder)
+(settings "ShardSize" oldShardSize)
+(assert (scan "memcp-tests" "rp" '() (lambda () true) '("v") (lambda (v) v) + 0) 30000 "no insert is lost during repartitioning")
+(assert (apply_assoc (lambda (totalShards) (> totalShards 1)) (partition-prune-check "memcp-tests" "rp" '() (lambda () true))) true "the table was repartitioned")
+(dropdatabase "memcp-tests")
+
+/* Test for group_by */
+(define gbRows '('("k" "a" "n" 1 "p" 2) '("k" "a" "n" 2 "p" nil) '("k" "b" "n" 1 "p" 5) '("k" "a" "n" 1 "p" 4)))
+(assert (group_by gbRows '("k") '("cnt" count "total" '('sum "p"))) '('("k" "a" "cnt" 3 "total" 6) '("k" "b" "cnt" 1 "total" 5)) "group_by with builtin count and quoted sum")
+(assert (group_by gbRows '("k" "n") (list "cnt" 'count "total" (list 'sum "p"))) '('("k" "a" "n" 1 "cnt" 2 "total" 6) '("k" "a" "n" 2 "cnt" 1 "total" nil) '("k" "b" "n" 1 "cnt" 1 "total" 5)) "group_by on two columns")
+(assert (group_by gbRows '() (list "cnt" '('count "p") "lo" (list min "p") "hi" (list max "p") "avg" (list 'avg "p"))) '('("cnt" 3 "lo" 2 "hi" 5 "avg" 3.6666666666666665)) "count, min, max and avg skip NULL")
+(assert (group_by '() '() '("cnt" count "total" '('sum "p"))) '('("cnt" 0 "total" nil)) "group_by without columns returns one group for empty input")
+(assert (group_by '() '("k") '("cnt" count)) '() "group_by on empty input")
+(assert (try (lambda () (group_by gbRows '() '("x" 'median))) (lambda (e) "rejected")) "rejected" "unknown aggregates are rejected")
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "gb" '('("column" "p" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "gb" '("p") '('(2) '(3) '(4)))
+(rebuild false false)
+(define gbIntRows (scan "memcp-tests" "gb" '() (lambda () true) '("p") (lambda (p) (list (list "p" p))) merge '()))
+(assert (apply_assoc (lambda (total) (int? total)) (car (group_by gbIntRows '() '("total" '('sum "p"))))) true "integer sums stay integers")
+(assert (group_by gbIntRows '() '("total" '('sum "p"))) '('("total" 9)) "integer sum")
+(dropdatabase "memcp-tests")
+
+/* Test for sandbox-resources */
+(set sandboxGlobal 1)
+(assert (sandbox-resources (scheme "(concat (+ 1 2) \"x\")") 0 0) "3x" "pure builtins work in the sandbox")
+(sandbox-resources (scheme "(set sandboxGlobal 2)") 0 0)
+(sandbox-resources (scheme "(outer (set sandboxGlobal 3))") 0 0)
+(assert sandboxGlobal 1 "a sandboxed set does not leak into the globals")
+(assert (sandbox-resources (scheme "sandboxGlobal") 0 0) nil "global variables are invisible in the sandbox")
+(assert (try (lambda () (sandbox-resources (scheme "(show)") 0 0)) (lambda (e) "rejected")) "rejected" "storage builtins are refused in the sandbox")
+(assert (try (lambda () (sandbox-resources (scheme "(map (produceN 1000) (lambda (i) (+ i 1)))") 100 0)) (lambda (e) "rejected")) "rejected" "the step budget is enforced")
+(assert (try (lambda () (sandbox-resources (scheme "(produceN 1000)") 0 100)) (lambda (e) "rejected")) "rejected" "the cell budget is enforced")
+(assert (try (lambda () (sandbox-resources (scheme "(begin (define f (lambda (s n) (if (< n 26) (f (concat s s) (+ n 1)) (strlen s)))) (f \"xxxxxxxxxx\" 0))") 1000 1000)) (lambda (e) "rejected")) "rejected" "string bytes count against the cell budget")
+(assert (try (lambda () (sandbox-resources (scheme "(begin (define f (lambda (s n) (if (< n 26) (f (replace s \"x\" \"xx\") (+ n 1)) (strlen s)))) (f \"xxxxxxxxxx\" 0))") 1000 1000)) (lambda (e) "rejected")) "rejected" "growing replace hits the cell budget")
+(assert (try (lambda () (sandbox-resources (scheme "(produceN 50000000)") 0 1000)) (lambda (e) "rejected")) "rejected" "produceN is refused before it allocates")
+(assert (sandbox-resources (scheme "(strlen (replace \"abcabc\" \"b\" \"xyz\"))") 0 1000) 10 "small strings fit into the cell budget")
+
+/* Test for scan having */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "having" '('("column" "id" "int" '() '()) '("column" "g" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "having" '("id" "g") (map (produceN 30000) (lambda (i) (list i (if (< i 20000) 0 1)))))
+(define havingCount (lambda (group) (scan "memcp-tests" "having" '("g") (lambda (g) (equal? g group)) '() (lambda () 1) + 0 nil false nil (lambda (cnt) (> cnt 15000)))))
+(assert (havingCount 0) 20000 "having keeps a group that passes")
+(assert (havingCount 1) 0 "having replaces a group that fails with the neutral element")
+(assert (scan "memcp-tests" "having" '() (lambda () true) '("g") (lambda (g) g) + 0 (lambda (acc sum) (* 2 (+ acc sum))) false nil (lambda (total) (equal? total 20000))) 20000 "having sees the result of reduce2")
+(assert (scan nil '('("a" 1) '("a" 2)) '() (lambda () true) '("a") (lambda (a) a) + 0 nil false nil (lambda (s) (> s 5))) 0 "having on lists")
+(dropdatabase "memcp-tests")
+
+/* Test for scan_order reading ORDER BY ... LIMIT from an index */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "ord" '('("column" "id" "int" '() '()) '("column" "v" "int" '() '())) '("engine" "memory") true)
+(seed-random 1759)
+(insert "memcp-tests" "ord" '("id" "v") (map (produceN 3000) (lambda (i) (list i (random-int 0 500)))))
+(rebuild false false)
+(scan "memcp-tests" "ord" '("v") (lambda (v) (>= v 0)) '("v") (lambda (v) 1) + 0 nil false '("indexOnly" true)) /* materializes the index on v */
+(insert "memcp-tests" "ord" '("id" "v") (map (produceN 300) (lambda (i) (list (+ 3000 i) (random-int -10 510))))) /* delta rows are not in the index */
+(scan "memcp-tests" "ord" '("id") (lambda (id) (< id 100)) '("$update") (lambda ($update) ($update)) + 0)
+(seed-random nil)
+(define ordRows (lambda (sortcol dir offset limit) (scan_order "memcp-tests" "ord" '() (lambda () true) (list sortcol "id") (list dir <) offset limit '("v" "id") (lambda (v id) (list (list v id))) merge '())))
+(assert (ordRows "v" < 0 25) (ordRows (lambda (v) v) < 0 25) "indexed ascending limit equals the sorted scan")
+(assert (ordRows "v" > 0 25) (ordRows (lambda (v) v) > 0 25) "indexed descending limit equals the sorted scan")
+(assert (ordRows "v" < 40 60) (ordRows (lambda (v) v) < 40 60) "indexed offset and limit equal the sorted scan")
+(assert (count (ordRows "v" < 0 5000)) 3200 "indexed order skips deleted rows")
+(dropdatabase "memcp-tests")
+
+/* Test for mergeable variance and stddev */
+(define nearly (lambda (a b) (and (< (- a b) 0.000000001) (< (- b a) 0.000000001))))
+(seed-random 1762)
+(define varValues (map (produceN 3000) (lambda (i) (+ 1000 (* 50 (random))))))
+(seed-random nil)
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "var" '('("column" "id" "int" '() '()) '("column" "x" "double" '() '())) '("engine" "memory") true)
+(set oldShardSize (settings "ShardSize"))
+(settings "ShardSize" 1000)
+(map (produceN 3) (lambda (j) (insert "memcp-tests" "var" '("id" "x") (map (produceN 1000) (lambda (i) (list (+ i (* j 1000)) (nth varValues (+ i (* j 1000)))))))))
+(settings "ShardSize" oldShardSize)
+(define varAcc (scan "memcp-tests" "var" '() (lambda () true) '("x") (lambda (x) x) variance-accumulator nil variance-merge))
+(assert (car varAcc) 3000 "variance accumulator counts all rows")
+(assert (nearly (variance-finalize varAcc) (variance varValues)) true "sharded variance equals the single pass")
+(assert (nearly (variance-finalize varAcc true) (variance varValues true)) true "sharded sample variance equals the single pass")
+(assert (nearly (stddev-finalize varAcc) (stddev varValues)) true "sharded stddev equals the single pass")
+(dropdatabase "memcp-tests")
+(assert (variance '(2 4 4 4 5 5 7 9)) 4 "population variance")
+(assert (stddev '(2 4 4 4 5 5 7 9)) 2 "population stddev")
+(assert (variance '(1 nil 3) true) 2 "sample variance skips NULL")
+(assert (variance '(1) true) nil "sample variance needs two values")
+(assert (variance-merge nil (variance-accumulator nil 5)) '(1 5 0) "merging with an empty accumulator")
+
+/* Test for json_decode_stream */
+(define jsonSeen (newsession))
+(define jsonItems (lambda (json) (begin
+	(jsonSeen "list" '())
+	(list (json_decode_stream json (lambda (item) (jsonSeen "list" (append (jsonSeen "list") item)))) (jsonSeen "list"))
+)))
+(assert (jsonItems "[1, \"a\", {\"k\": [true]}]") '(3 '(1 "a" '("k" '(true)))) "array elements are passed one by one")
+(assert (jsonItems "{\"a\": 1}") '(1 '('("a" 1))) "a top-level object is passed once")
+(assert (jsonItems "42") '(1 '(42)) "a top-level scalar is passed once")
+(assert (jsonItems "[]") '(0 '()) "empty array")
+(assert (try (lambda () (jsonItems "[1, 2] 3")) (lambda (e) "rejected")) "rejected" "trailing data is rejected")
+(assert (try (lambda () (jsonItems "[1, 2")) (lambda (e) "rejected")) "rejected" "an unterminated array is rejected")
+(define jsonSum (newsession))
+(jsonSum "sum" 0)
+(assert (json_decode_stream (json_encode (produceN 100000)) (lambda (item) (jsonSum "sum" (+ (jsonSum "sum") item)))) 100000 "large array")
+(assert (jsonSum "sum") 4999950000 "large array values")
+
+/* Test for scan progress */
+(define progressSeen (newsession))
+(define progressCalls (lambda (run) (begin
+	(progressSeen "calls" '())
+	(run (lambda (done total) (progressSeen "calls" (append (progressSeen "calls") (list done total)))))
+	(progressSeen "calls")
+)))
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "progress" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(set oldShardSize (settings "ShardSize"))
+(settings "ShardSize" 300000)
+(insert "memcp-tests" "progress" '("v") (map (produceN 250000) (lambda (i) (list i))))
+(settings "ShardSize" oldShardSize)
+(define progressTable (progressCalls (lambda (progress) (scan "memcp-tests" "progress" '() (lambda () true) '("v") (lambda (v) 1) + 0 nil false (list "progress" progress)))))
+(assert (> (count progressTable) 1) true "progress is reported during the scan")
+(assert (nth progressTable (- (count progressTable) 1)) '(250000 250000) "the final progress call reports all rows")
+(assert (car (reduce progressTable (lambda (acc call) (list (and (car acc) (>= (car call) (nth acc 1))) (car call))) '(true 0))) true "progress counts are monotonic")
+(assert (progressCalls (lambda (progress) (scan nil '('("v" 1) '("v" 2)) '() (lambda () true) '("v") (lambda (v) v) + 0 nil false (list "progress" progress)))) '('(2 2)) "progress on a list is reported once")
+(dropdatabase "memcp-tests")
+
+/* Test for scan-selection and preFilter */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "sel" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(createtable "memcp-tests" "sel2" '('("column" "v" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "sel" '("v") (map (produceN 1000) (lambda (i) (list i))))
+(rebuild false false)
+(define selLow (scan-selection "memcp-tests" "sel" '("v") (lambda (v) (< v 500))))
+(define selEven (lambda (sel) (scan "memcp-tests" "sel" '("v") (lambda (v) (equal? (floor (/ v 2)) (/ v 2))) '() (lambda () 1) + 0 nil false (list "preFilter" sel))))
+(assert (selEven selLow) 250 "preFilter refines a previous selection")
+(assert (scan "memcp-tests" "sel" '("v") (lambda (v) (>= v 250)) '() (lambda () 1) + 0 nil false (list "preFilter" (scan-selection "memcp-tests" "sel" '("v") (lambda (v) (< v 300)) (list "preFilter" selLow)))) 50 "selections can be refined")
+(scan "memcp-tests" "sel" '("v") (lambda (v) (< v 10)) '("$update") (lambda ($update) ($update)) + 0)
+(assert (selEven selLow) 245 "preFilter skips rows that were deleted after the selection")
+(assert (try (lambda () (scan "memcp-tests" "sel2" '() (lambda () true) '() (lambda () 1) + 0 nil false (list "preFilter" selLow))) (lambda (e) "rejected")) "rejected" "a selection of another table is rejected")
+(rebuild true false)
+(assert (try (lambda () (selEven selLow)) (lambda (e) "rejected")) "rejected" "a selection is invalid after a rebuild")
+(dropdatabase "memcp-tests")
+
+/* Test for indexOnly scans */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "covering" '('("column" "a" "int" '() '()) '("column" "b" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "covering" '("a" "b") (map (produceN 1000) (lambda (i) (list i (* i 3)))))
+(rebuild false false)
+(insert "memcp-tests" "covering" '("a" "b") '('(5 0) '(2000 0)))
+(define coveringSum (lambda (options) (scan "memcp-tests" "covering" '("a") (lambda (a) (< a 100)) '("a") (lambda (a) a) + 0 nil false options)))
+(assert (coveringSum '("indexOnly" true)) (coveringSum '()) "indexOnly gives the same result as a normal scan")
+(assert (coveringSum '("indexOnly" true)) 4955 "indexOnly includes delta rows")
+(assert (try (lambda () (scan "memcp-tests" "covering" '("a") (lambda (a) (< a 100)) '("b") (lambda (b) b) + 0 nil false '("indexOnly" true))) (lambda (e) "rejected")) "rejected" "indexOnly is rejected if the index does not cover the map columns")
+(assert (try (lambda () (scan "memcp-tests" "covering" '() (lambda () true) '() (lambda () 1) + 0 nil false '("indexOnly" true))) (lambda (e) "rejected")) "rejected" "indexOnly needs an indexable filter")
+(dropdatabase "memcp-tests")
+
+/* Test for apply-defaults */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "defaults" '('("column" "id" "int" '() '()) '("column" "v" "int" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "defaults" '("id" "v") '('(1 nil) '(2 5) '(3 nil)))
+(rebuild false false)
+(insert "memcp-tests" "defaults" '("id" "v") '('(4 nil) '(5 0)))
+(assert (apply-defaults "memcp-tests" "defaults" "v") 0 "apply-defaults without a default changes nothing")
+(altercolumn "memcp-tests" "defaults" "v" "default" 7)
+(assert (apply-defaults "memcp-tests" "defaults" "v") 3 "apply-defaults fills the NULL values of main and delta storage")
+(assert (scan "memcp-tests" "defaults" '("v") (lambda (v) (equal? v 7)) '() (lambda () 1) + 0) 3 "apply-defaults wrote the default")
+(assert (scan "memcp-tests" "defaults" '("id") (lambda (id) (equal? id 2)) '("v") (lambda (v) v) + 0) 5 "explicit values are kept")
+(assert (scan "memcp-tests" "defaults" '("id") (lambda (id) (equal? id 5)) '("v") (lambda (v) v) + 0) 0 "explicit zero is not NULL")
+(assert (apply-defaults "memcp-tests" "defaults" "v") 0 "a second apply-defaults finds no NULLs")
+(assert (try (lambda () (apply-defaults "memcp-tests" "defaults" "nosuchcolumn")) (lambda (e) "rejected")) "rejected" "apply-defaults on an unknown column")
+(dropdatabase "memcp-tests")
+
+/* Test for the collate scan option */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "coll" '('("column" "id" "int" '() '()) '("column" "name" "text" '() '())) '("engine" "memory") true)
+(define collWords '("apple" "Apple" "APPLE" "banana" "Banana" "cherry"))
+(define collNames (map (produceN 600) (lambda (i) (nth collWords (- i (* 6 (floor (/ i 6))))))))
+(insert "memcp-tests" "coll" '("id" "name") (map (produceN 600) (lambda (i) (list i (nth collNames i)))))
+(rebuild false false)
+(define collLess (collate "en_ci"))
+(define collCount (lambda (filter) (scan "memcp-tests" "coll" '("name") filter '() (lambda () 1) + 0 nil false '("collate" '("name" "en_ci")))))
+(assert (collCount (lambda (name) (equal? name "aPPle"))) (count (filter collNames (lambda (n) (and (not (collLess n "aPPle")) (not (collLess "aPPle" n)))))) "collated equality matches the collation")
+(assert (collCount (lambda (name) (and (>= name "b") (< name "BANANAZ")))) (count (filter collNames (lambda (n) (and (not (collLess n "b")) (collLess n "BANANAZ"))))) "collated range matches the collation")
+(assert (scan "memcp-tests" "coll" '("name") (lambda (name) (equal? name "aPPle")) '() (lambda () 1) + 0) 0 "without collate, strings compare bytewise")
+(map (produceN 10) (lambda (i) (collCount (lambda (name) (equal? name "apple"))))) /* make the collated index pay off */
+(assert (apply_assoc (lambda (access indexesBuilt) (list access indexesBuilt)) (explain "memcp-tests" "coll" '("name") (lambda (name) (equal? name "BANANA")) '("collate" '("name" "en_ci")))) '("indexed" 1) "a collated filter uses an index in collation order")
+(assert (collCount (lambda (name) (equal? name "BANANA"))) 200 "collated index lookup")
+(insert "memcp-tests" "coll" '("id" "name") '('(600 "bAnAnA")))
+(assert (collCount (lambda (name) (equal? name "BANANA"))) 201 "collated index lookup includes delta rows")
+(dropdatabase "memcp-tests")
+
+/* Test for StorageBits */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "bits" '('("column" "id" "int" '() '()) '("column" "flag" "bool" '() '()) '("column" "set" "bool" '() '())) '("engine" "memory") true)
+(insert "memcp-tests" "bits" '("id" "flag" "set") (map (produceN 200) (lambda (i) (list i (if (equal? (- i (* 3 (floor (/ i 3)))) 0) nil (equal? (- i (* 3 (floor (/ i 3)))) 1)) (< i 100)))))
+(rebuild false false)
+(assert (apply_assoc (lambda (columns) (apply_assoc (lambda (flag set) (list flag set)) columns)) (inspect-shard "memcp-tests" "bits" 0)) '("bits-nullable" "bits") "boolean columns are stored as bits")
+(assert (scan "memcp-tests" "bits" '("id") (lambda (id) (< id 6)) '("id" "flag" "set") (lambda (id flag set) (concat id (if (nil? flag) "N" (if flag "T" "F")) (if set "T" "F"))) concat "" nil false '("orderedWithinShard" true)) "0NT1TT2FT3NT4TT5FT" "bits read back true, false and NULL")
+(assert (scan "memcp-tests" "bits" '("flag") (lambda (flag) (equal? flag true)) '() (lambda () 1) + 0) 67 "bits filter true")
+(assert (scan "memcp-tests" "bits" '("flag") (lambda (flag) (nil? flag)) '() (lambda () 1) + 0) 67 "bits filter NULL")
+(assert (scan "memcp-tests" "bits" '("set") (lambda (set) set) '() (lambda () 1) + 0) 100 "bits without NULLs")
+(dropdatabase "memcp-tests")
+
+/* Test for random-int */
+(assert (random-int 5 5) 5 "random-int with min = max")
+(define wideDraws (map (produceN 200) (lambda (i) (random-int (- 0 9000000000000000000) 9000000000000000000)))) /* the span does not fit into int64 */
+(assert (count (filter wideDraws (lambda (x) (or (< x (- 0 9000000000000000000)) (> x 9000000000000000000))))) 0 "random-int over a span wider than int64")
+(assert (> (count (filter wideDraws (lambda (x) (< x 0)))) 0) true "random-int over a wide span also draws negative values")
+(seed-random 1725)
+(define seededDraws (map (produceN 5) (lambda (i) (random-int (- 0 9000000000000000000) 9000000000000000000))))
+(seed-random 1725)
+(assert (map (produceN 5) (lambda (i) (random-int (- 0 9000000000000000000) 9000000000000000000))) seededDraws "seeded wide random-int is reproducible")
+(seed-random nil)
+(assert (try (lambda () (random-int 2 1)) (lambda (e) "rejected")) "rejected" "random-int with max < min")
+
+/* Test for insert returnIds */
+(createdatabase "memcp-tests" true)
+(createtable "memcp-tests" "ai" '('("column" "id" "int" '() '("auto_increment" true)) '("column" "name" "text" '() '())) '("engine" "memory") true)
+(assert (insert "memcp-tests" "ai" '("name") '('("a") '("b")) '() nil false true) '(1 2) "returnIds of generated ids")
+(assert (insert "memcp-tests" "ai" '("id" "name") '('(100 "c") '(200 "d")) '() nil false true) '(100 200) "returnIds of explicit ids")
+(assert (scan "memcp-tests" "ai" '("name") (lambda (name) (equal? name "d")) '("id") (lambda (id) id) + 0) 200 "the explicit id is stored")
+(dropdatabase "memcp-tests")
+
 (print "finished unit tests")
 (print "test result: " (teststat "success") "/" (teststat "count"))
 (if (< (teststat "success") (teststat "count")) (begin
@@ -29,6 +29,7 @@ import "flag"
 import "time"
 import "bufio"
 import "sync"
+import "strings"
 import "syscall"
 import "runtime"
 import "io/ioutil"
@@ -62,6 +63,7 @@ func getImport(path string) func (a ...scm.Scmer) scm.Scmer {
 				nil,
 				&IOEnv,
 				true,
+				nil,
 			}
 			bytes, err := ioutil.ReadFile(filename)
 			if err != nil {
@@ -73,6 +75,9 @@ func getImport(path string) func (a ...scm.Scmer) scm.Scmer {
 
 func getStream(path string) func (a ...scm.Scmer) scm.Scmer {
 	return func (a ...scm.Scmer) scm.Scmer {
+			if name := scm.String(a[0]); strings.Contains(name, "://") {
+				return scm.OpenURL(name) // http://, https:// or tcp://host:port
+			}
 			filename := path + "/" + scm.String(a[0])
 			stream, err := os.Open(filename)
 			if err != nil {
@@ -195,6 +200,7 @@ func setupIO(wd string) {
 		nil,
 		&scm.Globalenv,
 		true, // other defines go into Globalenv
+		nil,
 	}
 	scm.DeclareTitle("IO")
 	scm.Declare(&IOEnv, &scm.Declaration{
@@ -264,10 +270,10 @@ func setupIO(wd string) {
 		(func(...scm.Scmer) scm.Scmer)(getLoad(wd)),
 	})
 	scm.Declare(&IOEnv, &scm.Declaration{
-		"stream", "Opens a file readonly as stream",
+		"stream", "Opens a file readonly as stream. http://, https:// and tcp://host:port URLs are opened as network streams that are closed at EOF.",
 		1, 1,
 		[]scm.DeclarationParameter{
-			scm.DeclarationParameter{"filename", "string", "filename relative to folder of source file"},
+			scm.DeclarationParameter{"filename", "string", "filename relative to folder of source file or a http://, https:// or tcp:// URL"},
 		}, "stream",
 		(func(...scm.Scmer) scm.Scmer)(getStream(wd)),
 	})
@@ -289,6 +295,17 @@ func setupIO(wd string) {
 		}, "bool",
 		scm.HTTPServe,
 	})
+	scm.Declare(&IOEnv, &scm.Declaration{
+		"websocket", "upgrades the request of a (serve) handler to a websocket and returns the socket as a function: (ws \"send\" msg) sends a text message, (ws \"sendBinary\" msg) a binary message, (ws \"close\") closes the connection",
+		3, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"req", "list", "request of the handler"},
+			scm.DeclarationParameter{"res", "list", "response of the handler"},
+			scm.DeclarationParameter{"onMessage", "func", "lambda(msg isBinary) that is called for every received message; binary messages are passed as raw byte strings"},
+			scm.DeclarationParameter{"onClose", "func", "(optional) lambda() that is called when the connection is closed"},
+		}, "func",
+		scm.HTTPWebsocket,
+	})
 	scm.Declare(&IOEnv, &scm.Declaration{
 		"serveStatic", "creates a static handler for use as a callback in (serve) - returns a handler lambda(req res)",
 		1, 1,
@@ -316,6 +333,14 @@ func setupIO(wd string) {
 		}, "string",
 		scm.MySQLPassword,
 	})
+	scm.Declare(&IOEnv, &scm.Declaration{
+		"connection-info", "returns metadata of the client connection of a session as assoc list (id address user schema charset connected protocol) or nil if the session has no connection. The id is unique and stable for the lifetime of the connection.",
+		1, 1,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"session", "func", "session as passed to the mysql handler"},
+		}, "list",
+		scm.ConnectionInfo,
+	})
 }
 
 func main() {
@@ -26,6 +26,7 @@ Copyright (C) 2013  Pieter Kelchtermans (originally licensed unter WTFPL 2.0)
 package scm
 
 import "math"
+import "math/big"
 import "strconv"
 
 //go:inline
@@ -186,6 +187,7 @@ func init_alu() {
 			DeclarationParameter{"value...", "number", "values"},
 		}, "number",
 		func(a ...Scmer) Scmer {
+			// TODO: when a JIT code generator exists, emit integer division/modulo (IDIV with CQO on amd64) and fold constant operands
 			v := ToFloat(a[0])
 			for _, i := range a[1:] {
 				v /= ToFloat(i)
@@ -318,33 +320,117 @@ func init_alu() {
 		},
 	})
 	Declare(&Globalenv, &Declaration{
-		"floor", "rounds the number down",
+		"floor", "rounds the number down; integers are returned unchanged",
 		1, 1,
 		[]DeclarationParameter{
 			DeclarationParameter{"value", "number", "value"},
 		}, "number",
 		func(a ...Scmer) (result Scmer) {
+			if i, ok := a[0].(int64); ok {
+				return i
+			}
 			return math.Floor(ToFloat(a[0]))
 		},
 	})
 	Declare(&Globalenv, &Declaration{
-		"ceil", "rounds the number up",
+		"ceil", "rounds the number up; integers are returned unchanged",
 		1, 1,
 		[]DeclarationParameter{
 			DeclarationParameter{"value", "number", "value"},
 		}, "number",
 		func(a ...Scmer) (result Scmer) {
+			if i, ok := a[0].(int64); ok {
+				return i
+			}
 			return math.Ceil(ToFloat(a[0]))
 		},
 	})
 	Declare(&Globalenv, &Declaration{
-		"round", "rounds the number",
+		"trunc", "rounds the number towards zero; integers are returned unchanged",
 		1, 1,
 		[]DeclarationParameter{
 			DeclarationParameter{"value", "number", "value"},
 		}, "number",
 		func(a ...Scmer) (result Scmer) {
-			return math.Round(ToFloat(a[0]))
+			if i, ok := a[0].(int64); ok {
+				return i
+			}
+			return math.Trunc(ToFloat(a[0]))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"round", "rounds the number to a number of decimal places. By default, halves are rounded away from zero like math.Round (2.5 -> 3, -2.5 -> -3). The decimal places refer to the shortest decimal representation of the value, so (round 1.005 2) is 1.01 even though 1.005 is slightly less in binary. Integers are returned unchanged unless digits is negative.",
+		1, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "number", "value"},
+			DeclarationParameter{"digits", "number", "(optional) number of decimal places (default 0); negative values round to tens, hundreds and so on"},
+			DeclarationParameter{"mode", "string", "(optional) \"half-up\" (default: halves away from zero) or \"half-even\" (banker's rounding: halves to the nearest even digit)"},
+		}, "number",
+		func(a ...Scmer) (result Scmer) {
+			digits := 0
+			if len(a) > 1 {
+				digits = ToInt(a[1])
+			}
+			halfEven := false
+			if len(a) > 2 {
+				switch String(a[2]) {
+					case "half-up":
+					case "half-even":
+						halfEven = true
+					default:
+						panic("unknown rounding mode: " + String(a[2]))
+				}
+			}
+			if i, ok := a[0].(int64); ok {
+				if digits >= 0 {
+					return i
+				}
+				return int64(roundDigits(float64(i), digits, halfEven))
+			}
+			return roundDigits(ToFloat(a[0]), digits, halfEven)
 		},
 	})
 }
+
+// rounds the shortest decimal representation of x to digits decimal places
+func roundDigits(x float64, digits int, halfEven bool) float64 {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return x
+	}
+	if digits == 0 && !halfEven {
+		return math.Round(x)
+	}
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(x, 'g', -1, 64))
+	if !ok {
+		return x
+	}
+	absDigits := digits
+	if absDigits < 0 {
+		absDigits = -absDigits
+	}
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(absDigits)), nil))
+	if digits > 0 {
+		r.Mul(r, scale)
+	} else {
+		r.Quo(r, scale)
+	}
+	// split into integer part (truncated towards zero) and remainder, then decide on the remainder
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	if c := twice.Cmp(r.Denom()); c > 0 || c == 0 && (!halfEven || q.Bit(0) == 1) {
+		if rem.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	r.SetInt(q)
+	if digits > 0 {
+		r.Quo(r, scale)
+	} else {
+		r.Mul(r, scale)
+	}
+	result, _ := r.Float64()
+	return result
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package scm
+
+import "sort"
+import "math"
+import "time"
+import "runtime"
+
+// results of benchmarked calls are stored here so the call cannot be optimized away
+var benchmarkSink Scmer
+
+func init_benchmark() {
+	DeclareTitle("Benchmarking")
+
+	Declare(&Globalenv, &Declaration{
+		"benchmark", "calls a function repeatedly and returns timing statistics per call as assoc list (iterations min median mean p99 max stddev in nanoseconds, allocsPerOp bytesPerOp). Compared to (time), warmup runs are discarded and the variance is reported.",
+		2, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"iterations", "number", "number of measured calls"},
+			DeclarationParameter{"func", "func", "function without parameters that is benchmarked"},
+			DeclarationParameter{"warmup", "number", "(optional) number of calls before measuring, defaults to iterations/10"},
+		}, "list",
+		func (a ...Scmer) Scmer {
+			iterations := ToInt(a[0])
+			if iterations < 1 {
+				panic("benchmark: iterations must be at least 1")
+			}
+			warmup := iterations / 10
+			if len(a) > 2 {
+				warmup = ToInt(a[2])
+			}
+			fn := OptimizeProcToSerialFunction(a[1])
+			for i := 0; i < warmup; i++ {
+				benchmarkSink = fn()
+			}
+
+			durations := make([]float64, iterations)
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for i := 0; i < iterations; i++ {
+				start := time.Now()
+				benchmarkSink = fn()
+				durations[i] = float64(time.Since(start).Nanoseconds())
+			}
+			runtime.ReadMemStats(&after)
+
+			sort.Float64s(durations)
+			var sum float64
+			for _, d := range durations {
+				sum += d
+			}
+			mean := sum / float64(iterations)
+			var variance float64
+			for _, d := range durations {
+				variance += (d - mean) * (d - mean)
+			}
+			variance /= float64(iterations)
+			percentile := func(p float64) float64 {
+				return durations[int(math.Ceil(p * float64(iterations))) - 1]
+			}
+			return []Scmer{
+				"iterations", int64(iterations),
+				"min", durations[0],
+				"median", percentile(0.5),
+				"mean", mean,
+				"p99", percentile(0.99),
+				"max", durations[iterations-1],
+				"stddev", math.Sqrt(variance),
+				"allocsPerOp", float64(after.Mallocs - before.Mallocs) / float64(iterations),
+				"bytesPerOp", float64(after.TotalAlloc - before.TotalAlloc) / float64(iterations),
+			}
+		},
+	})
+}
@@ -17,20 +17,97 @@ Copyright (C) 2024  Carl-Philip Hänsch
 package scm
 
 import "time"
+import "strings"
+
+var allowed_formats = []string{
+	"2006-01-02 15:04:05.000000",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"06-01-02 15:04:05.000000",
+	"06-01-02 15:04:05",
+	"06-01-02 15:04",
+	"06-01-02",
+}
+
+// dates are unix timestamps or strings in one of the allowed_formats; format is "" for timestamps
+func parseDate(v Scmer) (t time.Time, format string, ok bool) {
+	switch v := v.(type) {
+		case int64, float64:
+			return time.Unix(int64(ToInt(v)), 0).UTC(), "", true
+		case string:
+			for _, format := range allowed_formats { // try through all formats
+				if t, err := time.Parse(format, v); err == nil {
+					return t, format, true
+				}
+			}
+	}
+	return time.Time{}, "", false
+}
+
+// adds n months; the day is clamped to the end of the month (Jan 31 + 1 month = Feb 28/29) instead of overflowing like time.AddDate
+func addMonths(t time.Time, n int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m, 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location()).AddDate(0, n, 0)
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d - 1)
+}
+
+func dateAdd(t time.Time, n int, unit string) time.Time {
+	switch strings.ToLower(unit) {
+		case "second":
+			return t.Add(time.Duration(n) * time.Second)
+		case "minute":
+			return t.Add(time.Duration(n) * time.Minute)
+		case "hour":
+			return t.Add(time.Duration(n) * time.Hour)
+		case "day":
+			return t.AddDate(0, 0, n)
+		case "month":
+			return addMonths(t, n)
+		case "year":
+			return addMonths(t, 12 * n)
+		default:
+			panic("unknown date unit: " + unit)
+	}
+}
+
+// number of whole units from a to b (negative if b is before a)
+func dateDiff(a, b time.Time, unit string) int64 {
+	switch strings.ToLower(unit) {
+		case "second":
+			return int64(b.Sub(a) / time.Second)
+		case "minute":
+			return int64(b.Sub(a) / time.Minute)
+		case "hour":
+			return int64(b.Sub(a) / time.Hour)
+		case "day":
+			return int64(b.Sub(a) / (24 * time.Hour))
+		case "month", "year":
+			months := (b.Year() - a.Year()) * 12 + int(b.Month()) - int(a.Month())
+			// don't count the last month if it is not complete (like MySQL: compare day of month and time of day)
+			offset := func (t time.Time) time.Duration {
+				return t.Sub(time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()))
+			}
+			if months > 0 && offset(b) < offset(a) {
+				months--
+			} else if months < 0 && offset(b) > offset(a) {
+				months++
+			}
+			if strings.ToLower(unit) == "year" {
+				return int64(months / 12)
+			}
+			return int64(months)
+		default:
+			panic("unknown date unit: " + unit)
+	}
+}
 
 func init_date() {
 	// string functions
 	DeclareTitle("Date")
-	allowed_formats := []string{
-		"2006-01-02 15:04:05.000000",
-		"2006-01-02 15:04:05",
-		"2006-01-02 15:04",
-		"2006-01-02",
-		"06-01-02 15:04:05.000000",
-		"06-01-02 15:04:05",
-		"06-01-02 15:04",
-		"06-01-02",
-	}
 
 
 	Declare(&Globalenv, &Declaration{
@@ -49,14 +126,55 @@ func init_date() {
 			DeclarationParameter{"value", "string", "values to parse"},
 		}, "int",
 		func(a ...Scmer) Scmer {
-			for _, format := range allowed_formats { // try through all formats
-				if t, err := time.Parse(format, String(a[0])); err != nil {
-					return int64(t.Unix())
-				}
+			if t, _, ok := parseDate(String(a[0])); ok {
+				return int64(t.Unix())
 			}
 			return nil
 		},
 	})
+	Declare(&Globalenv, &Declaration{
+		"date-add", "adds an interval to a date (like DATE_ADD(date, INTERVAL n unit)); adding months or years clamps the day to the end of the month",
+		3, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"date", "number|string", "unix timestamp or date string"},
+			DeclarationParameter{"n", "number", "number of units to add (negative to subtract)"},
+			DeclarationParameter{"unit", "string", "second, minute, hour, day, month or year"},
+		}, "number|string",
+		func(a ...Scmer) Scmer {
+			if a[0] == nil {
+				return nil
+			}
+			t, format, ok := parseDate(a[0])
+			if !ok {
+				return nil
+			}
+			t = dateAdd(t, ToInt(a[1]), String(a[2]))
+			if format == "" {
+				return int64(t.Unix())
+			}
+			return t.Format(format) // dates stay dates, timestamps stay timestamps
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"date-diff", "returns the number of whole units from date a to date b (like TIMESTAMPDIFF(unit, a, b)); negative if b is before a",
+		3, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"a", "number|string", "unix timestamp or date string"},
+			DeclarationParameter{"b", "number|string", "unix timestamp or date string"},
+			DeclarationParameter{"unit", "string", "second, minute, hour, day, month or year"},
+		}, "int",
+		func(a ...Scmer) Scmer {
+			ta, _, ok := parseDate(a[0])
+			if !ok {
+				return nil
+			}
+			tb, _, ok := parseDate(a[1])
+			if !ok {
+				return nil
+			}
+			return dateDiff(ta, tb, String(a[2]))
+		},
+	})
 }
 
 
@@ -26,6 +26,12 @@ Copyright (C) 2013  Pieter Kelchtermans (originally licensed unter WTFPL 2.0)
 package scm
 
 import "fmt"
+import "sort"
+import "runtime"
+import "github.com/jtolds/gls"
+
+// preduce: below this many items per worker, a serial reduce is faster
+const preduceMinChunk = 1024
 
 func init_list() {
 	// list functions
@@ -159,6 +165,38 @@ func init_list() {
 			return result
 		},
 	})
+	Declare(&Globalenv, &Declaration{
+		"zip-with", "applies a function to the corresponding elements of multiple lists and returns the list of results. The result is as long as the shortest list.",
+		2, 1000,
+		[]DeclarationParameter{
+			DeclarationParameter{"func", "func", "function func(any...)->any that gets one item of each list"},
+			DeclarationParameter{"list...", "list", "lists whose items are combined"},
+		}, "list",
+		func (a ...Scmer) Scmer {
+			fn := OptimizeProcToSerialFunction(a[0])
+			lists := make([][]Scmer, len(a) - 1)
+			size := -1
+			for i, l := range a[1:] {
+				var ok bool
+				lists[i], ok = l.([]Scmer)
+				if !ok {
+					panic("invalid input for zip-with: " + fmt.Sprint(l))
+				}
+				if size == -1 || len(lists[i]) < size {
+					size = len(lists[i])
+				}
+			}
+			result := make([]Scmer, size)
+			for i := range result {
+				args := make([]Scmer, len(lists)) // fresh per call, fn may keep its arguments (e.g. list)
+				for j, l := range lists {
+					args[j] = l[i]
+				}
+				result[i] = fn(args...)
+			}
+			return result
+		},
+	})
 	Declare(&Globalenv, &Declaration{
 		"merge", "flattens a list of lists into a list containing all the subitems. If one parameter is given, it is a list of lists that is flattened. If multiple parameters are given, they are treated as lists that will be merged into one",
 		1, 1000,
@@ -322,6 +360,68 @@ func init_list() {
 			return result
 		},
 	})
+	Declare(&Globalenv, &Declaration{
+		"preduce", "parallel reduce: splits the list into chunks that are reduced by one worker per CPU starting from neutral, then combines the chunk results in order. Small lists are reduced serially.",
+		3, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"list", "list", "list that has to be reduced"},
+			DeclarationParameter{"reduce", "func", "reduce function func(any any)->any; it must be associative and accept an accumulator on both sides since chunk results are combined with it"},
+			DeclarationParameter{"neutral", "any", "neutral element of reduce; every chunk starts with it"},
+		}, "any",
+		func(a ...Scmer) Scmer {
+			list, _ := a[0].([]Scmer)
+			workers := runtime.NumCPU()
+			if workers > len(list) / preduceMinChunk {
+				workers = len(list) / preduceMinChunk
+			}
+			if workers <= 1 {
+				fn := OptimizeProcToSerialFunction(a[1])
+				result := a[2]
+				for _, v := range list {
+					result = fn(result, v)
+				}
+				return result
+			}
+			results := make([]Scmer, workers)
+			errs := make(chan any, workers)
+			chunk := (len(list) + workers - 1) / workers
+			for w := 0; w < workers; w++ {
+				gls.Go(func(w int) func() {
+					return func() {
+						defer func() {
+							// catch errors and pass them on
+							errs <- recover()
+						}()
+						fn := OptimizeProcToSerialFunction(a[1]) // serial functions must not be shared between goroutines
+						result := a[2]
+						end := (w + 1) * chunk
+						if end > len(list) {
+							end = len(list)
+						}
+						for _, v := range list[w * chunk:end] {
+							result = fn(result, v)
+						}
+						results[w] = result
+					}
+				}(w))
+			}
+			var err any
+			for w := 0; w < workers; w++ {
+				if e := <- errs; e != nil && err == nil {
+					err = e
+				}
+			}
+			if err != nil {
+				panic(err)
+			}
+			fn := OptimizeProcToSerialFunction(a[1])
+			result := results[0]
+			for _, v := range results[1:] {
+				result = fn(result, v)
+			}
+			return result
+		},
+	})
 	Declare(&Globalenv, &Declaration{
 		"produce", "returns a list that contains produced items - it works like for(state = startstate, condition(state), state = iterator(state)) {yield state}",
 		3, 3,
@@ -535,27 +635,401 @@ func init_list() {
 	})
 	Declare(&Globalenv, &Declaration{
 		"merge_assoc", "returns a dictionary where all keys from dict1 and all keys from dict2 are present.\nIf a key is present in both inputs, the second one will be dominant so the first value will be overwritten unless you provide a merge function",
-		2, 3,
+		2, 4,
 		[]DeclarationParameter{
 			DeclarationParameter{"dict1", "list", "first input dictionary that has to be changed. You must not use this value again."},
 			DeclarationParameter{"dict2", "list", "input dictionary that contains the new values that have to be added"},
-			DeclarationParameter{"merge", "func", "(optional) func(any any)->any that is called when a value is overwritten. The first parameter is the old value, the second is the new value from dict2. It must return the merged value that shall be pysically stored in the new dictionary."},
+			DeclarationParameter{"merge", "func", "(optional) func(any any string)->any that is called when a value is overwritten. The first parameter is the old value, the second is the new value from dict2, the third is the key. It must return the merged value that shall be pysically stored in the new dictionary. Pass nil to overwrite."},
+			DeclarationParameter{"deep", "bool", "(optional) if true, values that are dictionaries in both inputs are merged recursively; merge is only called for the other values"},
 		}, "list",
 		func(a ...Scmer) Scmer {
-			// naive implementation, bad performance
-			set_assoc := Globalenv.Vars["set_assoc"].(func(...Scmer) Scmer)
-			list := a[0]
-			dict := a[1].([]Scmer)
-			if len(a) > 2 {
-				for i := 0; i < len(dict); i += 2 {
-					list = set_assoc(list, dict[i], dict[i+1], a[2])
-				}
-			} else {
-				for i := 0; i < len(dict); i += 2 {
-					list = set_assoc(list, dict[i], dict[i+1])
-				}
+			var fn func(a ...Scmer) Scmer
+			if len(a) > 2 && a[2] != nil {
+				fn = OptimizeProcToSerialFunction(a[2])
 			}
-			return list
+			return mergeAssoc(a[0], a[1], fn, len(a) > 3 && ToBool(a[3]))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"diff", "computes the changes between two versions of a dictionary. The result is a patch: a list of operations (\"set\" key value), (\"remove\" key) and (\"diff\" key subpatch) for nested dictionaries. Unchanged keys produce no operation, so equal documents give an empty patch. If a value changes its type (e.g. from a scalar to a dictionary), it is replaced as a whole.",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"old", "list", "old version of the dictionary"},
+			DeclarationParameter{"new", "list", "new version of the dictionary"},
+		}, "list",
+		func(a ...Scmer) Scmer {
+			return diffAssoc(assertDict(a[0], "diff", "old"), assertDict(a[1], "diff", "new"))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"patch", "applies a patch that was computed by diff and returns the changed dictionary. The input stays unharmed. New keys are appended at the end.",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"doc", "list", "dictionary to change"},
+			DeclarationParameter{"patch", "list", "list of operations as returned by diff"},
+		}, "list",
+		func(a ...Scmer) Scmer {
+			patch, _ := a[1].([]Scmer)
+			return patchAssoc(assertDict(a[0], "patch", "doc"), patch)
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"group_by", "groups a list of rows and computes aggregates for each group. Returns one dictionary per group (in order of first appearance) that contains the group columns and the aggregates.",
+		3, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"rows", "list", "list of dictionaries (one per row)"},
+			DeclarationParameter{"cols", "list", "list of column names to group by; if empty, all rows form one group (which also exists for empty input)"},
+			DeclarationParameter{"aggregates", "list", "dictionary of result name -> aggregate, e.g. (list \"cnt\" count \"total\" (list 'sum \"price\")). Aggregates are given as symbol or builtin: count (all rows), (count col), (sum col), (min col), (max col) and (avg col); NULL values are skipped like in SQL"},
+		}, "list",
+		func(a ...Scmer) Scmer {
+			return groupBy(a[0].([]Scmer), a[1].([]Scmer), a[2].([]Scmer))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"sort", "returns a sorted copy of a list. The sort is stable, so elements with equal keys keep their order. This is the in-memory counterpart of scan_order.",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"list", "list", "list that has to be sorted"},
+			DeclarationParameter{"comparators", "list|func", "list of (keyfn direction) pairs; keyfn is func(any)->any and extracts the sort key, direction is < for ascending, > for descending or a (collate ...) function. Later pairs decide only if the earlier keys are equal. A bare keyfn sorts ascending by that key."},
+		}, "list",
+		func(a ...Scmer) Scmer {
+			list, _ := a[0].([]Scmer)
+			return sortList(list, a[1])
 		},
 	})
 }
+
+// stable multi-key sort; the keys are extracted once per element
+func sortList(list []Scmer, comparators Scmer) []Scmer {
+	var pairs []Scmer
+	if c, ok := comparators.([]Scmer); ok {
+		pairs = c
+	} else {
+		pairs = []Scmer{comparators}
+	}
+	keyfns := make([]func(...Scmer) Scmer, len(pairs))
+	dirs := make([]func(...Scmer) Scmer, len(pairs))
+	for i, pair := range pairs {
+		if p, ok := pair.([]Scmer); ok {
+			if len(p) != 2 {
+				panic("sort: comparator must be a (keyfn direction) pair: " + String(pair))
+			}
+			keyfns[i] = OptimizeProcToSerialFunction(p[0])
+			dirs[i] = OptimizeProcToSerialFunction(p[1])
+		} else {
+			keyfns[i] = OptimizeProcToSerialFunction(pair)
+			dirs[i] = func(a ...Scmer) Scmer {
+				return Less(a[0], a[1])
+			}
+		}
+	}
+	type item struct {
+		value Scmer
+		keys []Scmer
+	}
+	items := make([]item, len(list))
+	for i, v := range list {
+		items[i].value = v
+		items[i].keys = make([]Scmer, len(keyfns))
+		for c, fn := range keyfns {
+			items[i].keys[c] = fn(v)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		for c, dir := range dirs {
+			a := items[i].keys[c]
+			b := items[j].keys[c]
+			if ToBool(dir(a, b)) {
+				return true
+			} else if ToBool(dir(b, a)) {
+				return false
+			} // else: go to next level
+		}
+		return false // equal is not less
+	})
+	result := make([]Scmer, len(items))
+	for i, it := range items {
+		result[i] = it.value
+	}
+	return result
+}
+
+func assertDict(dict Scmer, fn string, name string) []Scmer {
+	list, ok := dict.([]Scmer)
+	if !ok && dict != nil {
+		panic(fn + ": " + name + " is not a dictionary: " + String(dict))
+	}
+	if len(list) % 2 != 0 {
+		panic(fn + ": " + name + " has an odd number of elements: " + String(dict))
+	}
+	return list
+}
+
+// whether diff and patch recurse into a value: a list of key-value pairs with string keys
+func isAssoc(v Scmer) bool {
+	list, ok := v.([]Scmer)
+	if !ok || len(list) % 2 != 0 {
+		return false
+	}
+	for i := 0; i < len(list); i += 2 {
+		if _, ok := list[i].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func diffAssoc(old, new []Scmer) []Scmer {
+	result := make([]Scmer, 0)
+	for i := 0; i < len(old); i += 2 {
+		found := false
+		for j := 0; j < len(new); j += 2 {
+			if Equal(old[i], new[j]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, []Scmer{"remove", old[i]})
+		}
+	}
+	nextkey:
+	for j := 0; j < len(new); j += 2 {
+		for i := 0; i < len(old); i += 2 {
+			if Equal(old[i], new[j]) {
+				if isAssoc(old[i+1]) && isAssoc(new[j+1]) {
+					if sub := diffAssoc(old[i+1].([]Scmer), new[j+1].([]Scmer)); len(sub) > 0 {
+						result = append(result, []Scmer{"diff", new[j], sub})
+					}
+				} else if !Equal(old[i+1], new[j+1]) {
+					result = append(result, []Scmer{"set", new[j], new[j+1]})
+				}
+				continue nextkey
+			}
+		}
+		result = append(result, []Scmer{"set", new[j], new[j+1]})
+	}
+	return result
+}
+
+func patchAssoc(doc []Scmer, patch []Scmer) []Scmer {
+	result := make([]Scmer, len(doc))
+	copy(result, doc)
+	for _, op_ := range patch {
+		op, ok := op_.([]Scmer)
+		if !ok || len(op) < 2 {
+			panic("patch: invalid operation: " + String(op_))
+		}
+		pos := -1
+		for i := 0; i < len(result); i += 2 {
+			if Equal(result[i], op[1]) {
+				pos = i
+				break
+			}
+		}
+		switch op[0] {
+			case "set":
+				if len(op) != 3 {
+					panic("patch: invalid operation: " + String(op_))
+				}
+				if pos == -1 {
+					result = append(result, op[1], op[2])
+				} else {
+					result[pos+1] = op[2]
+				}
+			case "remove":
+				if pos != -1 {
+					result = append(result[:pos], result[pos+2:]...)
+				}
+			case "diff":
+				if len(op) != 3 {
+					panic("patch: invalid operation: " + String(op_))
+				}
+				var sub []Scmer
+				if pos != -1 {
+					sub = assertDict(result[pos+1], "patch", "doc")
+				}
+				subpatch, _ := op[2].([]Scmer)
+				if pos == -1 {
+					result = append(result, op[1], patchAssoc(sub, subpatch))
+				} else {
+					result[pos+1] = patchAssoc(sub, subpatch)
+				}
+			default:
+				panic("patch: unknown operation: " + String(op[0]))
+		}
+	}
+	return result
+}
+
+// merges dict2 into dict1 (dict1 is changed in place)
+func mergeAssoc(dict1, dict2 Scmer, fn func(...Scmer) Scmer, deep bool) []Scmer {
+	list := assertDict(dict1, "merge_assoc", "dict1")
+	dict := assertDict(dict2, "merge_assoc", "dict2")
+	nextkey:
+	for i := 0; i < len(dict); i += 2 {
+		for j := 0; j < len(list); j += 2 {
+			if Equal(list[j], dict[i]) {
+				old, oldIsList := list[j+1].([]Scmer)
+				newv, newIsList := dict[i+1].([]Scmer)
+				if deep && oldIsList && newIsList && len(old) % 2 == 0 && len(newv) % 2 == 0 {
+					list[j+1] = mergeAssoc(old, newv, fn, deep)
+				} else if fn != nil {
+					list[j+1] = fn(list[j+1], dict[i+1], dict[i])
+				} else {
+					list[j+1] = dict[i+1]
+				}
+				continue nextkey
+			}
+		}
+		list = append(list, dict[i], dict[i+1])
+	}
+	return list
+}
+
+// value of a column in a row dictionary
+func assocGet(row []Scmer, key Scmer) Scmer {
+	for i := 0; i < len(row); i += 2 {
+		if Equal(row[i], key) {
+			return row[i+1]
+		}
+	}
+	return nil
+}
+
+type groupAggregate struct {
+	name Scmer
+	fn string // count sum min max avg
+	col Scmer // nil: count(*)
+}
+
+type groupState struct {
+	key []Scmer
+	values []Scmer
+	counts []int // non-NULL values per aggregate
+}
+
+// name of an aggregate given as string, symbol or builtin (count, min, max)
+func aggregateName(v Scmer) string {
+	switch v := v.(type) {
+		case SourceInfo:
+			return aggregateName(v.value)
+		case Symbol:
+			return string(v)
+		case string:
+			return v
+		case func(...Scmer) Scmer:
+			if def, ok := declarations_hash[fmt.Sprintf("%p", v)]; ok {
+				return def.Name
+			}
+	}
+	return String(v)
+}
+
+func parseGroupAggregates(aggregates []Scmer) []groupAggregate {
+	result := make([]groupAggregate, len(aggregates) / 2)
+	for i := range result {
+		result[i].name = aggregates[2*i]
+		spec := aggregates[2*i+1]
+		if l, ok := spec.([]Scmer); ok && len(l) > 0 {
+			result[i].fn = aggregateName(l[0])
+			if len(l) > 1 {
+				result[i].col = l[1]
+			}
+		} else {
+			result[i].fn = aggregateName(spec)
+		}
+		switch result[i].fn {
+			case "count":
+			case "sum", "min", "max", "avg":
+				if result[i].col == nil {
+					panic("group_by: aggregate " + result[i].fn + " needs a column")
+				}
+			default:
+				panic("group_by: unknown aggregate " + fmt.Sprint(spec))
+		}
+	}
+	return result
+}
+
+func groupBy(rows []Scmer, cols []Scmer, aggregates []Scmer) []Scmer {
+	aggs := parseGroupAggregates(aggregates)
+	groups := make(map[string]*groupState)
+	var order []*groupState
+	newGroup := func(key []Scmer) *groupState {
+		g := &groupState{key, make([]Scmer, len(aggs)), make([]int, len(aggs))}
+		order = append(order, g)
+		return g
+	}
+	if len(cols) == 0 {
+		groups[""] = newGroup(nil) // like SQL: aggregates without GROUP BY always return one row
+	}
+	for _, row_ := range rows {
+		row := row_.([]Scmer)
+		key := make([]Scmer, len(cols))
+		for i, col := range cols {
+			key[i] = assocGet(row, col)
+		}
+		k := ""
+		if len(cols) > 0 {
+			k = SerializeToString(key, &Globalenv) // distinguishes 1 from "1"
+		}
+		g, ok := groups[k]
+		if !ok {
+			g = newGroup(key)
+			groups[k] = g
+		}
+		for i, agg := range aggs {
+			if agg.col == nil {
+				g.counts[i]++ // count(*)
+				continue
+			}
+			v := assocGet(row, agg.col)
+			if v == nil {
+				continue // NULL is skipped by all aggregates
+			}
+			g.counts[i]++
+			switch agg.fn {
+				case "sum", "avg":
+					if sum, ok := g.values[i].(int64); ok || g.counts[i] == 1 {
+						if vi, ok := v.(int64); ok {
+							g.values[i] = sum + vi // integer sums stay integers
+							break
+						}
+					}
+					g.values[i] = ToFloat(g.values[i]) + ToFloat(v)
+				case "min":
+					if g.counts[i] == 1 || Less(v, g.values[i]) {
+						g.values[i] = v
+					}
+				case "max":
+					if g.counts[i] == 1 || Less(g.values[i], v) {
+						g.values[i] = v
+					}
+			}
+		}
+	}
+	result := make([]Scmer, len(order))
+	for gi, g := range order {
+		item := make([]Scmer, 0, 2 * (len(cols) + len(aggs)))
+		for i, col := range cols {
+			item = append(item, col, g.key[i])
+		}
+		for i, agg := range aggs {
+			var v Scmer
+			switch agg.fn {
+				case "count":
+					v = int64(g.counts[i])
+				case "avg":
+					if g.counts[i] > 0 {
+						v = ToFloat(g.values[i]) / float64(g.counts[i])
+					}
+				default:
+					v = g.values[i] // NULL if the group had no non-NULL value
+			}
+			item = append(item, agg.name, v)
+		}
+		result[gi] = item
+	}
+	return result
+}
@@ -19,6 +19,8 @@ package scm
 
 import "fmt"
 import "sync"
+import "bytes"
+import "time"
 import "errors"
 import "runtime"
 import "github.com/launix-de/go-mysqlstack/driver"
@@ -49,6 +51,15 @@ func MySQLServe(a ...Scmer) Scmer {
 	return true
 }
 
+// metadata of the client connection behind a session
+func ConnectionInfo(a ...Scmer) Scmer {
+	sess := getSessionObject(a[0])
+	if sess.Connection == nil {
+		return nil
+	}
+	return sess.Connection()
+}
+
 // driver.CreatePassword helper function
 func MySQLPassword(a ...Scmer) Scmer {
 	return string(driver.CreatePassword(String(a[0])))
@@ -71,8 +82,22 @@ func (m *MySQLWrapper) SetServerVersion() {
 }
 func (m *MySQLWrapper) NewSession(session *driver.Session) {
 	m.log.Info("New Session from " + session.Addr())
-	// initialize something??
-	mysqlsessions.Store(session.ID(), NewSession())
+	scmSession := NewSession()
+	connected := time.Now()
+	addr := session.Addr() // read once, the connection is nil after close
+	// TODO: client capabilities and connection attributes (client name/version) as well as PROXY protocol addresses are parsed but not exposed by go-mysqlstack
+	getSessionObject(scmSession).Connection = func () Scmer {
+		return []Scmer{
+			"id", int64(session.ID()),
+			"address", addr,
+			"user", session.User(),
+			"schema", session.Schema(),
+			"charset", int64(session.Charset()),
+			"connected", connected.Format("2006-01-02 15:04:05"),
+			"protocol", "mysql",
+		}
+	}
+	mysqlsessions.Store(session.ID(), scmSession)
 }
 func (m *MySQLWrapper) SessionInc(session *driver.Session) {
 	// I think we can skip session counting
@@ -131,8 +156,59 @@ func ScmerToMySQL(v Scmer) sqltypes.Value {
 			return sqltypes.NewVarChar(String(v2))
 	}
 }
+// prepared statements (COM_STMT_PREPARE/EXECUTE/CLOSE) are handled by the driver: the statement handles live in the driver session
+// and are freed with it; on execute, the query with ? placeholders arrives here together with the bound values v1..vN
+func interpolateBindVariables(query string, bindVariables map[string]*querypb.BindVariable) (string, error) {
+	var b bytes.Buffer
+	param := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if quote != 0 {
+			b.WriteByte(c)
+			if c == '\\' && quote != '`' && i + 1 < len(query) {
+				i++
+				c = query[i]
+				b.WriteByte(c)
+			} else if c == quote {
+				quote = 0
+			}
+			if c == '?' {
+				param++ // the driver counts every ? as parameter (also inside literals), so the numbering of v1..vN must do the same; the value is not used
+			}
+			continue
+		}
+		switch c {
+			case '\'', '"', '`':
+				quote = c
+				b.WriteByte(c)
+			case '?':
+				param++
+				bv, ok := bindVariables[fmt.Sprintf("v%d", param)]
+				if !ok {
+					return "", fmt.Errorf("missing value for parameter %d of prepared statement", param)
+				}
+				v, err := sqltypes.BindVariableToValue(bv)
+				if err != nil {
+					return "", err
+				}
+				v.EncodeSQL(&b) // quoted and escaped literal or null
+			default:
+				b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
 func (m *MySQLWrapper) ComQuery(session *driver.Session, query string, bindVariables map[string]*querypb.BindVariable, callback func(*sqltypes.Result) error) error {
 	var myerr error = nil
+	if len(bindVariables) > 0 {
+		// execution of a prepared statement
+		var err error
+		if query, err = interpolateBindVariables(query, bindVariables); err != nil {
+			return err
+		}
+	}
 	if query == "select @@version_comment limit 1" {
 		callback(&sqltypes.Result {
 			Fields: []*querypb.Field {
@@ -61,6 +61,79 @@ func HTTPStaticGetter(wd string) func (...Scmer) Scmer {
 	}
 }
 
+// (websocket req res onMessage onClose): upgrades the request of a (serve) handler and returns the socket
+// as a function: (ws "send" msg) sends a text frame, (ws "sendBinary" msg) a binary frame, (ws "close") closes cleanly
+func HTTPWebsocket(a ...Scmer) Scmer {
+	req := a[0].([]Scmer)[1].(*http.Request)
+	res := a[1].([]Scmer)[1].(http.ResponseWriter)
+	var onClose Scmer
+	if len(a) > 3 {
+		onClose = a[3]
+	}
+	ws, sendmutex := upgradeWebsocket(res, req, a[2], onClose)
+	return func (a ...Scmer) Scmer {
+		sendmutex.Lock()
+		defer sendmutex.Unlock()
+		var err error
+		switch String(a[0]) {
+			case "send":
+				err = ws.WriteMessage(websocket.TextMessage, []byte(String(a[1])))
+			case "sendBinary":
+				err = ws.WriteMessage(websocket.BinaryMessage, []byte(String(a[1])))
+			case "close":
+				// close handshake: the read loop gets the answer of the client and calls onClose
+				err = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			default:
+				panic("unknown websocket operation: " + String(a[0]))
+		}
+		if err != nil {
+			panic(err)
+		}
+		return "ok"
+	}
+}
+
+// performs the RFC 6455 handshake and starts the read loop; onMessage gets (msg isBinary), onClose (optional) is called once when the connection is gone
+// pings are answered by the default ping handler of the read loop
+func upgradeWebsocket(res http.ResponseWriter, req *http.Request, onMessage Scmer, onClose Scmer) (*websocket.Conn, *sync.Mutex) {
+	var upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	ws, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		// TODO: better error handling
+		panic(err)
+	}
+	go func() {
+		defer ws.Close()
+		defer func () {
+			if r := recover(); r != nil {
+				PrintError("error in websocket receive: " + fmt.Sprint(r))
+			}
+		}()
+		for {
+			// websocket read loop
+			messageType, msg, err := ws.ReadMessage()
+			if err != nil {
+				// closed connection (clean close frame or broken connection)
+				if onClose != nil {
+					Apply(onClose)
+				}
+				return // exit endless loop
+			}
+			switch messageType {
+				case websocket.TextMessage:
+					Apply(onMessage, string(msg), false)
+				case websocket.BinaryMessage:
+					Apply(onMessage, string(msg), true) // raw bytes, e.g. vector payloads
+			}
+		}
+	}()
+	return ws, new(sync.Mutex)
+}
+
 // TODO: implement NewServeMux.Handle(route, http.StripPrefix(pfx, handler))
 
 // HTTP handler with a scheme script underneath
@@ -206,47 +279,35 @@ func (s *HttpServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			res_lock.Unlock();
 			return "ok"
 		},
+		"stream", func (a ...Scmer) Scmer {
+			// streaming response: the callback gets a write function; every write is sent as a chunk right away (Transfer-Encoding: chunked)
+			rc := http.NewResponseController(res)
+			rc.SetWriteDeadline(time.Time{}) // big results may take longer than the WriteTimeout
+			res_lock.Lock()
+			res.Header().Del("Content-Length")
+			res_lock.Unlock()
+			return Apply(a[0], func (a ...Scmer) Scmer {
+				res_lock.Lock()
+				defer res_lock.Unlock()
+				for _, s := range a {
+					if _, err := io.WriteString(res, String(s)); err != nil {
+						panic("http stream: " + err.Error()) // client has gone, so stop producing
+					}
+				}
+				if err := rc.Flush(); err != nil {
+					panic("http stream: " + err.Error())
+				}
+				return "ok"
+			})
+		},
 		"websocket", func (a ...Scmer) Scmer {
 			// upgrade to a websocket, params: onMessage, onClose
-			var upgrader = websocket.Upgrader{
-				ReadBufferSize:  1024,
-				WriteBufferSize: 1024,
+			var onClose Scmer
+			if len(a) > 1 {
+				onClose = a[1]
 			}
-			upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-			ws, err := upgrader.Upgrade(res, req, nil)
-			if err != nil {
-				// TODO: better error handling
-				panic(err)
-			}
-			go func() {
-				defer func () {
-					if r := recover(); r != nil {
-						PrintError("error in websocket receive: " + fmt.Sprint(r))
-					}
-				}()
-				for {
-					// websocket read loop
-					messageType, msg, err := ws.ReadMessage()
-					if err != nil {
-						if _, ok := err.(*websocket.CloseError); ok {
-							// closed connection
-							if len(a) > 1 {
-								Apply(a[1]) // close callback
-							}
-							return // exit endless loop
-						} else {
-							// TODO: better error handling
-							panic(err)
-						}
-					}
-					// TODO: messageType 1 = text, 2 = binary?
-					if messageType == 1 {
-						Apply(a[0], string(msg)) // 1st parameter is callback to receive message
-					}
-				}
-			}()
+			ws, sendmutex := upgradeWebsocket(res, req, a[0], onClose)
 			// return send callback
-			var sendmutex sync.Mutex
 			return func(a ...Scmer) Scmer {
 				sendmutex.Lock()
 				defer sendmutex.Unlock()
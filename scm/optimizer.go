@@ -29,7 +29,8 @@ func OptimizeProcToSerialFunction(val Scmer) func (...Scmer) Scmer {
 	if result, ok := val.(func(...Scmer) Scmer); ok {
 		return result // already optimized
 	}
-	// TODO: JIT
+	// TODO: JIT (there is no JIT emitter in this tree yet; once an amd64 backend exists, an arm64 backend
+	// with the same emitter surface (X0-X30, V0-V31; Scmer returned in X0/X1) should follow so ARM servers are not left on the slow path)
 
 	// otherwise: precreate a lambda
 	p := val.(Proc) // precast procedure
@@ -42,7 +43,7 @@ func OptimizeProcToSerialFunction(val Scmer) func (...Scmer) Scmer {
 			}
 	}
 
-	en := &Env{make(Vars), make([]Scmer, p.NumVars), p.En, false} // reusable environment for one thread
+	en := &Env{make(Vars), make([]Scmer, p.NumVars), p.En, false, p.En.Sandbox} // reusable environment for one thread
 	switch params := p.Params.(type) {
 	case []Scmer: // default case: 
 		if p.NumVars > 0 {
@@ -392,6 +393,11 @@ func OptimizeParser(val Scmer, env *Env, ome *optimizerMetainfo, ignoreResult bo
 					// remove entry from map so we really read out the real variable
 					delete(ome.variableReplacement, v[1].(Symbol))
 				}
+			} else if v[0] == Symbol("infix") {
+				v[1] = OptimizeParser(v[1], env, ome, false)
+				for i := 2; i < len(v); i++ {
+					v[i], _ = OptimizeEx(v[i], env, ome, true) // operator tables and reducers
+				}
 			} else {
 				// + * ? or atom regex
 				for i := 1; i < len(v); i++ {
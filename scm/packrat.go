@@ -18,6 +18,8 @@ Copyright (C) 2023-2024  Carl-Philip Hänsch
 package scm
 
 import "fmt"
+import "math"
+import "sort"
 import "regexp"
 import packrat "github.com/launix-de/go-packrat/v2"
 
@@ -317,6 +319,12 @@ func parseSyntax(syntax Scmer, en *Env, ome *optimizerMetainfo, ignoreResult boo
 						}
 						return packrat.NewMaybeParser(parserResult{nil, nil}, packrat.NewAndParser(merger, subparser...))
 					}
+				case Symbol("infix"):
+					if ome != nil {
+						// operator table and reducers are only known at runtime
+						return nil
+					}
+					return newInfixParser(n, en)
 				case Symbol("define"):
 					result := new(ScmParserVariable)
 					result.Variable = n[1].(Symbol)
@@ -342,6 +350,94 @@ func parseSyntax(syntax Scmer, en *Env, ome *optimizerMetainfo, ignoreResult boo
 	panic("Unknown parser syntax: " + fmt.Sprint(syntax))
 }
 
+type infixOperator struct {
+	precedence float64
+	rightAssoc bool
+}
+
+// (infix operand '("+" 1 "-" 1 "^" '(3 "right")) reducer [prefixops prefixreducer])
+// parses operand (op operand)* and folds it by precedence climbing into (reducer left op right)
+func newInfixParser(n []Scmer, en *Env) packrat.Parser[parserResult] {
+	if len(n) != 4 && len(n) != 6 {
+		panic("infix expects (infix operand operators reducer [prefixoperators prefixreducer])")
+	}
+	operand := parseSyntax(n[1], en, nil, false)
+	reducer := Eval(n[3], en)
+	table := make(map[string]infixOperator)
+	var names []string
+	ops := Eval(n[2], en).([]Scmer)
+	if len(ops) % 2 != 0 {
+		panic("infix operators must be a list of operator/precedence pairs")
+	}
+	for i := 0; i < len(ops); i += 2 {
+		var op infixOperator
+		if p, ok := ops[i+1].([]Scmer); ok {
+			// '(precedence "right") declares a right associative operator
+			op.precedence = ToFloat(p[0])
+			op.rightAssoc = len(p) > 1 && String(p[1]) == "right"
+		} else {
+			op.precedence = ToFloat(ops[i+1])
+		}
+		table[String(ops[i])] = op
+		names = append(names, String(ops[i]))
+	}
+	if len(n) == 6 {
+		// unary prefix operators bind tighter than any infix operator and may be nested
+		prefixReducer := Eval(n[5], en)
+		var prefixNames []string
+		for _, op := range Eval(n[4], en).([]Scmer) {
+			prefixNames = append(prefixNames, String(op))
+		}
+		prefixed := packrat.NewOrParser[parserResult]()
+		prefixed.Set(packrat.NewAndParser(func (s string, r ...parserResult) parserResult {
+			return parserResult{Apply(prefixReducer, r[0].value, r[1].value), nil}
+		}, operatorParser(prefixNames), prefixed), operand)
+		operand = prefixed
+	}
+	tail := packrat.NewKleeneParser(mergeParserResults, packrat.NewAndParser(mergeParserResults, operatorParser(names), operand), packrat.NewEmptyParser(parserResult{nil, nil}))
+	return packrat.NewAndParser(func (s string, r ...parserResult) parserResult {
+		// flatten into operand op operand op ... operand
+		terms := []Scmer{r[0].value}
+		pairs, _ := r[1].value.([]Scmer)
+		for _, pair := range pairs {
+			terms = append(terms, pair.([]Scmer)...)
+		}
+		pos := 0
+		return parserResult{climbInfix(terms, &pos, math.Inf(-1), false, table, reducer), nil}
+	}, operand, tail)
+}
+
+// matches one of the given operators; longer operators win over their prefixes
+func operatorParser(names []string) packrat.Parser[parserResult] {
+	sorted := append([]string{}, names...)
+	sort.SliceStable(sorted, func (i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	atoms := make([]packrat.Parser[parserResult], len(sorted))
+	for i, op := range sorted {
+		atoms[i] = packrat.NewAtomParser(parserResult{op, nil}, op, false, true)
+	}
+	return packrat.NewOrParser(atoms...)
+}
+
+// precedence climbing over terms = operand op operand ... starting at terms[*pos]
+// strict only accepts operators that bind tighter than minPrecedence (left associativity)
+func climbInfix(terms []Scmer, pos *int, minPrecedence float64, strict bool, table map[string]infixOperator, reducer Scmer) Scmer {
+	left := terms[*pos]
+	*pos++
+	for *pos < len(terms) {
+		opname := String(terms[*pos])
+		op := table[opname]
+		if op.precedence < minPrecedence || strict && op.precedence == minPrecedence {
+			break
+		}
+		*pos++
+		right := climbInfix(terms, pos, op.precedence, !op.rightAssoc, table, reducer)
+		left = Apply(reducer, left, opname, right)
+	}
+	return left
+}
+
 func NewParser(syntax, generator, whitespace Scmer, en *Env, ignoreResult bool) *ScmParser {
 	if generator != nil {
 		ignoreResult = true
@@ -379,6 +475,8 @@ syntax can be one of:
 (+ sub separator) ManyParser
 (? xyz) MaybeParser (if >1 AndParser)
 (not mainparser parser1 parser2 parser3 ...) a parser that matches mainparser but not parser1...
+(infix operand '("+" 1 "*" 2 "^" '(3 "right")) reducer) parses operand (op operand)* with operator precedence, calls (reducer left op right)
+(infix operand operators reducer '("-") prefixreducer) additionally accepts unary prefix operators, calls (prefixreducer op operand)
 $ EndParser
 empty EmptyParser
 symbol -> use other parser defined in env
@@ -101,6 +101,17 @@ func SerializeEx(b *bytes.Buffer, v Scmer, en *Env, glob *Env, p *Proc) {
 			b.WriteByte(')')
 		}
 	case func(...Scmer) Scmer:
+		if collation, reverse, ok := CollateOf(v); ok {
+			// comparator of a collation: recreate it by its constructor
+			b.WriteString("(collate ")
+			SerializeEx(b, collation, en, glob, p)
+			if reverse {
+				b.WriteString(" true)")
+			} else {
+				b.WriteString(" false)")
+			}
+			return
+		}
 		// native func serialization is the hardest; reverse the env!
 		// when later functional JIT is done, this must also handle deoptimization
 		en2 := en
@@ -0,0 +1,141 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package scm
+
+import "sync"
+import "sync/atomic"
+import "math/rand/v2"
+import "github.com/google/uuid"
+
+// unseeded, the runtime's per-thread ChaCha8 generator is used (lock-free, seeded from OS entropy)
+// after (seed-random n), all calls draw from one shared PCG so sequences are reproducible
+type seededGenerator struct {
+	mu sync.Mutex
+	r *rand.Rand
+}
+var seededRandom atomic.Pointer[seededGenerator]
+
+func randomFloat() float64 {
+	if g := seededRandom.Load(); g != nil {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.r.Float64()
+	}
+	return rand.Float64()
+}
+
+// uniform in [min, max]; the span is computed in uint64, so the full int64 range does not overflow
+func randomInt(min, max int64) int64 {
+	span := uint64(max) - uint64(min)
+	var r *rand.Rand
+	if g := seededRandom.Load(); g != nil {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		r = g.r
+	}
+	if span == ^uint64(0) {
+		if r != nil {
+			return int64(r.Uint64())
+		}
+		return int64(rand.Uint64())
+	}
+	if r != nil {
+		return min + int64(r.Uint64N(span + 1))
+	}
+	return min + int64(rand.Uint64N(span + 1))
+}
+
+func init_random() {
+	DeclareTitle("Random numbers")
+
+	Declare(&Globalenv, &Declaration{
+		"random", "returns a pseudo random float in [0, 1)",
+		0, 0,
+		[]DeclarationParameter{}, "number",
+		func (a ...Scmer) Scmer {
+			return randomFloat()
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"random-int", "returns a pseudo random integer between min and max (both inclusive)",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"min", "number", "lowest possible value"},
+			DeclarationParameter{"max", "number", "highest possible value"},
+		}, "int",
+		func (a ...Scmer) Scmer {
+			min := int64(ToInt(a[0]))
+			max := int64(ToInt(a[1]))
+			if max < min {
+				panic("random-int: max must not be smaller than min")
+			}
+			return randomInt(min, max)
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"seed-random", "seeds the pseudo random generator so (random) and (random-int) produce a reproducible sequence; (seed-random nil) switches back to the unseeded entropy source. Seeded generation is serialized by a lock.",
+		1, 1,
+		[]DeclarationParameter{
+			DeclarationParameter{"seed", "number", "seed value or nil"},
+		}, "bool",
+		func (a ...Scmer) Scmer {
+			if a[0] == nil {
+				seededRandom.Store(nil)
+			} else {
+				seed := uint64(ToInt(a[0]))
+				seededRandom.Store(&seededGenerator{r: rand.New(rand.NewPCG(seed, seed ^ 0x9e3779b97f4a7c15))})
+			}
+			return true
+		},
+	})
+
+	/* UUIDs are always drawn from the OS entropy source, also after (seed-random n), so they stay unique */
+	Declare(&Globalenv, &Declaration{
+		"uuid", "returns a random UUID (version 4) as lowercase string",
+		0, 0,
+		[]DeclarationParameter{}, "string",
+		func (a ...Scmer) Scmer {
+			return uuid.NewString()
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"uuid-v7", "returns a time-ordered UUID (version 7) as lowercase string. Its first 48 bits are the unix time in milliseconds and the next 12 bits a counter, so values created later always sort after earlier ones (also within the same millisecond and across threads). Use it for primary keys where index locality matters.",
+		0, 0,
+		[]DeclarationParameter{}, "string",
+		func (a ...Scmer) Scmer {
+			u, err := uuid.NewV7()
+			if err != nil {
+				panic(err)
+			}
+			return u.String()
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"uuid-parse", "validates a UUID and returns it in the normalized lowercase form xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx. Uppercase, braces, the urn:uuid: prefix and the 32 hex digits without hyphens are accepted; other input panics.",
+		1, 1,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "string", "UUID to parse"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			u, err := uuid.Parse(String(a[0]))
+			if err != nil {
+				panic("invalid UUID " + String(a[0]) + ": " + err.Error())
+			}
+			return u.String()
+		},
+	})
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package scm
+
+import "fmt"
+import "strings"
+import "sync/atomic"
+
+/* resource limits for untrusted code
+
+ Eval charges one step per application and one cell per argument, parameter slot and list item returned by a builtin.
+ Strings returned by a builtin cost one cell per 8 bytes. Builtins whose result size is given by their arguments
+ (produceN, concat, replace) are checked against the remaining budget before they allocate anything.
+ The counters only depend on the evaluated code, so the same input always exhausts at the same point.
+ Exceeding a limit panics; the panic unwinds through the same defers as any other error, so locks and sessions are released.
+*/
+type sandbox struct {
+	maxSteps int64
+	maxCells int64
+	steps atomic.Int64
+	cells atomic.Int64
+}
+
+func (s *sandbox) charge(steps, cells int64) {
+	if s.maxSteps > 0 && s.steps.Add(steps) > s.maxSteps {
+		panic(fmt.Sprintf("resource exhausted: sandbox exceeded %d evaluation steps", s.maxSteps))
+	}
+	if s.maxCells > 0 && s.cells.Add(cells) > s.maxCells {
+		panic(fmt.Sprintf("resource exhausted: sandbox exceeded %d allocated cells", s.maxCells))
+	}
+}
+
+// panics if allocating cells would exceed the budget; the cells are charged when the result is there
+func (s *sandbox) reserve(cells int64) {
+	if s.maxCells > 0 && s.cells.Load() + cells > s.maxCells {
+		panic(fmt.Sprintf("resource exhausted: sandbox exceeded %d allocated cells", s.maxCells))
+	}
+}
+
+// cells of a value returned by a builtin
+func sandboxCells(v Scmer) int64 {
+	switch x := v.(type) {
+		case []Scmer:
+			return int64(len(x))
+		case string:
+			return int64(len(x) + 7) / 8
+	}
+	return 0
+}
+
+// upper bounds of the cells a builtin will return, computed from its arguments before it runs
+var sandboxEstimates = map[string]func(a []Scmer) int64{
+	"produceN": func(a []Scmer) int64 {
+		if len(a) == 0 {
+			return 0
+		}
+		return int64(ToInt(a[0]))
+	},
+	"concat": func(a []Scmer) int64 {
+		size := 0
+		for _, x := range a {
+			if str, ok := x.(string); ok {
+				size += len(str)
+			} else {
+				size += 24 // numbers and other scalars
+			}
+		}
+		return int64(size + 7) / 8
+	},
+	"replace": func(a []Scmer) int64 {
+		if len(a) < 3 {
+			return 0
+		}
+		str, find, replace := String(a[0]), String(a[1]), String(a[2])
+		size := len(str)
+		if len(replace) > len(find) {
+			if find == "" {
+				size += (len(str) + 1) * len(replace)
+			} else {
+				size += strings.Count(str, find) * (len(replace) - len(find))
+			}
+		}
+		return int64(size + 7) / 8
+	},
+}
+
+// calls a builtin on behalf of sandboxed code
+func (s *sandbox) callBuiltin(fn func() Scmer, args []Scmer) Scmer {
+	s.charge(0, int64(len(args)))
+	for i, arg := range args {
+		if p, ok := arg.(Proc); ok && p.En.Sandbox != s {
+			// callbacks (e.g. of map) are charged, too, even if they were defined outside
+			p.En = &Env{make(Vars), p.En.VarsNumbered, p.En, true, s}
+			args[i] = p
+		}
+	}
+	result := fn()
+	s.charge(0, sandboxCells(result))
+	return result
+}
+
+// sections of builtins that are visible to sandboxed code: pure functions without access to storage, files, network, sessions or goroutines
+var sandboxSections = map[string]bool{
+	"SCM Builtins": true,
+	"Arithmetic / Logic": true,
+	"Strings": true,
+	"Lists": true,
+	"Associative Lists / Dictionaries": true,
+	"Date": true,
+	"Vectors": true,
+	"Statistics": true,
+}
+
+// fresh copy of the whitelisted builtins; every sandbox gets its own, so a (set ...) or (outer (define ...)) stays inside
+func sandboxGlobals(s *sandbox) Vars {
+	result := make(Vars)
+	visible := false
+	for _, name := range declaration_titles {
+		if strings.HasPrefix(name, "#") {
+			visible = sandboxSections[name[1:]]
+		} else if visible && declarations[name].Fn != nil {
+			fn := declarations[name].Fn // the builtin itself, even if a script has overwritten the global
+			if estimate, ok := sandboxEstimates[name]; ok {
+				result[Symbol(name)] = func (a ...Scmer) Scmer {
+					s.reserve(estimate(a))
+					return fn(a...)
+				}
+			} else {
+				result[Symbol(name)] = fn
+			}
+		}
+	}
+	return result
+}
+
+func init_sandbox() {
+	DeclareTitle("Sandbox")
+
+	Declare(&Globalenv, &Declaration{
+		"sandbox-resources", "evaluates code in its own environment that only sees pure builtins (no storage, IO, sessions or global variables) with a budget of evaluation steps and allocated cells (arguments, variables, list items and 8 bytes of string data each; produceN, concat and replace are refused before they allocate more than the remaining budget); when a budget is exceeded, the evaluation aborts with a resource exhausted error. The accounting is deterministic: the same code always stops at the same step.",
+		3, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"code", "list", "scheme code to evaluate, e.g. parsed with (scheme str)"},
+			DeclarationParameter{"maxSteps", "number", "maximum number of function applications, 0 for unlimited"},
+			DeclarationParameter{"maxCells", "number", "maximum number of allocated cells, 0 for unlimited"},
+		}, "any",
+		func (a ...Scmer) Scmer {
+			s := new(sandbox)
+			s.maxSteps = int64(ToInt(a[1]))
+			s.maxCells = int64(ToInt(a[2]))
+			globals := &Env{sandboxGlobals(s), nil, nil, false, s} // whitelist instead of Globalenv: no storage, IO or global variables
+			en := &Env{make(Vars), nil, globals, false, s} // defines stay inside the sandbox
+			return Eval(a[0], en)
+		},
+	})
+}
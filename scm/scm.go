@@ -84,6 +84,9 @@ func Eval(expression Scmer, en *Env) (value Scmer) {
 	case NthLocalVar:
 		value = en.VarsNumbered[e]
 	case []Scmer:
+		if en.Sandbox != nil {
+			en.Sandbox.charge(1, 0)
+		}
 		if car, ok := e[0].(Symbol); ok {
 			// switch-case through all special symbols
 			switch car {
@@ -127,6 +130,8 @@ func Eval(expression Scmer, en *Env) (value Scmer) {
 				}
 				return nil
 			case "and":
+				// TODO: and/or are special forms here and already short-circuit; there is no tools/jitgen and no and?/or?
+				// operator in alu.go yet. A JIT backend must lower them to branches (SSA If + Phi) instead of evaluating both sides.
 				for i, x := range e {
 					if i > 0 && !ToBool(Eval(x, en)) {
 						return false
@@ -159,7 +164,7 @@ func Eval(expression Scmer, en *Env) (value Scmer) {
 			case "match": // (match <value> <pattern> <result> <pattern> <result> <pattern> <result> [<default>])
 				val := Eval(e[1], en)
 				i := 2
-				en2 := Env{make(Vars), en.VarsNumbered, en, true}
+				en2 := Env{make(Vars), en.VarsNumbered, en, true, en.Sandbox}
 				for i < len(e)-1 {
 					if match(val, e[i], &en2) {
 						// pattern has matched
@@ -219,7 +224,7 @@ func Eval(expression Scmer, en *Env) (value Scmer) {
 				value = Proc{e[1], e[2], en, numVars}
 			case "begin":
 				// execute begin.. in own environment
-				en2 := Env{make(Vars), en.VarsNumbered, en, false}
+				en2 := Env{make(Vars), en.VarsNumbered, en, false, en.Sandbox}
 				for _, i := range e[1:len(e)-1] {
 					Eval(i, &en2)
 				}
@@ -270,17 +275,33 @@ func Eval(expression Scmer, en *Env) (value Scmer) {
 				for i, x := range operands {
 					args[i] = Eval(x, en)
 				}
+				if en.Sandbox != nil {
+					return en.Sandbox.callBuiltin(func () Scmer {
+						return p(args...)
+					}, args)
+				}
 				return p(args...)
 			case func(*Env, ...Scmer) Scmer:
 				args := make([]Scmer, len(operands))
 				for i, x := range operands {
 					args[i] = Eval(x, en)
 				}
+				if en.Sandbox != nil {
+					return en.Sandbox.callBuiltin(func () Scmer {
+						return p(en, args...)
+					}, args)
+				}
 				return p(en, args...)
 			case *ScmParser:
 				return p.Execute(String(Eval(e[1], en)), en)
 			case Proc:
-				en2 := Env{make(Vars), make([]Scmer, p.NumVars), p.En, false}
+				en2 := Env{make(Vars), make([]Scmer, p.NumVars), p.En, false, en.Sandbox} // the caller's budget also pays for global functions
+				if en2.Sandbox == nil {
+					en2.Sandbox = p.En.Sandbox
+				}
+				if en2.Sandbox != nil {
+					en2.Sandbox.charge(0, int64(len(operands) + p.NumVars))
+				}
 				switch params := p.Params.(type) {
 				case []Scmer:
 					if len(params) < len(operands) {
@@ -385,7 +406,7 @@ func ApplyEx(procedure Scmer, args []Scmer, en *Env) (value Scmer) {
 	case *ScmParser:
 		return p.Execute(String(args[0]), en)
 	case Proc:
-		en := &Env{make(Vars), make([]Scmer, p.NumVars), p.En, false}
+		en := &Env{make(Vars), make([]Scmer, p.NumVars), p.En, false, p.En.Sandbox}
 		switch params := p.Params.(type) {
 		case []Scmer:
 			if p.NumVars > 0 {
@@ -458,6 +479,7 @@ type Env struct {
 	VarsNumbered []Scmer // <- for the optimizer
 	Outer *Env
 	Nodefine bool // define will write to Outer
+	Sandbox *sandbox // resource budget of untrusted code (see sandbox-resources); inherited by every env created below it
 }
 
 func (e *Env) FindRead(s Symbol) *Env {
@@ -510,6 +532,7 @@ func init() {
 		nil,
 		nil,
 		false,
+		nil,
 	}
 
 	// system
@@ -773,7 +796,7 @@ Patterns can be any of:
 		"serialize", "serializes a piece of code into a (hopefully) reparsable string; you shall be able to send that code over network and reparse with (scheme)",
 		1, 1,
 		[]DeclarationParameter{
-			DeclarationParameter{"code", "list", "Scheme code"},
+			DeclarationParameter{"code", "any", "Scheme code"},
 		}, "string",
 		func (a ...Scmer) Scmer {
 			return SerializeToString(a[0], &Globalenv)
@@ -787,6 +810,11 @@ Patterns can be any of:
 	init_date()
 	init_parser()
 	init_sync()
+	init_vector()
+	init_random()
+	init_sandbox()
+	init_benchmark()
+	init_statistics()
 }
 
 /* TODO: abs, quotient, remainder, modulo, gcd, lcm, expt, sqrt
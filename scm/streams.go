@@ -17,9 +17,154 @@ Copyright (C) 2024  Carl-Philip Hänsch
 package scm
 
 import "io"
+import "bufio"
+import "net"
+import "strings"
+import "net/http"
 import "compress/gzip"
 import "github.com/ulikunitz/xz"
 
+// opens a http://, https:// or tcp://host:port URL as a read-only stream
+// the connection is closed at EOF or when the consumer calls Close (loadCSV and loadJSON do)
+func OpenURL(url string) io.ReadCloser {
+	switch {
+		case strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://"):
+			resp, err := http.Get(url)
+			if err != nil {
+				panic(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				panic("GET " + url + ": " + resp.Status)
+			}
+			return &closeOnEOF{r: resp.Body}
+		case strings.HasPrefix(url, "tcp://"):
+			conn, err := net.Dial("tcp", url[len("tcp://"):])
+			if err != nil {
+				panic(err)
+			}
+			return &closeOnEOF{r: conn}
+		default:
+			panic("unsupported URL: " + url)
+	}
+}
+
+// releases the connection as soon as the stream is read to the end
+type closeOnEOF struct {
+	r io.ReadCloser
+	closed bool
+}
+func (c *closeOnEOF) Read(p []byte) (int, error) {
+	if c.closed {
+		return 0, io.EOF
+	}
+	n, err := c.r.Read(p)
+	if err != nil {
+		c.Close()
+	}
+	return n, err
+}
+func (c *closeOnEOF) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.r.Close()
+}
+
+// splits a stream of SQL statements (e.g. a mysqldump) at ; and calls callback with each statement
+// quotes '...', "..." and `...` are respected, comments (--, #, /* */ and the /*! */ version comments) are dropped
+func SplitSQLStatements(stream io.Reader, callback func(string)) {
+	r := bufio.NewReaderSize(stream, 1024 * 1024)
+	var stmt strings.Builder
+	emit := func () {
+		str := strings.TrimSpace(stmt.String())
+		stmt.Reset()
+		if str != "" {
+			callback(str)
+		}
+	}
+	next := func () (byte, bool) {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, false
+		} else if err != nil {
+			panic(err)
+		}
+		return c, true
+	}
+	skipLine := func () {
+		for {
+			c, ok := next()
+			if !ok || c == '\n' {
+				return
+			}
+		}
+	}
+	lineStart := true
+	for {
+		c, ok := next()
+		if !ok {
+			break
+		}
+		switch c {
+			case '\'', '"', '`':
+				// copy quoted part; \ escapes in strings
+				stmt.WriteByte(c)
+				for {
+					c2, ok := next()
+					if !ok {
+						break
+					}
+					stmt.WriteByte(c2)
+					if c2 == '\\' && c != '`' {
+						if c3, ok := next(); ok {
+							stmt.WriteByte(c3)
+						}
+					} else if c2 == c {
+						break
+					}
+				}
+			case '-':
+				if b, _ := r.Peek(2); len(b) == 2 && b[0] == '-' && (b[1] == ' ' || b[1] == '\t' || b[1] == '\n' || b[1] == '\r') {
+					skipLine()
+					stmt.WriteByte(' ')
+					lineStart = true
+					continue
+				}
+				stmt.WriteByte(c)
+			case '#':
+				if lineStart {
+					skipLine()
+					lineStart = true
+					continue
+				}
+				stmt.WriteByte(c)
+			case '/':
+				if b, _ := r.Peek(1); len(b) == 1 && b[0] == '*' {
+					// block comment (also /*!40101 ... */ which only carries MySQL specific settings)
+					next()
+					var prev byte
+					for {
+						c2, ok := next()
+						if !ok || (prev == '*' && c2 == '/') {
+							break
+						}
+						prev = c2
+					}
+					stmt.WriteByte(' ')
+					continue
+				}
+				stmt.WriteByte(c)
+			case ';':
+				emit()
+			default:
+				stmt.WriteByte(c)
+		}
+		lineStart = c == '\n'
+	}
+	emit()
+}
 
 func init_streams() {
 	// string functions
@@ -56,6 +201,29 @@ func init_streams() {
 			return result
 		},
 	})
+	Declare(&Globalenv, &Declaration{
+		"sql-statements", "splits a stream (or string) of SQL statements (e.g. a mysqldump file) at the semicolons and calls callback with each statement as a string. Comments including /*! version comments */ are dropped, quoted strings and identifiers are kept intact. Returns the number of statements.",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"stream", "any", "input stream or string"},
+			DeclarationParameter{"callback", "func", "lambda(statement string) that is called for each statement"},
+		}, "int",
+		func(a ...Scmer) Scmer {
+			fn := OptimizeProcToSerialFunction(a[1])
+			var count int64
+			var r io.Reader
+			if s, ok := a[0].(string); ok {
+				r = strings.NewReader(s)
+			} else {
+				r = a[0].(io.Reader)
+			}
+			SplitSQLStatements(r, func (stmt string) {
+				fn(stmt)
+				count++
+			})
+			return count
+		},
+	})
 }
 
 
@@ -18,21 +18,172 @@ package scm
 
 import "fmt"
 import "html"
+import "io"
 import "bytes"
+import "reflect"
 import "regexp"
+import "strconv"
 import "strings"
+import "sync"
+import "unicode"
+import "unsafe"
+import "hash/crc32"
+import "crypto/md5"
+import "crypto/sha1"
+import "crypto/sha256"
 import "net/url"
+import "encoding/hex"
+import "encoding/base32"
+import "encoding/base64"
 import "encoding/json"
 import "golang.org/x/text/collate"
 import "golang.org/x/text/language"
+import "golang.org/x/text/unicode/norm"
 
 type LazyString struct {
 	Hash string
 	GetValue func() string
 }
 
+// compiled patterns of regexp_replace, keyed by flags + "/" + pattern (map lambdas of a scan call it once per row)
+var regexpCache sync.Map
+
+func compileRegexpCached(pattern string, flags string) *regexp.Regexp {
+	key := flags + "/" + pattern
+	if re, ok := regexpCache.Load(key); ok {
+		return re.(*regexp.Regexp)
+	}
+	prefix := ""
+	for _, flag := range flags {
+		switch flag {
+			case 'i', 'm', 's':
+				prefix += string(flag)
+			default:
+				panic("unknown regexp flag: " + string(flag))
+		}
+	}
+	if prefix != "" {
+		prefix = "(?" + prefix + ")"
+	}
+	re, err := regexp.Compile(prefix + pattern)
+	if err != nil {
+		panic(err.Error())
+	}
+	regexpCache.Store(key, re)
+	return re
+}
+
+var collation_re = regexp.MustCompile("^([^_]+_)?(.+?)$") // caracterset_language_case
+
+// comparators returned by (collate ...) are shared per collation and direction, so a closure
+// identifies its collation and the serializer can print (collate "de_ci" true) instead of the closure
+var collateCache sync.Map // collation + "/" + reverse -> func(...Scmer) Scmer
+var collateRegistry sync.Map // closure pointer -> collateEntry
+
+type collateEntry struct {
+	collation string
+	reverse bool
+}
+
+// returns the (cached) comparator of a collation
+func LookupCollate(collation string, reverse bool) func(...Scmer) Scmer {
+	key := fmt.Sprint(collation, "/", reverse)
+	if fn, ok := collateCache.Load(key); ok {
+		return fn.(func(...Scmer) Scmer)
+	}
+	fn := newCollate(collation, reverse)
+	if fn2, loaded := collateCache.LoadOrStore(key, fn); loaded {
+		return fn2.(func(...Scmer) Scmer)
+	}
+	if !isNativeGlobal(fn) {
+		collateRegistry.Store(closurePointer(fn), collateEntry{collation, reverse})
+	}
+	return fn
+}
+
+// finds the collation of a comparator that was created by LookupCollate
+func CollateOf(fn func(...Scmer) Scmer) (collation string, reverse bool, ok bool) {
+	if entry, found := collateRegistry.Load(closurePointer(fn)); found {
+		e := entry.(collateEntry)
+		return e.collation, e.reverse, true
+	}
+	return "", false, false
+}
+
+// identity of a closure (reflect's Pointer() is the code address which all closures of a func literal share)
+func closurePointer(fn func(...Scmer) Scmer) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&fn))
+}
+
+// the binary collation returns the plain < and > which must serialize as themselves
+func isNativeGlobal(fn func(...Scmer) Scmer) bool {
+	p := reflect.ValueOf(fn).Pointer()
+	return p == reflect.ValueOf(LessScm).Pointer() || p == reflect.ValueOf(GreaterScm).Pointer()
+}
+
+func newCollate(collation string, reverse bool) func(...Scmer) Scmer {
+	ci := false
+	if strings.HasSuffix(collation, "_ci") {
+		ci = true
+		collation = collation[:len(collation)-3]
+	} else if strings.HasSuffix(collation, "_cs") {
+		collation = collation[:len(collation)-3]
+	}
+	if m := collation_re.FindStringSubmatch(collation); m != nil {
+		if m[2] == "bin" { // binary
+			if reverse {
+				return GreaterScm
+			} else {
+				return LessScm
+			}
+		}
+		tag, err := language.Parse(m[2]) // treat as BCP 47
+		if err != nil {
+			// language not detected, try one of the aliases
+			switch m[2] {
+				case "danish": tag = language.Danish
+				case "german1": tag = language.German
+				case "german2": tag = language.German
+				case "spanish": tag = language.Spanish
+				case "swedish": tag = language.Swedish
+				default: tag = language.Swedish // swedish seems to be the most versatile collation
+			}
+		}
+		var c *collate.Collator
+		// the following options are available:
+		// IgnoreCase -> when string ends with _ci
+		// IgnoreDiacritics -> o == ö
+		// IgnoreWidth: half width == width
+		// Numeric -> sort numbers correctly
+		if ci {
+			c = collate.New(tag, collate.Numeric, collate.IgnoreCase)
+		} else {
+			c = collate.New(tag, collate.Numeric)
+		}
+
+		// return a LESS function specialized to that language
+		if reverse {
+			// reverse order
+			return func (a ...Scmer) Scmer {
+				return c.CompareString(String(a[0]), String(a[1])) == 1
+			}
+		} else {
+			return func (a ...Scmer) Scmer {
+				return c.CompareString(String(a[0]), String(a[1])) == -1
+			}
+		}
+	} else {
+		if reverse {
+			return GreaterScm
+		} else {
+			return LessScm
+		}
+	}
+}
+
 /* SQL LIKE operator implementation on strings */
-func StrLike(str, pattern string) bool {
+// escape (0 = none) in front of %, _ or itself makes the following character a literal
+func StrLike(str, pattern string, escape byte) bool {
 	for {
 		// boundary check
 		if len(pattern) == 0 {
@@ -44,17 +195,26 @@ func StrLike(str, pattern string) bool {
 				return false
 			}
 		}
-		// now str[0] and pattern[0] are assured to exist
-		if pattern[0] == '%' { // wildcard
+		// now pattern[0] is assured to exist
+		if isLikeEscape(pattern, escape) {
+			// escaped wildcard: compare literally
+			if len(str) > 0 && pattern[1] == str[0] {
+				pattern = pattern[2:]
+				str = str[1:]
+			} else {
+				return false
+			}
+		} else if pattern[0] == '%' { // wildcard
 			pattern = pattern[1:]
 			if pattern == "" {
 				return true // string ends with wildcard
 			}
 			// otherwise: match against all possible endings
-			for i := len(str)-1; i >= 0; i-- { // run from right to left to be as greedy and performant as possible
-				if str[i] == pattern[0] {
+			first, literal := likeFirstLiteral(pattern, escape)
+			for i := len(str); i >= 0; i-- { // run from right to left to be as greedy and performant as possible
+				if !literal || i < len(str) && str[i] == first {
 					// check if this caracter matches the rest
-					if StrLike(str[i:], pattern) {
+					if StrLike(str[i:], pattern, escape) {
 						return true // we found a match with this position as continuation
 					}
 				}
@@ -73,6 +233,258 @@ func StrLike(str, pattern string) bool {
 	}
 }
 
+// a lone escape character at the end or in front of any other character is taken as is
+func isLikeEscape(pattern string, escape byte) bool {
+	return escape != 0 && len(pattern) > 1 && pattern[0] == escape && (pattern[1] == '%' || pattern[1] == '_' || pattern[1] == escape)
+}
+
+// the character a continuation of pattern must start with (literal = false if it starts with a wildcard)
+func likeFirstLiteral(pattern string, escape byte) (first byte, literal bool) {
+	if isLikeEscape(pattern, escape) {
+		return pattern[1], true
+	}
+	if pattern[0] == '%' || pattern[0] == '_' {
+		return 0, false
+	}
+	return pattern[0], true
+}
+
+// letters that do not decompose into ASCII base letter + accent
+var slugTransliteration = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "ae", 'œ': "oe", 'Œ': "oe", 'ø': "o", 'Ø': "o",
+	'đ': "d", 'Đ': "d", 'ł': "l", 'Ł': "l", 'þ': "th", 'Þ': "th", 'ð': "d", 'Ð': "d",
+}
+
+/* URL slug: transliterate to ASCII, lowercase, join alphanumeric runs with single hyphens */
+func Slugify(str string) string {
+	var b strings.Builder
+	separator := false
+	for _, r := range norm.NFD.String(str) {
+		if unicode.Is(unicode.Mn, r) {
+			continue // strip accents
+		}
+		replacement, ok := slugTransliteration[r]
+		if !ok {
+			replacement = string(r)
+		}
+		for _, c := range strings.ToLower(replacement) {
+			if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+				if separator && b.Len() > 0 {
+					b.WriteByte('-') // collapse separators, no leading hyphen
+				}
+				separator = false
+				b.WriteRune(c)
+			} else {
+				separator = true // trailing separators are never written
+			}
+		}
+	}
+	return b.String()
+}
+
+// splits after each newline, so joining the parts gives back the input
+func splitLines(str string) []string {
+	result := make([]string, 0)
+	for len(str) > 0 {
+		i := strings.IndexByte(str, '\n')
+		if i < 0 {
+			result = append(result, str)
+			break
+		}
+		result = append(result, str[:i+1])
+		str = str[i+1:]
+	}
+	return result
+}
+
+/* Myers' O(ND) line diff; returns the edit script as one byte per step: '=' keep, '-' delete from a, '+' insert from b */
+func diffLines(a, b []string) []byte {
+	// common prefix and suffix don't need the expensive part
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a) - prefix && suffix < len(b) - prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a2 := a[prefix:len(a)-suffix]
+	b2 := b[prefix:len(b)-suffix]
+	n, m := len(a2), len(b2)
+
+	middle := make([]byte, 0, n + m)
+	offset := n + m + 1
+	v := make([]int, 2 * offset + 1)
+	trace := make([][]int, 0)
+	found := false
+	for d := 0; d <= n + m && !found; d++ {
+		if d * len(v) > 1 << 24 {
+			break // too many differences to trace them in memory: replace the whole middle part
+		}
+		vc := make([]int, len(v))
+		copy(vc, v)
+		trace = append(trace, vc)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // down: insertion
+			} else {
+				x = v[offset+k-1] + 1 // right: deletion
+			}
+			y := x - k
+			for x < n && y < m && a2[x] == b2[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if found {
+		// backtrack the shortest edit script
+		x, y := n, m
+		for d := len(trace) - 1; d >= 0; d-- {
+			vd := trace[d]
+			k := x - y
+			var prevK int
+			if k == -d || (k != d && vd[offset+k-1] < vd[offset+k+1]) {
+				prevK = k + 1
+			} else {
+				prevK = k - 1
+			}
+			prevX := vd[offset+prevK]
+			prevY := prevX - prevK
+			for x > prevX && y > prevY {
+				middle = append(middle, '=')
+				x--
+				y--
+			}
+			if d > 0 {
+				if x == prevX {
+					middle = append(middle, '+')
+				} else {
+					middle = append(middle, '-')
+				}
+			}
+			x, y = prevX, prevY
+		}
+		for i, j := 0, len(middle) - 1; i < j; i, j = i+1, j-1 {
+			middle[i], middle[j] = middle[j], middle[i]
+		}
+	} else {
+		middle = append(middle, bytes.Repeat([]byte{'-'}, n)...)
+		middle = append(middle, bytes.Repeat([]byte{'+'}, m)...)
+	}
+
+	result := bytes.Repeat([]byte{'='}, prefix)
+	result = append(result, middle...)
+	return append(result, bytes.Repeat([]byte{'='}, suffix)...)
+}
+
+/* compact patch: header @<length of base>,<crc32 of base>; followed by =<n>; (keep n lines) -<n>; (skip n lines) +<bytes>:<text> (insert text) */
+func TextDiff(old, new string) string {
+	a := splitLines(old)
+	b := splitLines(new)
+	script := diffLines(a, b)
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("@%d,%08x;", len(old), crc32.ChecksumIEEE([]byte(old))))
+	j := 0 // position in b
+	for i := 0; i < len(script); {
+		op := script[i]
+		count := 0
+		for i < len(script) && script[i] == op {
+			count++
+			i++
+		}
+		switch op {
+			case '=':
+				result.WriteString("=" + strconv.Itoa(count) + ";")
+				j += count
+			case '-':
+				result.WriteString("-" + strconv.Itoa(count) + ";")
+			case '+':
+				text := strings.Join(b[j:j+count], "")
+				result.WriteString("+" + strconv.Itoa(len(text)) + ":" + text)
+				j += count
+		}
+	}
+	return result.String()
+}
+
+func TextPatch(old, patch string) string {
+	fail := func (reason string) {
+		panic("text-patch: " + reason)
+	}
+	readNumber := func (terminator byte) int {
+		i := strings.IndexByte(patch, terminator)
+		if i < 0 {
+			fail("malformed patch")
+		}
+		n, err := strconv.Atoi(patch[:i])
+		if err != nil || n < 0 {
+			fail("malformed patch")
+		}
+		patch = patch[i+1:]
+		return n
+	}
+	if len(patch) == 0 || patch[0] != '@' {
+		fail("malformed patch")
+	}
+	patch = patch[1:]
+	length := readNumber(',')
+	if len(patch) < 9 || patch[8] != ';' {
+		fail("malformed patch")
+	}
+	checksum, err := strconv.ParseUint(patch[:8], 16, 32)
+	if err != nil {
+		fail("malformed patch")
+	}
+	patch = patch[9:]
+	if length != len(old) || uint32(checksum) != crc32.ChecksumIEEE([]byte(old)) {
+		fail("the patch was made for a different base text")
+	}
+	lines := splitLines(old)
+	pos := 0
+	var result strings.Builder
+	for len(patch) > 0 {
+		op := patch[0]
+		patch = patch[1:]
+		switch op {
+			case '=':
+				n := readNumber(';')
+				if pos + n > len(lines) {
+					fail("malformed patch")
+				}
+				for _, line := range lines[pos:pos+n] {
+					result.WriteString(line)
+				}
+				pos += n
+			case '-':
+				n := readNumber(';')
+				if pos + n > len(lines) {
+					fail("malformed patch")
+				}
+				pos += n
+			case '+':
+				n := readNumber(':')
+				if n > len(patch) {
+					fail("malformed patch")
+				}
+				result.WriteString(patch[:n])
+				patch = patch[n:]
+			default:
+				fail("malformed patch")
+		}
+	}
+	if pos != len(lines) {
+		fail("malformed patch")
+	}
+	return result.String()
+}
+
 func init_strings() {
 	// string functions
 	DeclareTitle("Strings")
@@ -146,15 +558,24 @@ func init_strings() {
 	})
 	Declare(&Globalenv, &Declaration{
 		"strlike", "matches the string against a wildcard pattern (SQL compliant)",
-		2, 3,
+		2, 4,
 		[]DeclarationParameter{
 			DeclarationParameter{"value", "string", "input string"},
 			DeclarationParameter{"pattern", "string", "pattern with % and _ in them"},
 			DeclarationParameter{"collation", "string", "collation in which to compare them"},
+			DeclarationParameter{"escape", "string", "(optional) escape character (SQL LIKE ... ESCAPE); in front of %, _ or itself, the next character is matched literally"},
 		}, "bool",
 		func(a ...Scmer) Scmer {
 			// string
-			return StrLike(String(a[0]), String(a[1])) // TODO: collation
+			var escape byte
+			if len(a) > 3 && a[3] != nil {
+				e := String(a[3])
+				if len(e) != 1 {
+					panic("LIKE ESCAPE must be a single character: " + e)
+				}
+				escape = e[0]
+			}
+			return StrLike(String(a[0]), String(a[1]), escape) // TODO: collation
 		},
 	})
 	Declare(&Globalenv, &Declaration{
@@ -192,6 +613,26 @@ func init_strings() {
 			return strings.ReplaceAll(String(a[0]), String(a[1]), String(a[2]))
 		},
 	})
+	Declare(&Globalenv, &Declaration{
+		"regexp_replace", "replaces all matches of a regular expression in a string; the replacement may reference capture groups with $1 or ${name}",
+		3, 4,
+		[]DeclarationParameter{
+			DeclarationParameter{"s", "string", "input string"},
+			DeclarationParameter{"pattern", "string", "regular expression (Go RE2 syntax)"},
+			DeclarationParameter{"replacement", "string", "replace string; $1 or ${name} inserts the text of a capture group, $$ a literal $"},
+			DeclarationParameter{"flags", "string", "(optional) i: case-insensitive, m: multi-line (^ and $ match at line breaks), s: . matches \\n"},
+		}, "string",
+		func(a ...Scmer) Scmer {
+			if a[0] == nil {
+				return nil
+			}
+			flags := ""
+			if len(a) > 3 && a[3] != nil {
+				flags = String(a[3])
+			}
+			return compileRegexpCached(String(a[1]), flags).ReplaceAllString(String(a[0]), String(a[2]))
+		},
+	})
 	Declare(&Globalenv, &Declaration{
 		"split", "splits a string using a separator or space",
 		1, 2,
@@ -215,73 +656,15 @@ func init_strings() {
 	})
 
 	/* comparison */
-	collation_re := regexp.MustCompile("^([^_]+_)?(.+?)$") // caracterset_language_case
 	Declare(&Globalenv, &Declaration{
 		"collate", "returns the `<` operator for a given collation. MemCP allows natural sorting of numeric literals.",
-		1, 1,
+		1, 2,
 		[]DeclarationParameter{
 			DeclarationParameter{"collation", "string", "collation string of the form LANG or LANG_cs or LANG_ci where LANG is a BCP 47 code, for compatibility to MySQL, a CHARSET_ prefix is allowed and ignored as well as the aliases bin, danish, general, german1, german2, spanish and swedish are allowed for language codes"},
 			DeclarationParameter{"reverse", "bool", "whether to reverse the order like in ORDER BY DESC"},
 		}, "func",
 		func(a ...Scmer) Scmer {
-			collation := String(a[0])
-			ci := false
-			if strings.HasSuffix(collation, "_ci") {
-				ci = true
-				collation = collation[:len(collation)-3]
-			} else if strings.HasSuffix(collation, "_cs") {
-				collation = collation[:len(collation)-3]
-			}
-			if m := collation_re.FindStringSubmatch(collation); m != nil {
-				if m[2] == "bin" { // binary
-					if len(a) > 1 && ToBool(a[1]) {
-						return GreaterScm
-					} else {
-						return LessScm
-					}
-				}
-				tag, err := language.Parse(m[2]) // treat as BCP 47
-				if err != nil {
-					// language not detected, try one of the aliases
-					switch m[2] {
-						case "danish": tag = language.Danish
-						case "german1": tag = language.German
-						case "german2": tag = language.German
-						case "spanish": tag = language.Spanish
-						case "swedish": tag = language.Swedish
-						default: tag = language.Swedish // swedish seems to be the most versatile collation
-					}
-				}
-				var c *collate.Collator
-				// the following options are available:
-				// IgnoreCase -> when string ends with _ci
-				// IgnoreDiacritics -> o == ö
-				// IgnoreWidth: half width == width
-				// Numeric -> sort numbers correctly
-				if ci {
-					c = collate.New(tag, collate.Numeric, collate.IgnoreCase)
-				} else {
-					c = collate.New(tag, collate.Numeric)
-				}
-
-				// return a LESS function specialized to that language
-				if len(a) > 1 && ToBool(a[1]) {
-					// reverse order
-					return func (a ...Scmer) Scmer {
-						return c.CompareString(String(a[0]), String(a[1])) == 1
-					}
-				} else {
-					return func (a ...Scmer) Scmer {
-						return c.CompareString(String(a[0]), String(a[1])) == -1
-					}
-				}
-			} else {
-				if len(a) > 1 && ToBool(a[1]) {
-					return GreaterScm
-				} else {
-					return LessScm
-				}
-			}
+			return LookupCollate(String(a[0]), len(a) > 1 && ToBool(a[1]))
 		},
 	})
 
@@ -374,30 +757,27 @@ func init_strings() {
 			if err != nil {
 				panic(err)
 			}
-			var transform func(any) Scmer
-			transform = func(a_ any) Scmer {
-				switch a := a_.(type) {
-					case map[string]any:
-						result := make([]Scmer, 2 * len(a))
-						i := 0
-						for k, v := range a {
-							result[i] = k
-							result[i+1] = transform(v)
-							i += 2
-						}
-						return result
-					case []any:
-						// TODO: maybe rather make a JS like object with length = x, index = ...
-						result := make([]Scmer, len(a))
-						for i, v := range a {
-							result[i] = transform(v)
-						}
-						return result
-					default:
-						return Scmer(a_)
-				}
+			return TransformFromJSON(result)
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"json_decode_stream", "parses a JSON array from a stream (or string) element by element and calls callback for each element, so arrays larger than the memory can be imported. A top-level object or value is passed to callback once. Returns the number of callback calls.",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"stream", "any", "input stream or string"},
+			DeclarationParameter{"callback", "func", "lambda(value any) that is called for each element"},
+		}, "int",
+		func (a ...Scmer) Scmer {
+			fn := OptimizeProcToSerialFunction(a[1])
+			var r io.Reader
+			if s, ok := a[0].(string); ok {
+				r = strings.NewReader(s)
+			} else {
+				r = a[0].(io.Reader)
 			}
-			return transform(result)
+			return JSONDecodeStream(r, func (v Scmer) {
+				fn(v)
+			})
 		},
 	})
 	sql_escapings := regexp.MustCompile("\\\\[\\\\'\"nr0]")
@@ -445,6 +825,270 @@ func init_strings() {
 			return string(result);
 		},
 	})
+	Declare(&Globalenv, &Declaration{
+		"base32_encode", "encodes binary data in base32 (RFC 4648), e.g. for TOTP secrets",
+		1, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "string", "binary data to encode"},
+			DeclarationParameter{"nopadding", "bool", "(optional) if true, the trailing = are left out"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			if len(a) > 1 && ToBool(a[1]) {
+				return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(String(a[0])))
+			}
+			return base32.StdEncoding.EncodeToString([]byte(String(a[0])))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"base32_decode", "decodes base32 (RFC 4648) with or without padding",
+		1, 1,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "string", "base32 string to decode"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			result, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(String(a[0]), "="))
+			if err != nil {
+				panic("base32_decode: " + err.Error())
+			}
+			return string(result)
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"base64url_encode", "encodes binary data in URL-safe base64 (RFC 4648 section 5) like it is used in JWT",
+		1, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "string", "binary data to encode"},
+			DeclarationParameter{"nopadding", "bool", "(optional) if true, the trailing = are left out (as in JWT)"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			if len(a) > 1 && ToBool(a[1]) {
+				return base64.RawURLEncoding.EncodeToString([]byte(String(a[0])))
+			}
+			return base64.URLEncoding.EncodeToString([]byte(String(a[0])))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"base64url_decode", "decodes URL-safe base64 (RFC 4648 section 5) with or without padding",
+		1, 1,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "string", "base64url string to decode"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			result, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(String(a[0]), "="))
+			if err != nil {
+				panic("base64url_decode: " + err.Error())
+			}
+			return string(result)
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"hash", "computes a hex digest of a value for caching and deduplication. Strings and numbers are hashed in their string form, lists in their serialized form (see serialize), so equal values give equal hashes (and a list hashes like the string of its serialization). The order of list and assoc list elements matters: assoc lists with the same keys in a different order give different hashes.",
+		1, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "any", "value to hash"},
+			DeclarationParameter{"algorithm", "string", "(optional) sha256 (default), sha1, md5 or xxhash (xxh64)"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			var input []byte
+			switch v := a[0].(type) {
+				case []Scmer:
+					input = []byte(SerializeToString(v, &Globalenv))
+				default:
+					input = []byte(String(v))
+			}
+			algorithm := "sha256"
+			if len(a) > 1 {
+				algorithm = String(a[1])
+			}
+			switch algorithm {
+				case "sha256":
+					sum := sha256.Sum256(input)
+					return hex.EncodeToString(sum[:])
+				case "sha1":
+					sum := sha1.Sum(input)
+					return hex.EncodeToString(sum[:])
+				case "md5":
+					sum := md5.Sum(input)
+					return hex.EncodeToString(sum[:])
+				case "xxhash":
+					return fmt.Sprintf("%016x", xxh64(input))
+				default:
+					panic("unknown hash algorithm: " + algorithm)
+			}
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"hexdump", "dumps binary data in the canonical hex+ASCII format of hexdump -C: lines that repeat the previous line are collapsed into *, the total length ends the dump, and empty data gives an empty string",
+		1, 1,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "string", "binary data to dump"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			return Hexdump([]byte(String(a[0])))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"text-diff", "computes a compact line based patch that turns old into new (e.g. to store document revisions as deltas); apply it with text-patch",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"old", "string", "base text"},
+			DeclarationParameter{"new", "string", "new text"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			return TextDiff(String(a[0]), String(a[1]))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"text-patch", "applies a patch from text-diff to its base text and returns the new text; fails if the base text is not the one the patch was made for",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"old", "string", "base text"},
+			DeclarationParameter{"patch", "string", "patch from text-diff"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			return TextPatch(String(a[0]), String(a[1]))
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"slugify", "turns a string into an URL-safe slug: accents are removed, letters are lowercased and every run of other characters becomes a single hyphen (no leading or trailing hyphens)",
+		1, 1,
+		[]DeclarationParameter{
+			DeclarationParameter{"value", "string", "title to convert"},
+		}, "string",
+		func (a ...Scmer) Scmer {
+			return Slugify(String(a[0]))
+		},
+	})
 
 }
 
+// converts the result of json.Unmarshal into lists (objects become assoc lists)
+func TransformFromJSON(a_ any) Scmer {
+	switch a := a_.(type) {
+		case map[string]any:
+			result := make([]Scmer, 2 * len(a))
+			i := 0
+			for k, v := range a {
+				result[i] = k
+				result[i+1] = TransformFromJSON(v)
+				i += 2
+			}
+			return result
+		case []any:
+			// TODO: maybe rather make a JS like object with length = x, index = ...
+			result := make([]Scmer, len(a))
+			for i, v := range a {
+				result[i] = TransformFromJSON(v)
+			}
+			return result
+		default:
+			return Scmer(a_)
+	}
+}
+
+// calls callback for each element of a top-level JSON array without holding the whole array in memory
+func JSONDecodeStream(stream io.Reader, callback func(Scmer)) int64 {
+	dec := json.NewDecoder(stream)
+	fail := func(err error) {
+		panic(fmt.Sprintf("json_decode_stream: %v at byte %d", err, dec.InputOffset()))
+	}
+	var count int64
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return 0 // empty input
+	} else if err != nil {
+		fail(err)
+	}
+	var single any // top-level object or scalar: passed to callback after the input was checked
+	switch tok {
+		case json.Delim('['):
+			for dec.More() {
+				var item any
+				if err := dec.Decode(&item); err != nil {
+					fail(err)
+				}
+				callback(TransformFromJSON(item))
+				count++
+			}
+		case json.Delim('{'):
+			// the opening brace is already consumed, so decode the object member by member
+			object := make(map[string]any)
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					fail(err)
+				}
+				var value any
+				if err := dec.Decode(&value); err != nil {
+					fail(err)
+				}
+				object[key.(string)] = value
+			}
+			single = object
+		default:
+			single = tok
+	}
+	if _, ok := tok.(json.Delim); ok {
+		if _, err := dec.Token(); err != nil {
+			fail(err) // missing closing bracket
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("unexpected data after the top-level value")
+		}
+		fail(err)
+	}
+	if single != nil || tok == nil {
+		callback(TransformFromJSON(single))
+		count++
+	}
+	return count
+}
+
+// output of hexdump -C: offset, two groups of 8 hex bytes and |ascii| with dots for non-printables
+func Hexdump(data []byte) string {
+	if len(data) == 0 {
+		return "" // hexdump -C prints not even the length
+	}
+	var b strings.Builder
+	squeezed := false
+	for offset := 0; offset < len(data); offset += 16 {
+		end := offset + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		line := data[offset:end]
+		if len(line) == 16 && offset >= 16 && bytes.Equal(line, data[offset-16:offset]) {
+			// repeated full lines are printed as a single *
+			if !squeezed {
+				b.WriteString("*\n")
+				squeezed = true
+			}
+			continue
+		}
+		squeezed = false
+		fmt.Fprintf(&b, "%08x  ", offset)
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				b.WriteByte(' ')
+			}
+			if i < len(line) {
+				fmt.Fprintf(&b, "%02x ", line[i])
+			} else {
+				b.WriteString("   ") // a short last line keeps the ascii column aligned
+			}
+		}
+		b.WriteString(" |")
+		for _, c := range line {
+			if c >= 0x20 && c <= 0x7e {
+				b.WriteByte(c)
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteString("|\n")
+	}
+	fmt.Fprintf(&b, "%08x\n", len(data))
+	return b.String()
+}
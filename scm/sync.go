@@ -20,13 +20,34 @@ package scm
 import "sync"
 import "time"
 import "context"
+import "math/rand/v2"
 import "github.com/jtolds/gls"
 
+/* background jobs of spawn; await blocks until done is closed */
+type future struct {
+	done chan struct{}
+	result Scmer
+	err any // panic of the body, rethrown by every await
+}
+
 /* threadsafe session storage */
 
 type session struct {
 	Mu sync.RWMutex
 	Map map[string]Scmer
+	Connection func() Scmer // metadata of the client connection (see connection-info); nil for sessions without connection
+}
+
+// passing this value to a session function returns the underlying *session
+type sessionObjectRequest struct{}
+
+func getSessionObject(s Scmer) *session {
+	if fn, ok := s.(func(...Scmer) Scmer); ok {
+		if sess, ok := fn(sessionObjectRequest{}).(*session); ok {
+			return sess
+		}
+	}
+	panic("expected session but found: " + String(s))
 }
 
 // build this function into your SCM environment to offer http server capabilities
@@ -42,6 +63,9 @@ func NewSession(a ...Scmer) Scmer {
 			sess.Map[String(a[0])] = a[1]
 			return a[1] // reflect the value as of mysql semantics
 		} else if len(a) == 1 {
+			if _, ok := a[0].(sessionObjectRequest); ok {
+				return sess
+			}
 			// get
 			sess.Mu.RLock()
 			defer sess.Mu.RUnlock()
@@ -172,8 +196,72 @@ func init_sync() {
 		},
 	})
 	Declare(&Globalenv, &Declaration{
-		"mutex", "Creates a mutex. The return value is a function that takes one parameter which is a parameterless function. The mutex is guaranteed that all calls to that mutex get serialized.",
+		"spawn", "runs a function in the background and returns a handle immediately. Use (await handle) to get the result.",
+		1, 1000,
+		[]DeclarationParameter{
+			DeclarationParameter{"body", "func", "function that computes the result"},
+			DeclarationParameter{"args...", "any", "(optional) parameters that are passed to body; use them instead of variables of a loop since the loop may have moved on when body starts"},
+		}, "any",
+		func (a ...Scmer) Scmer {
+			f := &future{done: make(chan struct{})}
+			args := append([]Scmer{}, a[1:]...)
+			gls.Go(func () {
+				defer func () {
+					f.err = recover()
+					close(f.done)
+				}()
+				f.result = Apply(a[0], args...)
+			})
+			return f
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"await", "waits until a background job of spawn is finished and returns its result. If the job panicked, the panic is rethrown. A handle can be awaited multiple times; it returns the same result every time.",
 		1, 1,
+		[]DeclarationParameter{
+			DeclarationParameter{"handle", "any", "handle returned by spawn"},
+		}, "any",
+		func (a ...Scmer) Scmer {
+			f, ok := a[0].(*future)
+			if !ok {
+				panic("await expects a handle of spawn but found: " + String(a[0]))
+			}
+			<- f.done
+			if f.err != nil {
+				panic(f.err)
+			}
+			return f.result
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"retry", "calls a function until it succeeds, at most attempts times. Between two attempts, it waits with an exponential backoff (backoffMs, 2*backoffMs, 4*backoffMs... each jittered down to half of it). If all attempts fail, the error of the last attempt is rethrown.",
+		2, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"func", "func", "function that takes the attempt number (starting at 1)"},
+			DeclarationParameter{"attempts", "number", "maximum number of calls"},
+			DeclarationParameter{"backoffMs", "number", "(optional) milliseconds to wait before the second attempt; 0 retries immediately (default: 100)"},
+		}, "any",
+		func (a ...Scmer) Scmer {
+			attempts := ToInt(a[1])
+			backoff := 100 * time.Millisecond
+			if len(a) > 2 {
+				backoff = time.Duration(ToFloat(a[2]) * float64(time.Millisecond))
+			}
+			for attempt := 1; ; attempt++ {
+				result, err := tryApply(a[0], int64(attempt))
+				if err == nil {
+					return result
+				}
+				if attempt >= attempts {
+					panic(err)
+				}
+				waitBackoff(backoff, attempt)
+			}
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"mutex", "Creates a mutex. The return value is a function that takes one parameter which is a parameterless function. The mutex is guaranteed that all calls to that mutex get serialized.",
+		0, 0,
 		[]DeclarationParameter{
 		}, "func",
 		func (a ...Scmer) Scmer {
@@ -195,3 +283,40 @@ func init_sync() {
 		},
 	})
 }
+
+// result of fn or the value it panicked with
+func tryApply(fn Scmer, args ...Scmer) (result Scmer, err any) {
+	defer func() {
+		err = recover()
+	}()
+	result = Apply(fn, args...)
+	return
+}
+
+const maxBackoff = 30 * time.Second
+
+// sleeps before attempt+1; cancelling the context aborts the wait
+func waitBackoff(backoff time.Duration, attempt int) {
+	if backoff <= 0 {
+		return
+	}
+	delay := backoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	delay = delay / 2 + rand.N(delay / 2 + 1) // jitter, so concurrent retries don't collide again
+	var done <-chan struct{}
+	if mgr != nil {
+		if ctx, ok := mgr.GetValue("context"); ok {
+			done = ctx.(context.Context).Done()
+		}
+	}
+	select {
+		case <- done:
+			panic(GetContext().Err())
+		case <- time.After(delay):
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package scm
+
+import "fmt"
+import "sort"
+
+// dense vectors are represented as []float64
+
+func ToVector(v Scmer) []float64 {
+	switch v_ := v.(type) {
+		case []float64:
+			return v_
+		case []Scmer:
+			result := make([]float64, len(v_))
+			for i, x := range v_ {
+				result[i] = ToFloat(x)
+			}
+			return result
+		default:
+			panic("expected vector but found: " + String(v))
+	}
+}
+
+func init_vector() {
+	DeclareTitle("Vectors")
+
+	Declare(&Globalenv, &Declaration{
+		"vector", "creates a dense vector of floats",
+		0, 1000,
+		[]DeclarationParameter{
+			DeclarationParameter{"value...", "number", "values of the vector"},
+		}, "vector",
+		func (a ...Scmer) Scmer {
+			result := make([]float64, len(a))
+			for i, x := range a {
+				result[i] = ToFloat(x)
+			}
+			return result
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"vector-sort", "sorts a vector in place and returns it. If vec is a view, the sorted range of the parent vector changes, too.",
+		1, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"vec", "vector", "vector to sort"},
+			DeclarationParameter{"dir", "string", "(optional) \"asc\" (default) or \"desc\""},
+		}, "vector",
+		func (a ...Scmer) Scmer {
+			vec := ToVector(a[0])
+			if len(a) > 1 && a[1] != nil {
+				switch String(a[1]) {
+					case "asc":
+						sort.Float64s(vec)
+					case "desc":
+						sort.Sort(sort.Reverse(sort.Float64Slice(vec)))
+					default:
+						panic("unknown sort direction: " + String(a[1]))
+				}
+			} else {
+				sort.Float64s(vec)
+			}
+			return vec
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"vector-slice", "returns the subvector [start, end). A view shares the memory with its parent: writes to the view (e.g. vector-sort) are visible in the parent and vice versa. Otherwise a copy is returned.",
+		3, 4,
+		[]DeclarationParameter{
+			DeclarationParameter{"vec", "vector", "vector to slice"},
+			DeclarationParameter{"start", "number", "index of the first element"},
+			DeclarationParameter{"end", "number", "index after the last element"},
+			DeclarationParameter{"view", "bool", "(optional) if true, return a view instead of a copy"},
+		}, "vector",
+		func (a ...Scmer) Scmer {
+			vec := ToVector(a[0])
+			start := ToInt(a[1])
+			end := ToInt(a[2])
+			if start < 0 || end < start || end > len(vec) {
+				panic(fmt.Sprintf("vector-slice: invalid bounds [%d, %d) for vector of length %d", start, end, len(vec)))
+			}
+			if len(a) > 3 && ToBool(a[3]) {
+				return vec[start:end:end] // limit capacity so the view can never grow into the parent
+			}
+			result := make([]float64, end - start)
+			copy(result, vec[start:end])
+			return result
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"vector-dot", "returns the dot product of two vectors of the same length",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"a", "vector", "first vector"},
+			DeclarationParameter{"b", "vector", "second vector"},
+		}, "number",
+		func (a ...Scmer) Scmer {
+			x := ToVector(a[0])
+			y := ToVector(a[1])
+			if len(x) != len(y) {
+				panic(fmt.Sprintf("vector-dot: length mismatch %d vs %d", len(x), len(y)))
+			}
+			var result float64
+			for i, v := range x {
+				result += v * y[i]
+			}
+			return result
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"vector-add", "returns the elementwise sum of two vectors of the same length",
+		2, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"a", "vector", "first vector"},
+			DeclarationParameter{"b", "vector", "second vector"},
+			DeclarationParameter{"into", "vector", "(optional) destination vector of the same length; the sum is written in place and into is returned (into may be a or b)"},
+		}, "vector",
+		func (a ...Scmer) Scmer {
+			x := ToVector(a[0])
+			y := ToVector(a[1])
+			if len(x) != len(y) {
+				panic(fmt.Sprintf("vector-add: length mismatch %d vs %d", len(x), len(y)))
+			}
+			var result []float64
+			if len(a) > 2 && a[2] != nil {
+				dst, ok := a[2].([]float64)
+				if !ok {
+					panic("vector-add: into must be a vector")
+				}
+				if len(dst) != len(x) {
+					panic(fmt.Sprintf("vector-add: length mismatch of into: %d vs %d", len(dst), len(x)))
+				}
+				result = dst
+			} else {
+				result = make([]float64, len(x))
+			}
+			for i, v := range x {
+				result[i] = v + y[i]
+			}
+			return result
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"vector-map", "returns a new vector where each element is the result of fn(value index)",
+		2, 2,
+		[]DeclarationParameter{
+			DeclarationParameter{"vec", "vector", "input vector"},
+			DeclarationParameter{"fn", "func", "lambda(value index) that returns the new value as a number"},
+		}, "vector",
+		func (a ...Scmer) Scmer {
+			vec := ToVector(a[0])
+			fn := OptimizeProcToSerialFunction(a[1])
+			result := make([]float64, len(vec))
+			args := make([]Scmer, 2) // reused for every call
+			// TODO: call a JIT-compiled arithmetic lambda directly on the floats once there is a JIT (see OptimizeProcToSerialFunction)
+			for i, v := range vec {
+				args[0] = v
+				args[1] = int64(i)
+				result[i] = ToFloat(fn(args...))
+			}
+			return result
+		},
+	})
+	Declare(&Globalenv, &Declaration{
+		"vector-reduce", "folds a vector from left to right: acc = fn(acc value index), starting with acc = neutral. Returns neutral for an empty vector.",
+		3, 3,
+		[]DeclarationParameter{
+			DeclarationParameter{"vec", "vector", "input vector"},
+			DeclarationParameter{"fn", "func", "lambda(acc value index) that returns the new accumulator"},
+			DeclarationParameter{"neutral", "any", "initial value of the accumulator"},
+		}, "any",
+		func (a ...Scmer) Scmer {
+			vec := ToVector(a[0])
+			fn := OptimizeProcToSerialFunction(a[1])
+			acc := a[2]
+			args := make([]Scmer, 3) // reused for every call
+			for i, v := range vec {
+				args[0] = acc
+				args[1] = v
+				args[2] = int64(i)
+				acc = fn(args...)
+			}
+			return acc
+		},
+	})
+}
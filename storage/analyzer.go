@@ -25,6 +25,7 @@ type columnboundaries struct{
 	lowerInclusive bool
 	upper scm.Scmer
 	upperInclusive bool
+	collation string // "" is the default order; otherwise the index has to be built in that collation (scan option collate)
 }
 
 type boundaries []columnboundaries
@@ -99,7 +100,7 @@ func extractBoundaries(conditionCols []string, condition scm.Scmer) boundaries {
 							if col, ok := symbolmapping[v1]; ok { // left is a column
 								if v2, ok := extractConstant(v[2]); ok { // right is a constant
 									// ?equal var const
-									cols = addConstraint(cols, columnboundaries{col, v2, true, v2, true})
+									cols = addConstraint(cols, columnboundaries{col, v2, true, v2, true, ""})
 								}
 							}
 						// TODO: equals constant vs. column
@@ -111,7 +112,7 @@ func extractBoundaries(conditionCols []string, condition scm.Scmer) boundaries {
 							if col, ok := symbolmapping[v1]; ok { // left is a column
 								if v2, ok := extractConstant(v[2]); ok { // right is a constant
 									// ?equal var const
-									cols = addConstraint(cols, columnboundaries{col, nil, false, v2, v[0] == scm.Symbol("<=")})
+									cols = addConstraint(cols, columnboundaries{col, nil, false, v2, v[0] == scm.Symbol("<="), ""})
 								}
 							}
 						// TODO: constant vs. column
@@ -123,7 +124,7 @@ func extractBoundaries(conditionCols []string, condition scm.Scmer) boundaries {
 							if col, ok := symbolmapping[v1]; ok { // left is a column
 								if v2, ok := extractConstant(v[2]); ok { // right is a constant
 									// ?equal var const
-									cols = addConstraint(cols, columnboundaries{col, v2, v[0] == scm.Symbol(">="), nil, false})
+									cols = addConstraint(cols, columnboundaries{col, v2, v[0] == scm.Symbol(">="), nil, false, ""})
 								}
 							}
 						// TODO: constant vs. column
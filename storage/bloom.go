@@ -0,0 +1,194 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "math"
+import "strconv"
+import "unicode"
+import "hash/fnv"
+import "encoding/binary"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+Bloom filters over the main storage of a shard (column option "bloom")
+
+An equality filter on a bloomed column first asks the filter; on a definite miss,
+the main storage of that shard is skipped and only the delta storage is scanned.
+Deletions don't invalidate the filter, they only lead to a maybe-hit.
+
+equal? compares numbers with strings ("12" = 12) and equal?? compares strings
+case-insensitive, so numbers are hashed as float and strings case-folded; a filter
+that has seen both kinds (or anything else) never says no to a query of the other kind.
+
+*/
+
+const bloomFileName = ".bloom"
+const bloomBitsPerValue = 10 // ~1% false positives with bloomHashes
+const bloomHashes = 7
+
+const (
+	bloomNumbers = 1
+	bloomStrings = 2
+	bloomOther = 4
+)
+
+type bloomFilter struct {
+	bits []uint64
+	kinds uint8 // which kinds of values were added
+}
+
+func newBloomFilter(n uint) *bloomFilter {
+	words := (n * bloomBitsPerValue + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words)}
+}
+
+func bloomKey(v scm.Scmer) (key []byte, kind uint8) {
+	switch v_ := v.(type) {
+		case int64, float64:
+			return strconv.AppendFloat([]byte{'n'}, scm.ToFloat(v_), 'g', -1, 64), bloomNumbers
+		case string:
+			key = append(key, 's')
+			for _, r := range v_ {
+				key = append(key, string(foldRune(r))...)
+			}
+			return key, bloomStrings
+	}
+	return nil, bloomOther
+}
+
+// the smallest rune of the case folding orbit, so strings.EqualFold strings get the same key
+func foldRune(r rune) rune {
+	result := r
+	for r2 := unicode.SimpleFold(r); r2 != r; r2 = unicode.SimpleFold(r2) {
+		if r2 < result {
+			result = r2
+		}
+	}
+	return result
+}
+
+// double hashing: positions h1 + i*h2
+func (b *bloomFilter) positions(key []byte, fn func(uint64)) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+	h2 := (h1 >> 33 | h1 << 31) * 0x9E3779B97F4A7C15 | 1
+	m := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		fn((h1 + i * h2) % m)
+	}
+}
+
+func (b *bloomFilter) add(v scm.Scmer) {
+	if v == nil {
+		return // NULL never matches equal?
+	}
+	key, kind := bloomKey(v)
+	b.kinds |= kind
+	if kind == bloomOther {
+		return
+	}
+	b.positions(key, func (p uint64) {
+		b.bits[p / 64] |= 1 << (p % 64)
+	})
+}
+
+// false means v is definitely not in the main storage
+func (b *bloomFilter) mayContain(v scm.Scmer) bool {
+	key, kind := bloomKey(v)
+	if kind == bloomOther || b.kinds & ^uint8(kind) != 0 {
+		return true // the loose comparison of equal? may match values of another kind
+	}
+	result := true
+	b.positions(key, func (p uint64) {
+		if b.bits[p / 64] & (1 << (p % 64)) == 0 {
+			result = false
+		}
+	})
+	return result
+}
+
+// equality boundaries of bloomed columns that definitely miss the main storage
+func (t *storageShard) bloomMiss(boundaries boundaries) bool {
+	if len(t.blooms) == 0 {
+		return false
+	}
+	for _, b := range boundaries {
+		if b.collation != "" || b.lower == nil || !b.lowerInclusive || !b.upperInclusive || !scm.Equal(b.lower, b.upper) {
+			continue // not an equality (collations compare differently)
+		}
+		if filter, ok := t.blooms[b.col]; ok && !filter.mayContain(b.lower) {
+			return true
+		}
+	}
+	return false
+}
+
+// file format: per column 1, name length, name, kinds, number of words, words; 0 terminates
+func (t *storageShard) saveBlooms() {
+	if t.t.PersistencyMode == Memory || len(t.blooms) == 0 {
+		return
+	}
+	f := t.t.schema.persistence.WriteColumn(t.uuid.String(), bloomFileName)
+	for col, filter := range t.blooms {
+		binary.Write(f, binary.LittleEndian, uint8(1))
+		binary.Write(f, binary.LittleEndian, uint32(len(col)))
+		io.WriteString(f, col)
+		binary.Write(f, binary.LittleEndian, filter.kinds)
+		binary.Write(f, binary.LittleEndian, uint64(len(filter.bits)))
+		binary.Write(f, binary.LittleEndian, filter.bits)
+	}
+	binary.Write(f, binary.LittleEndian, uint8(0))
+	f.Close()
+}
+
+func (t *storageShard) loadBlooms() {
+	f := t.t.schema.persistence.ReadColumn(t.uuid.String(), bloomFileName)
+	defer f.Close()
+	for {
+		var marker uint8
+		if err := binary.Read(f, binary.LittleEndian, &marker); err != nil || marker != 1 {
+			return // no bloom file or end of file
+		}
+		var l uint32
+		binary.Read(f, binary.LittleEndian, &l)
+		col := make([]byte, l)
+		if _, err := io.ReadFull(f, col); err != nil {
+			panic("bloom file of shard " + t.uuid.String() + " is damaged: " + err.Error())
+		}
+		filter := new(bloomFilter)
+		binary.Read(f, binary.LittleEndian, &filter.kinds)
+		var words uint64
+		binary.Read(f, binary.LittleEndian, &words)
+		if words > math.MaxInt32 {
+			panic("bloom file of shard " + t.uuid.String() + " is damaged")
+		}
+		filter.bits = make([]uint64, words)
+		if err := binary.Read(f, binary.LittleEndian, filter.bits); err != nil {
+			panic("bloom file of shard " + t.uuid.String() + " is damaged: " + err.Error())
+		}
+		if t.blooms == nil {
+			t.blooms = make(map[string]*bloomFilter)
+		}
+		t.blooms[string(col)] = filter
+	}
+}
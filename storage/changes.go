@@ -0,0 +1,255 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "sort"
+import "sync/atomic"
+import "github.com/google/uuid"
+import "github.com/launix-de/memcp/scm"
+
+// change-data-capture: every write gets a sequence number that is stored in the log;
+// the shard remembers which record ids were inserted/deleted by which write, so the rows can be read from the shard itself
+type shardChange struct {
+	seq uint64
+	time int64 // wall-clock time of the write (unix nanoseconds)
+	idx uint // record id of the (first) affected item
+	count uint // number of inserted items; 0 for a deletion
+}
+
+// a change whose rows were read out of their shard, so it outlives rebuild and repartitioning
+// the history of a table is persisted in its own log (table.HistoryId) and loaded on startup
+type changeEvent struct {
+	seq uint64
+	time int64
+	deleted bool
+	row []scm.Scmer // assoc list
+}
+
+const shardChangesLimit = 65536 // changes per shard; the older half is moved into the table history when it is reached
+const changeHistoryLimit = 1048576 // events of a table; the older half is dropped (and LogCompacted raised) when it is reached
+
+func (t *table) nextSequence() uint64 {
+	return atomic.AddUint64(&t.LogSequence, 1)
+}
+
+// raises a sequence counter to at least seq
+func raiseSequence(counter *uint64, seq uint64) {
+	for {
+		old := atomic.LoadUint64(counter)
+		if old >= seq || atomic.CompareAndSwapUint64(counter, old, seq) {
+			return
+		}
+	}
+}
+
+func raiseTime(counter *int64, ts int64) {
+	for {
+		old := atomic.LoadInt64(counter)
+		if old >= ts || atomic.CompareAndSwapInt64(counter, old, ts) {
+			return
+		}
+	}
+}
+
+// contract: must only be called inside full write mutex mu.Lock()
+func (t *storageShard) recordChange(seq uint64, ts int64, idx uint, count uint) {
+	t.changes = append(t.changes, shardChange{seq, ts, idx, count})
+	if atomic.LoadInt32(&t.t.activeSnapshots) > 0 {
+		t.t.snapshotChange(t, seq, idx, count)
+	}
+	if len(t.changes) > shardChangesLimit && t.next == nil && !t.dualWrite { // while rebuilding, later changes are recorded twice
+		half := len(t.changes) / 2
+		t.archiveChanges(func (i int, c shardChange) bool {
+			return i < half
+		})
+	}
+}
+
+// moves the changes that match filter into the table history
+// contract: must only be called inside full write mutex mu.Lock() (or while the shard is no longer written)
+func (t *storageShard) archiveChanges(filter func(int, shardChange) bool) {
+	var events []changeEvent
+	kept := t.changes[:0:0]
+	for i, c := range t.changes {
+		if !filter(i, c) {
+			kept = append(kept, c)
+		} else if c.count == 0 {
+			events = append(events, changeEvent{c.seq, c.time, true, t.rowAssoc(c.idx).([]scm.Scmer)})
+		} else {
+			for i := uint(0); i < c.count; i++ {
+				events = append(events, changeEvent{c.seq, c.time, false, t.rowAssoc(c.idx + i).([]scm.Scmer)})
+			}
+		}
+	}
+	t.changes = kept
+	t.t.appendHistory(events)
+}
+
+func (t *table) persistsHistory() bool {
+	return t.PersistencyMode == Safe || t.PersistencyMode == Logged
+}
+
+// lock order: shard mu before historyMu
+func (t *table) appendHistory(events []changeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	t.history = append(t.history, events...)
+	if len(t.history) > changeHistoryLimit {
+		// drop the older half; consumers with an older checkpoint get an error from now on
+		sort.SliceStable(t.history, func (i, j int) bool {
+			return t.history[i].seq < t.history[j].seq
+		})
+		dropped := t.history[:len(t.history) / 2]
+		for _, e := range dropped {
+			raiseTime(&t.LogCompactedTime, e.time)
+		}
+		raiseSequence(&t.LogCompacted, dropped[len(dropped) - 1].seq)
+		t.history = append([]changeEvent{}, t.history[len(dropped):]...)
+		if t.historyLog != nil {
+			// rewrite the log with the remaining events
+			t.historyLog.Close()
+			t.historyLog = nil
+			t.schema.persistence.RemoveLog(t.HistoryId)
+		}
+		events = t.history
+	}
+	if !t.persistsHistory() {
+		return
+	}
+	if t.historyLog == nil {
+		if t.HistoryId == "" {
+			id, _ := uuid.NewRandom()
+			t.HistoryId = "history-" + id.String()
+			t.schema.save()
+		}
+		t.historyLog = t.schema.persistence.OpenLog(t.HistoryId)
+	}
+	for _, e := range events {
+		t.historyLog.Write(LogEntryChange{e.seq, e.time, e.deleted, e.row})
+	}
+	t.historyLog.Sync()
+}
+
+// reads the persisted change history; called before the shards are loaded
+func (t *table) loadHistory() {
+	if t.HistoryId == "" || !t.persistsHistory() {
+		return
+	}
+	log, logfile := t.schema.persistence.ReplayLog(t.HistoryId, 0)
+	for logentry := range log {
+		if e, ok := logentry.(LogEntryChange); ok {
+			t.history = append(t.history, changeEvent{e.seq, e.ts, e.deleted, e.row})
+			raiseSequence(&t.LogSequence, e.seq)
+		}
+	}
+	t.historyLog = logfile // ReplayLog leaves the file open for appending
+}
+
+func (t *table) removeHistory() {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	if t.historyLog != nil {
+		t.historyLog.Close()
+		t.historyLog = nil
+	}
+	if t.HistoryId != "" {
+		t.schema.persistence.RemoveLog(t.HistoryId)
+	}
+}
+
+// reads a whole row as assoc list
+func (t *storageShard) rowAssoc(idx uint) scm.Scmer {
+	result := make([]scm.Scmer, 0, 2 * len(t.t.Columns))
+	for _, c := range t.t.Columns {
+		var value scm.Scmer
+		if idx < t.main_count {
+			if cstorage, ok := t.columns[c.Name]; ok {
+				value = cstorage.GetValue(idx)
+			}
+		} else {
+			value = t.getDelta(int(idx - t.main_count), c.Name)
+		}
+		result = append(result, c.Name, value)
+	}
+	return result
+}
+
+// all changes of the table after a sequence number (history and shards) in commit order
+// an update is a delete followed by an insert with the same sequence number
+// visit (optional) reads the current state of each shard consistently with the returned changes
+func (t *table) changeEvents(since uint64, visit func(*storageShard)) []changeEvent {
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	// lock order: shards before history, so no change is moved into the history while we read
+	for _, s := range shardlist {
+		s.mu.RLock()
+	}
+	t.historyMu.Lock()
+	var events []changeEvent
+	for _, e := range t.history {
+		if e.seq > since {
+			events = append(events, e)
+		}
+	}
+	t.historyMu.Unlock()
+	for _, s := range shardlist {
+		if visit != nil {
+			visit(s)
+		}
+		for _, c := range s.changes {
+			if c.seq <= since {
+				continue
+			}
+			if c.count == 0 {
+				events = append(events, changeEvent{c.seq, c.time, true, s.rowAssoc(c.idx).([]scm.Scmer)})
+			} else {
+				for i := uint(0); i < c.count; i++ {
+					events = append(events, changeEvent{c.seq, c.time, false, s.rowAssoc(c.idx + i).([]scm.Scmer)})
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+	// the history and each shard are in commit order already, so a stable sort keeps delete+insert of an update together
+	sort.SliceStable(events, func (i, j int) bool {
+		return events[i].seq < events[j].seq
+	})
+	return events
+}
+
+// returns all inserts and deletions after a sequence number in commit order
+func (t *table) ChangesSince(since uint64) scm.Scmer {
+	if compacted := atomic.LoadUint64(&t.LogCompacted); since < compacted {
+		panic(fmt.Sprintf("changes of %s before sequence %d are no longer available (the change history is limited to %d events)", t.Name, compacted, changeHistoryLimit))
+	}
+	events := t.changeEvents(since, nil)
+	result := make([]scm.Scmer, len(events))
+	for i, e := range events {
+		op := "insert"
+		if e.deleted {
+			op = "delete"
+		}
+		result[i] = []scm.Scmer{"seq", int64(e.seq), "op", op, "row", e.row}
+	}
+	return result
+}
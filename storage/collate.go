@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import "sync"
+import "github.com/launix-de/memcp/scm"
+
+// less functions of collations (building a collator is expensive)
+var collations sync.Map // collation name -> func(a, b scm.Scmer) bool
+
+// returns the order of a collation as accepted by (collate ...); "" is the default byte order
+// strings are compared by the collation, everything else (NULL, numbers) falls back to scm.Less so the order stays total
+func collationLess(collation string) func(a, b scm.Scmer) bool {
+	if collation == "" {
+		return scm.Less
+	}
+	if less, ok := collations.Load(collation); ok {
+		return less.(func(a, b scm.Scmer) bool)
+	}
+	cmp := scm.Apply(scm.Globalenv.Vars[scm.Symbol("collate")], collation).(func(...scm.Scmer) scm.Scmer)
+	less := func(a, b scm.Scmer) bool {
+		if sa, ok := a.(string); ok {
+			if sb, ok := b.(string); ok {
+				return scm.ToBool(cmp(sa, sb))
+			}
+		}
+		return scm.Less(a, b)
+	}
+	collations.Store(collation, less)
+	return less
+}
+
+// the collate option: comparisons of these columns in the filter and the index bounds use the collation
+// boundaries are marked with their collation (so iterateIndex picks an index in that order); the returned condition compares in the collation
+func (o scanOptions) collateCondition(conditionCols []string, condition scm.Scmer, b boundaries) scm.Scmer {
+	if len(o.collate) == 0 {
+		return condition
+	}
+	for i := range b {
+		b[i].collation = o.collate[b[i].col]
+	}
+	p := condition.(scm.Proc)
+	symbols := make(map[scm.Symbol]func(a, b scm.Scmer) bool)
+	for i, sym := range p.Params.([]scm.Scmer) {
+		if collation, ok := o.collate[conditionCols[i]]; ok {
+			symbols[sym.(scm.Symbol)] = collationLess(collation)
+		}
+	}
+	if len(symbols) == 0 {
+		return condition
+	}
+	p.Body = collateExpression(p.Body, symbols)
+	return p
+}
+
+// replaces equal? < <= > >= on collated columns by comparisons in the collation
+func collateExpression(node scm.Scmer, symbols map[scm.Symbol]func(a, b scm.Scmer) bool) scm.Scmer {
+	v, ok := node.([]scm.Scmer)
+	if !ok || len(v) == 0 {
+		return node
+	}
+	result := make([]scm.Scmer, len(v))
+	for i, x := range v {
+		result[i] = collateExpression(x, symbols)
+	}
+	if len(v) != 3 {
+		return result
+	}
+	op, ok := v[0].(scm.Symbol)
+	if !ok {
+		return result
+	}
+	less, ok := symbols[collatedSymbol(v[1])]
+	if !ok {
+		if less, ok = symbols[collatedSymbol(v[2])]; !ok {
+			return result
+		}
+	}
+	original := scm.Globalenv.Vars[op]
+	var cmp func(a, b string) bool
+	switch op {
+		case "equal?", "equal??":
+			cmp = func(a, b string) bool { return !less(a, b) && !less(b, a) }
+		case "<":
+			cmp = func(a, b string) bool { return less(a, b) }
+		case "<=":
+			cmp = func(a, b string) bool { return !less(b, a) }
+		case ">":
+			cmp = func(a, b string) bool { return less(b, a) }
+		case ">=":
+			cmp = func(a, b string) bool { return !less(a, b) }
+		default:
+			return result
+	}
+	result[0] = func(a ...scm.Scmer) scm.Scmer {
+		if sa, ok := a[0].(string); ok {
+			if sb, ok := a[1].(string); ok {
+				return cmp(sa, sb)
+			}
+		}
+		return scm.Apply(original, a...) // NULL and numbers keep their semantics
+	}
+	return result
+}
+
+func collatedSymbol(v scm.Scmer) scm.Symbol {
+	if sym, ok := v.(scm.Symbol); ok {
+		return sym
+	}
+	return ""
+}
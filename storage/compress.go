@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "fmt"
+import "encoding/binary"
+import "github.com/ulikunitz/xz"
+import "github.com/klauspost/compress/zstd"
+
+/*
+
+compressed column files
+
+A compressed column file starts with the magic byte compressedColumn (which is not
+a storage type), followed by the codec byte and the compressed stream. The stream
+contains the column exactly as it would be written uncompressed, so uncompressed
+files of older versions still load and the compression of a table can be changed
+at any time; it applies to all columns written afterwards (rebuild, repartition).
+
+*/
+
+const compressedColumn uint8 = 255
+
+// codecs; the byte values are part of the file format
+// zstd decompresses much faster than xz (columns are read on every startup), xz compresses a bit better for archives
+var compressionCodecs = map[string]uint8 {
+	"xz": 1,
+	"zstd": 2,
+}
+
+func validateCompression(codec string) string {
+	if codec == "none" {
+		return ""
+	}
+	if _, ok := compressionCodecs[codec]; codec != "" && !ok {
+		panic("unknown compression: " + codec + " (supported: none, zstd, xz)")
+	}
+	return codec
+}
+
+type compressedWriter struct {
+	enc io.WriteCloser
+	f io.WriteCloser
+	closed bool
+}
+
+func (w *compressedWriter) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+// Serialize and its caller both close the writer, so Close must be idempotent
+func (w *compressedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.enc.Close() // flush the compressed stream
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// wraps a column file writer according to the table's compression
+func compressColumn(f io.WriteCloser, codec string) io.WriteCloser {
+	if codec == "" {
+		return f
+	}
+	binary.Write(f, binary.LittleEndian, compressedColumn)
+	binary.Write(f, binary.LittleEndian, compressionCodecs[codec])
+	switch codec {
+		case "xz":
+			enc, err := xz.NewWriter(f)
+			if err != nil {
+				panic(err)
+			}
+			return &compressedWriter{enc, f, false}
+		case "zstd":
+			enc, err := zstd.NewWriter(f)
+			if err != nil {
+				panic(err)
+			}
+			return &compressedWriter{enc, f, false}
+	}
+	panic("unknown compression: " + codec)
+}
+
+// opens a column file for writing (compressed if the table has a compression)
+func (t *table) writeColumn(shard string, col string) io.WriteCloser {
+	return compressColumn(t.schema.persistence.WriteColumn(shard, col), t.Compress)
+}
+
+// the Deserialize functions call Read directly and expect the whole buffer; decompressors may return less
+type fullReader struct {
+	r io.Reader
+}
+
+func (f fullReader) Read(p []byte) (int, error) {
+	return io.ReadFull(f.r, p)
+}
+
+// reads the magic byte of a column file and transparently decompresses it; returns the storage type and the reader for Deserialize
+func openColumn(f io.Reader) (uint8, io.Reader, error) {
+	var magicbyte uint8 // type of that column
+	if err := binary.Read(f, binary.LittleEndian, &magicbyte); err != nil {
+		return 0, f, err
+	}
+	if magicbyte != compressedColumn {
+		return magicbyte, f, nil
+	}
+	var codec uint8
+	if err := binary.Read(f, binary.LittleEndian, &codec); err != nil {
+		return 0, f, err
+	}
+	switch codec {
+		case compressionCodecs["xz"]:
+			dec, err := xz.NewReader(f)
+			if err != nil {
+				return 0, f, err
+			}
+			return openColumn(fullReader{dec})
+		case compressionCodecs["zstd"]:
+			dec, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1)) // synchronous: no decoder goroutines that would have to be closed after Deserialize
+			if err != nil {
+				return 0, f, err
+			}
+			return openColumn(fullReader{dec})
+	}
+	panic(fmt.Sprint("unknown compression codec in column file: ", codec))
+}
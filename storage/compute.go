@@ -25,6 +25,7 @@ func (t *table) ComputeColumn(name string, inputCols []string, computor scm.Scme
 		if c.Name == name {
 			// found the column
 			t.Columns[i].Computor = computor // set formula so delta storages and rebuild algo know how to recompute
+			t.Columns[i].ComputorCols = inputCols
 			done := make(chan error, 6)
 			shardlist := t.Shards
 			if shardlist == nil {
@@ -93,7 +94,40 @@ func (s *storageShard) ComputeColumn(name string, inputCols []string, computor s
 	store := new(StorageSCMER)
 	store.values = vals
 	s.columns[name] = store
+	s.buildComputors() // later inserts compute the new column, too
 	s.mu.Unlock()
 	// TODO: decide whether to rebuild optimized store
 	return true
 }
+
+// formula of a computed column, evaluated for the items of delta storage
+type deltaComputor struct {
+	fn scm.Scmer
+	cols []string // source columns
+}
+
+// collects the computed columns of the table, so computeDelta does not search t.Columns for every cell
+// contract: must be called inside the shard's write lock mu.Lock()
+func (s *storageShard) buildComputors() {
+	s.computors = make(map[string]deltaComputor)
+	for _, c := range s.t.Columns {
+		if c.Computor != nil {
+			s.computors[c.Name] = deltaComputor{c.Computor, c.ComputorCols}
+		}
+	}
+}
+
+// computes the value of a computed column for an item of delta storage; ok=false if col is no computed column
+// contract: must be called inside the shard's read lock
+func (s *storageShard) computeDelta(idx int, col string) (result scm.Scmer, ok bool) {
+	c, ok := s.computors[col]
+	if !ok {
+		return nil, false
+	}
+	// feed the source columns into the computor (NULL values are passed as nil, so the computor decides how to propagate them)
+	args := make([]scm.Scmer, len(c.cols))
+	for i, inputCol := range c.cols {
+		args[i] = s.getDelta(idx, inputCol)
+	}
+	return scm.Apply(c.fn, args...), true
+}
@@ -16,25 +16,145 @@ Copyright (C) 2023  Carl-Philip Hänsch
 */
 package storage
 
+import "io"
 import "os"
+import "sync"
 import "bufio"
+import "strconv"
 import "strings"
 import "github.com/launix-de/memcp/scm"
 
-func LoadCSV(schema, table, filename, delimiter string) {
+// options of loadCSV
+type csvOptions struct {
+	nullToken *string // fields equal to this become NULL (nil: no token)
+	lenient bool // malformed numbers become NULL instead of failing
+	header bool // the first line names the columns of the fields (as written by ExportCSV)
+}
+
+func LoadCSV(schema, table, filename, delimiter string, options csvOptions) {
 	f, _ := os.Open(filename)
 	defer f.Close()
+	LoadCSVStream(schema, table, f, delimiter, options)
+}
+
+// how a CSV field is converted for a column type
+const (
+	csvAny = iota // scm.Simplify
+	csvString
+	csvInt
+	csvFloat
+)
+
+func csvColumnKind(typ string) int {
+	typ = strings.ToLower(typ)
+	switch typ {
+		case "int", "integer", "tinyint", "smallint", "mediumint", "bigint":
+			return csvInt
+		case "float", "double", "real", "decimal", "numeric":
+			return csvFloat
+	}
+	if strings.Contains(typ, "char") || strings.Contains(typ, "text") || strings.Contains(typ, "blob") || strings.Contains(typ, "binary") || typ == "enum" || typ == "set" {
+		return csvString
+	}
+	return csvAny
+}
+
+// converts a field according to the column type; empty numeric fields are NULL
+func (o csvOptions) field(value string, kind int, line int, col string) scm.Scmer {
+	if o.nullToken != nil && value == *o.nullToken {
+		return nil
+	}
+	switch kind {
+		case csvString:
+			return value
+		case csvInt, csvFloat:
+			trimmed := strings.TrimSpace(value)
+			if trimmed == "" {
+				return nil
+			}
+			if kind == csvInt {
+				if i, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+					return i
+				}
+			} else if f, err := strconv.ParseFloat(trimmed, 64); err == nil {
+				return f
+			}
+			if o.lenient {
+				return nil
+			}
+			panic("loadCSV: line " + strconv.Itoa(line) + ": invalid number " + strconv.Quote(value) + " for column " + col)
+		default:
+			return scm.Simplify(value)
+	}
+}
+
+// splits a CSV record into its fields; quoted fields (RFC 4180) may contain the delimiter, "" and line breaks
+// open is true if the record ends inside a quoted field, i.e. the next line belongs to it
+func splitCSV(text, delimiter string) (fields []string, open bool) {
+	for {
+		if strings.HasPrefix(text, "\"") {
+			var b strings.Builder
+			i := 1
+			for {
+				j := strings.IndexByte(text[i:], '"')
+				if j < 0 {
+					return fields, true
+				}
+				b.WriteString(text[i:i+j])
+				i += j + 1
+				if i < len(text) && text[i] == '"' {
+					b.WriteByte('"') // escaped quote
+					i++
+				} else {
+					break
+				}
+			}
+			text = text[i:]
+			// anything between the closing quote and the delimiter is kept
+			end := strings.Index(text, delimiter)
+			if end < 0 {
+				b.WriteString(text)
+				return append(fields, b.String()), false
+			}
+			b.WriteString(text[:end])
+			fields = append(fields, b.String())
+			text = text[end+len(delimiter):]
+		} else {
+			end := strings.Index(text, delimiter)
+			if end < 0 {
+				return append(fields, text), false
+			}
+			fields = append(fields, text[:end])
+			text = text[end+len(delimiter):]
+		}
+	}
+}
+
+type csvLine struct {
+	number int
+	text string
+}
+
+// loads CSV from a stream (e.g. a (stream "http://...")); the caller closes f
+func LoadCSVStream(schema, table string, f io.Reader, delimiter string, options csvOptions) {
 	scanner := bufio.NewScanner(f)
 	scanner.Split(bufio.ScanLines)
 
-	lines := make(chan string, 512)
+	lines := make(chan csvLine, 512)
 
 	go func () {
+		number := 0
 		for scanner.Scan() {
-			lines <- scanner.Text()
+			number++
+			lines <- csvLine{number, scanner.Text()}
 		}
 		close(lines)
 	}()
+	defer func () {
+		for range lines {
+			// on a panic, let the reader finish so it does not block forever
+		}
+	}()
 
 	db := GetDatabase(schema)
 	if db == nil {
@@ -45,30 +165,119 @@ func LoadCSV(schema, table, filename, delimiter string) {
 		panic("table " + table + " does not exist")
 	}
 	cols := make([]string, len(t.Columns))
+	kinds := make([]int, len(t.Columns))
 	for i, col := range t.Columns {
 		cols[i] = col.Name
+		kinds[i] = csvColumnKind(col.Typ)
 	}
+	headerPending := options.header
 	buffer := make([][]scm.Scmer, 0, 4096)
-	for s := range(lines) {
-		if s == "" {
+	record := "" // a quoted field may span several lines
+	number := 0 // line of the record start
+	for l := range(lines) {
+		if record == "" {
+			record = l.text
+			number = l.number
+		} else {
+			record = record + "\n" + l.text
+		}
+		arr, open := splitCSV(record, delimiter)
+		if open {
+			continue
+		}
+		record = ""
+		if len(arr) == 1 && arr[0] == "" {
 			// ignore
+		} else if headerPending {
+			// the fields of the following lines are in the order of the header
+			headerPending = false
+			cols = arr
+			kinds = make([]int, len(arr))
+			for i, name := range arr {
+				found := false
+				for _, col := range t.Columns {
+					if col.Name == name {
+						kinds[i] = csvColumnKind(col.Typ)
+						found = true
+					}
+				}
+				if !found {
+					panic("loadCSV: column " + name + " of the header does not exist in table " + table)
+				}
+			}
 		} else {
-			arr := strings.Split(s, delimiter)
-			x := make([]scm.Scmer, len(t.Columns))
-			for i, _ := range t.Columns {
+			x := make([]scm.Scmer, len(cols))
+			for i := range cols {
 				if i < len(arr) {
-					x[i] = scm.Simplify(arr[i])
+					x[i] = options.field(arr[i], kinds[i], number, cols[i])
 				}
 			}
 			buffer = append(buffer, x)
 			if len(buffer) >= 4096 {
-				t.Insert(cols, buffer, nil, nil, false)
+				t.Insert(cols, buffer, nil, nil, false, nil)
 				buffer = buffer[:0]
 			}
 		}
 	}
+	if record != "" {
+		panic("loadCSV: line " + strconv.Itoa(number) + ": quoted field is not terminated")
+	}
 	if len(buffer) > 0 {
-		t.Insert(cols, buffer, nil, nil, false)
+		t.Insert(cols, buffer, nil, nil, false, nil)
 	}
 }
 
+
+// writes all rows of the table as CSV (RFC 4180 quoting), optionally with a header line; rows are written while the shards are scanned
+func ExportCSV(schema, table string, f io.Writer, delimiter string, cols []string, header bool) {
+	db := GetDatabase(schema)
+	if db == nil {
+		panic("database " + schema + " does not exist")
+	}
+	t := db.Tables.Get(table)
+	if t == nil {
+		panic("table " + table + " does not exist")
+	}
+	if cols == nil {
+		cols = make([]string, len(t.Columns))
+		for i, col := range t.Columns {
+			cols[i] = col.Name
+		}
+	}
+	w := bufio.NewWriter(f)
+	var mu sync.Mutex
+	writeLine := func (values []string) {
+		for i, v := range values {
+			if i > 0 {
+				w.WriteString(delimiter)
+			}
+			if strings.Contains(v, delimiter) || strings.ContainsAny(v, "\"\r\n") {
+				w.WriteString("\"")
+				w.WriteString(strings.ReplaceAll(v, "\"", "\"\""))
+				w.WriteString("\"")
+			} else {
+				w.WriteString(v)
+			}
+		}
+		w.WriteString("\n")
+	}
+	if header {
+		writeLine(cols)
+	}
+	alwaysTrue := scm.Proc{[]scm.Scmer{}, true, &scm.Globalenv, 0}
+	t.scan(nil, alwaysTrue, cols, func (a ...scm.Scmer) scm.Scmer {
+		values := make([]string, len(a))
+		for i, v := range a {
+			if v != nil { // NULL is an empty field
+				values[i] = scm.String(v)
+			}
+		}
+		mu.Lock()
+		writeLine(values)
+		mu.Unlock()
+		return nil
+	}, nil, nil, nil, false, scanOptions{})
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+}
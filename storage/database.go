@@ -20,6 +20,8 @@ import "os"
 import "fmt"
 import "sync"
 import "time"
+import "unsafe"
+import "sync/atomic"
 import "encoding/json"
 import "github.com/launix-de/memcp/scm"
 import "github.com/launix-de/NonLockingReadMap"
@@ -28,6 +30,7 @@ type database struct {
 	Name string `json:"name"`
 	persistence PersistenceEngine `json:"-"`
 	Tables NonLockingReadMap.NonLockingReadMap[table, string] `json:"tables"`
+	SchemaVersion int64 `json:"schemaVersion,omitempty"` // set by migration scripts (set-schema-version)
 	schemalock sync.RWMutex `json:"-"` // TODO: rw-locks for schemalock
 }
 // TODO: replace databases map everytime something changes, so we don't run into read-while-write
@@ -52,11 +55,12 @@ func Rebuild(all bool, repartition bool) string {
 
 func UnloadDatabases() {
 	fmt.Println("table compression done in ", Rebuild(false, false))
-	data, _ := json.Marshal(Settings)
-	if settings, err := os.OpenFile(Basepath + "/settings.json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640); err == nil {
-		defer settings.Close()
-		settings.Write(data)
-	}
+	defer func () {
+		if r := recover(); r != nil {
+			fmt.Println("error: could not save settings:", r) // don't abort the shutdown
+		}
+	}()
+	SaveSettings()
 }
 
 func LoadDatabases() {
@@ -88,12 +92,15 @@ func LoadDatabases() {
 				// restore back references of the tables
 				for _, t := range db.Tables.GetAll() {
 					t.schema = db // restore schema reference
+					t.loadHistory()
 					func (t *table) {
 						t.iterateShards(nil, func (s *storageShard) {
 							s.load(t)
 						})
 					}(t)
 				}
+				// TODO: collect the databases and insert them with one SetMany; Set copies and re-sorts the whole map on every call,
+				// which is quadratic with many databases. SetMany has to be added to github.com/launix-de/NonLockingReadMap first (not part of this repository)
 				databases.Set(db)
 			}
 		} else {
@@ -233,6 +240,79 @@ func CreateTable(schema, name string, pm PersistencyMode, ifnotexists bool) (*ta
 	return t, true
 }
 
+// exchanges the names of two tables with a single schema save
+func SwapTables(schema, name1, name2 string) {
+	db := GetDatabase(schema)
+	if db == nil {
+		panic("Database " + schema + " does not exist")
+	}
+	db.schemalock.Lock()
+	defer db.schemalock.Unlock()
+	t1 := db.Tables.Get(name1)
+	if t1 == nil {
+		panic("Table " + schema + "." + name1 + " does not exist")
+	}
+	t2 := db.Tables.Get(name2)
+	if t2 == nil {
+		panic("Table " + schema + "." + name2 + " does not exist")
+	}
+	if t1 == t2 {
+		return // nothing to swap
+	}
+
+	// block rebuild and repartitioning of both tables (lock in name order to avoid deadlocks);
+	// in-flight scans keep the table object they already hold, so they finish on the old data
+	if name1 < name2 {
+		t1.mu.Lock()
+		t2.mu.Lock()
+	} else {
+		t2.mu.Lock()
+		t1.mu.Lock()
+	}
+	defer t1.mu.Unlock()
+	defer t2.mu.Unlock()
+
+	// foreign keys follow the data, so they are renamed together with their table
+	swapName := func(name string) string {
+		if name == name1 {
+			return name2
+		} else if name == name2 {
+			return name1
+		}
+		return name
+	}
+	for _, t := range db.Tables.GetAll() {
+		for i, k := range t.Foreign {
+			t.Foreign[i].Tbl1 = swapName(k.Tbl1)
+			t.Foreign[i].Tbl2 = swapName(k.Tbl2)
+		}
+	}
+
+	// exchange both entries with a single copy-on-write of the sorted table list, so lookups never miss one of the tables;
+	// NonLockingReadMap cannot replace two entries at once, so we swap its only field, the atomic list pointer, directly
+	t1.Name = name2
+	t2.Name = name1
+	list := (*atomic.Pointer[[]*table])(unsafe.Pointer(&db.Tables))
+	for {
+		old := list.Load()
+		swapped := make([]*table, len(*old))
+		for i, t := range *old {
+			switch t {
+				case t1:
+					swapped[i] = t2
+				case t2:
+					swapped[i] = t1
+				default:
+					swapped[i] = t
+			}
+		}
+		if list.CompareAndSwap(old, &swapped) {
+			break
+		}
+	}
+	db.save()
+}
+
 func DropTable(schema, name string, ifexists bool) {
 	db := GetDatabase(schema)
 	if db == nil {
@@ -258,5 +338,6 @@ func DropTable(schema, name string, ifexists bool) {
 	for _, s := range t.PShards {
 		s.RemoveFromDisk()
 	}
+	t.removeHistory()
 }
 
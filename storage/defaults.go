@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "time"
+import "github.com/launix-de/memcp/scm"
+
+// backfills the NULL values of a column with the column's current default and returns the number of changed rows
+func (t *table) ApplyDefaults(name string) int64 {
+	var value scm.Scmer
+	found := false
+	for _, c := range t.Columns {
+		if c.Name == name {
+			value = c.Default
+			found = true
+		}
+	}
+	if !found {
+		panic("column " + t.Name + "." + name + " does not exist")
+	}
+	if value == nil {
+		return 0 // nothing to fill in
+	}
+	unique := false
+	for _, u := range t.Unique {
+		for _, c := range u.Cols {
+			if c == name {
+				unique = true
+			}
+		}
+	}
+
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	var count int64
+	for _, s := range shardlist {
+		count += s.applyDefault(name, value, unique)
+	}
+	return count
+}
+
+// replaces all NULLs of a column under one write lock and one sequence number, so readers see the shard either before or after the backfill
+func (s *storageShard) applyDefault(name string, value scm.Scmer, unique bool) int64 {
+	s.mu.Lock()
+	reader := s.ColumnReader(name)
+	ids := make([]uint, 0)
+	for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ {
+		if !s.deletions.Get(idx) && reader(idx) == nil {
+			ids = append(ids, idx)
+		}
+	}
+	if len(ids) == 0 {
+		s.mu.Unlock()
+		return 0
+	}
+	if unique || s.next != nil {
+		// unique checks and rebuild propagation are handled row by row in the update function
+		s.mu.Unlock()
+		seq := s.t.nextSequence()
+		for _, idx := range ids {
+			s.updateFunction(idx, false, seq)([]scm.Scmer{name, value})
+		}
+		return int64(len(ids))
+	}
+
+	seq := s.t.nextSequence()
+	ts := time.Now().UnixNano()
+	cols := make([]string, 0, len(s.columns))
+	for col := range s.columns {
+		cols = append(cols, col)
+	}
+	rows := make([][]scm.Scmer, len(ids))
+	for i, idx := range ids {
+		row := make([]scm.Scmer, len(cols))
+		for j, col := range cols {
+			if col == name {
+				row[j] = value
+			} else if idx < s.main_count {
+				row[j] = s.columns[col].GetValue(idx)
+			} else {
+				row[j] = s.getDelta(int(idx - s.main_count), col)
+			}
+		}
+		rows[i] = row
+	}
+	recid := s.main_count + uint(len(s.inserts))
+	for _, idx := range ids {
+		s.deletions.Set(idx, true)
+		s.recordChange(seq, ts, idx, 0)
+		if s.t.PersistencyMode == Safe || s.t.PersistencyMode == Logged {
+			s.logfile.Write(LogEntryDelete{seq, ts, idx})
+		}
+	}
+	s.insertDataset(cols, rows) // also updates the indexes
+	s.recordChange(seq, ts, recid, uint(len(rows)))
+	if s.t.PersistencyMode == Safe || s.t.PersistencyMode == Logged {
+		s.logfile.Write(LogEntryInsert{seq, ts, cols, rows})
+	}
+	s.mu.Unlock()
+	if s.t.PersistencyMode == Safe {
+		s.logfile.Sync()
+	}
+	return int64(len(ids))
+}
@@ -0,0 +1,104 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sync"
+import "sync/atomic"
+import "runtime/debug"
+import "github.com/launix-de/memcp/scm"
+
+// panic value to leave iterateIndex early; it is recovered by the shard worker
+type scanAbort struct{}
+
+// filter pass that stops all shard workers as soon as one row matches (EXISTS)
+func (t *table) scanExists(conditionCols []string, condition scm.Scmer) bool {
+	boundaries := extractBoundaries(conditionCols, condition)
+	lower, upperLast := indexFromBoundaries(boundaries)
+
+	var found atomic.Bool
+	var mu sync.Mutex
+	var err scm.Scmer
+	t.iterateShards(boundaries, func (s *storageShard) {
+		if found.Load() {
+			return // another shard already has a match
+		}
+		defer func () {
+			if r := recover(); r != nil {
+				mu.Lock()
+				err = scanError{r, string(debug.Stack())}
+				mu.Unlock()
+			}
+		}()
+		if s.scanExists(boundaries, lower, upperLast, conditionCols, condition, &found) {
+			found.Store(true)
+		}
+	})
+	if found.Load() {
+		return true // a panic in another shard does not change the answer
+	}
+	if err != nil {
+		panic(err) // cascade panic
+	}
+	return false
+}
+
+func (t *storageShard) scanExists(boundaries boundaries, lower []scm.Scmer, upperLast scm.Scmer, conditionCols []string, condition scm.Scmer, found *atomic.Bool) (result bool) {
+	conditionFn := scm.OptimizeProcToSerialFunction(condition)
+	cdataset := make([]scm.Scmer, len(conditionCols))
+	ccols := make([]ColumnStorage, len(conditionCols))
+	for i, k := range conditionCols { // iterate over columns
+		var ok bool
+		ccols[i], ok = t.columns[k] // find storage
+		if !ok {
+			panic("Column does not exist: `" + t.t.schema.Name + "`.`" + t.t.Name + "`.`" + k + "`")
+		}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock() // also release the lock when we abort
+	defer func () {
+		if r := recover(); r != nil {
+			if _, ok := r.(scanAbort); !ok {
+				panic(r)
+			}
+		}
+	}()
+	maxInsertIndex := len(t.inserts)
+	t.iterateIndex(boundaries, lower, upperLast, maxInsertIndex, func (idx uint) {
+		if found.Load() {
+			panic(scanAbort{}) // another shard found a match, stop here
+		}
+		if t.deletions.Get(idx) {
+			return // item is on delete list
+		}
+		if idx < t.main_count {
+			for i, k := range ccols {
+				cdataset[i] = k.GetValue(idx)
+			}
+		} else {
+			for i, k := range conditionCols {
+				cdataset[i] = t.getDelta(int(idx - t.main_count), k)
+			}
+		}
+		if scm.ToBool(conditionFn(cdataset...)) {
+			result = true
+			found.Store(true)
+			panic(scanAbort{})
+		}
+	})
+	return
+}
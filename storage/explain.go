@@ -0,0 +1,157 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sync"
+import "github.com/launix-de/memcp/scm"
+
+// describes how a scan would be executed (analyze phase only, nothing is scanned)
+// the result is an assoc list:
+//   table, predicates (pushed down into index/partition search), index (columns of the chosen index or nil),
+//   indexesBuilt (number of shards where that index is already materialized), shards (shards to visit after partition pruning),
+//   totalShards, estimatedRows (upper bound: rows of the visited shards), preFilter (whether a selection restricts the rows),
+//   bloomSkipped (shards whose main storage is skipped because a bloom filter rules out an equality predicate),
+//   access ("indexed" or "full scan"), skippedShards (pruned by partitioning), estimatedOutput (estimatedRows reduced by the
+//   selectivity of the predicates: a fresh histogram of (analyze ...) is preferred, otherwise equality predicates are
+//   estimated with the column statistics that are already computed)
+// TODO: there is no AI estimator (Estimator.ScanEstimate, Python helper) in this tree; estimates only come from
+// the column statistics. If an external estimator is added, it needs a circuit breaker so a slow helper cannot delay every scan.
+func (t *table) explainScan(conditionCols []string, condition scm.Scmer, options scanOptions) scm.Scmer {
+	boundaries := extractBoundaries(conditionCols, condition)
+	options.collateCondition(conditionCols, condition, boundaries)
+	lower, _ := indexFromBoundaries(boundaries)
+
+	predicates := make([]scm.Scmer, len(boundaries))
+	for i, b := range boundaries {
+		lookup := "range"
+		if b.lower != nil && b.lower == b.upper {
+			lookup = "equality"
+		}
+		predicates[i] = []scm.Scmer{"column", b.col, "lookup", lookup, "lower", b.lower, "lowerInclusive", b.lowerInclusive, "upper", b.upper, "upperInclusive", b.upperInclusive, "collation", b.collation}
+	}
+	var index scm.Scmer
+	indexCols := indexColsFromBoundaries(boundaries, lower)
+	indexCollations := indexCollationsFromBoundaries(boundaries, lower)
+	if indexCols != nil {
+		index_ := make([]scm.Scmer, len(indexCols))
+		for i, col := range indexCols {
+			index_[i] = col
+		}
+		index = index_
+	}
+
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	var mu sync.Mutex
+	shards := 0
+	indexesBuilt := 0
+	bloomSkipped := 0
+	var estimatedRows uint
+	var estimatedOutput float64
+	columnHistograms := make([]*histogram, len(boundaries))
+	rows := t.Count()
+	for i, b := range boundaries {
+		// the histogram is in the collation of the column; that is also good enough to estimate predicates in the default order
+		if h := t.freshHistogram(b.col, rows); h != nil && (b.collation == "" || b.collation == h.collation) {
+			columnHistograms[i] = h
+		}
+	}
+	t.iterateShards(boundaries, func (s *storageShard) {
+		count := s.Count()
+		built := len(indexCols) > 0 && s.hasActiveIndex(indexCols, indexCollations)
+		skipped := s.bloomMiss(boundaries)
+		output := float64(count)
+		if skipped {
+			output = float64(len(s.inserts)) // upper bound: only the delta storage is visited
+		}
+		for i, b := range boundaries {
+			if columnHistograms[i] != nil {
+				output *= columnHistograms[i].selectivity(b)
+			} else if b.lower != nil && b.lower == b.upper && b.collation == "" {
+				if distinct, ok := s.cachedDistinct(b.col); ok && distinct > 0 {
+					output /= float64(distinct)
+				}
+			}
+		}
+		mu.Lock()
+		shards++
+		estimatedRows += count
+		estimatedOutput += output
+		if built {
+			indexesBuilt++
+		}
+		if skipped {
+			bloomSkipped++
+		}
+		mu.Unlock()
+	})
+	access := "full scan"
+	if index != nil {
+		access = "indexed"
+	}
+	return []scm.Scmer{
+		"table", t.Name,
+		"predicates", predicates,
+		"index", index,
+		"indexesBuilt", int64(indexesBuilt),
+		"shards", int64(shards),
+		"totalShards", int64(len(shardlist)),
+		"estimatedRows", int64(estimatedRows),
+		"preFilter", options.preFilter != nil,
+		"bloomSkipped", int64(bloomSkipped),
+		"access", access,
+		"skippedShards", int64(len(shardlist) - shards),
+		"estimatedOutput", int64(estimatedOutput + 0.5),
+	}
+}
+
+// number of shards a scan with that condition visits after partition pruning and the total number of shards
+func (t *table) pruneCheck(conditionCols []string, condition scm.Scmer) (int, int) {
+	boundaries := extractBoundaries(conditionCols, condition)
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	var mu sync.Mutex
+	shards := 0
+	t.iterateShards(boundaries, func (s *storageShard) {
+		mu.Lock()
+		shards++
+		mu.Unlock()
+	})
+	return shards, len(shardlist)
+}
+
+// whether iterateIndex would find a materialized index starting with cols
+func (t *storageShard) hasActiveIndex(cols []string, collations []string) bool {
+	for _, index := range t.Indexes {
+		if len(index.Cols) >= len(cols) && index.active {
+			fits := true
+			for i, col := range cols {
+				if index.Cols[i] != col || index.collation(i) != collations[i] {
+					fits = false
+				}
+			}
+			if fits {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sync"
+import "github.com/jtolds/gls"
+import "github.com/launix-de/memcp/scm"
+
+var foreignKeyContext = gls.NewContextManager()
+
+// whether the running statement checks foreign keys; (foreign-key-checks false body) turns them off for body only,
+// so a session that loads a dump (SET FOREIGN_KEY_CHECKS = 0) does not affect the other sessions
+func foreignKeyChecks() bool {
+	if enabled, ok := foreignKeyContext.GetValue("foreignKeyChecks"); ok {
+		return enabled.(bool)
+	}
+	return Settings.ForeignKeyChecks
+}
+
+func WithForeignKeyChecks(enabled bool, body scm.Scmer) (result scm.Scmer) {
+	foreignKeyContext.SetValues(gls.Values{"foreignKeyChecks": enabled}, func () {
+		result = scm.Apply(body)
+	})
+	return
+}
+
+// a row of a shard
+type rowRef struct {
+	s *storageShard
+	idx uint
+}
+
+// row whose foreign key columns are set to NULL because the referenced row is deleted
+type setNullRef struct {
+	row rowRef
+	cols []string
+}
+
+// applies the ON DELETE rules of all foreign keys that reference the row idx of shard s before it is deleted
+// returns false if a RESTRICT key forbids the deletion; in that case, nothing was changed
+func (t *table) deleteReferences(s *storageShard, idx uint) bool {
+	visited := map[rowRef]bool{rowRef{s, idx}: true}
+	var deletes []rowRef
+	var setNulls []setNullRef
+	if !t.planDelete(s, idx, visited, &deletes, &setNulls) {
+		return false
+	}
+	// deletes are ordered children first; they get their own sequence number, so they don't cascade again
+	// (which also skips recordUndo, so a transaction has to be told about them here)
+	for _, r := range deletes {
+		if scm.ToBool(r.s.updateFunction(r.idx, true, r.s.t.nextSequence())()) {
+			r.s.mu.RLock()
+			r.s.recordUndo(r.idx, 0, true)
+			r.s.mu.RUnlock()
+		}
+	}
+	for _, r := range setNulls {
+		if visited[r.row] {
+			continue // the row is deleted anyway
+		}
+		changes := make([]scm.Scmer, 0, 2 * len(r.cols))
+		for _, col := range r.cols {
+			changes = append(changes, col, nil)
+		}
+		r.row.s.UpdateFunction(r.row.idx, true)(changes)
+	}
+	return true
+}
+
+// collects the rows that have to be deleted or set to NULL when row idx of s is deleted (recursively for CASCADE)
+// visited guards against cycles in the foreign key graph
+func (t *table) planDelete(s *storageShard, idx uint, visited map[rowRef]bool, deletes *[]rowRef, setNulls *[]setNullRef) bool {
+	for _, fk := range t.Foreign {
+		if fk.Tbl2 != t.Name {
+			continue // we are the referencing table of that key
+		}
+		child := t.schema.Tables.Get(fk.Tbl1)
+		if child == nil {
+			continue
+		}
+		key := make([]scm.Scmer, len(fk.Cols2))
+		hasNull := false
+		for i, col := range fk.Cols2 {
+			key[i] = s.ColumnReader(col)(idx)
+			if key[i] == nil {
+				hasNull = true
+			}
+		}
+		if hasNull {
+			continue // nothing can reference NULL
+		}
+		for _, r := range child.findReferencing(fk.Cols1, key) {
+			if visited[r] {
+				continue
+			}
+			switch fk.Deletemode {
+				case RESTRICT:
+					return false
+				case CASCADE:
+					visited[r] = true
+					if !child.planDelete(r.s, r.idx, visited, deletes, setNulls) {
+						return false
+					}
+					*deletes = append(*deletes, r)
+				case SETNULL:
+					*setNulls = append(*setNulls, setNullRef{r, fk.Cols1})
+			}
+		}
+	}
+	return true
+}
+
+// all rows whose columns cols have the values key
+func (t *table) findReferencing(cols []string, key []scm.Scmer) (result []rowRef) {
+	params := make([]scm.Scmer, len(cols))
+	conditionBody := make([]scm.Scmer, len(cols) + 1)
+	conditionBody[0] = scm.Symbol("and")
+	for i, c := range cols {
+		params[i] = scm.Symbol(c)
+		conditionBody[i + 1] = []scm.Scmer{scm.Symbol("equal?"), scm.NthLocalVar(i), key[i]}
+	}
+	boundaries := extractBoundaries(cols, scm.Proc {params, conditionBody, &scm.Globalenv, len(cols)})
+	lower, upperLast := indexFromBoundaries(boundaries)
+
+	var mu sync.Mutex
+	t.iterateShards(boundaries, func (s *storageShard) {
+		readers := make([]func(uint) scm.Scmer, len(cols))
+		for i, c := range cols {
+			readers[i] = s.ColumnReader(c)
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		s.iterateIndex(boundaries, lower, upperLast, len(s.inserts), func (idx uint) {
+			if s.deletions.Get(idx) {
+				return
+			}
+			for i, read := range readers {
+				if !scm.Equal(read(idx), key[i]) {
+					return
+				}
+			}
+			mu.Lock()
+			result = append(result, rowRef{s, idx})
+			mu.Unlock()
+		})
+	})
+	return
+}
@@ -0,0 +1,224 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sort"
+import "github.com/launix-de/memcp/scm"
+
+// equi-depth histogram of a column, computed by (analyze ...)
+// TODO: there is no system_statistic schema in this tree, so histograms are only kept in memory until the next restart
+type histogram struct {
+	rows uint // rows of the table when the histogram was computed (to check freshness)
+	nulls uint
+	min, max scm.Scmer
+	distinct uint
+	collation string
+	buckets []histogramBucket
+}
+
+// one bucket covers about the same number of non-NULL rows; lower and upper are the smallest and largest value in the bucket
+type histogramBucket struct {
+	lower, upper scm.Scmer
+	count uint
+	distinct uint
+}
+
+// default number of buckets of analyze
+const histogramBuckets = 100
+
+func (t *table) histogram(col string) *histogram {
+	if h, ok := t.histograms.Load(col); ok {
+		return h.(*histogram)
+	}
+	return nil
+}
+
+// histogram of a column if it was computed and the table did not grow or shrink by more than 10% since
+func (t *table) freshHistogram(col string, rows uint) *histogram {
+	h := t.histogram(col)
+	if h == nil || h.rows == 0 {
+		return nil
+	}
+	diff := int64(rows) - int64(h.rows)
+	if diff < 0 {
+		diff = -diff
+	}
+	if uint(diff) * 10 > h.rows {
+		return nil // stale
+	}
+	return h
+}
+
+// scans a column and computes its histogram with up to numBuckets buckets; strings are ordered by the collation of the column
+func (t *table) Analyze(col string, numBuckets int) *histogram {
+	var c *column
+	for i := range t.Columns {
+		if t.Columns[i].Name == col {
+			c = &t.Columns[i]
+		}
+	}
+	if c == nil {
+		panic("column " + t.Name + "." + col + " does not exist")
+	}
+	if numBuckets < 1 {
+		panic("analyze needs at least one bucket")
+	}
+	h := &histogram{collation: c.Collation}
+	less := collationLess(c.Collation)
+
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	values := make([]scm.Scmer, 0)
+	for _, s := range shardlist {
+		for _, v := range s.columnValues(col) {
+			h.rows++
+			if v == nil {
+				h.nulls++
+			} else {
+				values = append(values, v)
+			}
+		}
+	}
+	sort.Slice(values, func (i, j int) bool {
+		return less(values[i], values[j])
+	})
+	equal := func (a, b scm.Scmer) bool {
+		return !less(a, b) && !less(b, a)
+	}
+	if len(values) > 0 {
+		h.min = values[0]
+		h.max = values[len(values) - 1]
+	}
+	if numBuckets > len(values) {
+		numBuckets = len(values)
+	}
+	for i := 0; i < numBuckets; i++ {
+		part := values[i * len(values) / numBuckets : (i + 1) * len(values) / numBuckets]
+		b := histogramBucket{lower: part[0], upper: part[len(part) - 1], count: uint(len(part)), distinct: 1}
+		for j := 1; j < len(part); j++ {
+			if !equal(part[j-1], part[j]) {
+				b.distinct++
+			}
+		}
+		h.buckets = append(h.buckets, b)
+	}
+	for i := range values {
+		if i == 0 || !equal(values[i-1], values[i]) {
+			h.distinct++
+		}
+	}
+
+	t.histograms.Store(col, h)
+	return h
+}
+
+// non-deleted values of a column of this shard
+func (t *storageShard) columnValues(col string) []scm.Scmer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make([]scm.Scmer, 0, t.Count())
+	cstorage := t.columns[col]
+	for idx := uint(0); idx < t.main_count; idx++ {
+		if !t.deletions.Get(idx) {
+			result = append(result, cstorage.GetValue(idx))
+		}
+	}
+	for idx := 0; idx < len(t.inserts); idx++ {
+		if !t.deletions.Get(t.main_count + uint(idx)) {
+			result = append(result, t.getDelta(idx, col))
+		}
+	}
+	return result
+}
+
+func (h *histogram) toScmer(col string) scm.Scmer {
+	buckets := make([]scm.Scmer, len(h.buckets))
+	for i, b := range h.buckets {
+		buckets[i] = []scm.Scmer{"lower", b.lower, "upper", b.upper, "count", int64(b.count), "distinct", int64(b.distinct)}
+	}
+	return []scm.Scmer{"column", col, "rows", int64(h.rows), "nulls", int64(h.nulls), "min", h.min, "max", h.max, "distinct", int64(h.distinct), "buckets", buckets}
+}
+
+// fraction of the rows that fulfill a boundary according to the histogram
+func (h *histogram) selectivity(b columnboundaries) float64 {
+	less := collationLess(h.collation)
+	rows := 0.0
+	for _, bucket := range h.buckets {
+		if b.lower != nil && b.lower == b.upper {
+			// equality: a bucket that only holds this value counts fully, otherwise assume uniform distribution over its distinct values
+			if less(b.lower, bucket.lower) || less(bucket.upper, b.lower) {
+				continue
+			}
+			if !less(bucket.lower, bucket.upper) {
+				rows += float64(bucket.count)
+			} else {
+				rows += float64(bucket.count) / float64(bucket.distinct)
+			}
+			continue
+		}
+		// range: skip buckets outside, count buckets inside and estimate the partially covered ones
+		if b.lower != nil && (less(bucket.upper, b.lower) || !b.lowerInclusive && !less(b.lower, bucket.upper)) {
+			continue
+		}
+		if b.upper != nil && (less(b.upper, bucket.lower) || !b.upperInclusive && !less(bucket.lower, b.upper)) {
+			continue
+		}
+		lowerInside := b.lower == nil || less(b.lower, bucket.lower) || b.lowerInclusive && !less(bucket.lower, b.lower)
+		upperInside := b.upper == nil || less(bucket.upper, b.upper) || b.upperInclusive && !less(b.upper, bucket.upper)
+		if lowerInside && upperInside {
+			rows += float64(bucket.count)
+		} else {
+			rows += float64(bucket.count) * bucket.overlap(b)
+		}
+	}
+	if h.rows == 0 {
+		return 0
+	}
+	return rows / float64(h.rows)
+}
+
+// fraction of a partially covered bucket: interpolated for numbers, half of the bucket otherwise
+func (bucket histogramBucket) overlap(b columnboundaries) float64 {
+	lower, ok1 := histogramNumber(bucket.lower)
+	upper, ok2 := histogramNumber(bucket.upper)
+	if !ok1 || !ok2 || upper <= lower {
+		return 0.5
+	}
+	from, to := lower, upper
+	if v, ok := histogramNumber(b.lower); ok && v > from {
+		from = v
+	}
+	if v, ok := histogramNumber(b.upper); ok && v < to {
+		to = v
+	}
+	if to <= from {
+		return 1 / float64(bucket.distinct) // only a single value of the bucket is covered
+	}
+	return (to - from) / (upper - lower)
+}
+
+func histogramNumber(v scm.Scmer) (float64, bool) {
+	switch x := v.(type) {
+		case int64:
+			return float64(x), true
+		case float64:
+			return x, true
+	}
+	return 0, false
+}
@@ -17,10 +17,13 @@ Copyright (C) 2023  Carl-Philip Hänsch
 
 package storage
 
+import "io"
 import "fmt"
 import "sort"
 import "sync"
 import "reflect"
+import "encoding/json"
+import "encoding/binary"
 import "github.com/google/btree"
 import "github.com/launix-de/memcp/scm"
 
@@ -29,13 +32,18 @@ type indexPair struct {
 	data []scm.Scmer
 }
 
+// building an index costs 1x the time as traversing the list
+const indexSavingsThreshold = 2.0
+
 type StorageIndex struct {
 	Cols []string // sort equal-cols alphabetically, so similar conditions are canonical
+	Collations []string // collation of each column ("" or nil: default order)
 	Savings float64 // store the amount of time savings here -> add selectivity (outputted / size) on each
 	mainIndexes StorageInt // we can do binary searches here
 	deltaBtree *btree.BTreeG[indexPair]
 	t *storageShard
 	active bool
+	dirty bool // built since the index file of the shard was written
 	mu sync.Mutex
 }
 
@@ -107,7 +115,7 @@ func (t *storageShard) iterateIndex(cols boundaries, lower []scm.Scmer, upperLas
 			// naive index search algo; TODO: improve
 			if len(index.Cols) >= len(lower) {
 				for i := 0; i < len(lower); i++ {
-					if cols[i].col != index.Cols[i] {
+					if cols[i].col != index.Cols[i] || cols[i].collation != index.collation(i) {
 						goto skip_index // this index does not fit
 					}
 				}
@@ -125,10 +133,8 @@ func (t *storageShard) iterateIndex(cols boundaries, lower []scm.Scmer, upperLas
 			goto retry_indexscan // someone has added a index in the meantime: recheck
 		}
 		index := new(StorageIndex)
-		index.Cols = make([]string, len(lower))
-		for i := range lower {
-			index.Cols[i] = cols[i].col
-		}
+		index.Cols = indexColsFromBoundaries(cols, lower)
+		index.Collations = indexCollationsFromBoundaries(cols, lower)
 		index.Savings = 0.0 // count how many cost we wasted so we decide when to build the index
 		index.active = false // tell the engine that index has to be built first
 		index.t = t
@@ -148,8 +154,18 @@ func (t *storageShard) iterateIndex(cols boundaries, lower []scm.Scmer, upperLas
 }
 
 func rebuildIndexes(t1 *storageShard, t2 *storageShard) {
-	// TODO rebuild index in database rebuild
-	// check if indexes share same prefix -> leave out the shorter one
+	// indexes that were materialized in the old shard have paid off; the new shard builds them on their first use
+	// (and persists them with the next index write), so a rebuild does not sort indexes that are no longer queried
+	t1.indexMutex.Lock()
+	old_indexes := t1.Indexes
+	t1.indexMutex.Unlock()
+	for _, old := range old_indexes {
+		if old.active {
+			t2.addIndex(old.Cols, old.Collations)
+		}
+	}
+	t2.addForeignKeyIndexes() // they are not subject to savings
+	// TODO: check if indexes share same prefix -> leave out the shorter one
 	// savings = 0.9 * savings (decrease)
 	// according to memory pressure -> threshold for discard savings
 	// -> mark inactive if we can don't want to store this index
@@ -157,20 +173,217 @@ func rebuildIndexes(t1 *storageShard, t2 *storageShard) {
 	// (also consider incremental indexes??)
 }
 
-// iterate over index
-func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsertIndex int, callback func(uint)) {
+// the child columns of foreign keys are indexed in advance so constraint checks and cascades don't need a full scan
+func (t *storageShard) addForeignKeyIndexes() {
+	for _, cols := range t.t.foreignKeyIndexCols() {
+		t.addIndex(cols, nil)
+	}
+}
 
-	// find columns in storage
+func (t *table) addForeignKeyIndexes() {
+	shards := t.Shards
+	if shards == nil {
+		shards = t.PShards
+	}
+	for _, s := range shards {
+		if s != nil {
+			s.addForeignKeyIndexes()
+		}
+	}
+}
+
+// index columns of foreign keys where t is the referencing table
+func (t *table) foreignKeyIndexCols() (result [][]string) {
+	for _, fk := range t.Foreign {
+		if fk.Tbl1 == t.Name {
+			// equality lookups: iterateIndex expects the columns alphabetically
+			cols := make([]string, len(fk.Cols1))
+			copy(cols, fk.Cols1)
+			sort.Strings(cols)
+			result = append(result, cols)
+		}
+	}
+	return
+}
+
+// adds an index that is built on its first use; if iterateIndex already has an index with that prefix, that one is built on its next use
+func (t *storageShard) addIndex(cols []string, collations []string) {
+	t.indexMutex.Lock()
+	defer t.indexMutex.Unlock()
+	for _, index := range t.Indexes {
+		if len(index.Cols) >= len(cols) && reflect.DeepEqual(index.Cols[:len(cols)], cols) && index.hasCollations(collations, len(cols)) {
+			if index.Savings < indexSavingsThreshold {
+				index.Savings = indexSavingsThreshold
+			}
+			return // already covered
+		}
+	}
+	index := new(StorageIndex)
+	index.Cols = cols
+	index.Collations = collations
+	index.Savings = indexSavingsThreshold // skip the savings phase
+	index.active = false
+	index.t = t
+	t.Indexes = append(t.Indexes, index)
+}
+
+// columns of the index that iterateIndex uses for these boundaries (nil if the scan has no index)
+func indexColsFromBoundaries(cols boundaries, lower []scm.Scmer) []string {
+	if len(lower) == 0 {
+		return nil
+	}
+	result := make([]string, len(lower))
+	for i := range lower {
+		result[i] = cols[i].col
+	}
+	return result
+}
+
+// collations of the index columns (nil if all columns use the default order)
+func indexCollationsFromBoundaries(cols boundaries, lower []scm.Scmer) []string {
+	var result []string
+	for i := range lower {
+		if cols[i].collation != "" {
+			if result == nil {
+				result = make([]string, len(lower))
+			}
+			result[i] = cols[i].collation
+		}
+	}
+	return result
+}
+
+func (s *StorageIndex) collation(i int) string {
+	if i < len(s.Collations) {
+		return s.Collations[i]
+	}
+	return ""
+}
+
+// whether the first n columns of the index are sorted in these collations (nil: default order)
+func (s *StorageIndex) hasCollations(collations []string, n int) bool {
+	for i := 0; i < n; i++ {
+		c := ""
+		if collations != nil {
+			c = collations[i]
+		}
+		if s.collation(i) != c {
+			return false
+		}
+	}
+	return true
+}
+
+// indexOnly scans: all columns the scan reads must be part of the index
+// (StorageIndex only keeps record ids in key order, so the values are still read from the column storages, but no other column is touched)
+func checkIndexCovers(indexCols []string, conditionCols []string, callbackCols []string) {
+	if indexCols == nil {
+		panic("indexOnly: the condition cannot be answered by an index")
+	}
+	covered := make(map[string]bool)
+	for _, c := range indexCols {
+		covered[c] = true
+	}
+	for _, c := range conditionCols {
+		if !covered[c] {
+			panic("indexOnly: index over " + fmt.Sprint(indexCols) + " does not cover column " + c)
+		}
+	}
+	for _, c := range callbackCols {
+		if c == "$update" || (len(c) >= 4 && c[:4] == "NEW.") {
+			continue // these do not read a column
+		}
+		if !covered[c] {
+			panic("indexOnly: index over " + fmt.Sprint(indexCols) + " does not cover column " + c)
+		}
+	}
+}
+
+// sorts the main storage into mainIndexes and fills the delta btree; the caller holds s.mu
+func (s *StorageIndex) build(cols []ColumnStorage, less []func(a, b scm.Scmer) bool) {
+	// main storage
+	tmp := make([]uint, s.t.main_count)
+	for i := uint(0); i < s.t.main_count; i++ {
+		tmp[i] = i // fill with natural order
+	}
+	// sort indexes
+	sort.Slice(tmp, func (i, j int) bool {
+		for k, c := range cols {
+			a := c.GetValue(tmp[i])
+			b := c.GetValue(tmp[j])
+			if less[k](a, b) {
+				return true // less
+			} else if less[k](b, a) {
+				return false // greater
+			}
+			// otherwise: next iteration
+		}
+		return false // fully equal
+	})
+	// store sorted values into compressed format
+	s.mainIndexes.prepare()
+	for i, v := range tmp {
+		s.mainIndexes.scan(uint(i), v)
+	}
+	s.mainIndexes.init(uint(len(tmp)))
+	for i, v := range tmp {
+		s.mainIndexes.build(uint(i), v)
+	}
+	s.mainIndexes.finish()
+	s.buildDelta(less)
+	s.dirty = true // not persisted yet
+}
+
+func (s *StorageIndex) buildDelta(less []func(a, b scm.Scmer) bool) {
+	s.deltaBtree = btree.NewG[indexPair](8, func (i, j indexPair) bool {
+		for k, col := range s.Cols {
+			colpos, ok := s.t.deltaColumns[col]
+			if !ok {
+				continue // non-existing column -> don't compare
+			}
+			var a, b scm.Scmer
+			if colpos < len(i.data) {
+				a = i.data[colpos]
+			}
+			if colpos < len(j.data) {
+				b = j.data[colpos]
+			}
+			if less[k](a, b) {
+				return true // less
+			} else if less[k](b, a) {
+				return false // greater
+			}
+			// otherwise: next iteration
+		}
+		return false // fully equal
+	})
+	// fill deltaBtree (no locking required; we are already in a readlock)
+	for i, data := range s.t.inserts {
+		s.deltaBtree.ReplaceOrInsert(indexPair{i, data})
+	}
+}
+
+// column storages and orders of the index columns
+func (s *StorageIndex) comparators() ([]ColumnStorage, []func(a, b scm.Scmer) bool) {
 	cols := make([]ColumnStorage, len(s.Cols))
+	less := make([]func(a, b scm.Scmer) bool, len(s.Cols))
 	for i, c := range s.Cols {
 		cols[i] = s.t.columns[c]
+		less[i] = collationLess(s.collation(i))
 	}
+	return cols, less
+}
+
+// iterate over index
+func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsertIndex int, callback func(uint)) {
+
+	// find columns in storage
+	cols, less := s.comparators()
 
-	savings_threshold := 2.0 // building an index costs 1x the time as traversing the list
 	s.Savings = s.Savings + 1.0 // mark that we could save time
 	if !s.active {
 		// index is not built yet
-		if s.Savings < savings_threshold {
+		if s.Savings < indexSavingsThreshold {
 			// iterate over all items because we don't want to store the index
 			for i := uint(0); i < s.t.main_count; i++ {
 				callback(i)
@@ -188,65 +401,7 @@ func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsert
 				goto start_scan
 			}
 			fmt.Println("building index on", s.t.t.Name, "over", s.Cols)
-
-			// main storage
-			tmp := make([]uint, s.t.main_count)
-			for i := uint(0); i < s.t.main_count; i++ {
-				tmp[i] = i // fill with natural order
-			}
-			// sort indexes
-			sort.Slice(tmp, func (i, j int) bool {
-				for _, c := range cols {
-					a := c.GetValue(tmp[i])
-					b := c.GetValue(tmp[j])
-					if scm.Less(a, b) {
-						return true // less
-					} else if !reflect.DeepEqual(a, b) {
-						return false // greater
-					}
-					// otherwise: next iteration
-				}
-				return false // fully equal
-			})
-			// store sorted values into compressed format
-			s.mainIndexes.prepare()
-			for i, v := range tmp {
-				s.mainIndexes.scan(uint(i), v)
-			}
-			s.mainIndexes.init(uint(len(tmp)))
-			for i, v := range tmp {
-				s.mainIndexes.build(uint(i), v)
-			}
-			s.mainIndexes.finish()
-
-			// delta storage
-			s.deltaBtree = btree.NewG[indexPair](8, func (i, j indexPair) bool {
-				for _, col := range s.Cols {
-					colpos, ok := s.t.deltaColumns[col]
-					if !ok {
-						continue // non-existing column -> don't compare
-					}
-					var a, b scm.Scmer
-					if colpos < len(i.data) {
-						a = i.data[colpos]
-					}
-					if colpos < len(j.data) {
-						b = j.data[colpos]
-					}
-					if scm.Less(a, b) {
-						return true // less
-					} else if !reflect.DeepEqual(a, b) {
-						return false // greater
-					}
-					// otherwise: next iteration
-				}
-				return false // fully equal
-			})
-			// fill deltaBtree (no locking required; we are already in a readlock)
-			for i, data := range s.t.inserts {
-				s.deltaBtree.ReplaceOrInsert(indexPair{i, data})
-			}
-
+			s.build(cols, less)
 			s.active = true // mark as ready
 			s.mu.Unlock()
 		}
@@ -260,9 +415,9 @@ func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsert
 			a := lower[i]
 			b := c.GetValue(uint(idx2))
 			 // TODO: respect !lowerEqual
-			if scm.Less(a, b) {
+			if less[i](a, b) {
 				return true // less
-			} else if scm.Less(b, a) {
+			} else if less[i](b, a) {
 				return false // greater
 			}
 			// otherwise: next iteration
@@ -281,10 +436,10 @@ func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsert
 		for i, c := range cols {
 			a := c.GetValue(uint(idx2))
 			if i == len(cols) - 1 {
-				if upperLast != nil && scm.Less(upperLast, a) { // TODO: respect !upperEqual
+				if upperLast != nil && less[i](upperLast, a) { // TODO: respect !upperEqual
 					break iteration // stop traversing when we exceed the < part of last col
 				}
-			} else if !scm.Equal(a, lower[i]) {
+			} else if less[i](a, lower[i]) || less[i](lower[i], a) {
 				break iteration // stop traversing when we exceed the equal-part
 			}
 			// otherwise: next col
@@ -325,3 +480,86 @@ func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsert
 		}
 	}
 }
+
+// the materialized indexes of a shard are stored in one file next to its columns
+const indexFileName = ".indexes"
+
+type indexFileHeader struct {
+	Cols []string `json:"cols"`
+	Collations []string `json:"collations,omitempty"`
+	Savings float64 `json:"savings"`
+}
+
+// writes all materialized indexes of the shard (sorted record ids of the main storage; the delta btree is rebuilt on load)
+func (t *storageShard) saveIndexes() {
+	if t.t.PersistencyMode == Memory {
+		return
+	}
+	t.indexMutex.Lock()
+	indexes := t.Indexes
+	t.indexMutex.Unlock()
+	f := t.t.schema.persistence.WriteColumn(t.uuid.String(), indexFileName)
+	for _, index := range indexes {
+		index.mu.Lock()
+		if index.active {
+			header, _ := json.Marshal(indexFileHeader{index.Cols, index.Collations, index.Savings})
+			binary.Write(f, binary.LittleEndian, uint8(1)) // 1 = another index follows
+			binary.Write(f, binary.LittleEndian, uint32(len(header)))
+			f.Write(header)
+			index.mainIndexes.Serialize(f)
+			index.dirty = false
+		}
+		index.mu.Unlock()
+	}
+	binary.Write(f, binary.LittleEndian, uint8(0)) // end of file
+	f.Close()
+}
+
+// whether an index was built since the index file was written
+func (t *storageShard) hasDirtyIndexes() bool {
+	t.indexMutex.Lock()
+	defer t.indexMutex.Unlock()
+	for _, index := range t.Indexes {
+		index.mu.Lock()
+		dirty := index.dirty
+		index.mu.Unlock()
+		if dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// reads the indexes written by saveIndexes; call after the columns and the log are loaded
+func (t *storageShard) loadIndexes() {
+	f := t.t.schema.persistence.ReadColumn(t.uuid.String(), indexFileName)
+	defer f.Close()
+	for {
+		var marker uint8
+		if err := binary.Read(f, binary.LittleEndian, &marker); err != nil || marker != 1 {
+			return // no index file or end of file
+		}
+		var l uint32
+		binary.Read(f, binary.LittleEndian, &l)
+		header := make([]byte, l)
+		if _, err := io.ReadFull(f, header); err != nil {
+			panic("index file of shard " + t.uuid.String() + " is damaged: " + err.Error())
+		}
+		var h indexFileHeader
+		json.Unmarshal(header, &h)
+		index := new(StorageIndex)
+		index.Cols = h.Cols
+		index.Collations = h.Collations
+		index.Savings = h.Savings
+		index.t = t
+		if index.mainIndexes.DeserializeEx(f, true) != t.main_count {
+			fmt.Println("Warning: index over", h.Cols, "of shard", t.uuid.String(), "does not match the main storage and is rebuilt on demand")
+			continue
+		}
+		fmt.Println("loading index on", t.t.Name, "over", h.Cols)
+		_, less := index.comparators()
+		index.buildDelta(less)
+		index.active = true
+		t.Indexes = append(t.Indexes, index)
+	}
+}
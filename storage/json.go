@@ -28,14 +28,58 @@ JSON storage on disk for persistence:
 
 */
 
+import "io"
 import "os"
+import "sync"
 import "bufio"
+import "runtime"
+import "strings"
 import "encoding/json"
 import "github.com/launix-de/memcp/scm"
 
 func LoadJSON(schema, filename string) {
 	f, _ := os.Open(filename)
 	defer f.Close()
+	loadJSONStream(schema, f)
+}
+
+// loads several streams concurrently (at most GOMAXPROCS at once) and returns the number of inserted rows;
+// each stream has its own #table directive, concurrent inserts into the same table are synchronized by the shards
+func LoadJSONParallel(schema string, streams []io.Reader) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var err interface{}
+	result := 0
+	slots := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for _, stream := range streams {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func (stream io.Reader) {
+			defer wg.Done()
+			defer func () {
+				<- slots
+				if r := recover(); r != nil {
+					mu.Lock()
+					err = r
+					mu.Unlock()
+				}
+			}()
+			rows := loadJSONStream(schema, stream)
+			mu.Lock()
+			result += rows
+			mu.Unlock()
+		}(stream)
+	}
+	wg.Wait()
+	if err != nil {
+		panic(err) // cascade the panic of a stream
+	}
+	return result
+}
+
+// returns the number of inserted rows
+func loadJSONStream(schema string, f io.Reader) int {
+	result := 0
 	scanner := bufio.NewScanner(f)
 	scanner.Split(bufio.ScanLines)
 
@@ -52,7 +96,7 @@ func LoadJSON(schema, filename string) {
 	for s := range(lines) {
 		if s == "" {
 			// ignore
-		} else if s[0:7] == "#table " {
+		} else if strings.HasPrefix(s, "#table ") {
 			// new table (or find the existing one)
 			t, _ = CreateTable(schema, s[7:], Safe, true)
 		} else if s[0] == '#' {
@@ -81,10 +125,11 @@ func LoadJSON(schema, filename string) {
 						x[i] = v
 						i++
 					}
-					t.Insert(cols, [][]scm.Scmer{x}, nil, nil, false) // put into table
+					result += t.Insert(cols, [][]scm.Scmer{x}, nil, nil, false, nil) // put into table
 				}(t, s)
 			}
 		}
 	}
+	return result
 }
 
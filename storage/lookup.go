@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sync"
+import "math"
+import "strconv"
+import "strings"
+import "github.com/launix-de/memcp/scm"
+
+// canonical hashmap key for a tuple of values (int and integral float are the same key)
+func lookupKey(values []scm.Scmer) string {
+	var b strings.Builder
+	for _, v := range values {
+		switch v_ := v.(type) {
+			case nil:
+				b.WriteByte('n')
+			case bool:
+				if v_ {
+					b.WriteByte('t')
+				} else {
+					b.WriteByte('f')
+				}
+			case int64:
+				b.WriteByte('i')
+				b.WriteString(strconv.FormatInt(v_, 10))
+			case float64:
+				if v_ == math.Trunc(v_) && math.Abs(v_) < 1 << 62 {
+					b.WriteByte('i')
+					b.WriteString(strconv.FormatInt(int64(v_), 10))
+				} else {
+					b.WriteByte('d')
+					b.WriteString(strconv.FormatFloat(v_, 'g', -1, 64))
+				}
+			case scm.LazyString:
+				str := v_.GetValue()
+				b.WriteByte('s')
+				b.WriteString(strconv.Itoa(len(str)))
+				b.WriteByte(':')
+				b.WriteString(str)
+			default:
+				str := scm.String(v)
+				b.WriteByte('s')
+				b.WriteString(strconv.Itoa(len(str)))
+				b.WriteByte(':')
+				b.WriteString(str)
+		}
+	}
+	return b.String()
+}
+
+// builds a hashmap keyCols -> valueCol over the table and returns a lookup function
+// the hashmap is a read-only snapshot, so the lookup can be called from parallel shard workers without locking
+func (t *table) BindLookup(keyCols []string, valueCol string) func(...scm.Scmer) scm.Scmer {
+	result := make(map[string]scm.Scmer)
+	var mu sync.Mutex
+	callbackCols := append(append([]string{}, keyCols...), valueCol)
+	alwaysTrue := scm.Proc{[]scm.Scmer{}, true, &scm.Globalenv, 0}
+	t.scan(nil, alwaysTrue, callbackCols, func (a ...scm.Scmer) scm.Scmer {
+		key := lookupKey(a[:len(keyCols)])
+		mu.Lock()
+		result[key] = a[len(keyCols)]
+		mu.Unlock()
+		return nil
+	}, nil, nil, nil, false, scanOptions{})
+
+	return func (a ...scm.Scmer) scm.Scmer {
+		if len(a) != len(keyCols) {
+			panic("lookup on " + t.Name + " expects " + strconv.Itoa(len(keyCols)) + " key values")
+		}
+		return result[lookupKey(a)] // NULL if not found
+	}
+}
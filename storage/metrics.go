@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "sort"
+import "runtime"
+import "strings"
+import "sync/atomic"
+
+// counters of the scan path; shards add their visited rows once per scan to keep the atomics off the row loop
+var scanStats struct {
+	scans atomic.Uint64
+	rows atomic.Uint64
+}
+
+type metricsWriter struct {
+	b strings.Builder
+}
+
+func (w *metricsWriter) header(name string, typ string, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labels are alternating name/value pairs
+func (w *metricsWriter) sample(name string, value any, labels ...string) {
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		w.b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			w.b.WriteString(labels[i] + "=\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(labels[i+1]) + "\"")
+		}
+		w.b.WriteByte('}')
+	}
+	fmt.Fprintf(&w.b, " %v\n", value)
+}
+
+// Prometheus text exposition format (version 0.0.4) of the storage and runtime counters
+func Metrics() string {
+	var w metricsWriter
+	dbs := databases.GetAll()
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].Name < dbs[j].Name
+	})
+	type tableEntry struct {
+		db string
+		t *table
+	}
+	var tables []tableEntry
+	w.header("memcp_tables", "gauge", "Number of tables per database.")
+	for _, db := range dbs {
+		dbTables := db.Tables.GetAll()
+		sort.Slice(dbTables, func(i, j int) bool {
+			return dbTables[i].Name < dbTables[j].Name
+		})
+		w.sample("memcp_tables", len(dbTables), "database", db.Name)
+		for _, t := range dbTables {
+			tables = append(tables, tableEntry{db.Name, t})
+		}
+	}
+	// all samples of a metric have to be grouped under its header
+	w.header("memcp_table_rows", "gauge", "Number of rows per table.")
+	for _, e := range tables {
+		w.sample("memcp_table_rows", e.t.Count(), "database", e.db, "table", e.t.Name)
+	}
+	w.header("memcp_table_shards", "gauge", "Number of shards per table.")
+	for _, e := range tables {
+		shards := e.t.Shards
+		if shards == nil {
+			shards = e.t.PShards
+		}
+		w.sample("memcp_table_shards", len(shards), "database", e.db, "table", e.t.Name)
+	}
+	w.header("memcp_table_size_bytes", "gauge", "Estimated main memory usage per table.")
+	for _, e := range tables {
+		w.sample("memcp_table_size_bytes", e.t.Size(), "database", e.db, "table", e.t.Name)
+	}
+
+	w.header("memcp_scans_total", "counter", "Number of table scans since startup.")
+	w.sample("memcp_scans_total", scanStats.scans.Load())
+	w.header("memcp_scanned_rows_total", "counter", "Number of rows visited by scans since startup.")
+	w.sample("memcp_scanned_rows_total", scanStats.rows.Load())
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	w.header("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	w.sample("go_goroutines", runtime.NumGoroutine())
+	w.header("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	w.sample("go_memstats_alloc_bytes", m.Alloc)
+	w.header("go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.")
+	w.sample("go_memstats_alloc_bytes_total", m.TotalAlloc)
+	w.header("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	w.sample("go_memstats_sys_bytes", m.Sys)
+	w.header("go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	w.sample("go_memstats_heap_objects", m.HeapObjects)
+	w.header("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	w.sample("go_gc_cycles_total", m.NumGC)
+	return w.b.String()
+}
@@ -21,6 +21,7 @@ import "sort"
 import "sync"
 import "time"
 import "runtime"
+import "sync/atomic"
 import "github.com/jtolds/gls"
 import "github.com/launix-de/memcp/scm"
 
@@ -49,7 +50,58 @@ func computeShardIndex(schema []shardDimension, values []scm.Scmer) (result int)
 	return // schema[0] has the higest stride; schema[len(schema)-1] is the least significant bit
 }
 
-func (t *table) iterateShards(boundaries []columnboundaries, callback_old func(*storageShard)) {
+// shard workers running at the moment; bounded by Settings.MaxScanParallelism
+var shardWorkers struct {
+	mu sync.Mutex
+	cond *sync.Cond
+	running int
+}
+// marks goroutines that already hold a worker slot, so nested scans run without waiting for a slot (they would deadlock otherwise)
+var shardWorkerContext = gls.NewContextManager()
+
+func init() {
+	shardWorkers.cond = sync.NewCond(&shardWorkers.mu)
+}
+
+func maxScanParallelism() int {
+	if Settings.MaxScanParallelism > 0 {
+		return int(Settings.MaxScanParallelism)
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// runs callback(s) inside a worker slot; a nested scan inherits the slot of its outer shard
+func runShardWorker(callback func(*storageShard), s *storageShard) {
+	if _, nested := shardWorkerContext.GetValue("worker"); nested {
+		callback(s)
+		return
+	}
+	shardWorkers.mu.Lock()
+	for shardWorkers.running >= maxScanParallelism() {
+		shardWorkers.cond.Wait()
+	}
+	shardWorkers.running++
+	shardWorkers.mu.Unlock()
+	defer func() {
+		shardWorkers.mu.Lock()
+		shardWorkers.running--
+		shardWorkers.mu.Unlock()
+		shardWorkers.cond.Signal()
+	}()
+	shardWorkerContext.SetValues(gls.Values{"worker": true}, func() {
+		callback(s)
+	})
+}
+
+func (t *table) iterateShards(boundaries []columnboundaries, callback_inner func(*storageShard)) {
+	t.iterateShardLists(t.Shards, t.PShards, t.PDimensions, boundaries, callback_inner)
+}
+
+// like iterateShards, but over given shard lists (e.g. the ones of a snapshot)
+func (t *table) iterateShardLists(shards []*storageShard, pshards []*storageShard, pdimensions []shardDimension, boundaries []columnboundaries, callback_inner func(*storageShard)) {
+	callback_old := func(s *storageShard) {
+		runShardWorker(callback_inner, s)
+	}
 	callback := callback_old
 	if scm.Trace != nil {
 		// hook on tracing
@@ -59,7 +111,9 @@ func (t *table) iterateShards(boundaries []columnboundaries, callback_old func(*
 			})
 		}
 	}
-	shards := t.Shards
+	// TODO: shard-affinity scheduling (batch concurrent scans that touch the same shard so it is loaded only once)
+	// only pays off once shards can be loaded lazily and evicted; at the moment, load() reads all columns at startup
+	// and keeps them resident, so every scan already finds its shards hot and there is no cold load to save
 	var done sync.WaitGroup
 	if shards != nil {
 		done.Add(len(shards))
@@ -77,7 +131,14 @@ func (t *table) iterateShards(boundaries []columnboundaries, callback_old func(*
 			}(s))
 		}
 	} else {
-		iterateShardIndex(t.PDimensions, boundaries, t.PShards, callback, &done, false)
+		// partitions are split in the default order, so collated bounds cannot prune
+		pruning := boundaries[:0:0]
+		for _, b := range boundaries {
+			if b.collation == "" {
+				pruning = append(pruning, b)
+			}
+		}
+		iterateShardIndex(pdimensions, pruning, pshards, callback, &done, false)
 	}
 	done.Wait()
 }
@@ -305,8 +366,9 @@ func (t *table) proposerepartition(maincount uint) (shardCandidates []shardDimen
 				totalShards2 *= t.PDimensions[i].NumPartitions
 			}
 		}
-		// deviation of >50% of shardsize
-		if 2 * totalShards1 > 3 * totalShards2 || 2 * totalShards2 > 3 * totalShards1 {
+		// deviation of more than RepartitionThreshold percent of shardsize
+		threshold := 100 + int(Settings.RepartitionThreshold)
+		if 100 * totalShards1 > threshold * totalShards2 || 100 * totalShards2 > threshold * totalShards1 {
 			shouldChange = true
 		}
 	}
@@ -342,17 +404,23 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 			datasetids[idx][si] = items
 		}
 	}
+	snapshotSequence := atomic.LoadUint64(&t.LogSequence) // later inserts are recorded by the new shards, too
 	// put values into shards
 	fmt.Println("moving data from", t.Name, len(oldshards), "into", totalShards,"shards")
 	newshards := make([]*storageShard, totalShards)
 	var done sync.WaitGroup
 	done.Add(totalShards)
-	progress := make(chan int, runtime.NumCPU() / 2) // don't go all at once, we don't have enough RAM
-	for i := 0; i < runtime.NumCPU() / 2; i++ {
+	workers := runtime.NumCPU() / 2 // don't go all at once, we don't have enough RAM
+	if workers < 1 {
+		workers = 1 // single core machines
+	}
+	progress := make(chan int, workers)
+	for i := 0; i < workers; i++ {
 		go func() { // threadpool with half of the cores
 			for si := range progress {
 				// create a new shard and put all data in
 				s := NewShard(t)
+				s.baseSequence = snapshotSequence
 				// directly build main storage from list, no delta
 				for _, items := range datasetids[si] {
 					s.main_count += uint(len(items))
@@ -371,13 +439,21 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 					}
 
 					// compress into a new column
-					var newcol ColumnStorage = new(StorageSCMER)
+					newcol, hint := t.initialStorage(col.Name)
+					forced := false
 					for {
 						newcol.prepare()
 						for i, v := range values {
 							newcol.scan(uint(i), v)
 						}
+						if forced {
+							break // the hinted storage is kept as it is
+						}
 						newcol2 := newcol.proposeCompression(i)
+						if hint != "" {
+							newcol2, forced = hintedStorage(hint, newcol, newcol2)
+							hint = ""
+						}
 						if newcol2 == nil {
 							break // we found the optimal storage format
 						} else {
@@ -395,7 +471,7 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 
 					// write to disc (only if required)
 					if s.t.PersistencyMode != Memory {
-						f := s.t.schema.persistence.WriteColumn(s.uuid.String(), col.Name)
+						f := s.t.writeColumn(s.uuid.String(), col.Name)
 						newcol.Serialize(f) // col takes ownership of f, so they will defer f.Close() at the right time
 						f.Close()
 					}
@@ -404,7 +480,7 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 
 				if s.t.PersistencyMode == Safe || s.t.PersistencyMode == Logged {
 					// open a logfile
-					s.logfile = s.t.schema.persistence.OpenLog(s.uuid.String())
+					s.logfile = groupCommit(s.t.schema.persistence.OpenLog(s.uuid.String()))
 				}
 				done.Done()
 			}
@@ -415,19 +491,52 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 		fmt.Println("rebuild", t.Name, si+1, "/", len(newshards))
 	}
 	done.Wait()
+	close(progress)
 
+	// inserts that were blocked by the read locks write into the old shards and the new partitions from now on (dual write)
+	t.repartitionInserts = 0
+	t.repartitionDimensions = shardCandidates
+	t.repartitionShards = newshards
 	for _, s := range oldshards {
-		// TODO: set next such that Inserts will be redirected
+		s.dualWrite = true // read by inserts inside the shard's write lock, so no insert is lost or written twice
 		s.mu.RUnlock()
 	}
 
+	// wait for the running inserts; new inserts will choose the new shard list
+	t.insertMu.Lock()
+	defer t.insertMu.Unlock()
+	for _, s := range oldshards {
+		s.mu.Lock()
+		s.dualWrite = false
+		s.mu.Unlock()
+	}
+	t.repartitionShards = nil
+	t.repartitionDimensions = nil
+
+	// only inserts are written twice; updates and deletions on the old shards would get lost
+	if atomic.LoadUint64(&t.LogSequence) - snapshotSequence != atomic.LoadUint64(&t.repartitionInserts) {
+		fmt.Println("error: aborted partitioning schema for ", t.Name, "after", time.Since(start), " because rows were changed during repartitioning")
+		for _, s := range newshards {
+			s.RemoveFromDisk()
+		}
+		return
+	}
+
 	// verify transformation result
+	total_count = 0
+	for _, s := range oldshards {
+		total_count += uint64(s.Count())
+	}
 	total_count2 := uint64(0)
 	for _, s := range newshards {
 		total_count2 += uint64(s.Count())
 	}
 	if total_count != total_count2 {
+		// e.g. rows were deleted from the old shards in the meantime; the old shards are still complete
 		fmt.Println("error: aborted partitioning schema for ", t.Name, "after", time.Since(start), " because of inconsistency: before", total_count, "items, after", total_count2)
+		for _, s := range newshards {
+			s.RemoveFromDisk()
+		}
 		return
 	}
 
@@ -447,7 +556,12 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 	t.schema.schemalock.Unlock()
 
 	for _, s := range oldshards {
-		// discard from disk
+		// keep the merged changes as history, then discard from disk
+		s.mu.Lock()
+		s.archiveChanges(func (i int, c shardChange) bool {
+			return c.seq <= snapshotSequence
+		})
+		s.mu.Unlock()
 		s.RemoveFromDisk()
 	}
 }
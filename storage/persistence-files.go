@@ -22,6 +22,8 @@ import "fmt"
 import "bufio"
 import "bytes"
 import "strings"
+import "strconv"
+import "time"
 import "crypto/sha256"
 import "encoding/json"
 import "github.com/launix-de/memcp/scm"
@@ -101,37 +103,67 @@ func (s *FileStorage) OpenLog(shard string) PersistenceLogfile {
 	return FileLogfile{f}
 }
 
-func (s *FileStorage) ReplayLog(shard string) (chan interface{}, PersistenceLogfile) {
+func (s *FileStorage) ReplayLog(shard string, until int64) (chan interface{}, PersistenceLogfile) {
 	f, err := os.OpenFile(s.path + shard + ".log", os.O_RDWR|os.O_CREATE, 0750)
 	if err != nil {
 		panic(err)
 	}
 	replay := make(chan interface{}, 8)
-	fi, _ := f.Stat()
-	if fi.Size() > 0 {
+	go func() {
 		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1024 * 1024 * 1024) // inserts of big batches produce long lines
 		for scanner.Scan() {
 			b := scanner.Bytes()
+			var seq uint64
+			var ts int64
+			if len(b) > 0 && b[0] == '@' {
+				// sequence number prefix @seq,timestamp (logs without sequence numbers or timestamps are still readable)
+				split := bytes.IndexByte(b, ' ')
+				prefix := string(b[1:split])
+				if comma := strings.IndexByte(prefix, ','); comma >= 0 {
+					ts, _ = strconv.ParseInt(prefix[comma+1:], 10, 64)
+					prefix = prefix[:comma]
+				}
+				seq, _ = strconv.ParseUint(prefix, 10, 64)
+				b = b[split+1:]
+			}
+			if until > 0 && ts > until {
+				break // point-in-time recovery: the log is in write order, so everything after this is too new
+			}
 			if string(b) == "" {
 				// nop
+			} else if len(b) > 9 && string(b[0:9]) == "undelete " {
+				var idx uint
+				json.Unmarshal(b[9:], &idx)
+				replay <- LogEntryUndelete{seq, ts, idx}
 			} else if string(b[0:7]) == "delete " {
 				var idx uint
 				json.Unmarshal(b[7:], &idx)
-				replay <- LogEntryDelete{idx}
+				replay <- LogEntryDelete{seq, ts, idx}
 			} else if string(b[0:7]) == "insert " {
 				split := strings.Index(string(b), "][") + 1
 				var cols []string
 				var values [][]scm.Scmer
 				json.Unmarshal(b[7:split], &cols)
 				json.Unmarshal(b[split:], &values)
-				replay <- LogEntryInsert{cols, values}
+				replay <- LogEntryInsert{seq, ts, cols, values}
+			} else if string(b[0:7]) == "rename " {
+				var names [2]string
+				json.Unmarshal(b[7:], &names)
+				replay <- LogEntryRename{names[0], names[1]}
+			} else if string(b[0:7]) == "change " {
+				var change struct {
+					Deleted bool
+					Row []scm.Scmer
+				}
+				json.Unmarshal(b[7:], &change)
+				replay <- LogEntryChange{seq, ts, change.Deleted, change.Row}
 			} else {
 				panic("unknown log sequence: " + string(b))
 			}
 		}
-	} else {
 		close(replay)
-	}
+	}()
 	return replay, FileLogfile{f}
 }
 
@@ -143,16 +175,33 @@ type FileLogfile struct {
 	w *os.File
 }
 func (w FileLogfile) Write(logentry interface{}) {
+	now := time.Now().UnixNano()
+	stamp := func(ts int64) string {
+		if ts == 0 {
+			ts = now
+		}
+		return strconv.FormatInt(ts, 10)
+	}
 	switch l := logentry.(type) {
 		case LogEntryDelete:
 			var b bytes.Buffer
+			b.WriteString("@" + strconv.FormatUint(l.seq, 10) + "," + stamp(l.ts) + " ")
 			b.WriteString("delete ")
 			tmp, _ := json.Marshal(l.idx)
 			b.Write(tmp)
 			b.WriteString("\n")
 			w.w.Write(b.Bytes())
+		case LogEntryUndelete:
+			var b bytes.Buffer
+			b.WriteString("@" + strconv.FormatUint(l.seq, 10) + "," + stamp(l.ts) + " ")
+			b.WriteString("undelete ")
+			tmp, _ := json.Marshal(l.idx)
+			b.Write(tmp)
+			b.WriteString("\n")
+			w.w.Write(b.Bytes())
 		case LogEntryInsert:
 			var b bytes.Buffer
+			b.WriteString("@" + strconv.FormatUint(l.seq, 10) + "," + stamp(l.ts) + " ")
 			b.WriteString("insert ")
 			tmp, _ := json.Marshal(l.cols)
 			b.Write(tmp)
@@ -160,13 +209,32 @@ func (w FileLogfile) Write(logentry interface{}) {
 			b.Write(tmp)
 			b.WriteString("\n")
 			w.w.Write(b.Bytes())
+		case LogEntryRename:
+			var b bytes.Buffer
+			b.WriteString("@0," + stamp(0) + " ")
+			b.WriteString("rename ")
+			tmp, _ := json.Marshal([2]string{l.oldName, l.newName})
+			b.Write(tmp)
+			b.WriteString("\n")
+			w.w.Write(b.Bytes())
+		case LogEntryChange:
+			var b bytes.Buffer
+			b.WriteString("@" + strconv.FormatUint(l.seq, 10) + "," + stamp(l.ts) + " ")
+			b.WriteString("change ")
+			tmp, _ := json.Marshal(struct {
+				Deleted bool
+				Row []scm.Scmer
+			}{l.deleted, l.row})
+			b.Write(tmp)
+			b.WriteString("\n")
+			w.w.Write(b.Bytes())
 	}
 }
 func (w FileLogfile) Sync() {
-	w.Sync()
+	w.w.Sync()
 }
 func (w FileLogfile) Close() {
-	w.Close()
+	w.w.Close()
 }
 
 func (s *FileStorage) Remove() {
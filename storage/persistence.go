@@ -45,23 +45,45 @@ type PersistenceEngine interface {
 	WriteColumn(shard string, column string) io.WriteCloser
 	RemoveColumn(shard string, column string)
 	OpenLog(shard string) PersistenceLogfile // open for writing
-	ReplayLog(shard string) (chan interface{}, PersistenceLogfile) // replay existing log
+	ReplayLog(shard string, until int64) (chan interface{}, PersistenceLogfile) // replay existing log; until > 0 stops at the first entry written after that time (unix nanoseconds)
 	RemoveLog(shard string)
 	Remove() // delete from storage
 }
 
 type PersistenceLogfile interface {
-	Write(logentry interface{})
+	Write(logentry interface{}) // stamps the entry with the current wall-clock time
 	Sync()
 	Close()
 }
 type LogEntryDelete struct {
+	seq uint64 // sequence number of the write (see table.LogSequence)
+	ts int64 // wall-clock time of the write (unix nanoseconds); 0 = time of Write
+	idx uint
+}
+type LogEntryUndelete struct {
+	// a deleted row that is live again (rollback of a transaction)
+	seq uint64
+	ts int64
 	idx uint
 }
 type LogEntryInsert struct {
+	seq uint64 // sequence number of the write (see table.LogSequence)
+	ts int64 // wall-clock time of the write (unix nanoseconds); 0 = time of Write
 	cols []string
 	values [][]scm.Scmer
 }
+type LogEntryChange struct {
+	// change history of a table (see changes.go): a row that was inserted or deleted
+	seq uint64
+	ts int64
+	deleted bool
+	row []scm.Scmer // assoc list
+}
+type LogEntryRename struct {
+	// column rename: inserts that were logged before use the old column name
+	oldName string
+	newName string
+}
 
 // for CREATE TABLE
 type PersistenceFactory interface {
@@ -17,9 +17,15 @@ Copyright (C) 2023  Carl-Philip Hänsch
 package storage
 
 import "fmt"
+import "sort"
+import "math"
+import "sync"
+import "sync/atomic"
 import "runtime/debug"
+import "encoding/binary"
 import "github.com/jtolds/gls"
 import "github.com/launix-de/memcp/scm"
+import "github.com/launix-de/NonLockingReadMap"
 
 type scanError struct {
 	r interface{}
@@ -34,19 +40,365 @@ func (s scanError) Error() string {
 
 type emptyResult struct {}
 
+// result of one shard, tagged with its shard so the associative collect can restore the shard order
+type shardValue struct {
+	s *storageShard
+	value scm.Scmer
+}
+
+// optional parameters of scan; they are passed as assoc list '("preFilter" selection ...)
+type scanOptions struct {
+	preFilter *scanSelection // only visit the records of a previous scan-selection
+	explainOnly bool // return the plan instead of scanning
+	orderedWithinShard bool // call map in ascending record order inside each shard (shards still run in parallel)
+	associative bool // the user asserts that the reduce is associative, so shard results may be combined in a parallel tree
+	indexOnly bool // only read indexed columns and build the index immediately; panics if the index does not cover the scan
+	deterministicOrder bool // run map and reduce serially in shard and record order (for tests; buffers all matching rows and gives up parallel map)
+	stable bool // map in parallel, but reduce serially in shard and record order (buffers the map results)
+	collate map[string]string // column -> collation for filter comparisons and index bounds
+	outerDefaults map[string]scm.Scmer // map column -> value instead of NULL for the no-hit call of isOuter
+	progress *scanProgress // reports the number of visited rows during long scans
+	sample float64 // 0 = off, otherwise visit each row with that probability (TABLESAMPLE)
+	sampleSeed uint64 // mixed into the per-row decision of sample
+	sampleScale bool // divide a numeric result by sample to estimate the result of the full scan
+	flatmap bool // map returns a list and every element is reduced on its own (unnest)
+	limit int64 // 0 = unlimited, otherwise stop after that many rows passed the filter (any rows, since the order is unspecified)
+	offset int64 // skip that many rows that passed the filter
+	matched *atomic.Int64 // rows that passed the filter so far, shared by the shard workers for limit/offset
+	snapshot bool // all shards show the state of the moment the scan started
+	snapshotView *scanSnapshot // captured by table.scan if snapshot is set
+}
+
+// point-in-time view of a table: the shard lists at seq and the first write after seq to each row
+// nothing is copied up front; writers report to all running snapshots (see storageShard.recordChange)
+type scanSnapshot struct {
+	seq uint64
+	shards []*storageShard
+	pshards []*storageShard
+	pdimensions []shardDimension
+	mu sync.Mutex // protects views; the fields of a view are protected by the write lock of its shard
+	views map[*storageShard]*shardSnapshotView
+}
+
+// rows of a shard that were written after the snapshot
+type shardSnapshotView struct {
+	existed map[uint]bool // first write to a row: true = it was deleted, false = it was undeleted
+	appended bool
+	appendedFrom uint // rows from here on were inserted after the snapshot
+}
+
+// registers a snapshot of the table; the caller must call endSnapshot
+func (t *table) startSnapshot() *scanSnapshot {
+	for {
+		snap := &scanSnapshot{views: make(map[*storageShard]*shardSnapshotView)}
+		t.snapshotMu.Lock()
+		atomic.AddInt32(&t.activeSnapshots, 1) // before seq is read, so every write after seq reports to snap
+		snap.seq = atomic.LoadUint64(&t.LogSequence)
+		t.snapshots = append(t.snapshots, snap)
+		t.snapshotMu.Unlock()
+		snap.shards, snap.pshards, snap.pdimensions = t.Shards, t.PShards, t.PDimensions
+		shards := snap.shards
+		if shards == nil {
+			shards = snap.pshards
+		}
+		current := true
+		for _, s := range shards {
+			if s != nil && s.baseSequence > snap.seq {
+				current = false // rebuilt after seq: its main storage contains later writes
+			}
+		}
+		if current {
+			return snap
+		}
+		t.endSnapshot(snap)
+	}
+}
+
+func (t *table) endSnapshot(snap *scanSnapshot) {
+	t.snapshotMu.Lock()
+	for i, s := range t.snapshots {
+		if s == snap {
+			t.snapshots = append(t.snapshots[:i:i], t.snapshots[i+1:]...)
+			break
+		}
+	}
+	atomic.AddInt32(&t.activeSnapshots, -1)
+	t.snapshotMu.Unlock()
+}
+
+func (snap *scanSnapshot) view(s *storageShard) *shardSnapshotView {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	v, ok := snap.views[s]
+	if !ok {
+		v = &shardSnapshotView{existed: make(map[uint]bool)}
+		snap.views[s] = v
+	}
+	return v
+}
+
+// tells the running snapshots about a write (count = 0: deletion of idx, otherwise count rows from idx on are live)
+// contract: must only be called inside full write mutex s.mu.Lock()
+func (t *table) snapshotChange(s *storageShard, seq uint64, idx uint, count uint) {
+	t.snapshotMu.Lock()
+	defer t.snapshotMu.Unlock()
+	for _, snap := range t.snapshots {
+		if seq <= snap.seq {
+			continue // part of the snapshot
+		}
+		v := snap.view(s)
+		if v.appended && idx >= v.appendedFrom {
+			continue // the row did not exist at the snapshot anyway
+		}
+		if count == 0 {
+			if _, ok := v.existed[idx]; !ok {
+				v.existed[idx] = true
+			}
+		} else if idx + count == s.main_count + uint(len(s.inserts)) {
+			v.appended = true
+			v.appendedFrom = idx
+		} else {
+			for i := idx; i < idx + count; i++ {
+				if _, ok := v.existed[i]; !ok {
+					v.existed[i] = false
+				}
+			}
+		}
+	}
+}
+
+// whether idx was deleted at the time of the snapshot
+// contract: must only be called inside s.mu.RLock()
+func (v *shardSnapshotView) deleted(s *storageShard, idx uint) bool {
+	if existed, ok := v.existed[idx]; ok {
+		return !existed
+	}
+	if v.appended && idx >= v.appendedFrom {
+		return true
+	}
+	return s.deletions.Get(idx)
+}
+
+// iterates the shards of a scan: the shard lists of its snapshot or the current ones
+func (t *table) iterateScanShards(options scanOptions, boundaries []columnboundaries, callback func(*storageShard)) {
+	if snap := options.snapshotView; snap != nil {
+		t.iterateShardLists(snap.shards, snap.pshards, snap.pdimensions, boundaries, callback)
+	} else {
+		t.iterateShards(boundaries, callback)
+	}
+}
+
+// every shard reports its visited rows after this many rows
+const progressInterval = 100000
+
+// serializes the progress callbacks of the parallel shard workers, so the callback sees monotonic counts
+type scanProgress struct {
+	mu sync.Mutex
+	fn scm.Scmer
+	processed uint
+	estimate uint
+}
+
+// adds rows to the processed count; call is false for shard remainders that are only reported by the final call
+func (p *scanProgress) add(rows uint, call bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed += rows
+	if call {
+		scm.Apply(p.fn, int64(p.processed), int64(p.estimate))
+	}
+}
+
+// rows of one shard that matched the condition; map is applied later in record order (deterministicOrder)
+// or was already applied and only reduce is left (stable)
+type bufferedRow struct {
+	idx uint
+	values []scm.Scmer
+	mapped scm.Scmer
+}
+type bufferedRows []bufferedRow
+
+func parseScanOptions(options scm.Scmer) (result scanOptions) {
+	if options == nil {
+		return
+	}
+	list := options.([]scm.Scmer)
+	for i := 0; i + 1 < len(list); i += 2 {
+		switch scm.String(list[i]) {
+			case "preFilter":
+				if list[i+1] != nil {
+					result.preFilter = list[i+1].(*scanSelection)
+				}
+			case "explainOnly":
+				result.explainOnly = scm.ToBool(list[i+1])
+			case "deterministicOrder":
+				result.deterministicOrder = scm.ToBool(list[i+1])
+			case "stable":
+				result.stable = scm.ToBool(list[i+1])
+			case "indexOnly":
+				result.indexOnly = scm.ToBool(list[i+1])
+			case "associative":
+				result.associative = scm.ToBool(list[i+1])
+			case "orderedWithinShard":
+				result.orderedWithinShard = scm.ToBool(list[i+1])
+			case "collate":
+				result.collate = make(map[string]string)
+				if list[i+1] != nil {
+					collate := list[i+1].([]scm.Scmer)
+					for j := 0; j + 1 < len(collate); j += 2 {
+						result.collate[scm.String(collate[j])] = scm.String(collate[j+1])
+					}
+				}
+			case "outerDefaults":
+				result.outerDefaults = make(map[string]scm.Scmer)
+				if list[i+1] != nil {
+					defaults := list[i+1].([]scm.Scmer)
+					for j := 0; j + 1 < len(defaults); j += 2 {
+						result.outerDefaults[scm.String(defaults[j])] = defaults[j+1]
+					}
+				}
+			case "progress":
+				if list[i+1] != nil {
+					result.progress = &scanProgress{fn: list[i+1]}
+				}
+			case "sample":
+				result.sample = scm.ToFloat(list[i+1])
+				if !(result.sample > 0 && result.sample <= 1) {
+					panic("scan sample must be between 0 and 1")
+				}
+				if result.sample == 1 {
+					result.sample = 0 // full scan
+				}
+			case "sampleSeed":
+				result.sampleSeed = uint64(scm.ToInt(list[i+1]))
+			case "sampleScale":
+				result.sampleScale = scm.ToBool(list[i+1])
+			case "flatmap":
+				result.flatmap = scm.ToBool(list[i+1])
+			case "snapshot":
+				result.snapshot = scm.ToBool(list[i+1])
+			case "limit":
+				result.limit = int64(scm.ToInt(list[i+1]))
+			case "offset":
+				result.offset = int64(scm.ToInt(list[i+1]))
+			default:
+				panic("unknown scan option: " + scm.String(list[i]))
+		}
+	}
+	return
+}
+
+// shard scans hand their rows to scanDeterministic instead of reducing them
+func (o scanOptions) buffered() bool {
+	return o.deterministicOrder || o.stable
+}
+
+// creates the shared counter for limit/offset; call once per scan before the shard workers start
+func (o *scanOptions) startLimit() {
+	if o.limit > 0 || o.offset > 0 {
+		o.matched = new(atomic.Int64)
+	}
+}
+
+// counts a row that passed the filter: skip = the row is inside offset or beyond limit, stop = limit is reached
+func (o *scanOptions) limitRow() (skip bool, stop bool) {
+	if o.matched == nil {
+		return false, false
+	}
+	n := o.matched.Add(1)
+	if n <= o.offset {
+		return true, false
+	}
+	if o.limit > 0 && n > o.offset + o.limit {
+		return true, true
+	}
+	return false, false
+}
+
+// limit is reached, so further shards need not be visited
+func (o *scanOptions) limitReached() bool {
+	return o.matched != nil && o.limit > 0 && o.matched.Load() >= o.offset + o.limit
+}
+
+// feeds the result of one map call into reduce; with flatmap, every list element is reduced on its own
+// and emitted is false if map returned an empty list
+func (o scanOptions) reduceMapped(aggregateFn func(...scm.Scmer) scm.Scmer, akkumulator scm.Scmer, intermediate scm.Scmer) (result scm.Scmer, emitted bool) {
+	if !o.flatmap {
+		return aggregateFn(akkumulator, intermediate), true
+	}
+	items, _ := intermediate.([]scm.Scmer)
+	for _, item := range items {
+		akkumulator = aggregateFn(akkumulator, item)
+	}
+	return akkumulator, len(items) > 0
+}
+
+// values of the no-hit call of an outer scan; with flatmap an empty list still yields one NULL row
+func (o scanOptions) outerValues(callback scm.Scmer, callbackCols []string) []scm.Scmer {
+	intermediate := scm.Apply(callback, o.outerRow(callbackCols)...)
+	if !o.flatmap {
+		return []scm.Scmer{intermediate}
+	}
+	if items, _ := intermediate.([]scm.Scmer); len(items) > 0 {
+		return items
+	}
+	return []scm.Scmer{nil}
+}
+
+// map parameters of the no-hit call of an outer scan: NULL unless outerDefaults says otherwise
+func (o scanOptions) outerRow(callbackCols []string) []scm.Scmer {
+	result := make([]scm.Scmer, len(callbackCols))
+	for i, col := range callbackCols {
+		result[i] = o.outerDefaults[col]
+	}
+	return result
+}
+
 // map reduce implementation based on scheme scripts
-func (t *table) scan(conditionCols []string, condition scm.Scmer, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, aggregate2 scm.Scmer, isOuter bool) scm.Scmer {
+func (t *table) scan(conditionCols []string, condition scm.Scmer, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, aggregate2 scm.Scmer, isOuter bool, options scanOptions) (result scm.Scmer) {
+	if options.preFilter != nil && options.preFilter.t != t {
+		panic("preFilter selection belongs to table " + options.preFilter.t.Name + ", not " + t.Name)
+	}
+	scanStats.scans.Add(1)
 	/* analyze query */
 	boundaries := extractBoundaries(conditionCols, condition)
+	condition = options.collateCondition(conditionCols, condition, boundaries)
 	lower, upperLast := indexFromBoundaries(boundaries)
+	if options.indexOnly {
+		checkIndexCovers(indexColsFromBoundaries(boundaries, lower), conditionCols, callbackCols)
+	}
 	// give sharding hints
 	for _, b := range boundaries {
 		t.AddPartitioningScore([]string{b.col})
 	}
 
+	if options.sample > 0 && options.sampleScale {
+		defer func () {
+			result = scaleSample(result, options.sample) // estimate of the full scan from the final result
+		}()
+	}
+	options.startLimit()
+	if options.snapshot && options.snapshotView == nil {
+		options.snapshotView = t.startSnapshot()
+		defer t.endSnapshot(options.snapshotView)
+	}
+	if options.progress != nil {
+		options.progress.estimate = t.Count()
+	}
+
+	var shardBefore func(a, b *storageShard) bool
+	if options.associative && !options.buffered() && (aggregate2 != nil || aggregate != nil) {
+		shardBefore = t.shardOrder() // buffered scans already deliver in shard order and are collected serially
+	}
 	values := make(chan scm.Scmer, 4)
 	gls.Go(func() {
-		t.iterateShards(boundaries, func (s *storageShard) {
+		if options.buffered() {
+			t.scanDeterministic(values, boundaries, lower, upperLast, conditionCols, condition, callbackCols, callback, aggregate, neutral, options)
+			options.finishProgress(values)
+			close(values)
+			return
+		}
+		t.iterateScanShards(options, boundaries, func (s *storageShard) {
 			// parallel scan over shards
 			defer func () {
 				if r := recover(); r != nil {
@@ -54,14 +406,50 @@ func (t *table) scan(conditionCols []string, condition scm.Scmer, callbackCols [
 					values <- scanError{r, string(debug.Stack())}
 				}
 			}()
-			values <- s.scan(boundaries, lower, upperLast, conditionCols, condition, callbackCols, callback, aggregate, neutral)
+			result := s.scan(boundaries, lower, upperLast, conditionCols, condition, callbackCols, callback, aggregate, neutral, options)
+			if shardBefore != nil {
+				result = shardValue{s, result}
+			}
+			values <- result
 		})
+		options.finishProgress(values)
 		close(values) // last scan is finished
 	})
 	// collect values from parallel scan
 	akkumulator := neutral
 	hadValue := false
-	if aggregate2 != nil {
+	if shardBefore != nil {
+		fn := aggregate2
+		if fn == nil {
+			fn = aggregate
+		}
+		// shards finish in any order; put their results back into shard order, so reduce only needs to be associative
+		shardResults := make([]shardValue, 0)
+		for intermediate := range values {
+			switch x := intermediate.(type) {
+				case scanError:
+					panic(x) // cascade panic
+				case shardValue:
+					if _, empty := x.value.(emptyResult); !empty {
+						shardResults = append(shardResults, x)
+					}
+			}
+		}
+		sort.Slice(shardResults, func (i, j int) bool {
+			return shardBefore(shardResults[i].s, shardResults[j].s)
+		})
+		results := make([]scm.Scmer, len(shardResults))
+		for i, r := range shardResults {
+			results[i] = r.value
+		}
+		if len(results) == 0 {
+			if !isOuter {
+				return akkumulator
+			}
+			results = append(results, options.outerValues(callback, callbackCols)...) // outer join: push one NULL row
+		}
+		return scm.Apply(fn, akkumulator, reduceTree(fn, results))
+	} else if aggregate2 != nil {
 		fn := scm.OptimizeProcToSerialFunction(aggregate2)
 		for intermediate := range values {
 			// eat value
@@ -77,7 +465,9 @@ func (t *table) scan(conditionCols []string, condition scm.Scmer, callbackCols [
 			}
 		}
 		if !hadValue && isOuter {
-			akkumulator = fn(akkumulator, scm.Apply(callback, make([]scm.Scmer, len(callbackCols))...)) // outer join: push one NULL row
+			for _, v := range options.outerValues(callback, callbackCols) { // outer join: push one NULL row
+				akkumulator = fn(akkumulator, v)
+			}
 		}
 		return akkumulator
 	} else if aggregate != nil {
@@ -96,7 +486,9 @@ func (t *table) scan(conditionCols []string, condition scm.Scmer, callbackCols [
 			}
 		}
 		if !hadValue && isOuter {
-			akkumulator = fn(akkumulator, scm.Apply(callback, make([]scm.Scmer, len(callbackCols))...)) // outer join: push one NULL row
+			for _, v := range options.outerValues(callback, callbackCols) { // outer join: push one NULL row
+				akkumulator = fn(akkumulator, v)
+			}
 		}
 		return akkumulator
 	} else {
@@ -113,14 +505,174 @@ func (t *table) scan(conditionCols []string, condition scm.Scmer, callbackCols [
 			}
 		}
 		if !hadValue && isOuter {
-			scm.Apply(callback, make([]scm.Scmer, len(callbackCols))...) // outer join: push one NULL row
+			options.outerValues(callback, callbackCols) // outer join: push one NULL row
 		}
 		return akkumulator
 	}
 }
 
-func (t *storageShard) scan(boundaries boundaries, lower []scm.Scmer, upperLast scm.Scmer, conditionCols []string, condition scm.Scmer, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer) scm.Scmer {
+// extrapolates a numeric result of a sampled scan (counts and sums) to the whole table
+func scaleSample(result scm.Scmer, sample float64) scm.Scmer {
+	switch v := result.(type) {
+		case int64:
+			return int64(math.Round(float64(v) / sample))
+		case float64:
+			return v / sample
+		default:
+			return result // no numeric result: nothing to scale
+	}
+}
+
+// decides deterministically whether a row is part of the sample: the shard uuid and the record id
+// are hashed (splitmix64), so the same scan on the same storage returns the same sample
+func (t *storageShard) sampled(idx uint, options scanOptions) bool {
+	x := binary.LittleEndian.Uint64(t.uuid[:8]) ^ binary.LittleEndian.Uint64(t.uuid[8:]) ^ options.sampleSeed
+	x += uint64(idx + 1) * 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x >> 11) < options.sample * (1 << 53)
+}
+
+// reports the final count once all shards are finished; a panic of the callback is cascaded like a shard panic
+func (o scanOptions) finishProgress(values chan scm.Scmer) {
+	if o.progress == nil {
+		return
+	}
+	defer func () {
+		if r := recover(); r != nil {
+			values <- scanError{r, string(debug.Stack())}
+		}
+	}()
+	o.progress.add(0, true)
+}
+
+// orders shards by their position in the table; the positions are taken now (before the scan), since a shard that is rebuilt during the scan gets replaced in the list
+func (t *table) shardOrder() func(a, b *storageShard) bool {
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	position := make(map[*storageShard]int)
+	for i, s := range shardlist {
+		position[s] = i
+	}
+	return func(a, b *storageShard) bool {
+		pa, ok := position[a]
+		if !ok {
+			pa = len(shardlist) // shard was replaced during scan
+		}
+		pb, ok := position[b]
+		if !ok {
+			pb = len(shardlist)
+		}
+		if pa != pb {
+			return pa < pb
+		}
+		return a.uuid.String() < b.uuid.String()
+	}
+}
+
+// combines shard results pairwise in a parallel binary tree; values must be in shard order; neighbours stay neighbours, so associativity is enough (no commutativity needed)
+func reduceTree(fn scm.Scmer, values []scm.Scmer) scm.Scmer {
+	for len(values) > 1 {
+		next := make([]scm.Scmer, (len(values) + 1) / 2)
+		var done sync.WaitGroup
+		var mu sync.Mutex
+		var err scm.Scmer
+		for i := 0; i + 1 < len(values); i += 2 {
+			done.Add(1)
+			gls.Go(func () {
+				defer done.Done()
+				defer func () {
+					if r := recover(); r != nil {
+						mu.Lock()
+						err = scanError{r, string(debug.Stack())}
+						mu.Unlock()
+					}
+				}()
+				next[i / 2] = scm.Apply(fn, values[i], values[i + 1]) // Apply instead of a serial function: we run concurrently
+			})
+		}
+		if len(values) % 2 == 1 {
+			next[len(next) - 1] = values[len(values) - 1] // odd one moves up a level
+		}
+		done.Wait()
+		if err != nil {
+			panic(err) // cascade panic
+		}
+		values = next
+	}
+	return values[0]
+}
+
+// filters all shards in parallel, then maps and reduces the buffered rows serially in shard and record order
+// so repeated runs produce the same output, also for side effects like resultrow
+// with stable, the shards already ran map in parallel and only reduce is serialized
+func (t *table) scanDeterministic(values chan scm.Scmer, boundaries boundaries, lower []scm.Scmer, upperLast scm.Scmer, conditionCols []string, condition scm.Scmer, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, options scanOptions) {
+	type shardResult struct {
+		s *storageShard
+		rows bufferedRows
+	}
+	shardBefore := t.shardOrder()
+	var mu sync.Mutex
+	results := make([]shardResult, 0)
+	t.iterateScanShards(options, boundaries, func (s *storageShard) {
+		defer func () {
+			if r := recover(); r != nil {
+				values <- scanError{r, string(debug.Stack())}
+			}
+		}()
+		if rows, ok := s.scan(boundaries, lower, upperLast, conditionCols, condition, callbackCols, callback, aggregate, neutral, options).(bufferedRows); ok {
+			mu.Lock()
+			results = append(results, shardResult{s, rows})
+			mu.Unlock()
+		}
+	})
+
+	sort.Slice(results, func (i, j int) bool {
+		return shardBefore(results[i].s, results[j].s)
+	})
+
+	defer func () {
+		if r := recover(); r != nil {
+			values <- scanError{r, string(debug.Stack())}
+		}
+	}()
+	callbackFn := scm.OptimizeProcToSerialFunction(callback)
+	aggregateFn := func(...scm.Scmer) scm.Scmer {return nil}
+	if aggregate != nil {
+		aggregateFn = scm.OptimizeProcToSerialFunction(aggregate)
+	}
+	for _, r := range results {
+		akkumulator := neutral
+		hadValue := false
+		for _, row := range r.rows {
+			if skip, _ := options.limitRow(); skip {
+				continue // offset/limit in record order
+			}
+			intermediate := row.mapped
+			if !options.stable {
+				intermediate = callbackFn(row.values...)
+			}
+			var emitted bool
+			akkumulator, emitted = options.reduceMapped(aggregateFn, akkumulator, intermediate)
+			hadValue = hadValue || emitted
+		}
+		if !hadValue {
+			values <- emptyResult{} // flatmap: only empty lists
+			continue
+		}
+		values <- akkumulator
+	}
+}
+
+func (t *storageShard) scan(boundaries boundaries, lower []scm.Scmer, upperLast scm.Scmer, conditionCols []string, condition scm.Scmer, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, options scanOptions) scm.Scmer {
 	akkumulator := neutral
+	var selection *NonLockingReadMap.NonBlockingBitMap
+	if options.preFilter != nil {
+		selection = options.preFilter.forShard(t)
+	}
 
 	conditionFn := scm.OptimizeProcToSerialFunction(condition)
 	callbackFn := scm.OptimizeProcToSerialFunction(callback)
@@ -155,16 +707,48 @@ func (t *storageShard) scan(boundaries boundaries, lower []scm.Scmer, upperLast
 			}
 		}
 	}
+	if options.indexOnly {
+		t.addIndex(indexColsFromBoundaries(boundaries, lower), indexCollationsFromBoundaries(boundaries, lower)) // don't wait for the index to pay off
+	}
 	// remember current insert status (so don't scan things that are inserted during map)
 	t.mu.RLock() // lock whole shard for reading since we frequently read deletions
 	maxInsertIndex := len(t.inserts)
+	deletions := &t.deletions
+	var view *shardSnapshotView
+	if options.snapshotView != nil {
+		// snapshot scan: hide rows that were inserted after the scan started and show rows that were deleted after it
+		view = options.snapshotView.view(t)
+	}
 
 	// iterate over items (indexed)
 	hadValue := false
-	t.iterateIndex(boundaries, lower, upperLast, maxInsertIndex, func (idx uint) {
-		if t.deletions.Get(idx) {
+	var buffered bufferedRows
+	var processed uint // visited rows that were not yet reported to options.progress
+	var visited uint64
+	visit := func (idx uint) {
+		if view != nil {
+			if view.deleted(t, idx) {
+				return // item was not live when the snapshot was taken
+			}
+		} else if deletions.Get(idx) {
 			return // item is on delete list
 		}
+		if selection != nil && !selection.Get(idx) {
+			return // item was not selected by preFilter
+		}
+		if options.sample > 0 && !t.sampled(idx, options) {
+			return // not part of the sample
+		}
+		visited++
+		if options.progress != nil {
+			processed++
+			if processed == progressInterval {
+				t.mu.RUnlock() // the callback may wait for other shards
+				options.progress.add(processed, true)
+				processed = 0
+				t.mu.RLock()
+			}
+		}
 
 		// prepare mdataset
 		if idx < t.main_count {
@@ -208,13 +792,81 @@ func (t *storageShard) scan(boundaries boundaries, lower []scm.Scmer, upperLast
 				}
 			}
 		}
+		if !options.buffered() {
+			// scanDeterministic applies offset/limit in record order
+			if skip, stop := options.limitRow(); stop {
+				panic(scanAbort{}) // limit is reached by this or another shard
+			} else if skip {
+				return
+			}
+		}
+		if options.deterministicOrder {
+			// map is called later by scanDeterministic
+			buffered = append(buffered, bufferedRow{idx: idx, values: append([]scm.Scmer{}, mdataset...)})
+			hadValue = true
+			return
+		}
 		t.mu.RUnlock() // unlock while map callback, so we don't get into deadlocks when a user is updating
 		intermediate := callbackFn(mdataset...)
-		akkumulator = aggregateFn(akkumulator, intermediate)
-		hadValue = true
+		if options.stable {
+			// reduce is called later by scanDeterministic
+			buffered = append(buffered, bufferedRow{idx: idx, mapped: intermediate})
+			hadValue = true
+			t.mu.RLock()
+			return
+		}
+		var emitted bool
+		akkumulator, emitted = options.reduceMapped(aggregateFn, akkumulator, intermediate)
+		hadValue = hadValue || emitted
 		t.mu.RLock()
-	})
+	}
+	func () {
+		defer func () {
+			if r := recover(); r != nil {
+				if _, ok := r.(scanAbort); !ok {
+					panic(r)
+				}
+			}
+		}()
+		if options.limitReached() {
+			return // other shards already delivered enough rows
+		}
+		if t.bloomMiss(boundaries) {
+			// no row of the main storage can match: only scan the delta storage
+			for idx := 0; idx < maxInsertIndex; idx++ {
+				visit(t.main_count + uint(idx))
+			}
+		} else if options.orderedWithinShard && len(lower) > 0 {
+			// an index delivers the rows in key order: collect them and visit them in record order
+			ids := make([]uint, 0)
+			t.iterateIndex(boundaries, lower, upperLast, maxInsertIndex, func (idx uint) {
+				ids = append(ids, idx)
+			})
+			sort.Slice(ids, func (i, j int) bool {
+				return ids[i] < ids[j]
+			})
+			for _, idx := range ids {
+				visit(idx)
+			}
+		} else {
+			t.iterateIndex(boundaries, lower, upperLast, maxInsertIndex, visit) // without index, iterateIndex visits main storage and then delta in record order
+		}
+	}()
+	scanStats.rows.Add(visited)
 	t.mu.RUnlock() // finished reading
+	if options.progress != nil {
+		options.progress.add(processed, false) // the remainder is reported by the final call
+	}
+	if options.buffered() {
+		// an index delivers rows in key order, so restore record order
+		sort.Slice(buffered, func (i, j int) bool {
+			return buffered[i].idx < buffered[j].idx
+		})
+		if !hadValue {
+			return emptyResult{}
+		}
+		return buffered
+	}
 	if !hadValue {
 		return emptyResult{}
 	} else {
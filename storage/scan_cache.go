@@ -0,0 +1,64 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sync"
+import "github.com/jtolds/gls"
+import "github.com/launix-de/memcp/scm"
+
+// memoization of correlated subqueries: (cached fn) returns a function that caches the results of fn per scan.
+// Every scan of a table opens a new cache scope (inherited by its shard workers via gls); the results live in that scope
+// and are freed when the scan returns. Outside a scan, the wrapper just calls fn.
+var scanCacheContext = gls.NewContextManager()
+
+// results of all cached functions during one scan: *cachedFunction -> *sync.Map (serialized arguments -> result)
+type scanCache struct {
+	functions sync.Map
+}
+
+type cachedFunction struct {
+	fn scm.Scmer // called with scm.Apply, since the shard workers call it concurrently
+}
+
+// runs a scan in its own cache scope
+func withScanCache(fn func() scm.Scmer) (result scm.Scmer) {
+	scanCacheContext.SetValues(gls.Values{"scanCache": new(scanCache)}, func () {
+		result = fn()
+	})
+	return
+}
+
+func newCachedFunction(fn scm.Scmer) func(...scm.Scmer) scm.Scmer {
+	c := &cachedFunction{fn}
+	return c.call
+}
+
+func (c *cachedFunction) call(a ...scm.Scmer) scm.Scmer {
+	scope, ok := scanCacheContext.GetValue("scanCache")
+	if !ok {
+		return scm.Apply(c.fn, a...) // not inside a scan
+	}
+	results_, _ := scope.(*scanCache).functions.LoadOrStore(c, new(sync.Map))
+	results := results_.(*sync.Map)
+	key := scm.SerializeToString(a, &scm.Globalenv)
+	if result, ok := results.Load(key); ok {
+		return result
+	}
+	// two shard workers may compute the same key at the same time; fn is pure, so either result is fine
+	result, _ := results.LoadOrStore(key, scm.Apply(c.fn, a...))
+	return result
+}
@@ -18,6 +18,7 @@ package storage
 
 import "fmt"
 import "sort"
+import "reflect"
 import "runtime/debug"
 import "container/heap"
 import "github.com/jtolds/gls"
@@ -37,9 +38,13 @@ func (s *shardqueue) Len() int {
 	return len(s.items)
 }
 func (s *shardqueue) Less(i, j int) bool {
+	return s.less(s.items[i], s.items[j])
+}
+// compares two record ids by the sort criteria
+func (s *shardqueue) less(i, j uint) bool {
 	for c := 0; c < len(s.scols); c++ {
-		a := s.scols[c](s.items[i])
-		b := s.scols[c](s.items[j])
+		a := s.scols[c](i)
+		b := s.scols[c](j)
 		if scm.ToBool(s.sortdirs[c](a, b)) {
 			return true
 		} else if scm.ToBool(s.sortdirs[c](b, a)) {
@@ -92,7 +97,8 @@ func (s *globalqueue) Pop() any {
 // TODO: helper function for priority-q. golangs implementation is kinda quirky, so do our own. container/heap especially lacks the function to test the value at front instead of popping it
 
 // map reduce implementation based on scheme scripts
-func (t *table) scan_order(conditionCols []string, condition scm.Scmer, sortcols []scm.Scmer, sortdirs []func(...scm.Scmer) scm.Scmer, offset int, limit int, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, isOuter bool) scm.Scmer {
+func (t *table) scan_order(conditionCols []string, condition scm.Scmer, sortcols []scm.Scmer, sortdirs []func(...scm.Scmer) scm.Scmer, offset int, limit int, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, isOuter bool, options scanOptions) scm.Scmer {
+	scanStats.scans.Add(1)
 
 	/* analyze condition query */
 	boundaries := extractBoundaries(conditionCols, condition)
@@ -191,7 +197,7 @@ func (t *table) scan_order(conditionCols []string, condition scm.Scmer, sortcols
 		}
 	}
 	if !hadValue && isOuter {
-		akkumulator = aggregateFn(akkumulator, callbackFn(make([]scm.Scmer, len(callbackCols)))) // outer join: call once with NULLs
+		akkumulator = aggregateFn(akkumulator, callbackFn(options.outerRow(callbackCols)...)) // outer join: call once with NULLs
 	}
 	return akkumulator
 }
@@ -254,8 +260,18 @@ func (t *storageShard) scan_order(boundaries boundaries, lower []scm.Scmer, uppe
 		}
 	}
 
+	result.sortdirs = sortdirs
+	// ORDER BY ... LIMIT on an indexed column: read the index in order and stop early instead of sorting the whole shard
+	if len(lower) == 0 && limit >= 0 {
+		if index, descending := t.sortIndex(sortcols, sortdirs); index != nil {
+			t.scanOrderIndexed(index, descending, ccols, conditionCols, conditionFn, limit, result)
+			return
+		}
+	}
+
 	// scan loop in read lock
 	var maxInsertIndex int
+	var visited uint64
 	func () {
 		t.mu.RLock() // lock whole shard for reading since we frequently read deletions
 		defer t.mu.RUnlock() // finished reading
@@ -267,6 +283,7 @@ func (t *storageShard) scan_order(boundaries boundaries, lower []scm.Scmer, uppe
 			if t.deletions.Get(idx) {
 				return // item is on delete list
 			}
+			visited++
 
 			if idx < t.main_count {
 				// value from main storage
@@ -289,9 +306,9 @@ func (t *storageShard) scan_order(boundaries boundaries, lower []scm.Scmer, uppe
 			result.items = append(result.items, idx)
 		})
 	}()
+	scanStats.rows.Add(visited)
 
 	// and now sort result!
-	result.sortdirs = sortdirs
 	// TODO: find conditions when exactly we don't need to sort anymore (fully covered indexes, no inserts); the same condition could be used to exit early during iterateIndex
 	if (maxInsertIndex > 0 || true) && len(sortcols) > 0 {
 		sort.Sort(result)
@@ -300,3 +317,106 @@ func (t *storageShard) scan_order(boundaries boundaries, lower []scm.Scmer, uppe
 	return
 }
 
+
+// finds an active index whose first column is the first sort column in plain < or > order (nil if the shard has to be sorted)
+func (t *storageShard) sortIndex(sortcols []scm.Scmer, sortdirs []func(...scm.Scmer) scm.Scmer) (*StorageIndex, bool) {
+	if len(sortcols) == 0 {
+		return nil, false
+	}
+	for _, scol := range sortcols {
+		if _, ok := scol.(string); !ok {
+			return nil, false // lambda sort criteria are not indexed
+		}
+	}
+	descending := false
+	switch reflect.ValueOf(sortdirs[0]).Pointer() {
+		case reflect.ValueOf(scm.Globalenv.Vars["<"]).Pointer():
+		case reflect.ValueOf(scm.Globalenv.Vars[">"]).Pointer():
+			descending = true
+		default:
+			return nil, false // collations and custom orders
+	}
+	t.indexMutex.Lock()
+	defer t.indexMutex.Unlock()
+	for _, index := range t.Indexes {
+		if index.active && index.Cols[0] == sortcols[0].(string) && index.collation(0) == "" {
+			return index, descending
+		}
+	}
+	return nil, false
+}
+
+// fills result with the first limit rows of the shard in sort order: the main storage is read in index order, the delta storage is sorted and merged in
+func (t *storageShard) scanOrderIndexed(index *StorageIndex, descending bool, ccols []ColumnStorage, conditionCols []string, conditionFn func(...scm.Scmer) scm.Scmer, limit int, result *shardqueue) {
+	if limit == 0 {
+		return
+	}
+	index.Savings = index.Savings + 1.0 // mark that we could save time
+	cdataset := make([]scm.Scmer, len(conditionCols))
+	delta := &shardqueue{t, nil, scanError{}, nil, result.scols, result.sortdirs}
+
+	t.mu.RLock() // lock whole shard for reading since we frequently read deletions
+	maxInsertIndex := len(t.inserts) // don't scan things that are inserted during map
+
+	// main storage: take limit rows and all rows that are equal to the last one in the first sort column (the other sort columns are sorted below)
+	first := result.scols[0]
+	var last scm.Scmer
+	var visited uint64
+	for i := uint(0); i < t.main_count; i++ {
+		pos := i
+		if descending {
+			pos = t.main_count - 1 - i
+		}
+		idx := uint(int64(index.mainIndexes.GetValueUInt(pos)) + index.mainIndexes.offset)
+		if t.deletions.Get(idx) {
+			continue // item is on delete list
+		}
+		visited++
+		for j, k := range ccols {
+			cdataset[j] = k.GetValue(idx)
+		}
+		if !scm.ToBool(conditionFn(cdataset...)) {
+			continue // condition did not match
+		}
+		value := first(idx)
+		if len(result.items) >= limit && (scm.Less(last, value) || scm.Less(value, last)) {
+			break // all further rows come after the limit
+		}
+		result.items = append(result.items, idx)
+		last = value
+	}
+
+	// delta storage is not part of the index
+	for i := 0; i < maxInsertIndex; i++ {
+		idx := t.main_count + uint(i)
+		if t.deletions.Get(idx) {
+			continue // item is on delete list
+		}
+		visited++
+		for j, k := range conditionCols {
+			cdataset[j] = t.getDelta(i, k)
+		}
+		if !scm.ToBool(conditionFn(cdataset...)) {
+			continue // condition did not match
+		}
+		delta.items = append(delta.items, idx)
+	}
+	t.mu.RUnlock()
+	scanStats.rows.Add(visited)
+
+	// merge both sorted lists up to limit
+	sort.Sort(result)
+	sort.Sort(delta)
+	items := make([]uint, 0, limit)
+	i, j := 0, 0
+	for len(items) < limit && (i < len(result.items) || j < len(delta.items)) {
+		if j >= len(delta.items) || (i < len(result.items) && !delta.less(delta.items[j], result.items[i])) {
+			items = append(items, result.items[i])
+			i++
+		} else {
+			items = append(items, delta.items[j])
+			j++
+		}
+	}
+	result.items = items
+}
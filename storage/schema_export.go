@@ -0,0 +1,252 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "sort"
+import "strings"
+import "github.com/launix-de/memcp/scm"
+
+// DDL of a database: Scheme code of createtable/createforeignkey calls or SQL CREATE TABLE statements
+// only the table structs are read, so no shard is loaded; partitioning is not part of the schema (rebuild derives it from the data)
+func (db *database) ExportSchema(sql bool) string {
+	db.schemalock.RLock()
+	defer db.schemalock.RUnlock()
+	tables := db.Tables.GetAll()
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Name < tables[j].Name
+	})
+	if sql {
+		var b strings.Builder
+		for _, t := range tables {
+			b.WriteString(t.exportSQL())
+		}
+		return b.String()
+	}
+	code := []scm.Scmer{scm.Symbol("begin")}
+	for _, t := range tables {
+		code = append(code, t.exportCreateTable())
+	}
+	// foreign keys come last, so they may reference tables in any order
+	for _, t := range tables {
+		for _, k := range t.ownForeignKeys() {
+			code = append(code, []scm.Scmer{scm.Symbol("createforeignkey"), db.Name, k.Id, k.Tbl1, exportList(k.Cols1), k.Tbl2, exportList(k.Cols2), k.Updatemode.String(), k.Deletemode.String()})
+		}
+	}
+	var b strings.Builder
+	b.WriteString("(")
+	for i, c := range code {
+		if i > 0 {
+			b.WriteString("\n\t")
+		}
+		b.WriteString(scm.SerializeToString(c, &scm.Globalenv))
+	}
+	b.WriteString(")\n")
+	return b.String()
+}
+
+func (m foreignKeyMode) String() string {
+	switch m {
+		case CASCADE:
+			return "cascade"
+		case SETNULL:
+			return "set null"
+		default:
+			return "restrict"
+	}
+}
+
+// foreign keys declared by this table; t.Foreign also holds the keys that reference t
+func (t *table) ownForeignKeys() (result []foreignKey) {
+	seen := make(map[string]bool)
+	for _, k := range t.Foreign {
+		if k.Tbl1 == t.Name && !seen[k.Id] {
+			seen[k.Id] = true
+			result = append(result, k)
+		}
+	}
+	return
+}
+
+// '(...) of strings in generated code
+func exportList(items []string) scm.Scmer {
+	result := []scm.Scmer{scm.Symbol("list")}
+	for _, s := range items {
+		result = append(result, s)
+	}
+	return result
+}
+
+func (t *table) exportCreateTable() scm.Scmer {
+	cols := []scm.Scmer{scm.Symbol("list")}
+	for _, c := range t.Columns {
+		if c.IsTemp {
+			continue // computed caches are recreated by the queries that need them
+		}
+		dims := []scm.Scmer{scm.Symbol("list")}
+		for _, d := range c.Typdimensions {
+			dims = append(dims, int64(d))
+		}
+		params := []scm.Scmer{scm.Symbol("list")}
+		if c.AutoIncrement {
+			params = append(params, "auto_increment", true)
+		}
+		if !c.AllowNull {
+			params = append(params, "null", false)
+		}
+		if c.Default != nil {
+			params = append(params, "default", c.Default)
+		}
+		if c.OnUpdate != nil {
+			params = append(params, "update", c.OnUpdate)
+		}
+		if c.Comment != "" {
+			params = append(params, "comment", c.Comment)
+		}
+		if c.Collation != "utf8mb4" {
+			params = append(params, "collate", c.Collation)
+		}
+		if c.StorageHint != "" {
+			params = append(params, "storage", c.StorageHint)
+		}
+		if c.Bloom {
+			params = append(params, "bloom", true)
+		}
+		if c.EnumValues != nil {
+			params = append(params, "enum", exportList(c.EnumValues))
+		}
+		if c.EnumInvalidNull {
+			params = append(params, "enumInvalidNull", true)
+		}
+		cols = append(cols, []scm.Scmer{scm.Symbol("list"), "column", c.Name, c.Typ, dims, params})
+	}
+	for _, u := range t.Unique {
+		cols = append(cols, []scm.Scmer{scm.Symbol("list"), "unique", u.Id, exportList(u.Cols)})
+	}
+	options := []scm.Scmer{scm.Symbol("list"), "engine", t.PersistencyMode.String()}
+	if t.Collation != "" {
+		options = append(options, "collation", t.Collation)
+	}
+	if t.Charset != "" {
+		options = append(options, "charset", t.Charset)
+	}
+	if t.Comment != "" {
+		options = append(options, "comment", t.Comment)
+	}
+	if t.Compress != "" {
+		options = append(options, "compress", t.Compress)
+	}
+	if t.Auto_increment != 0 {
+		options = append(options, "auto_increment", int64(t.Auto_increment))
+	}
+	return []scm.Scmer{scm.Symbol("createtable"), t.schema.Name, t.Name, cols, options}
+}
+
+func sqlIdentifier(id string) string {
+	return "`" + strings.ReplaceAll(id, "`", "``") + "`"
+}
+
+func sqlIdentifiers(ids []string) string {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = sqlIdentifier(id)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func sqlLiteral(v scm.Scmer) string {
+	switch v := v.(type) {
+		case nil:
+			return "NULL"
+		case string:
+			return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(v) + "'"
+		case bool:
+			if v {
+				return "TRUE"
+			}
+			return "FALSE"
+		default:
+			return scm.String(v)
+	}
+}
+
+func (t *table) exportSQL() string {
+	var defs []string
+	for _, c := range t.Columns {
+		if c.IsTemp {
+			continue
+		}
+		def := sqlIdentifier(c.Name) + " " + c.Typ
+		if c.EnumValues != nil {
+			members := make([]string, len(c.EnumValues))
+			for i, m := range c.EnumValues {
+				members[i] = sqlLiteral(m)
+			}
+			def += "(" + strings.Join(members, ", ") + ")"
+		} else if len(c.Typdimensions) > 0 {
+			dims := make([]string, len(c.Typdimensions))
+			for i, d := range c.Typdimensions {
+				dims[i] = fmt.Sprint(d)
+			}
+			def += "(" + strings.Join(dims, ",") + ")"
+		}
+		if !c.AllowNull {
+			def += " NOT NULL"
+		}
+		if c.AutoIncrement {
+			def += " AUTO_INCREMENT"
+		}
+		if c.Default != nil {
+			def += " DEFAULT " + sqlLiteral(c.Default)
+		}
+		if c.OnUpdate != nil {
+			def += " ON UPDATE " + sqlLiteral(c.OnUpdate)
+		}
+		if c.Collation != "utf8mb4" {
+			def += " COLLATE " + c.Collation
+		}
+		if c.Comment != "" {
+			def += " COMMENT " + sqlLiteral(c.Comment)
+		}
+		defs = append(defs, def)
+	}
+	for _, u := range t.Unique {
+		if u.Id == "PRIMARY" {
+			defs = append(defs, "PRIMARY KEY (" + sqlIdentifiers(u.Cols) + ")")
+		} else {
+			defs = append(defs, "UNIQUE KEY " + sqlIdentifier(u.Id) + " (" + sqlIdentifiers(u.Cols) + ")")
+		}
+	}
+	// CREATE TABLE accepts forward references, so the keys can stay inline
+	for _, k := range t.ownForeignKeys() {
+		defs = append(defs, "CONSTRAINT " + sqlIdentifier(k.Id) + " FOREIGN KEY (" + sqlIdentifiers(k.Cols1) + ") REFERENCES " + sqlIdentifier(k.Tbl2) + " (" + sqlIdentifiers(k.Cols2) + ") ON DELETE " + strings.ToUpper(k.Deletemode.String()) + " ON UPDATE " + strings.ToUpper(k.Updatemode.String()))
+	}
+	result := "CREATE TABLE " + sqlIdentifier(t.Name) + " (\n\t" + strings.Join(defs, ",\n\t") + "\n) ENGINE=" + strings.ToUpper(t.PersistencyMode.String())
+	if t.Collation != "" {
+		result += " COLLATE=" + t.Collation
+	}
+	if t.Charset != "" {
+		result += " DEFAULT CHARSET=" + t.Charset
+	}
+	if t.Comment != "" {
+		result += " COMMENT=" + sqlLiteral(t.Comment)
+	}
+	if t.Auto_increment != 0 {
+		result += fmt.Sprintf(" AUTO_INCREMENT=%d", t.Auto_increment)
+	}
+	return result + ";\n"
+}
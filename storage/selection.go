@@ -0,0 +1,132 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "sync"
+import "runtime/debug"
+import "github.com/google/uuid"
+import "github.com/launix-de/memcp/scm"
+import "github.com/launix-de/NonLockingReadMap"
+
+// result of scan-selection: the matching record ids of each shard
+// a selection is a snapshot; it can be fed into scan as preFilter as long as the shards are not rebuilt
+type scanSelection struct {
+	t *table
+	shards map[uuid.UUID]*NonLockingReadMap.NonBlockingBitMap // shard uuid changes on rebuild, so record ids stay valid per uuid
+	count uint
+}
+
+func (s *scanSelection) String() string {
+	return fmt.Sprintf("[selection of %d items in %s]", s.count, s.t.Name)
+}
+
+func (s *scanSelection) forShard(shard *storageShard) *NonLockingReadMap.NonBlockingBitMap {
+	result, ok := s.shards[shard.uuid]
+	if !ok {
+		panic("selection on table " + s.t.Name + " is outdated: the shards have been rebuilt since scan-selection")
+	}
+	return result
+}
+
+// filter pass that remembers the record ids instead of mapping them
+func (t *table) scanSelection(conditionCols []string, condition scm.Scmer, options scanOptions) *scanSelection {
+	if options.preFilter != nil && options.preFilter.t != t {
+		panic("preFilter selection belongs to table " + options.preFilter.t.Name + ", not " + t.Name)
+	}
+	boundaries := extractBoundaries(conditionCols, condition)
+	condition = options.collateCondition(conditionCols, condition, boundaries)
+	lower, upperLast := indexFromBoundaries(boundaries)
+
+	result := new(scanSelection)
+	result.t = t
+	result.shards = make(map[uuid.UUID]*NonLockingReadMap.NonBlockingBitMap)
+	// shards that are skipped by partitioning have an empty selection
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	for _, s := range shardlist {
+		result.shards[s.uuid] = new(NonLockingReadMap.NonBlockingBitMap)
+	}
+
+	var mu sync.Mutex
+	var err scm.Scmer
+	t.iterateShards(boundaries, func (s *storageShard) {
+		defer func () {
+			if r := recover(); r != nil {
+				mu.Lock()
+				err = scanError{r, string(debug.Stack())}
+				mu.Unlock()
+			}
+		}()
+		bitmap, count := s.scanSelection(boundaries, lower, upperLast, conditionCols, condition, options)
+		mu.Lock()
+		result.shards[s.uuid] = bitmap
+		result.count += count
+		mu.Unlock()
+	})
+	if err != nil {
+		panic(err) // cascade panic
+	}
+	return result
+}
+
+func (t *storageShard) scanSelection(boundaries boundaries, lower []scm.Scmer, upperLast scm.Scmer, conditionCols []string, condition scm.Scmer, options scanOptions) (result *NonLockingReadMap.NonBlockingBitMap, count uint) {
+	result = new(NonLockingReadMap.NonBlockingBitMap)
+	var selection *NonLockingReadMap.NonBlockingBitMap
+	if options.preFilter != nil {
+		selection = options.preFilter.forShard(t)
+	}
+
+	conditionFn := scm.OptimizeProcToSerialFunction(condition)
+	cdataset := make([]scm.Scmer, len(conditionCols))
+	ccols := make([]ColumnStorage, len(conditionCols))
+	for i, k := range conditionCols { // iterate over columns
+		var ok bool
+		ccols[i], ok = t.columns[k] // find storage
+		if !ok {
+			panic("Column does not exist: `" + t.t.schema.Name + "`.`" + t.t.Name + "`.`" + k + "`")
+		}
+	}
+
+	t.mu.RLock()
+	maxInsertIndex := len(t.inserts)
+	t.iterateIndex(boundaries, lower, upperLast, maxInsertIndex, func (idx uint) {
+		if t.deletions.Get(idx) {
+			return // item is on delete list
+		}
+		if selection != nil && !selection.Get(idx) {
+			return // item was not selected by preFilter
+		}
+		if idx < t.main_count {
+			for i, k := range ccols {
+				cdataset[i] = k.GetValue(idx)
+			}
+		} else {
+			for i, k := range conditionCols {
+				cdataset[i] = t.getDelta(int(idx - t.main_count), k)
+			}
+		}
+		if scm.ToBool(conditionFn(cdataset...)) {
+			result.Set(idx, true)
+			count++
+		}
+	})
+	t.mu.RUnlock()
+	return
+}
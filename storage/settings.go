@@ -16,6 +16,9 @@ Copyright (C) 2024  Carl-Philip Hänsch
 */
 package storage
 
+import "os"
+import "strings"
+import "encoding/json"
 import "github.com/dc0d/onexit"
 import "github.com/launix-de/memcp/scm"
 
@@ -25,9 +28,17 @@ type SettingsT struct {
 	PartitionMaxDimensions int
 	DefaultEngine string
 	ShardSize uint
+	ColumnStatistics bool
+	ForeignKeyChecks bool // default for sessions that did not SET FOREIGN_KEY_CHECKS (see foreignKeyChecks)
+	RepartitionThreshold uint // rebuild only repartitions when the shard count deviates by more than this percentage
+	SyncInterval uint // milliseconds; > 0 groups the fsyncs of safe tables at the cost of latency (see groupcommit.go), 0 = fsync after every statement
+	MaxScanParallelism uint // maximum number of shards scanned concurrently; 0 = GOMAXPROCS
 }
 
-var Settings SettingsT = SettingsT{false, false, 10, "safe", 60000}
+var Settings SettingsT = SettingsT{false, false, 10, "safe", 60000, true, true, 50, 0, 0}
+
+// keys accepted by (settings); used for the error message on unknown keys
+var settingsKeys = []string{"Backtrace", "Trace", "PartitionMaxDimensions", "DefaultEngine", "ShardSize", "ColumnStatistics", "ForeignKeyChecks", "RepartitionThreshold", "SyncInterval", "MaxScanParallelism"}
 
 // call this after you filled Settings
 func InitSettings() {
@@ -43,33 +54,94 @@ func ChangeSettings(a ...scm.Scmer) scm.Scmer {
 			case "Backtrace":
 				return Settings.Backtrace
 			case "Trace":
-				return Settings.Backtrace
+				return Settings.Trace
 			case "PartitionMaxDimensions":
 				return int64(Settings.PartitionMaxDimensions)
 			case "DefaultEngine":
 				return Settings.DefaultEngine
 			case "ShardSize":
 				return int64(Settings.ShardSize)
+			case "ColumnStatistics":
+				return Settings.ColumnStatistics
+			case "ForeignKeyChecks":
+				return Settings.ForeignKeyChecks
+			case "RepartitionThreshold":
+				return int64(Settings.RepartitionThreshold)
+			case "SyncInterval":
+				return int64(Settings.SyncInterval)
+			case "MaxScanParallelism":
+				return int64(Settings.MaxScanParallelism)
 			default:
-				panic("unknown setting: " + scm.String(a[0]))
+				panic("unknown setting: " + scm.String(a[0]) + " (valid keys: " + strings.Join(settingsKeys, ", ") + ")")
 		}
 	} else {
 		switch scm.String(a[0]) {
 			case "Backtrace":
-				scm.SettingsHaveGoodBacktraces = Settings.Backtrace
 				Settings.Backtrace = scm.ToBool(a[1])
+				scm.SettingsHaveGoodBacktraces = Settings.Backtrace
 			case "Trace":
 				Settings.Trace = scm.ToBool(a[1])
 				scm.SetTrace(Settings.Trace)
 			case "PartitionMaxDimensions":
-				Settings.PartitionMaxDimensions = scm.ToInt(a[1])
+				Settings.PartitionMaxDimensions = settingsInt(a[0], a[1], 1)
 			case "DefaultEngine":
 				Settings.DefaultEngine = scm.String(a[1])
 			case "ShardSize":
-				Settings.ShardSize = uint(scm.ToInt(a[1]))
+				Settings.ShardSize = uint(settingsInt(a[0], a[1], 1))
+			case "ColumnStatistics":
+				Settings.ColumnStatistics = scm.ToBool(a[1])
+			case "ForeignKeyChecks":
+				Settings.ForeignKeyChecks = scm.ToBool(a[1])
+			case "RepartitionThreshold":
+				Settings.RepartitionThreshold = uint(settingsInt(a[0], a[1], 1))
+			case "SyncInterval":
+				Settings.SyncInterval = uint(settingsInt(a[0], a[1], 0))
+			case "MaxScanParallelism":
+				Settings.MaxScanParallelism = uint(settingsInt(a[0], a[1], 0))
 			default:
-				panic("unknown setting: " + scm.String(a[0]))
+				panic("unknown setting: " + scm.String(a[0]) + " (valid keys: " + strings.Join(settingsKeys, ", ") + ")")
 		}
+		SaveSettings()
 		return true
 	}
 }
+
+// validates an integer setting against its lower bound
+func settingsInt(key, value scm.Scmer, min int) int {
+	switch value.(type) {
+		case int64, float64:
+			// ok
+		default:
+			panic("setting " + scm.String(key) + " must be an integer")
+	}
+	if f, ok := value.(float64); ok && f != float64(int64(f)) {
+		panic("setting " + scm.String(key) + " must be an integer")
+	}
+	result := scm.ToInt(value)
+	if result < min {
+		panic("setting " + scm.String(key) + " must be at least " + scm.String(int64(min)))
+	}
+	return result
+}
+
+// writes data/settings.json; the temp file + rename keeps the old file intact on a crash
+func SaveSettings() {
+	data, _ := json.Marshal(Settings)
+	if err := os.MkdirAll(Basepath, 0750); err != nil {
+		panic(err)
+	}
+	tmpname := Basepath + "/settings.json.tmp"
+	f, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		panic(err)
+	}
+	f.Sync()
+	f.Close()
+	if err := os.Rename(tmpname, Basepath + "/settings.json"); err != nil {
+		panic(err)
+	}
+}
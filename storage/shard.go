@@ -21,8 +21,9 @@ import "sync"
 import "strings"
 import "reflect"
 import "runtime"
+import "time"
+import "sync/atomic"
 import "encoding/json"
-import "encoding/binary"
 import "github.com/google/uuid"
 import "github.com/launix-de/memcp/scm"
 import "github.com/launix-de/NonLockingReadMap"
@@ -41,12 +42,21 @@ type storageShard struct {
 	mu sync.RWMutex // delta write lock (working on main storage is lock free)
 	uniquelock sync.Mutex // unique insert lock (only used in the sharded case)
 	next *storageShard // TODO: also make a next-partition-schema
+	nextDeletions NonLockingReadMap.NonBlockingBitMap // deletions when the rebuild into next started
+	dualWrite bool // repartitioning: inserts are also written into the new partitions (set and cleared by repartition)
+	baseSequence uint64 // writes up to this sequence number were merged into the shard when it was built by rebuild or repartition
 	// indexes
 	Indexes []*StorageIndex // sorted keys
 	indexMutex sync.Mutex
 	hashmaps1 map[[1]string]map[[1]scm.Scmer]uint // hashmaps for single columned unique keys
 	hashmaps2 map[[2]string]map[[2]scm.Scmer]uint // hashmaps for single columned unique keys
 	hashmaps3 map[[3]string]map[[3]scm.Scmer]uint // hashmaps for single columned unique keys
+	// change-data-capture: which writes since the last rebuild touched which record ids
+	changes []shardChange
+	computors map[string]deltaComputor // computed columns for the delta storage (built with the first insert, see compute.go)
+	// statistics
+	stats map[string]*columnStats // incrementally maintained column statistics (nil until first use)
+	blooms map[string]*bloomFilter // bloom filters over the main storage of columns with the bloom option (see bloom.go)
 }
 
 func (s *storageShard) Size() uint {
@@ -61,6 +71,47 @@ func (s *storageShard) Size() uint {
 	return result
 }
 
+// read-only snapshot of the internal state for diagnostics (inspect-shard)
+// shards are always resident in memory, so there is no cold state that could be loaded by this
+func (s *storageShard) inspect() scm.Scmer {
+	s.mu.RLock()
+	columns := make([]scm.Scmer, 0, 2 * len(s.columns))
+	for name, c := range s.columns {
+		columns = append(columns, name, c.String())
+	}
+	deltaColumns := make([]scm.Scmer, 0, 2 * len(s.deltaColumns))
+	for name, pos := range s.deltaColumns {
+		deltaColumns = append(deltaColumns, name, int64(pos))
+	}
+	inserts := len(s.inserts)
+	changes := len(s.changes)
+	rebuilding := s.next != nil
+	logfile := s.logfile != nil
+	s.mu.RUnlock()
+	s.indexMutex.Lock()
+	indexes := make([]scm.Scmer, len(s.Indexes))
+	for i, index := range s.Indexes {
+		cols := make([]scm.Scmer, len(index.Cols))
+		for j, c := range index.Cols {
+			cols[j] = c
+		}
+		indexes[i] = []scm.Scmer{"cols", cols, "active", index.active, "savings", index.Savings}
+	}
+	s.indexMutex.Unlock()
+	return []scm.Scmer{
+		"uuid", s.uuid.String(),
+		"main_count", int64(s.main_count),
+		"inserts", int64(inserts),
+		"deletions", int64(s.deletions.Count()),
+		"columns", columns,
+		"deltaColumns", deltaColumns,
+		"indexes", indexes,
+		"changes", int64(changes),
+		"rebuilding", rebuilding, // next != nil: a rebuild or repartition is in progress and writes are mirrored to the new shard
+		"logfile", logfile,
+	}
+}
+
 func (u *storageShard) MarshalJSON() ([]byte, error) {
 	return json.Marshal(u.uuid.String())
 }
@@ -75,6 +126,11 @@ func (u *storageShard) UnmarshalJSON(data []byte) error {
 	// the rest of the unmarshalling is done in the caller because u.t is nil in the moment
 	return nil
 }
+/* TODO: evict cold shards under memory pressure. load reads all columns eagerly and shards
+stay resident until the table is dropped, so there is no COLD/SHARED state that an evictor
+could fall back to. This needs lazy column loading on every access path to t.columns (scan,
+scan_order, indexes, updates, rebuild) plus a last-access time per shard; only then can an
+LRU walk free the columns of idle non-Memory shards once the heap exceeds a memory budget. */
 func (u *storageShard) load(t *table) {
 	u.t = t
 	// load the columns
@@ -85,8 +141,7 @@ func (u *storageShard) load(t *table) {
 		} else {
 			// read column from file
 			f := u.t.schema.persistence.ReadColumn(u.uuid.String(), col.Name)
-			var magicbyte uint8 // type of that column
-			err := binary.Read(f, binary.LittleEndian, &magicbyte)
+			magicbyte, r, err := openColumn(f) // decompresses compressed column files
 			if err != nil {
 				// empty storage
 				u.columns[col.Name] = new(StorageSparse)
@@ -96,23 +151,37 @@ func (u *storageShard) load(t *table) {
 			fmt.Println("loading storage "+u.t.schema.Name + " shard " + u.uuid.String() + " column " + col.Name+" of type", magicbyte)
 
 			columnstorage := reflect.New(storages[magicbyte]).Interface().(ColumnStorage)
-			u.main_count = columnstorage.Deserialize(f) // read; ownership of f goes to Deserialize, so they will free the handle
+			u.main_count = columnstorage.Deserialize(r) // read; ownership of f goes to Deserialize, so they will free the handle
 			u.columns[col.Name] = columnstorage
 			f.Close()
 		}
 	}
 
 	if t.PersistencyMode == Safe || t.PersistencyMode == Logged {
-		var log chan interface{}
-		log, u.logfile = u.t.schema.persistence.ReplayLog(u.uuid.String())
+		log, logfile := u.t.schema.persistence.ReplayLog(u.uuid.String(), 0)
+		u.logfile = groupCommit(logfile)
 		numEntriesRestored := 0
 		for logentry := range log {
 			numEntriesRestored++
 			switch l := logentry.(type) {
 				case LogEntryDelete:
 					u.deletions.Set(l.idx, true) // mark deletion
+					u.recordChange(l.seq, l.ts, l.idx, 0)
+					raiseSequence(&t.LogSequence, l.seq)
+				case LogEntryUndelete:
+					u.deletions.Set(l.idx, false)
+					u.recordChange(l.seq, l.ts, l.idx, 1)
+					raiseSequence(&t.LogSequence, l.seq)
 				case LogEntryInsert:
+					recid := u.main_count + uint(len(u.inserts))
 					u.insertDataset(l.cols, l.values)
+					u.recordChange(l.seq, l.ts, recid, uint(len(l.values)))
+					raiseSequence(&t.LogSequence, l.seq)
+				case LogEntryRename:
+					if idx, ok := u.deltaColumns[l.oldName]; ok {
+						delete(u.deltaColumns, l.oldName)
+						u.deltaColumns[l.newName] = idx
+					}
 				default:
 					panic("unknown log sequence: " + fmt.Sprint(l))
 			}
@@ -121,6 +190,11 @@ func (u *storageShard) load(t *table) {
 			fmt.Println("restoring delta storage from database " + u.t.schema.Name + " shard " + u.uuid.String() + ":", numEntriesRestored, "entries")
 		}
 	}
+	if t.PersistencyMode != Memory {
+		u.loadIndexes()
+		u.loadBlooms()
+	}
+	u.addForeignKeyIndexes()
 }
 
 func NewShard(t *table) *storageShard {
@@ -137,8 +211,9 @@ func NewShard(t *table) *storageShard {
 		result.columns[column.Name] = new (StorageSparse)
 	}
 	if t.PersistencyMode == Safe || t.PersistencyMode == Logged {
-		result.logfile = result.t.schema.persistence.OpenLog(result.uuid.String())
+		result.logfile = groupCommit(result.t.schema.persistence.OpenLog(result.uuid.String()))
 	}
+	result.addForeignKeyIndexes()
 	return result
 }
 
@@ -147,14 +222,25 @@ func (t *storageShard) Count() uint {
 }
 
 func (t *storageShard) UpdateFunction(idx uint, withTrigger bool) func(...scm.Scmer) scm.Scmer {
+	return t.updateFunction(idx, withTrigger, 0)
+}
+
+// seq = 0 assigns a new sequence number; changes that are propagated to the next shard keep their sequence number
+func (t *storageShard) updateFunction(idx uint, withTrigger bool, seq uint64) func(...scm.Scmer) scm.Scmer {
 	// returns a callback with which you can delete or update an item
 	return func(a ...scm.Scmer) scm.Scmer {
+		rowseq := seq
 		//fmt.Println("update/delete", a)
-		// TODO: check foreign keys (new value of column must be present in referenced table)
-		// TODO: check foreign key removal (old value is referenced in another table)
+		// TODO: check foreign keys on update (new value of column must be present in referenced table, old value may be referenced in another table)
 
 		result := false // result = true when update was possible; false if there was a RESTRICT
+		var oldRow, newRow []scm.Scmer // OLD and NEW for triggers
 		if len(a) > 0 {
+			if withTrigger && t.t.hasTriggers("update") {
+				oldRow = t.oldRow(idx)
+				newRow = t.t.fireBefore("update", oldRow, applyChanges(oldRow, a[0].([]scm.Scmer)))
+				a = []scm.Scmer{newRow}
+			}
 			func () {
 				t.mu.Lock() // write lock
 				defer t.mu.Unlock() // write lock
@@ -181,14 +267,20 @@ func (t *storageShard) UpdateFunction(idx uint, withTrigger bool) func(...scm.Sc
 						d2[colidx] = t.getDelta(int(idx - t.main_count), k)
 					}
 				}
-				// now d2 contains the old col (TODO: preserve OLD and NEW for triggers or bind them to trigger variables)
+				// now d2 contains the old col
 				for j := 0; j < len(changes); j += 2 {
 					colidx, ok := t.deltaColumns[scm.String(changes[j])]
 					if !ok {
 						panic("UPDATE on invalid column: " + scm.String(changes[j]))
 					}
-					if d2[colidx] != changes[j+1] {
-						d2[colidx] = changes[j+1]
+					value := changes[j+1]
+					for _, c := range t.t.Columns {
+						if c.EnumValues != nil && c.Name == cols[colidx] {
+							value = c.enumValue(value)
+						}
+					}
+					if d2[colidx] != value {
+						d2[colidx] = value
 						result = true // mark that something has changed
 					}
 				}
@@ -211,42 +303,68 @@ func (t *storageShard) UpdateFunction(idx uint, withTrigger bool) func(...scm.Sc
 					t.deletions.Set(idx, true) // mark as deleted
 				}
 
+				if rowseq == 0 {
+					rowseq = t.t.nextSequence()
+				}
+				recid := t.main_count + uint(len(t.inserts))
+				ts := time.Now().UnixNano()
 				t.insertDataset(cols, [][]scm.Scmer{d2})
-				if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
-					t.logfile.Write(LogEntryDelete{idx})
-					t.logfile.Write(LogEntryInsert{cols, [][]scm.Scmer{d2}})
+				t.recordChange(rowseq, ts, idx, 0)
+				t.recordChange(rowseq, ts, recid, 1)
+				if seq == 0 {
+					t.recordUndo(idx, 0, true)
+					t.recordUndo(recid, 1, false)
+				}
+				if (t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged) && t.logfile != nil { // a rebuilt shard has no log; its successor logs the change
+					t.logfile.Write(LogEntryDelete{rowseq, ts, idx})
+					t.logfile.Write(LogEntryInsert{rowseq, ts, cols, [][]scm.Scmer{d2}})
 				}
 			}()
-			if t.t.PersistencyMode == Safe {
-				defer t.logfile.Sync() // write barrier after the lock, so other threads can continue without waiting for the other thread to write
+			if logfile := t.logfile; t.t.PersistencyMode == Safe && logfile != nil {
+				defer logfile.Sync() // write barrier after the lock, so other threads can continue without waiting for the other thread to write
 			}
-			if withTrigger {
-				// TODO: before/after update trigger
+			if result && oldRow != nil {
+				t.t.fireAfter("update", oldRow, newRow)
 			}
 		} else {
 			// delete
+			if withTrigger && t.t.hasTriggers("delete") {
+				oldRow = t.oldRow(idx)
+				t.t.fireBefore("delete", oldRow, nil)
+			}
+			if seq == 0 && foreignKeyChecks() && !t.t.deleteReferences(t, idx) {
+				return false // RESTRICT
+			}
 			func () {
 				t.mu.Lock() // write lock
 				defer t.mu.Unlock() // write lock
 
 				t.deletions.Set(idx, true) // mark as deleted
-				if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
-					t.logfile.Write(LogEntryDelete{idx})
+				if rowseq == 0 {
+					rowseq = t.t.nextSequence()
+				}
+				ts := time.Now().UnixNano()
+				t.recordChange(rowseq, ts, idx, 0)
+				if seq == 0 {
+					t.recordUndo(idx, 0, true)
+				}
+				if (t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged) && t.logfile != nil {
+					t.logfile.Write(LogEntryDelete{rowseq, ts, idx})
 				}
 				result = true
 			}()
-			if t.t.PersistencyMode == Safe {
-				defer t.logfile.Sync() // write barrier after the lock, so other threads can continue without waiting for the other thread to write
+			if logfile := t.logfile; t.t.PersistencyMode == Safe && logfile != nil {
+				defer logfile.Sync() // write barrier after the lock, so other threads can continue without waiting for the other thread to write
 			}
-			if withTrigger {
-				// TODO: before/after delete trigger
+			if result && oldRow != nil {
+				t.t.fireAfter("delete", oldRow, nil)
 			}
 		}
 		if result && t.next != nil {
 			// also change in next storage
-			// idx translation (subtract the amount of deletions from that idx)
-			idx2 := idx - t.deletions.CountUntil(idx)
-			t.next.UpdateFunction(idx2, false)(a...) // propagate to succeeding shard
+			// idx translation (subtract the amount of deletions that were removed by the rebuild from that idx)
+			idx2 := idx - t.nextDeletions.CountUntil(idx)
+			t.next.updateFunction(idx2, false, rowseq)(a...) // propagate to succeeding shard
 		}
 		return result // maybe instead return UpdateFunction for newly inserted item??
 	}
@@ -266,29 +384,51 @@ func (t *storageShard) ColumnReader(col string) func(uint) scm.Scmer {
 	}
 }
 
-func (t *storageShard) Insert(columns []string, values [][]scm.Scmer, alreadyLocked bool) {
+// returns the auto_increment ids of the inserted rows (nil if the table has no auto_increment column)
+func (t *storageShard) Insert(columns []string, values [][]scm.Scmer, alreadyLocked bool) []scm.Scmer {
+	return t.insert(columns, values, alreadyLocked, 0)
+}
+
+// seq = 0 assigns a new sequence number; inserts that are propagated to the next shard keep their sequence number
+func (t *storageShard) insert(columns []string, values [][]scm.Scmer, alreadyLocked bool, seq uint64) (ids []scm.Scmer) {
 	if !alreadyLocked {
 		t.mu.Lock()
 	}
-	t.insertDataset(columns, values)
-	if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
-		t.logfile.Write(LogEntryInsert{columns, values})
+	recid := t.main_count + uint(len(t.inserts))
+	if seq == 0 {
+		seq = t.t.nextSequence()
+		t.recordUndo(recid, uint(len(values)), false) // only the original write, not its propagation to next or dualWrite
+	}
+	ids = t.insertDataset(columns, values)
+	ts := time.Now().UnixNano()
+	t.recordChange(seq, ts, recid, uint(len(values)))
+	logfile := t.logfile // nil after the shard was rebuilt; its successor logs the insert
+	if (t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged) && logfile != nil {
+		logfile.Write(LogEntryInsert{seq, ts, columns, values})
 	}
 	if t.next != nil {
 		// also insert into next storage
-		t.next.Insert(columns, values, false)
+		t.next.insert(columns, values, false, seq)
+	}
+	if t.dualWrite {
+		// the shard is being repartitioned and was already copied
+		t.t.dualWrite(columns, values, seq)
 	}
 	if !alreadyLocked {
 		t.mu.Unlock()
 	}
-	if t.t.PersistencyMode == Safe {
-		t.logfile.Sync() // write barrier after the lock, so other threads can continue without waiting for the other thread to write
+	if t.t.PersistencyMode == Safe && logfile != nil {
+		logfile.Sync() // write barrier after the lock, so other threads can continue without waiting for the other thread to write
 	}
-	// TODO: before/after insert trigger
+	return // insert triggers are fired by table.Insert
 }
 
 // contract: must only be called inside full write mutex mu.Lock()
-func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
+// returns the auto_increment id of each row (nil if the table has no auto_increment column)
+func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) (ids []scm.Scmer) {
+	if t.computors == nil {
+		t.buildComputors()
+	}
 	colidx := make([]int, len(columns))
 	for i, col := range columns {
 		// copy all dataset entries into packed array
@@ -301,12 +441,14 @@ func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
 		}
 	}
 	var Auto_increment uint64
+	autoIncrementIdx := -1
 	for _, c := range t.t.Columns {
 		if c.AutoIncrement {
 			t.t.mu.Lock() // auto increment with global table lock outside the loop for a batch
 			Auto_increment = t.t.Auto_increment
 			t.t.Auto_increment = t.t.Auto_increment + uint64(len(values)) // batch reservation of new IDs
 			t.t.mu.Unlock()
+			ids = make([]scm.Scmer, len(values))
 		}
 		if c.AutoIncrement || c.Default != nil {
 			// column with default or auto increment -> also add to deltacolumns
@@ -319,7 +461,7 @@ func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
 			}
 		}
 	}
-	for _, row := range values {
+	for i, row := range values {
 		newrow := make([]scm.Scmer, len(t.deltaColumns))
 		for _, c := range t.t.Columns {
 			if c.AutoIncrement {
@@ -327,6 +469,7 @@ func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
 				cidx := t.deltaColumns[c.Name]
 				Auto_increment++ // local increase
 				newrow[cidx] = int64(Auto_increment)
+				autoIncrementIdx = cidx
 			} else if c.Default != nil {
 				// fill col with default
 				cidx := t.deltaColumns[c.Name]
@@ -339,7 +482,11 @@ func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
 				newrow[colidx] = row[j]
 			}
 		}
+		if autoIncrementIdx >= 0 {
+			ids[i] = newrow[autoIncrementIdx] // an explicit id of the row overrides the generated one
+		}
 		t.inserts = append(t.inserts, newrow)
+		t.updateColumnStats(recid)
 
 		// notify all hashmaps (what if col is not present in newrow??)
 		for k, v := range t.hashmaps1 {
@@ -369,6 +516,7 @@ func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
 			}
 		}
 	}
+	return
 }
 
 func (t *storageShard) GetRecordidForUnique(columns []string, values []scm.Scmer) (result uint, present bool) {
@@ -484,6 +632,9 @@ func (t *storageShard) GetRecordidForUnique(columns []string, values []scm.Scmer
 }
 
 func (t *storageShard) getDelta(idx int, col string) scm.Scmer {
+	if value, ok := t.computeDelta(idx, col); ok {
+		return value // computed columns are always recomputed from their source columns
+	}
 	item := t.inserts[idx]
 	colidx, ok := t.deltaColumns[col]
 	if ok {
@@ -497,15 +648,97 @@ func (t *storageShard) getDelta(idx int, col string) scm.Scmer {
 	}
 }
 
+// renames a column inside the shard; the main storage is rewritten under the new name and
+// the log gets a rename entry, so inserts that were logged under the old name are replayed correctly
+func (t *storageShard) renameColumn(oldName string, newName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.columns[oldName]; ok {
+		delete(t.columns, oldName)
+		t.columns[newName] = c
+		if t.t.PersistencyMode != Memory {
+			f := t.t.writeColumn(t.uuid.String(), newName)
+			c.Serialize(f) // c takes ownership of f
+			t.t.schema.persistence.RemoveColumn(t.uuid.String(), oldName)
+		}
+	}
+	if t.computors != nil {
+		t.buildComputors() // t.t.Columns is already renamed
+	}
+	if idx, ok := t.deltaColumns[oldName]; ok {
+		delete(t.deltaColumns, oldName)
+		t.deltaColumns[newName] = idx
+		if t.logfile != nil && (t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged) {
+			t.logfile.Write(LogEntryRename{oldName, newName})
+		}
+	}
+	if s, ok := t.stats[oldName]; ok {
+		delete(t.stats, oldName)
+		t.stats[newName] = s
+	}
+	if b, ok := t.blooms[oldName]; ok {
+		delete(t.blooms, oldName)
+		t.blooms[newName] = b
+		t.saveBlooms()
+	}
+	// unique hashmaps are keyed by their column names
+	for k, v := range t.hashmaps1 {
+		if k2 := renameInKey(k[:], oldName, newName); k2 != nil {
+			delete(t.hashmaps1, k)
+			t.hashmaps1[[1]string(k2)] = v
+		}
+	}
+	for k, v := range t.hashmaps2 {
+		if k2 := renameInKey(k[:], oldName, newName); k2 != nil {
+			delete(t.hashmaps2, k)
+			t.hashmaps2[[2]string(k2)] = v
+		}
+	}
+	for k, v := range t.hashmaps3 {
+		if k2 := renameInKey(k[:], oldName, newName); k2 != nil {
+			delete(t.hashmaps3, k)
+			t.hashmaps3[[3]string(k2)] = v
+		}
+	}
+	t.indexMutex.Lock()
+	renamed := false
+	for _, index := range t.Indexes {
+		if k2 := renameInKey(index.Cols, oldName, newName); k2 != nil {
+			index.Cols = k2
+			renamed = true
+		}
+	}
+	t.indexMutex.Unlock()
+	if renamed {
+		t.saveIndexes()
+	}
+}
+
+// returns a copy of cols with oldName replaced or nil if oldName does not occur
+func renameInKey(cols []string, oldName string, newName string) []string {
+	var result []string
+	for i, c := range cols {
+		if c == oldName {
+			if result == nil {
+				result = append([]string{}, cols...)
+			}
+			result[i] = newName
+		}
+	}
+	return result
+}
+
 func (t *storageShard) RemoveFromDisk() {
 	// close logfile
-	if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
+	if t.logfile != nil {
 		t.logfile.Close()
 	}
 	for _, col := range t.t.Columns {
 		// delete column from file
 		t.t.schema.persistence.RemoveColumn(t.uuid.String(), col.Name)
 	}
+	t.t.schema.persistence.RemoveColumn(t.uuid.String(), indexFileName)
+	t.t.schema.persistence.RemoveColumn(t.uuid.String(), bloomFileName)
 	t.t.schema.persistence.RemoveLog(t.uuid.String())
 }
 
@@ -525,16 +758,36 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 	result := new(storageShard)
 	result.t = t.t
 	t.next = result
+	compactedSequence := atomic.LoadUint64(&t.t.LogSequence) // all later writes are propagated to result
+	result.baseSequence = compactedSequence
 	result.mu.Lock() // interlock so no one will rebuild the shard twice
-	defer result.mu.Unlock()
-	t.mu.Unlock()
-
-	// now read out deletion list
-	t.mu.RLock()
+	var oldLogfile PersistenceLogfile
+	rebuilt := false
+	defer func () {
+		result.mu.Unlock()
+		if rebuilt {
+			// the changes of the old delta storage are merged into main storage; keep them as history (later ones were propagated to result)
+			t.mu.Lock()
+			t.archiveChanges(func (i int, c shardChange) bool {
+				return c.seq <= compactedSequence
+			})
+			t.mu.Unlock()
+		}
+		if oldLogfile != nil {
+			// remove old log file; not before result is unlocked since inserts into t wait for result while they hold t.mu
+			t.mu.Lock()
+			t.logfile = nil
+			t.mu.Unlock()
+			oldLogfile.Close()
+			t.t.schema.persistence.RemoveLog(t.uuid.String())
+		}
+	}()
+	// read out deletion list in the same lock, so every later write is propagated exactly once
 	maxInsertIndex := len(t.inserts)
 	// copy-freeze deletions so we don't have to lock anything
 	deletions := t.deletions.Copy()
-	t.mu.RUnlock()
+	t.nextDeletions = t.deletions.Copy() // record ids of the old shard are translated with the frozen deletions
+	t.mu.Unlock()
 	// from now on, we can rebuild with no hurry; inserts and update/deletes on the previous shard will propagate to us, too
 
 	if all || maxInsertIndex > 0 || deletions.Count() > 0 {
@@ -558,8 +811,9 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 		result.deletions.Reset()
 		if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
 			// safe mode: also write all deltas to disk
-			t.logfile = result.t.schema.persistence.OpenLog(result.uuid.String())
+			result.logfile = groupCommit(result.t.schema.persistence.OpenLog(result.uuid.String()))
 		}
+		rebuilt = true
 
 		// copy column data in two phases: scan, build (if delta is non-empty)
 		isFirst := true
@@ -569,7 +823,8 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 			} else {
 				b.WriteString(", ")
 			}
-			var newcol ColumnStorage = new(StorageSCMER) // currently only scmer-storages
+			newcol, hint := t.t.initialStorage(col)
+			forced := false
 			var i uint
 			for {
 				// scan phase
@@ -595,7 +850,14 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 					newcol.scan(i, t.getDelta(idx, col))
 					i++
 				}
+				if forced {
+					break // the hinted storage is kept as it is
+				}
 				newcol2 := newcol.proposeCompression(i)
+				if hint != "" {
+					newcol2, forced = hintedStorage(hint, newcol, newcol2)
+					hint = ""
+				}
 				if newcol2 == nil {
 					break // we found the optimal storage format
 				} else {
@@ -607,6 +869,15 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 			// build phase
 			newcol.init(i)
 			i = 0
+			// keep statistics alive (and exact again, since deletions are gone now)
+			var stats *columnStats
+			if _, ok := t.stats[col]; ok && Settings.ColumnStatistics {
+				stats = newColumnStats()
+			}
+			var bloom *bloomFilter
+			if t.t.hasBloom(col) {
+				bloom = newBloomFilter(t.main_count + uint(maxInsertIndex)) // upper bound of the rows
+			}
 			// build main
 			for idx := uint(0); idx < t.main_count; idx++ {
 				// check for deletion
@@ -614,7 +885,14 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 					continue
 				}
 				// build
-				newcol.build(i, c.GetValue(idx))
+				value := c.GetValue(idx)
+				newcol.build(i, value)
+				if stats != nil {
+					stats.add(value)
+				}
+				if bloom != nil {
+					bloom.add(value)
+				}
 				i++
 			}
 			// build delta
@@ -624,11 +902,30 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 					continue
 				}
 				// build
-				newcol.build(i, t.getDelta(idx, col))
+				value := t.getDelta(idx, col)
+				newcol.build(i, value)
+				if stats != nil {
+					stats.add(value)
+				}
+				if bloom != nil {
+					bloom.add(value)
+				}
 				i++
 			}
 			newcol.finish()
 			result.columns[col] = newcol
+			if stats != nil {
+				if result.stats == nil {
+					result.stats = make(map[string]*columnStats)
+				}
+				result.stats[col] = stats
+			}
+			if bloom != nil {
+				if result.blooms == nil {
+					result.blooms = make(map[string]*bloomFilter)
+				}
+				result.blooms[col] = bloom
+			}
 			result.main_count = i
 
 			// write statistics
@@ -638,7 +935,7 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 
 			// write to disc (only if required)
 			if t.t.PersistencyMode != Memory {
-				f := result.t.schema.persistence.WriteColumn(result.uuid.String(), col)
+				f := result.t.writeColumn(result.uuid.String(), col)
 				newcol.Serialize(f) // col takes ownership of f, so they will defer f.Close() at the right time
 				f.Close()
 			}
@@ -647,13 +944,11 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 		b.WriteString(fmt.Sprint(result.main_count))
 		fmt.Println(b.String())
 		rebuildIndexes(t, result)
+		result.saveBlooms()
 		result.t.schema.save()
 
 		if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
-			// remove old log file
-			t.logfile.Close()
-			t.logfile = nil
-			t.t.schema.persistence.RemoveLog(t.uuid.String())
+			oldLogfile = t.logfile // writers that still hold the old shard check for nil inside the lock
 		}
 	} else {
 		// otherwise: table stays the same
@@ -664,9 +959,17 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 		result.inserts = t.inserts
 		result.deletions = deletions
 		result.Indexes = t.Indexes
+		result.blooms = t.blooms
 		result.hashmaps1 = t.hashmaps1
 		result.hashmaps2 = t.hashmaps2
 		result.hashmaps3 = t.hashmaps3
+		result.stats = t.stats
+		result.changes = t.changes
+		result.computors = t.computors
+		result.logfile = t.logfile
+		if result.hasDirtyIndexes() {
+			result.saveIndexes() // main storage is unchanged, only indexes that were built since the last write have to be added
+		}
 	}
 	return result
 }
@@ -0,0 +1,214 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "os"
+import "reflect"
+import "path/filepath"
+import "time"
+import "encoding/json"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+table snapshots
+
+a snapshot is a directory with a schema.json that describes the table, the main storage of
+every shard as column files and the delta of every shard frozen into a log file:
+
+ - path/schema.json
+ - path/[shard]-[column]
+ - path/[shard].log
+
+main storage is only replaced by rebuild and never mutated in place, so the column files of
+file-backed tables are hardlinked (and serialized from memory otherwise). The delta is copied
+while all shards are read-locked and inserts are blocked, so the snapshot reflects exactly one
+point in time between two rebuilds. Writes, rebuilds and schema changes are only blocked for the time
+it takes to copy the delta; the files are written afterwards. If a rebuild removes the column files
+of a frozen shard in the meantime, the hardlink fails and the column is serialized from memory.
+
+*/
+
+type tableSnapshot struct {
+	Table string
+	Time int64 // unix nanoseconds when the delta was frozen
+	PersistencyMode PersistencyMode
+	Columns []column
+	Unique []uniqueKey
+	Auto_increment uint64
+	Compress string
+	Shards []shardSnapshot
+}
+type shardSnapshot struct {
+	Uuid string
+	MainCount uint
+}
+
+// frozen state of one shard: main storage is immutable, so the references suffice
+type shardFreeze struct {
+	s *storageShard
+	columns map[string]ColumnStorage
+	main_count uint
+	inserts [][]scm.Scmer // delta rows in the order of t.Columns
+	deletions []uint
+}
+
+func (t *table) Snapshot(path string) int {
+	t.mu.Lock() // no rebuild or repartition while we freeze the shards
+	shards := t.Shards
+	if shards == nil {
+		shards = t.PShards
+	}
+
+	// freeze: block inserts and hold all shard locks at once, so all shards show the same point in time
+	t.insertMu.Lock()
+	for _, s := range shards {
+		s.mu.RLock()
+	}
+	snap := tableSnapshot{t.Name, time.Now().UnixNano(), t.PersistencyMode, append([]column(nil), t.Columns...), append([]uniqueKey(nil), t.Unique...), t.Auto_increment, t.Compress, nil}
+	freezes := make([]shardFreeze, len(shards))
+	result := 0
+	for i, s := range shards {
+		f := shardFreeze{s, make(map[string]ColumnStorage), s.main_count, make([][]scm.Scmer, len(s.inserts)), nil}
+		for col, c := range s.columns {
+			f.columns[col] = c
+		}
+		for j := range s.inserts {
+			row := make([]scm.Scmer, len(t.Columns))
+			for k, col := range t.Columns {
+				row[k] = s.getDelta(j, col.Name)
+			}
+			f.inserts[j] = row
+		}
+		for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ {
+			if s.deletions.Get(idx) {
+				f.deletions = append(f.deletions, idx)
+			}
+		}
+		freezes[i] = f
+		snap.Shards = append(snap.Shards, shardSnapshot{s.uuid.String(), s.main_count})
+		result += int(s.main_count) + len(s.inserts) - len(f.deletions)
+	}
+	for _, s := range shards {
+		s.mu.RUnlock()
+	}
+	t.insertMu.Unlock()
+	t.mu.Unlock()
+
+	// write the snapshot without holding any lock; only the frozen state is used from here on
+	path = snapshotPath(path)
+	if err := os.MkdirAll(path, 0750); err != nil {
+		panic(err)
+	}
+	dst := &FileStorage{path + "/"}
+	cols := make([]string, len(snap.Columns))
+	for i, c := range snap.Columns {
+		cols[i] = c.Name
+	}
+	for _, f := range freezes {
+		shard := f.s.uuid.String()
+		for col, c := range f.columns {
+			if src, ok := t.schema.persistence.(*FileStorage); ok && snap.PersistencyMode != Memory {
+				if os.Link(src.path + shard + "-" + ProcessColumnName(col), dst.path + shard + "-" + ProcessColumnName(col)) == nil {
+					continue
+				}
+			}
+			w := compressColumn(dst.WriteColumn(shard, col), snap.Compress)
+			c.Serialize(w) // c takes ownership of w
+			w.Close()
+		}
+		dst.RemoveLog(shard) // OpenLog appends
+		log := dst.OpenLog(shard)
+		if len(f.inserts) > 0 {
+			log.Write(LogEntryInsert{0, 0, cols, f.inserts})
+		}
+		for _, idx := range f.deletions {
+			log.Write(LogEntryDelete{0, 0, idx})
+		}
+		log.Sync()
+		log.Close()
+	}
+	// schema.json is written last, so an incomplete snapshot cannot be restored
+	data, err := json.Marshal(&snap)
+	if err != nil {
+		panic(err)
+	}
+	dst.WriteSchema(data)
+	return result
+}
+
+// creates a new table target from a snapshot written by Snapshot and returns the number of restored rows
+func (db *database) RestoreSnapshot(target string, path string) int {
+	src := &FileStorage{snapshotPath(path) + "/"}
+	data := src.ReadSchema()
+	if len(data) == 0 {
+		panic("no table snapshot found in " + path)
+	}
+	var snap tableSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		panic(err)
+	}
+
+	t, _ := CreateTable(db.Name, target, snap.PersistencyMode, false)
+	cols := make([]string, len(snap.Columns))
+	for i, c := range snap.Columns {
+		cols[i] = c.Name
+		t.CreateColumn(c.Name, c.Typ, c.Typdimensions, []scm.Scmer{"null", c.AllowNull, "default", c.Default, "collate", c.Collation, "comment", c.Comment, "auto_increment", c.AutoIncrement})
+	}
+	t.Unique = snap.Unique
+	t.Compress = snap.Compress
+
+	result := 0
+	for _, shard := range snap.Shards {
+		columns := make(map[string]ColumnStorage)
+		for _, col := range cols {
+			if c := readColumn(src, shard.Uuid, col); c != nil {
+				columns[col] = c
+			}
+		}
+		rows := replayRows(src, shard.Uuid, columns, shard.MainCount, cols, 0)
+		if len(rows) > 0 {
+			result += t.Insert(cols, rows, nil, nil, false, nil)
+		}
+	}
+	if t.Auto_increment < snap.Auto_increment {
+		t.Auto_increment = snap.Auto_increment
+	}
+	db.save()
+	return result
+}
+
+// relative paths are relative to the data directory
+func snapshotPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(Basepath, path)
+}
+
+// reads a column file (magic byte + content); nil if it does not exist
+func readColumn(p PersistenceEngine, shard string, col string) ColumnStorage {
+	f := p.ReadColumn(shard, col)
+	defer f.Close()
+	magicbyte, r, err := openColumn(f)
+	if err != nil {
+		return nil
+	}
+	columnstorage := reflect.New(storages[magicbyte]).Interface().(ColumnStorage)
+	columnstorage.Deserialize(r) // ownership of f goes to Deserialize
+	return columnstorage
+}
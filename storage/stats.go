@@ -0,0 +1,139 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "github.com/launix-de/memcp/scm"
+
+// incrementally maintained statistics of a column in one shard
+// deletions are not subtracted, so min/max/nulls/distinct are an upper bound until the next rebuild
+type columnStats struct {
+	min, max scm.Scmer
+	nulls uint
+	distinct scm.HyperLogLog // same sketch as hll-add
+}
+
+func newColumnStats() *columnStats {
+	return &columnStats{distinct: scm.NewHyperLogLog()}
+}
+
+func (s *columnStats) add(value scm.Scmer) {
+	if value == nil {
+		s.nulls++
+		return
+	}
+	if s.min == nil || scm.Less(value, s.min) {
+		s.min = value
+	}
+	if s.max == nil || scm.Less(s.max, value) {
+		s.max = value
+	}
+	s.distinct.Add(value)
+}
+
+func (s *columnStats) merge(other *columnStats) {
+	if other.min != nil && (s.min == nil || scm.Less(other.min, s.min)) {
+		s.min = other.min
+	}
+	if other.max != nil && (s.max == nil || scm.Less(s.max, other.max)) {
+		s.max = other.max
+	}
+	s.nulls += other.nulls
+	s.distinct.Merge(other.distinct)
+}
+
+// contract: must only be called inside full write mutex mu.Lock()
+func (t *storageShard) updateColumnStats(recid uint) {
+	if t.stats == nil {
+		return
+	}
+	if !Settings.ColumnStatistics {
+		t.stats = nil // statistics would get stale, so forget them
+		return
+	}
+	for col, s := range t.stats {
+		s.add(t.getDelta(int(recid - t.main_count), col))
+	}
+}
+
+// merges the statistics of a column of this shard into result (computes them on first use)
+func (t *storageShard) mergeColumnStats(col string, result *columnStats) {
+	t.mu.RLock()
+	if s, ok := t.stats[col]; ok {
+		result.merge(s)
+		t.mu.RUnlock()
+		return
+	}
+	t.mu.RUnlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.stats[col]; ok {
+		result.merge(s) // someone computed them in the meantime
+		return
+	}
+	s := newColumnStats()
+	cstorage := t.columns[col]
+	for idx := uint(0); idx < t.main_count; idx++ {
+		if !t.deletions.Get(idx) {
+			s.add(cstorage.GetValue(idx))
+		}
+	}
+	for idx := 0; idx < len(t.inserts); idx++ {
+		if !t.deletions.Get(t.main_count + uint(idx)) {
+			s.add(t.getDelta(idx, col))
+		}
+	}
+	if Settings.ColumnStatistics {
+		if t.stats == nil {
+			t.stats = make(map[string]*columnStats)
+		}
+		t.stats[col] = s // from now on, maintain them on insert
+	}
+	result.merge(s)
+}
+
+// distinct count of a column if the statistics were already computed (read-only, nothing is computed)
+func (t *storageShard) cachedDistinct(col string) (uint64, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if s, ok := t.stats[col]; ok {
+		return uint64(s.distinct.Count()), true
+	}
+	return 0, false
+}
+
+// statistics of a column over all shards
+func (t *table) ColumnStats(col string) *columnStats {
+	found := false
+	for _, c := range t.Columns {
+		if c.Name == col {
+			found = true
+		}
+	}
+	if !found {
+		panic("column " + t.Name + "." + col + " does not exist")
+	}
+	result := newColumnStats()
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	for _, s := range shardlist {
+		s.mergeColumnStats(col, result)
+	}
+	return result
+}
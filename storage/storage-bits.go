@@ -0,0 +1,110 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "encoding/binary"
+import "github.com/launix-de/memcp/scm"
+
+// boolean columns: one bit per row plus a NULL bitmap
+type StorageBits struct {
+	count uint64
+	values []uint64
+	nulls []uint64 // nil if the column has no NULLs
+	hasNull bool // scan phase
+}
+
+func (s *StorageBits) Size() uint {
+	return 8 * uint(len(s.values) + len(s.nulls)) + 8 + 2 * 24 /* two slices */
+}
+
+func (s *StorageBits) String() string {
+	if s.nulls != nil {
+		return "bits-nullable"
+	}
+	return "bits"
+}
+
+func (s *StorageBits) Serialize(f io.Writer) {
+	binary.Write(f, binary.LittleEndian, uint8(13)) // 13 = StorageBits
+	if s.nulls != nil {
+		io.WriteString(f, "\x01234567") // has NULL bitmap; fill up to 64 bit alignment
+	} else {
+		io.WriteString(f, "\x00234567")
+	}
+	binary.Write(f, binary.LittleEndian, s.count)
+	// now at offset 16 begin data
+	binary.Write(f, binary.LittleEndian, s.values)
+	if s.nulls != nil {
+		binary.Write(f, binary.LittleEndian, s.nulls)
+	}
+}
+func (s *StorageBits) Deserialize(f io.Reader) uint {
+	var flags [7]byte
+	f.Read(flags[:])
+	binary.Read(f, binary.LittleEndian, &s.count)
+	s.values = make([]uint64, (s.count + 63) / 64)
+	binary.Read(f, binary.LittleEndian, s.values)
+	if flags[0] == 1 {
+		s.nulls = make([]uint64, (s.count + 63) / 64)
+		binary.Read(f, binary.LittleEndian, s.nulls)
+	} else {
+		s.nulls = nil
+	}
+	return uint(s.count)
+}
+
+func (s *StorageBits) GetValue(i uint) scm.Scmer {
+	if s.nulls != nil && (s.nulls[i / 64] >> (i % 64)) & 1 != 0 {
+		return nil
+	}
+	return (s.values[i / 64] >> (i % 64)) & 1 != 0
+}
+
+func (s *StorageBits) scan(i uint, value scm.Scmer) {
+	if value == nil {
+		s.hasNull = true
+	}
+}
+func (s *StorageBits) prepare() {
+	s.hasNull = false
+}
+func (s *StorageBits) init(i uint) {
+	// allocate
+	s.count = uint64(i)
+	s.values = make([]uint64, (i + 63) / 64)
+	if s.hasNull {
+		s.nulls = make([]uint64, (i + 63) / 64)
+	} else {
+		s.nulls = nil
+	}
+}
+func (s *StorageBits) build(i uint, value scm.Scmer) {
+	// store
+	if value == nil {
+		s.nulls[i / 64] |= 1 << (i % 64)
+	} else if scm.ToBool(value) {
+		s.values[i / 64] |= 1 << (i % 64)
+	}
+}
+func (s *StorageBits) finish() {
+}
+
+func (s *StorageBits) proposeCompression(i uint) ColumnStorage {
+	// dont't propose another pass
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright (C) 2023  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "fmt"
+import "sync/atomic"
+import "encoding/binary"
+import "github.com/launix-de/memcp/scm"
+
+// rows per block; every block starts with its own base value, so GetValue decodes at most deltaBlockSize varints
+const deltaBlockSize = 256
+
+// delta-of-delta encoding for (nearly) monotonic integers like timestamps and auto_increment ids
+// each value is stored as the zigzag varint of the change of the difference to its predecessor,
+// so a constant stride costs one byte per row; NULLs are kept in a bitmap and have no varint
+type StorageDeltaInt struct {
+	bases []int64 // first value of each block
+	offsets []uint64 // start of each block in data
+	data []byte
+	nulls []uint64 // bitmap of NULL rows (nil if there are none)
+	count uint
+
+	// build state
+	hasNull bool
+	prev, prevDelta int64
+	blockHasValue bool
+
+	// position of the last read, so sequential reads continue decoding instead of restarting at the block
+	cursor atomic.Pointer[deltaCursor]
+}
+
+type deltaCursor struct {
+	idx uint
+	pos int
+	value, delta int64
+}
+
+func (s *StorageDeltaInt) Size() uint {
+	return uint(len(s.data)) + 16 * uint(len(s.bases)) + 8 * uint(len(s.nulls)) + 8*8
+}
+
+func (s *StorageDeltaInt) String() string {
+	if s.nulls != nil {
+		return fmt.Sprintf("delta[%d blocks; %d bytes]NULL", len(s.bases), len(s.data))
+	}
+	return fmt.Sprintf("delta[%d blocks; %d bytes]", len(s.bases), len(s.data))
+}
+
+func (s *StorageDeltaInt) Serialize(f io.Writer) {
+	binary.Write(f, binary.LittleEndian, uint8(14)) // 14 = StorageDeltaInt
+	io.WriteString(f, "1234567") // dummy
+	binary.Write(f, binary.LittleEndian, uint64(s.count))
+	binary.Write(f, binary.LittleEndian, uint64(len(s.bases)))
+	binary.Write(f, binary.LittleEndian, uint64(len(s.nulls)))
+	binary.Write(f, binary.LittleEndian, uint64(len(s.data)))
+	binary.Write(f, binary.LittleEndian, s.bases)
+	binary.Write(f, binary.LittleEndian, s.offsets)
+	binary.Write(f, binary.LittleEndian, s.nulls)
+	f.Write(s.data)
+}
+
+func (s *StorageDeltaInt) Deserialize(f io.Reader) uint {
+	var dummy [7]byte
+	io.ReadFull(f, dummy[:])
+	var count, blocks, nulls, datalen uint64
+	binary.Read(f, binary.LittleEndian, &count)
+	binary.Read(f, binary.LittleEndian, &blocks)
+	binary.Read(f, binary.LittleEndian, &nulls)
+	binary.Read(f, binary.LittleEndian, &datalen)
+	s.count = uint(count)
+	s.bases = make([]int64, blocks)
+	s.offsets = make([]uint64, blocks)
+	binary.Read(f, binary.LittleEndian, s.bases)
+	binary.Read(f, binary.LittleEndian, s.offsets)
+	if nulls > 0 {
+		s.nulls = make([]uint64, nulls)
+		binary.Read(f, binary.LittleEndian, s.nulls)
+	}
+	s.data = make([]byte, datalen)
+	io.ReadFull(f, s.data)
+	return s.count
+}
+
+func (s *StorageDeltaInt) isNull(i uint) bool {
+	return s.nulls != nil && s.nulls[i / 64] & (1 << (i % 64)) != 0
+}
+
+func (s *StorageDeltaInt) GetValue(i uint) scm.Scmer {
+	if s.isNull(i) {
+		return nil
+	}
+	block := i / deltaBlockSize
+	c := deltaCursor{block * deltaBlockSize, int(s.offsets[block]), s.bases[block], 0}
+	if last := s.cursor.Load(); last != nil && last.idx <= i && last.idx / deltaBlockSize == block {
+		c = *last // continue from the last read
+	}
+	for ; c.idx <= i; c.idx++ {
+		if s.isNull(c.idx) {
+			continue
+		}
+		dd, n := binary.Uvarint(s.data[c.pos:])
+		c.pos += n
+		c.delta += int64(dd >> 1) ^ -int64(dd & 1) // zigzag decode
+		c.value += c.delta
+	}
+	result := c.value
+	if c.idx % deltaBlockSize != 0 {
+		s.cursor.Store(&c)
+	}
+	return result
+}
+
+func (s *StorageDeltaInt) prepare() {
+	s.hasNull = false
+}
+func (s *StorageDeltaInt) scan(i uint, value scm.Scmer) {
+	if value == nil {
+		s.hasNull = true
+	}
+}
+func (s *StorageDeltaInt) init(i uint) {
+	blocks := (i + deltaBlockSize - 1) / deltaBlockSize
+	s.bases = make([]int64, blocks)
+	s.offsets = make([]uint64, blocks)
+	s.data = make([]byte, 0, i) // one byte per row for constant strides
+	s.nulls = nil
+	if s.hasNull {
+		s.nulls = make([]uint64, (i + 63) / 64)
+	}
+	s.count = i
+	s.cursor.Store(nil)
+}
+func (s *StorageDeltaInt) build(i uint, value scm.Scmer) {
+	block := i / deltaBlockSize
+	if i % deltaBlockSize == 0 {
+		s.offsets[block] = uint64(len(s.data))
+		s.blockHasValue = false
+	}
+	if value == nil {
+		s.nulls[i / 64] |= 1 << (i % 64)
+		return
+	}
+	v := toInt(value)
+	if !s.blockHasValue {
+		// the first value of a block is its base
+		s.blockHasValue = true
+		s.bases[block] = v
+		s.prev = v
+		s.prevDelta = 0
+	}
+	delta := v - s.prev
+	dd := delta - s.prevDelta
+	s.data = binary.AppendUvarint(s.data, uint64(dd << 1) ^ uint64(dd >> 63)) // zigzag encode
+	s.prev = v
+	s.prevDelta = delta
+}
+func (s *StorageDeltaInt) finish() {
+}
+func (s *StorageDeltaInt) proposeCompression(i uint) ColumnStorage {
+	// dont't propose another pass
+	return nil
+}
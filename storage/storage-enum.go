@@ -0,0 +1,179 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "encoding/binary"
+import "github.com/launix-de/memcp/scm"
+
+// ENUM columns: the members are fixed when the column is created, so each value is stored as a
+// 1 or 2 byte code (0 = NULL, i+1 = members[i]) without building a dictionary on rebuild
+type StorageEnum struct {
+	members []string
+	codes8 []uint8 // if len(members) < 256
+	codes16 []uint16 // otherwise
+	index map[string]uint16 // member -> code (scan/build phase)
+	invalid bool // scan phase: a value is not a member
+}
+
+func newStorageEnum(members []string) *StorageEnum {
+	return &StorageEnum{members: members}
+}
+
+func (s *StorageEnum) Size() uint {
+	result := uint(len(s.codes8) + 2 * len(s.codes16)) + 2 * 24 + 24
+	for _, m := range s.members {
+		result += uint(len(m)) + 16
+	}
+	return result
+}
+
+func (s *StorageEnum) String() string {
+	return "enum"
+}
+
+func (s *StorageEnum) Serialize(f io.Writer) {
+	binary.Write(f, binary.LittleEndian, uint8(22)) // 22 = StorageEnum
+	binary.Write(f, binary.LittleEndian, uint32(len(s.members)))
+	for _, m := range s.members {
+		binary.Write(f, binary.LittleEndian, uint32(len(m)))
+		io.WriteString(f, m)
+	}
+	if s.codes16 != nil {
+		binary.Write(f, binary.LittleEndian, uint64(len(s.codes16)))
+		binary.Write(f, binary.LittleEndian, s.codes16)
+	} else {
+		binary.Write(f, binary.LittleEndian, uint64(len(s.codes8)))
+		binary.Write(f, binary.LittleEndian, s.codes8)
+	}
+}
+func (s *StorageEnum) Deserialize(f io.Reader) uint {
+	var n uint32
+	binary.Read(f, binary.LittleEndian, &n)
+	s.members = make([]string, n)
+	for i := range s.members {
+		var l uint32
+		binary.Read(f, binary.LittleEndian, &l)
+		b := make([]byte, l)
+		io.ReadFull(f, b)
+		s.members[i] = string(b)
+	}
+	var count uint64
+	binary.Read(f, binary.LittleEndian, &count)
+	if len(s.members) < 256 {
+		s.codes8 = make([]uint8, count)
+		binary.Read(f, binary.LittleEndian, s.codes8)
+	} else {
+		s.codes16 = make([]uint16, count)
+		binary.Read(f, binary.LittleEndian, s.codes16)
+	}
+	return uint(count)
+}
+
+func (s *StorageEnum) GetValue(i uint) scm.Scmer {
+	var code uint16
+	if s.codes16 != nil {
+		code = s.codes16[i]
+	} else {
+		code = uint16(s.codes8[i])
+	}
+	if code == 0 {
+		return nil
+	}
+	return s.members[code - 1]
+}
+
+func (s *StorageEnum) prepare() {
+	s.invalid = false
+	s.index = make(map[string]uint16, len(s.members))
+	for i, m := range s.members {
+		s.index[m] = uint16(i + 1)
+	}
+}
+func (s *StorageEnum) scan(i uint, value scm.Scmer) {
+	if value == nil {
+		return
+	}
+	if _, ok := s.index[scm.String(value)]; !ok {
+		s.invalid = true // e.g. rows from before the column became an ENUM
+	}
+}
+func (s *StorageEnum) init(i uint) {
+	if len(s.members) < 256 {
+		s.codes8 = make([]uint8, i)
+		s.codes16 = nil
+	} else {
+		s.codes16 = make([]uint16, i)
+		s.codes8 = nil
+	}
+}
+func (s *StorageEnum) build(i uint, value scm.Scmer) {
+	if value == nil {
+		return // code 0
+	}
+	code := s.index[scm.String(value)]
+	if s.codes16 != nil {
+		s.codes16[i] = code
+	} else {
+		s.codes8[i] = uint8(code)
+	}
+}
+func (s *StorageEnum) finish() {
+	s.index = nil
+}
+
+func (s *StorageEnum) proposeCompression(i uint) ColumnStorage {
+	if s.invalid {
+		return new(StorageSCMER) // cannot be encoded, keep the values as they are
+	}
+	return nil
+}
+
+// checks a value for an ENUM column; values outside the set panic or become NULL (EnumInvalidNull)
+func (c *column) enumValue(value scm.Scmer) scm.Scmer {
+	if value == nil {
+		return nil
+	}
+	str := scm.String(value)
+	for _, m := range c.EnumValues {
+		if m == str {
+			return m
+		}
+	}
+	if c.EnumInvalidNull {
+		return nil
+	}
+	panic("value " + str + " is not a member of ENUM column " + c.Name)
+}
+
+// validates the ENUM columns of the inserted rows in place
+func (t *table) checkEnums(columns []string, values [][]scm.Scmer) {
+	for _, c := range t.Columns {
+		if c.EnumValues == nil {
+			continue
+		}
+		for j, col := range columns {
+			if col == c.Name {
+				for _, row := range values {
+					if j < len(row) {
+						row[j] = c.enumValue(row[j])
+					}
+				}
+			}
+		}
+	}
+}
@@ -18,6 +18,7 @@ package storage
 
 import "io"
 import "math"
+import "math/bits"
 import "bufio"
 import "encoding/json"
 import "encoding/binary"
@@ -28,11 +29,16 @@ type StorageSCMER struct {
 	values []scm.Scmer
 	onlyInt bool
 	onlyFloat bool
+	onlyBool bool
+	onlyString bool
 	hasString bool
 	longStrings int
 	null uint // amount of NULL values (sparse map!)
 	numSeq uint // sequence statistics
 	last1, last2 int64 // sequence statistics
+	minInt, maxInt int64 // value range for StorageInt
+	deltaBytes uint // size of the delta-of-delta encoding for StorageDeltaInt
+	hasInt bool
 }
 
 func (s *StorageSCMER) Size() uint {
@@ -75,34 +81,30 @@ func (s *StorageSCMER) GetValue(i uint) scm.Scmer {
 
 func (s *StorageSCMER) scan(i uint, value scm.Scmer) {
 	switch v := value.(type) {
+		case bool:
+			s.onlyInt = false
+			s.onlyFloat = false
+			s.onlyString = false
 		case int64:
-			v2 := toInt(value)
-			// analyze whether there is a sequence
-			if v2 - s.last1 == s.last1 - s.last2 {
-				s.numSeq = s.numSeq + 1 // count as sequencable
-			}
-			// push sequence detector
-			s.last2 = s.last1
-			s.last1 = v2
+			s.onlyBool = false
+			s.onlyString = false
+			s.scanInt(v)
 		case float64:
+			s.onlyBool = false
+			s.onlyString = false
 			if _, f := math.Modf(v); f != 0.0 {
 				s.onlyInt = false
 			} else {
-				v := toInt(value)
-				// analyze whether there is a sequence
-				if v - s.last1 == s.last1 - s.last2 {
-					s.numSeq = s.numSeq + 1 // count as sequencable
-				}
-				// push sequence detector
-				s.last2 = s.last1
-				s.last1 = v
+				s.scanInt(toInt(value))
 			}
 		case scm.LazyString:
+			s.onlyBool = false
 			s.onlyInt = false
 			s.onlyFloat = false
 			s.hasString = true
 			s.longStrings++
 		case string:
+			s.onlyBool = false
 			s.onlyInt = false
 			s.onlyFloat = false
 			s.hasString = true
@@ -113,14 +115,44 @@ func (s *StorageSCMER) scan(i uint, value scm.Scmer) {
 			s.null = s.null + 1 // count NULL
 			// storageInt can also handle null
 		default:
+			s.onlyBool = false
 			s.onlyInt = false
 			s.onlyFloat = false
+			s.onlyString = false
+	}
+}
+func (s *StorageSCMER) scanInt(v int64) {
+	// analyze whether there is a sequence
+	if v - s.last1 == s.last1 - s.last2 {
+		s.numSeq = s.numSeq + 1 // count as sequencable
+	}
+	// size of the delta of delta (zigzag varint) for StorageDeltaInt
+	dd := (v - s.last1) - (s.last1 - s.last2)
+	n := (bits.Len64(uint64(dd << 1) ^ uint64(dd >> 63)) + 6) / 7
+	if n == 0 {
+		n = 1 // a zero still costs one byte
+	}
+	s.deltaBytes += uint(n)
+	// push sequence detector
+	s.last2 = s.last1
+	s.last1 = v
+	if !s.hasInt || v < s.minInt {
+		s.minInt = v
+	}
+	if !s.hasInt || v > s.maxInt {
+		s.maxInt = v
 	}
+	s.hasInt = true
 }
+
 func (s *StorageSCMER) prepare() {
 	s.onlyInt = true
 	s.onlyFloat = true
+	s.onlyBool = true
+	s.onlyString = true
 	s.hasString = false
+	s.hasInt = false
+	s.deltaBytes = 0
 }
 func (s *StorageSCMER) init(i uint) {
 	// allocate
@@ -133,8 +165,28 @@ func (s *StorageSCMER) build(i uint, value scm.Scmer) {
 func (s *StorageSCMER) finish() {
 }
 
+// whether the scanned values can be stored in a storage of the storageHints without loss
+func (s *StorageSCMER) fits(hint string) bool {
+	switch hint {
+		case "int", "seq", "delta":
+			return s.onlyInt
+		case "float":
+			return s.onlyFloat
+		case "bits":
+			return s.onlyBool
+		case "string":
+			return s.onlyString
+		default:
+			return true // scmer and sparse store any value
+	}
+}
+
 // soley to StorageSCMER
 func (s *StorageSCMER) proposeCompression(i uint) ColumnStorage {
+	if s.onlyBool && s.null < i {
+		// true/false/NULL: 2 bits per row at most, even beats sparse
+		return new(StorageBits)
+	}
 	if s.null * 100 > i * 13 {
 		// sparse payoff against bitcompressed is at ~13%
 		if s.longStrings > 2 {
@@ -144,7 +196,7 @@ func (s *StorageSCMER) proposeCompression(i uint) ColumnStorage {
 		}
 		return new(StorageSparse)
 	}
-	if s.hasString {
+	if s.hasString && s.onlyString { // StorageString would turn other values into NULL
 		if s.longStrings > 2 {
 			b := new (OverlayBlob)
 			b.Base = new (StorageString)
@@ -157,6 +209,10 @@ func (s *StorageSCMER) proposeCompression(i uint) ColumnStorage {
 		if i > 5 && 2 * (i - s.numSeq) < i {
 			return new(StorageSeq)
 		}
+		// delta of delta pays off for nearly monotonic values (timestamps) whose range needs more bits than their changes
+		if i > deltaBlockSize && s.hasInt && 8 * s.deltaBytes * 3 < uint(bits.Len64(uint64(s.maxInt - s.minInt))) * i * 2 {
+			return new(StorageDeltaInt)
+		}
 		return new(StorageInt)
 	}
 	if s.onlyFloat {
@@ -17,6 +17,7 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 package storage
 
 import "io"
+import "os"
 import "fmt"
 import "time"
 import "sort"
@@ -55,18 +56,74 @@ var storages = map[uint8]reflect.Type {
 	10: reflect.TypeOf(StorageInt{}),
 	11: reflect.TypeOf(StorageSeq{}),
 	12: reflect.TypeOf(StorageFloat{}),
+	13: reflect.TypeOf(StorageBits{}),
+	14: reflect.TypeOf(StorageDeltaInt{}),
 	20: reflect.TypeOf(StorageString{}),
 	21: reflect.TypeOf(StoragePrefix{}),
+	22: reflect.TypeOf(StorageEnum{}),
 	//30: reflect.TypeOf(OverlaySCMER{}),
 	31: reflect.TypeOf(OverlayBlob{}),
 }
 
+// storage types that can be forced with the "storage" column option ("" = let proposeCompression decide)
+// StoragePrefix is left out until it can be serialized
+var storageHints = map[string]func() ColumnStorage {
+	"scmer": func() ColumnStorage { return new(StorageSCMER) },
+	"sparse": func() ColumnStorage { return new(StorageSparse) },
+	"int": func() ColumnStorage { return new(StorageInt) },
+	"seq": func() ColumnStorage { return new(StorageSeq) },
+	"delta": func() ColumnStorage { return new(StorageDeltaInt) },
+	"float": func() ColumnStorage { return new(StorageFloat) },
+	"bits": func() ColumnStorage { return new(StorageBits) },
+	"string": func() ColumnStorage { return new(StorageString) },
+}
+
+// validates a storage hint when the column is created, so a typo does not fail on the next rebuild
+func checkStorageHint(hint string) string {
+	if _, ok := storageHints[hint]; !ok && hint != "" {
+		panic("unknown storage type: " + hint + " (use scmer, sparse, int, seq, delta, float, bits or string)")
+	}
+	return hint
+}
+
+// the first storage to try for a column and its storage hint
+// a hinted column is scanned as StorageSCMER first, so we know whether its values fit into the hinted storage (see hintedStorage)
+func (t *table) initialStorage(col string) (ColumnStorage, string) {
+	for _, c := range t.Columns {
+		if c.Name == col && c.StorageHint != "" {
+			return new(StorageSCMER), c.StorageHint
+		}
+		if c.Name == col && c.EnumValues != nil {
+			return newStorageEnum(c.EnumValues), "" // falls back to scmer if a value is not a member
+		}
+	}
+	return new(StorageSCMER), ""
+}
+
+// replaces the proposal of the first scan phase with the hinted storage if it can hold all scanned values;
+// otherwise the hint is ignored (e.g. "int" would cut 2.5 to 2), so the column falls back to the normal proposal
+func hintedStorage(hint string, scanned ColumnStorage, proposal ColumnStorage) (ColumnStorage, bool) {
+	if s, ok := scanned.(*StorageSCMER); ok && s.fits(hint) {
+		return storageHints[hint](), true
+	}
+	return proposal, false
+}
+
+func (t *table) hasBloom(col string) bool {
+	for _, c := range t.Columns {
+		if c.Name == col {
+			return c.Bloom
+		}
+	}
+	return false
+}
+
 func Init(en scm.Env) {
 	scm.DeclareTitle("Storage")
 
 	scm.Declare(&en, &scm.Declaration{
 		"scan", "does an unordered parallel filter-map-reduce pass on a single table and returns the reduced result",
-		6, 10,
+		6, 12,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string|nil", "database where the table is located"},
 			scm.DeclarationParameter{"table", "string|list", "name of the table to scan (or a list if you have temporary data)"},
@@ -78,6 +135,8 @@ func Init(en scm.Env) {
 			scm.DeclarationParameter{"neutral", "any", "(optional) neutral element for the reduce phase, otherwise nil is assumed"},
 			scm.DeclarationParameter{"reduce2", "func", "(optional) second stage reduce function that will apply a result of reduce to the neutral element/accumulator"},
 			scm.DeclarationParameter{"isOuter", "bool", "(optional) if true, in case of no hits, call map once anyway with NULL values"},
+			scm.DeclarationParameter{"options", "list", "(optional) assoc list of further options: \"preFilter\" selection (only visit the rows of a previous scan-selection), \"explainOnly\" bool (return the query plan instead of scanning), \"deterministicOrder\" bool (map and reduce serially in shard and record order so repeated runs give identical results; expensive: all matching rows are buffered and only the filter runs in parallel), \"stable\" bool (map still runs in parallel, but its results are buffered and reduce is called serially in shard and record order, so a reduce that accumulates result rows gives the same sequence on every run; serializes the collect phase and buffers all map results, but is cheaper than scan_order; side effects of map itself are not ordered), \"indexOnly\" bool (covering index scan: build the index immediately and only read indexed columns; panics if the index does not cover all filter and map columns), \"associative\" bool (assert that reduce is associative so the shard results are combined in a parallel tree instead of serially; the tree keeps the shard order, so reduce need not be commutative), \"orderedWithinShard\" bool (inside each shard, map is called in ascending record order, i.e. insertion order since the last rebuild; shards still run in parallel, so there is no order between shards), \"outerDefaults\" assoc list (map column -> value that is passed instead of NULL when isOuter calls map for the no-hit case), \"collate\" assoc list (column -> collation as in (collate ...), e.g. '(\"name\" \"utf8mb4_german_ci\"): equal? < <= > >= on these columns in the filter compare in that collation and an index on them is built in collation order), \"progress\" func (called with (rowsProcessed totalEstimate) every 100000 visited rows of a shard and once more when the scan is finished; calls are serialized, so the counts are monotonic; on a list, it is only called once at the end), \"sample\" number (0 < sample <= 1: only visit that fraction of the rows like TABLESAMPLE; the choice is a hash of shard and record id, so it is reproducible until the next rebuild; 1 is a normal scan), \"sampleSeed\" int (draw a different reproducible sample), \"sampleScale\" bool (divide a numeric result by sample, so sums and counts estimate the full table), \"flatmap\" bool (map returns a list and every element is passed to reduce on its own, e.g. to unnest values; an empty list contributes nothing, isOuter still emits one NULL row if no row produced an element), \"limit\" int and \"offset\" int (only map and reduce limit rows after skipping offset rows that passed the filter; since the order is unspecified, any matching rows are taken and the shard workers stop early once the limit is reached; limit 0 is unlimited), \"snapshot\" bool (the scan sees all shards as they were when it started and ignores rows that are inserted or deleted during the scan, also when shards are rebuilt in the meantime; nothing is copied up front, but every write during the scan is remembered by the scan)"},
+			scm.DeclarationParameter{"having", "func", "(optional) post-aggregation filter: called once with the final reduced result (after reduce2); if it returns false, the neutral element is returned instead (like SQL HAVING)"},
 		}, "any",
 		func (a ...scm.Scmer) scm.Scmer {
 			filtercols_ := a[2].([]scm.Scmer)
@@ -110,6 +169,11 @@ func Init(en scm.Env) {
 				if len(a) > 6 {
 					reducefn = scm.OptimizeProcToSerialFunction(a[6])
 				}
+				var options scanOptions
+				if len(a) > 10 {
+					options = parseScanOptions(a[10])
+				}
+				options.startLimit()
 				hadValue := false
 				for _, val := range list {
 					ds := dataset(val.([]scm.Scmer))
@@ -118,23 +182,40 @@ func Init(en scm.Env) {
 						filterparams[i], _ = ds.GetI(col)
 					}
 					if scm.ToBool(filterfn(filterparams...)) {
-						hadValue = true
+						if skip, stop := options.limitRow(); stop {
+							break
+						} else if skip {
+							continue
+						}
 						// map
 						for i, col := range mapcols {
 							mapparams[i], _ = ds.GetI(col)
 						}
 						// reduce
-						result = reducefn(result, mapfn(mapparams...))
+						var emitted bool
+						result, emitted = options.reduceMapped(reducefn, result, mapfn(mapparams...))
+						hadValue = hadValue || emitted
 					}
 				}
 				if !hadValue && isOuter {
 					// outer join
-					result = reducefn(result, mapfn(mapparams...)) // mapparams is filled with NULL
+					for _, v := range options.outerValues(a[5], mapcols) {
+						result = reducefn(result, v)
+					}
+				}
+				if len(a) > 10 {
+					if progress := options.progress; progress != nil {
+						progress.estimate = uint(len(list))
+						progress.add(uint(len(list)), true)
+					}
 				}
 				if len(a) > 8 && a[8] != nil {
 					reduce2 := scm.OptimizeProcToSerialFunction(a[8])
 					result = reduce2(a[7], result)
 				}
+				if len(a) > 11 && a[11] != nil && !scm.ToBool(scm.Apply(a[11], result)) {
+					return a[7] // having
+				}
 				return result
 			}
 			// otherwise: implementation on storage
@@ -159,13 +240,201 @@ func Init(en scm.Env) {
 			if len(a) > 8 {
 				reduce2 = a[8]
 			}
-			result := t.scan(filtercols, a[3], mapcols, a[5], aggregate, neutral, reduce2, isOuter)
+			var options scanOptions
+			if len(a) > 10 {
+				options = parseScanOptions(a[10])
+			}
+			if options.explainOnly {
+				return t.explainScan(filtercols, a[3], options)
+			}
+			result := withScanCache(func () scm.Scmer {
+				return t.scan(filtercols, a[3], mapcols, a[5], aggregate, neutral, reduce2, isOuter, options)
+			})
+			if len(a) > 11 && a[11] != nil && !scm.ToBool(scm.Apply(a[11], result)) {
+				return neutral // having
+			}
 			return result
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"explain", "describes how a scan with that filter would be executed without scanning: returns an assoc list with table, predicates (conditions that became indexed equality or range lookups), access (\"indexed\" or \"full scan\"), index, indexesBuilt, shards, skippedShards, totalShards, estimatedRows, estimatedOutput and bloomSkipped",
+		4, 5,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "database where the table is located"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"filterColumns", "list", "list of columns that are fed into filter"},
+			scm.DeclarationParameter{"filter", "func", "lambda function as it would be passed to scan"},
+			scm.DeclarationParameter{"options", "list", "(optional) scan options as in scan, e.g. collate"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			filtercols_ := a[2].([]scm.Scmer)
+			filtercols := make([]string, len(filtercols_))
+			for i, c := range filtercols_ {
+				filtercols[i] = scm.String(c)
+			}
+			var options scanOptions
+			if len(a) > 4 {
+				options = parseScanOptions(a[4])
+			}
+			return t.explainScan(filtercols, a[3], options)
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"scan-selection", "does a parallel filter pass on a single table and returns the selection of matching rows; the selection can be passed to scan as preFilter to refine a result without scanning from scratch. The selection gets invalid when the table is rebuilt.",
+		4, 5,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "database where the table is located"},
+			scm.DeclarationParameter{"table", "string", "name of the table to scan"},
+			scm.DeclarationParameter{"filterColumns", "list", "list of columns that are fed into filter"},
+			scm.DeclarationParameter{"filter", "func", "lambda function that decides whether a dataset is part of the selection"},
+			scm.DeclarationParameter{"options", "list", "(optional) assoc list of further options like in scan, e.g. \"preFilter\" selection"},
+		}, "any",
+		func (a ...scm.Scmer) scm.Scmer {
+			filtercols_ := a[2].([]scm.Scmer)
+			filtercols := make([]string, len(filtercols_))
+			for i, c := range filtercols_ {
+				filtercols[i] = scm.String(c)
+			}
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			var options scanOptions
+			if len(a) > 4 {
+				options = parseScanOptions(a[4])
+			}
+			return t.scanSelection(filtercols, a[3], options)
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"scan-exists", "does a parallel filter pass on a single table and returns true as soon as one row matches (e.g. for EXISTS subqueries); the remaining shard workers are cancelled",
+		4, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "database where the table is located"},
+			scm.DeclarationParameter{"table", "string", "name of the table to scan"},
+			scm.DeclarationParameter{"filterColumns", "list", "list of columns that are fed into filter"},
+			scm.DeclarationParameter{"filter", "func", "lambda function that decides whether a dataset matches"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			filtercols_ := a[2].([]scm.Scmer)
+			filtercols := make([]string, len(filtercols_))
+			for i, c := range filtercols_ {
+				filtercols[i] = scm.String(c)
+			}
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.scanExists(filtercols, a[3])
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"partition-prune-check", "returns how many shards a scan with that filter would visit after partition pruning without executing the scan, as assoc list (shards totalShards dimensions). Use it to validate the choice of partition columns.",
+		4, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "database where the table is located"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"filterColumns", "list", "list of columns that are fed into filter"},
+			scm.DeclarationParameter{"filter", "func", "lambda function as it would be passed to scan"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			filtercols_ := a[2].([]scm.Scmer)
+			filtercols := make([]string, len(filtercols_))
+			for i, c := range filtercols_ {
+				filtercols[i] = scm.String(c)
+			}
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			shards, total := t.pruneCheck(filtercols, a[3])
+			dimensions := make([]scm.Scmer, len(t.PDimensions))
+			for i, d := range t.PDimensions {
+				dimensions[i] = d.Column
+			}
+			return []scm.Scmer{"shards", int64(shards), "totalShards", int64(total), "dimensions", dimensions}
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"inspect-shard", "returns the internal state of a shard for debugging as assoc list (uuid main_count inserts deletions columns deltaColumns indexes changes rebuilding logfile). rebuilding is true while a rebuild or repartition of that shard is in progress. The call only reads and is safe on a live system.",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "database where the table is located"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"shardIndex", "number", "position of the shard in the shard list (or partition list of a partitioned table)"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			shardlist := t.Shards
+			if shardlist == nil {
+				shardlist = t.PShards
+			}
+			i := scm.ToInt(a[2])
+			if i < 0 || i >= len(shardlist) {
+				panic(fmt.Sprintf("shard index %d out of range: table %s.%s has %d shards", i, scm.String(a[0]), scm.String(a[1]), len(shardlist)))
+			}
+			if shardlist[i] == nil {
+				return nil
+			}
+			return shardlist[i].inspect()
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"bind-lookup", "reads a table into a hashmap and returns a lookup function (key...) -> value that can be called inside the map of a scan (e.g. for correlated subqueries). The hashmap is a snapshot of the moment bind-lookup is called. If a key occurs multiple times, one of the values is returned; unknown keys return nil.",
+		4, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "database where the table is located"},
+			scm.DeclarationParameter{"table", "string", "name of the table to look up"},
+			scm.DeclarationParameter{"keyCols", "list", "list of columns that form the lookup key"},
+			scm.DeclarationParameter{"valueCol", "string", "column whose value is returned"},
+		}, "func",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			keycols_ := a[2].([]scm.Scmer)
+			keycols := make([]string, len(keycols_))
+			for i, c := range keycols_ {
+				keycols[i] = scm.String(c)
+			}
+			return t.BindLookup(keycols, scm.String(a[3]))
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"scan_order", "does an ordered parallel filter and serial map-reduce pass on a single table and returns the reduced result",
-		10, 13,
+		10, 14,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "database where the table is located"},
 			scm.DeclarationParameter{"table", "string", "name of the table to scan"},
@@ -180,6 +449,7 @@ func Init(en scm.Env) {
 			scm.DeclarationParameter{"reduce", "func", "(optional) lambda function to aggregate the map results. It takes two parameters (a b) where a is the accumulator and b the new value. The accumulator for the first reduce call is the neutral element. The return value will be the accumulator input for the next reduce call. There are two reduce phases: shard-local and shard-collect. In the shard-local phase, a starts with neutral and b is fed with the return values of each map call. In the shard-collect phase, a starts with neutral and b is fed with the result of each shard-local pass."},
 			scm.DeclarationParameter{"neutral", "any", "(optional) neutral element for the reduce phase, otherwise nil is assumed"},
 			scm.DeclarationParameter{"isOuter", "bool", "(optional) if true, in case of no hits, call map once anyway with NULL values"},
+			scm.DeclarationParameter{"options", "list", "(optional) assoc list of further options: \"explainOnly\" bool (return the query plan instead of scanning), \"outerDefaults\" assoc list (map column -> value instead of NULL for the no-hit call of isOuter)"},
 		}, "any",
 		func (a ...scm.Scmer) scm.Scmer {
 			filtercols_ := a[2].([]scm.Scmer)
@@ -308,7 +578,16 @@ func Init(en scm.Env) {
 			if t == nil {
 				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
 			}
-			result := t.scan_order(filtercols, a[3], sortcols, sortdirs, scm.ToInt(a[6]), scm.ToInt(a[7]), mapcols, a[9], aggregate, neutral, isOuter)
+			var options scanOptions
+			if len(a) > 13 {
+				options = parseScanOptions(a[13])
+			}
+			if options.explainOnly {
+				return t.explainScan(filtercols, a[3], options)
+			}
+			result := withScanCache(func () scm.Scmer {
+				return t.scan_order(filtercols, a[3], sortcols, sortdirs, scm.ToInt(a[6]), scm.ToInt(a[7]), mapcols, a[9], aggregate, neutral, isOuter, options)
+			})
 			return result
 		},
 	})
@@ -345,7 +624,7 @@ func Init(en scm.Env) {
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the new table"},
 			scm.DeclarationParameter{"cols", "list", "list of columns and constraints, each '(\"column\" colname typename dimensions typeparams) where dimensions is a list of 0-2 numeric items or '(\"primary\" cols) or '(\"unique\" cols) or '(\"foreign\" cols tbl2 cols2 updatemode deletemode of 'restrict'|'cascade'|'set null')"},
-			scm.DeclarationParameter{"options", "list", "further options like engine=safe|sloppy|memory"},
+			scm.DeclarationParameter{"options", "list", "further options like engine=safe|sloppy|memory or compress=none|zstd|xz (compression of the column files on disk)"},
 			scm.DeclarationParameter{"ifnotexists", "bool", "don't throw an error if table already exists"},
 		}, "bool",
 		func (a ...scm.Scmer) scm.Scmer {
@@ -357,6 +636,7 @@ func Init(en scm.Env) {
 			collation := ""
 			charset := ""
 			comment := ""
+			compress := ""
 			for i := 0; i < len(options); i += 2 {
 				if options[i] == "engine" {
 					engine = scm.String(options[i+1])
@@ -368,6 +648,8 @@ func Init(en scm.Env) {
 					comment = scm.String(options[i+1])
 				} else if options[i] == "auto_increment" {
 					auto_increment, _ = strconv.ParseUint(scm.String(options[i+1]), 0, 64)
+				} else if options[i] == "compress" {
+					compress = validateCompression(scm.String(options[i+1]))
 				} else {
 					panic("unknown option: " + scm.String(options[i]))
 				}
@@ -393,6 +675,7 @@ func Init(en scm.Env) {
 			t.Collation = collation
 			t.Charset = charset
 			t.Comment = comment
+			t.Compress = compress
 			t.Auto_increment = auto_increment
 			if created {
 				// add columns and constraints
@@ -459,6 +742,7 @@ func Init(en scm.Env) {
 						}
 					}
 				}
+				t.addForeignKeyIndexes()
 			}
 			return true
 		},
@@ -472,7 +756,7 @@ func Init(en scm.Env) {
 			scm.DeclarationParameter{"colname", "string", "name of the new column"},
 			scm.DeclarationParameter{"type", "string", "name of the basetype"},
 			scm.DeclarationParameter{"dimensions", "list", "dimensions of the type (e.g. for decimal)"},
-			scm.DeclarationParameter{"options", "list", "assoc list with one of the following options: primary true, unique true, auto_increment true, null bool, comment string default string collate identifier"},
+			scm.DeclarationParameter{"options", "list", "assoc list with one of the following options: primary true, unique true, auto_increment true, null bool, comment string default string collate identifier storage scmer|sparse|int|seq|delta|float|bits|string (force a storage type instead of automatic compression) bloom bool (build a bloom filter on rebuild so equality filters that miss skip the main storage of a shard) enum list (ENUM column: only these strings are allowed and they are stored as 1-2 byte codes) enumInvalidNull bool (store NULL instead of failing for values that are not in enum)"},
 			scm.DeclarationParameter{"computorCols", "list", "list of columns that is passed into params of computor"},
 			scm.DeclarationParameter{"computor", "func", "lambda expression that can take other column values and computes the value of that column"},
 		}, "bool",
@@ -612,11 +896,39 @@ func Init(en scm.Env) {
 			k := foreignKey{id, t1.Name, cols1, t2.Name, cols2, getForeignKeyMode(a[6]), getForeignKeyMode(a[7])}
 			t1.Foreign = append(t1.Foreign, k)
 			t2.Foreign = append(t2.Foreign, k)
+			t1.addForeignKeyIndexes()
 			db.save()
 
 			return true
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"table-foreign-key-index", "returns the indexes that are maintained automatically for the foreign keys of a table as a list of column lists",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			result := make([]scm.Scmer, 0)
+			for _, cols := range t.foreignKeyIndexCols() {
+				cols_ := make([]scm.Scmer, len(cols))
+				for i, c := range cols {
+					cols_[i] = c
+				}
+				result = append(result, cols_)
+			}
+			return result
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"shardcolumn", "tells us how it would partition a column according to their values. Returns a list of pivot elements.",
 		3, 4,
@@ -688,6 +1000,8 @@ func Init(en scm.Env) {
 				if len(ps) > Settings.PartitionMaxDimensions {
 					ps = ps[:Settings.PartitionMaxDimensions]
 				}
+				t.mu.Lock()
+				defer t.mu.Unlock()
 				t.repartition(ps) // perform repartitioning immediately
 				return true
 			} else {
@@ -702,13 +1016,43 @@ func Init(en scm.Env) {
 			}
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"createtrigger", "creates a trigger on a table. The handler is called for every inserted, updated or deleted row with the rows as assoc lists: insert: (handler NEW), update: (handler OLD NEW), delete: (handler OLD). A before trigger may return a modified NEW assoc list or false to abort the statement.",
+		6, 6,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"timing", "string", "before|after"},
+			scm.DeclarationParameter{"event", "string", "insert|update|delete"},
+			scm.DeclarationParameter{"cols", "list", "update triggers only fire when one of these columns changes; empty list for any column"},
+			scm.DeclarationParameter{"handler", "func", "lambda(NEW), lambda(OLD NEW) or lambda(OLD); it is persisted as source, so it may only use its parameters and global functions"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			var cols []string
+			if a[4] != nil {
+				for _, c := range a[4].([]scm.Scmer) {
+					cols = append(cols, scm.String(c))
+				}
+			}
+			t.CreateTrigger(scm.String(a[2]), scm.String(a[3]), cols, a[5])
+			return true
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"altertable", "alters a table",
 		4, 4,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the table"},
-			scm.DeclarationParameter{"operation", "string", "one of owner|drop|engine|collation"},
+			scm.DeclarationParameter{"operation", "string", "one of owner|drop|engine|collation|comment|compress"},
 			scm.DeclarationParameter{"parameter", "any", "name of the column to drop or value of the parameter"},
 		}, "bool",
 		func (a ...scm.Scmer) scm.Scmer {
@@ -727,6 +1071,14 @@ func Init(en scm.Env) {
 				return t.DropColumn(scm.String(a[3]))
 			case "owner":
 				return false // ignore
+			case "comment":
+				t.Comment = scm.String(a[3])
+				db.save() // metadata only, no rebuild needed
+				return true
+			case "compress":
+				t.Compress = validateCompression(scm.String(a[3]))
+				db.save() // applies to the column files written by the next rebuild
+				return true
 			default:
 				panic("unimplemented alter table operation: " + scm.String(a[2]))
 			}
@@ -739,7 +1091,7 @@ func Init(en scm.Env) {
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the table"},
 			scm.DeclarationParameter{"column", "string", "name of the column"},
-			scm.DeclarationParameter{"operation", "string", "one of drop|type|collation|auto_increment|comment"},
+			scm.DeclarationParameter{"operation", "string", "one of drop|rename|type|collation|auto_increment|comment|storage|bloom (storage and bloom take effect on the next rebuild)"},
 			scm.DeclarationParameter{"parameter", "any", "name of the column to drop or value of the parameter"},
 		}, "bool",
 		func (a ...scm.Scmer) scm.Scmer {
@@ -752,11 +1104,14 @@ func Init(en scm.Env) {
 			if t == nil {
 				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
 			}
-			for _, c := range t.Columns {
+			for i := range t.Columns {
+				c := &t.Columns[i] // alter the column in place, not a copy
 				if c.Name == scm.String(a[2]) {
 					switch a[3] {
 					case "drop":
 						return t.DropColumn(scm.String(a[2]))
+					case "rename":
+						return t.RenameColumn(scm.String(a[2]), scm.String(a[4]))
 					case "auto_increment":
 						ai := scm.ToInt(a[4])
 						if ai > 1 {
@@ -766,16 +1121,118 @@ func Init(en scm.Env) {
 						} else {
 							// set ai flag for column
 							c.AutoIncrement = scm.ToBool(a[4])
+							db.save()
 							return true
 						}
 					default:
-						return c.Alter(scm.String(a[3]), a[4])
+						result := c.Alter(scm.String(a[3]), a[4])
+						db.save() // metadata only, no rebuild needed
+						return result
 					}
 				}
 			}
 			panic("column " + scm.String(a[0]) + "." + scm.String(a[1]) + "." + scm.String(a[2]) + " does not exist")
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"apply-defaults", "backfills the NULL values of a column with the column's current default (e.g. after adding a default) and returns the number of changed rows. Explicit values are left untouched.",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"column", "string", "name of the column"},
+		}, "int",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.ApplyDefaults(scm.String(a[2]))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"table-comment", "returns the comment of a table",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.Comment
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"column-comment", "returns the comment of a column",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"column", "string", "name of the column"},
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			for _, c := range t.Columns {
+				if c.Name == scm.String(a[2]) {
+					return c.Comment
+				}
+			}
+			panic("column " + scm.String(a[0]) + "." + scm.String(a[1]) + "." + scm.String(a[2]) + " does not exist")
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"schema-version", "returns the schema version of a database (0 if never set); migration scripts compare it to decide which migrations still have to be applied",
+		1, 1,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+		}, "int",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			db.schemalock.RLock()
+			defer db.schemalock.RUnlock()
+			return db.SchemaVersion
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"set-schema-version", "sets the schema version of a database; it is persisted in the schema file",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"version", "number", "new schema version"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			db.schemalock.Lock()
+			db.SchemaVersion = int64(scm.ToInt(a[1]))
+			db.save()
+			db.schemalock.Unlock()
+			return true
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"droptable", "removes a table",
 		2, 3,
@@ -794,17 +1251,31 @@ func Init(en scm.Env) {
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
-		"insert", "inserts a new dataset into table and returns the number of successful items",
-		4, 7,
+		"table-swap", "atomically exchanges the names of two tables (e.g. for blue-green rebuilds: build table_new, then swap it with table)",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"tableA", "string", "name of the first table"},
+			scm.DeclarationParameter{"tableB", "string", "name of the second table"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			SwapTables(scm.String(a[0]), scm.String(a[1]), scm.String(a[2]))
+			return true
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"insert", "inserts a new dataset into table and returns the number of successful items (or the list of auto_increment ids if returnIds is set)",
+		4, 8,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the table"},
 			scm.DeclarationParameter{"columns", "list", "list of column names, e.g. '(\"ID\", \"value\")"},
 			scm.DeclarationParameter{"datasets", "list", "list of list of column values, e.g. '('(1 10) '(2 15))"},
-			scm.DeclarationParameter{"onCollisionCols", "list", "list of columns of the old dataset that have to be passed to onCollision. Can also request $update."},
-			scm.DeclarationParameter{"onCollision", "func", "the function that is called on each collision dataset. The first parameter is filled with the $update function, the second parameter is the dataset as associative list. If not set, an error is thrown in case of a collision."},
+			scm.DeclarationParameter{"onCollisionCols", "list", "list of columns of the old dataset that have to be passed to onCollision. Can also request $update. If onCollision is 'update, this is an assoc list column -> value instead where value may be a lambda whose parameters are named old.col (existing row) or NEW.col (inserted row)"},
+			scm.DeclarationParameter{"onCollision", "any", "the function that is called on each collision dataset. The first parameter is filled with the $update function, the second parameter is the dataset as associative list. If it is the symbol 'update, the colliding row is updated with onCollisionCols (ON DUPLICATE KEY UPDATE). If not set, an error is thrown in case of a collision."},
 			scm.DeclarationParameter{"mergeNull", "bool", "if true, it will handle NULL values as equal according to SQL 2003's definition of DISTINCT (https://en.wikipedia.org/wiki/Null_(SQL)#When_two_nulls_are_equal:_grouping,_sorting,_and_some_set_operations)"},
-		}, "number",
+			scm.DeclarationParameter{"returnIds", "bool", "if true, insert returns the list of auto_increment ids that were assigned to each dataset instead of the count; datasets that collided get a nil placeholder"},
+		}, "any",
 		func (a ...scm.Scmer) scm.Scmer {
 			db := GetDatabase(scm.String(a[0]))
 			if db == nil {
@@ -813,12 +1284,16 @@ func Init(en scm.Env) {
 			var onCollisionCols []string
 			onCollision := scm.Scmer(nil)
 			if len(a) > 5 {
-				onCollisionCols_ := a[4].([]scm.Scmer)
-				onCollisionCols = make([]string, len(onCollisionCols_))
-				for i, c := range onCollisionCols_ {
-					onCollisionCols[i] = scm.String(c)
+				if a[5] == scm.Symbol("update") {
+					onCollisionCols, onCollision = onDuplicateUpdate(a[4].([]scm.Scmer))
+				} else {
+					onCollisionCols_ := a[4].([]scm.Scmer)
+					onCollisionCols = make([]string, len(onCollisionCols_))
+					for i, c := range onCollisionCols_ {
+						onCollisionCols[i] = scm.String(c)
+					}
+					onCollision = a[5]
 				}
-				onCollision = a[5]
 			}
 			mergeNull := false
 			if (len(a) > 6 && scm.ToBool(a[6])) {
@@ -834,7 +1309,135 @@ func Init(en scm.Env) {
 			for i, row := range rows_ {
 				rows[i] = row.([]scm.Scmer)
 			}
-			return int64(db.Tables.Get(scm.String(a[1])).Insert(cols, rows, onCollisionCols, onCollision, mergeNull))
+			var ids []scm.Scmer
+			if len(a) > 7 && scm.ToBool(a[7]) {
+				ids = make([]scm.Scmer, len(rows))
+			}
+			result := db.Tables.Get(scm.String(a[1])).Insert(cols, rows, onCollisionCols, onCollision, mergeNull, ids)
+			if ids != nil {
+				return ids
+			}
+			return int64(result)
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"cached", "wraps a function so its results are cached per scan, e.g. for a lookup into another table (correlated subquery) inside the map function of scan or scan_order: calls with the same arguments during one scan only compute the result once. The cache is shared by the shard workers of the scan and freed when the scan returns; outside of a scan, fn is called directly. fn must be pure, i.e. only depend on its arguments. Create the wrapper outside of the map function, otherwise every row gets a new cache.",
+		1, 1,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"fn", "func", "function whose results are cached by its arguments"},
+		}, "func",
+		func (a ...scm.Scmer) scm.Scmer {
+			return newCachedFunction(a[0])
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"transaction", "runs body and undoes all inserts, updates and deletes that body did on tables of the database if body fails; the error is passed on. This only gives atomic rollback: there is no isolation, other sessions see the rows before the transaction ends, and a crash during body does not roll back.",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database whose tables are rolled back"},
+			scm.DeclarationParameter{"body", "func", "function without parameters; its result is returned"},
+		}, "any",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			return db.Transaction(a[1])
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"foreign-key-checks", "runs body with foreign key checks turned on or off (like SET FOREIGN_KEY_CHECKS in a session) and returns its result; the setting only applies to body, so other sessions are not affected. With nil, the ForeignKeyChecks setting is used.",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"enabled", "bool|nil", "whether inserts are checked against the referenced tables and deletions apply ON DELETE rules"},
+			scm.DeclarationParameter{"body", "func", "function without parameters; its result is returned"},
+		}, "any",
+		func (a ...scm.Scmer) scm.Scmer {
+			if a[0] == nil {
+				return WithForeignKeyChecks(Settings.ForeignKeyChecks, a[1])
+			}
+			return WithForeignKeyChecks(scm.ToBool(a[0]), a[1])
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"changes-since", "returns all changes of a table after a sequence number in commit order as a list of assoc lists (seq op row) where op is insert or delete; an update is a delete and an insert with the same seq. Use the highest seq as checkpoint for the next call. The history keeps the last million changes of a table (across rebuilds; persisted for engine safe and logged); older checkpoints raise an error.",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"sequenceNumber", "number", "checkpoint: only changes with a higher sequence number are returned"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.ChangesSince(uint64(scm.ToInt(a[2])))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"recover", "point-in-time recovery: creates a new table with the rows of a table as they were at a given time and returns the number of recovered rows. The changes after that time are undone from the change history of the table, so this only works back to the oldest change that is still in the history (see changes-since).",
+		3, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"timestamp", "number", "unix timestamp (as from (now)); fractions of a second are allowed. Writes after that time are not recovered."},
+			scm.DeclarationParameter{"target", "string", "(optional) name of the new table, defaults to table_recovered"},
+		}, "int",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			target := t.Name + "_recovered"
+			if len(a) > 3 {
+				target = scm.String(a[3])
+			}
+			return int64(t.Recover(target, int64(scm.ToFloat(a[2]) * 1e9)))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"table-snapshot", "writes a consistent copy of a table into a directory and returns the number of rows in the snapshot. Writes are only blocked while the delta storage is copied; the main storage is hardlinked or copied afterwards. The snapshot reflects one point in time between two rebuilds.",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"path", "string", "directory to write the snapshot to (relative paths are relative to the data directory); it is created if it does not exist"},
+		}, "int",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return int64(t.Snapshot(scm.String(a[2])))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"table-restore", "creates a new table from a directory written by table-snapshot and returns the number of restored rows",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the new table"},
+			scm.DeclarationParameter{"path", "string", "directory of the snapshot (relative paths are relative to the data directory)"},
+		}, "int",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			return int64(db.RestoreSnapshot(scm.String(a[1]), scm.String(a[2])))
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
@@ -857,11 +1460,87 @@ func Init(en scm.Env) {
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
-		"show", "show databases/tables/columns\n\n(show) will list all databases as a list of strings\n(show schema) will list all tables as a list of strings\n(show schema tbl) will list all columns as a list of dictionaries with the keys (name type dimensions)",
-		0, 2,
+		"metrics", "returns the table sizes, scan counters and Go runtime statistics in the Prometheus text format, e.g. to be served under /metrics",
+		0, 0,
+		[]scm.DeclarationParameter{
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			return Metrics()
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"column-approx-distinct", "returns the approximate number of distinct values of a column (HyperLogLog sketch that is maintained on insert, see setting ColumnStatistics)",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"column", "string", "name of the column"},
+		}, "int",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.ColumnStats(scm.String(a[2])).distinct.Count()
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"column-stats", "returns the incrementally maintained statistics of a column as assoc list (min max nulls distinct); deleted rows are only removed from the statistics on rebuild",
+		3, 3,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"column", "string", "name of the column"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			stats := t.ColumnStats(scm.String(a[2]))
+			return []scm.Scmer{"min", stats.min, "max", stats.max, "nulls", int64(stats.nulls), "distinct", stats.distinct.Count()}
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"analyze", "scans a column and computes an equi-depth histogram; explain and the selectivity estimates prefer it over the column statistics as long as the table did not grow or shrink by more than 10%. Strings are ordered by the collation of the column. Returns an assoc list (column rows nulls min max distinct buckets) where buckets is a list of assoc lists (lower upper count distinct). The histogram is kept in memory until the next restart.",
+		3, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"column", "string", "name of the column"},
+			scm.DeclarationParameter{"buckets", "number", "(optional) number of buckets (default 100)"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			buckets := histogramBuckets
+			if len(a) > 3 {
+				buckets = scm.ToInt(a[3])
+			}
+			return t.Analyze(scm.String(a[2]), buckets).toScmer(scm.String(a[2]))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"show", "show databases/tables/columns\n\n(show) will list all databases as a list of strings\n(show schema) will list all tables as a list of strings\n(show schema tbl) will list all columns as a list of dictionaries with the keys (name type dimensions)\n(show schema tbl \"meta\") will return the table metadata as a dictionary with the keys (rows shards dimensions engine collation auto_increment)",
+		0, 3,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "(optional) name of the database if you want to list tables or columns"},
 			scm.DeclarationParameter{"table", "string", "(optional) name of the table if you want to list columns"},
+			scm.DeclarationParameter{"what", "string", "(optional) \"meta\" to get the table metadata instead of the columns"},
 		}, "any",
 		func (a ...scm.Scmer) scm.Scmer {
 			if len(a) == 0 {
@@ -886,11 +1565,37 @@ func Init(en scm.Env) {
 					panic("database " + scm.String(a[0]) + " does not exist")
 				}
 				return db.Tables.Get(scm.String(a[1])).ShowColumns()
+			} else if len(a) == 3 && a[2] == "meta" {
+				// show table status
+				db := GetDatabase(scm.String(a[0]))
+				if db == nil {
+					panic("database " + scm.String(a[0]) + " does not exist")
+				}
+				t := db.Tables.Get(scm.String(a[1]))
+				if t == nil {
+					panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+				}
+				return t.ShowMeta()
 			} else {
 				panic("invalid call of show")
 			}
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"export-schema", "returns the DDL of a database as a string of Scheme code that recreates all tables with their columns, keys and options when evaluated with (eval (scheme code)), or as SQL CREATE TABLE statements. Only the table definitions are read, no data is loaded.",
+		1, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"sql", "bool", "(optional) if true, return SQL CREATE TABLE statements instead of Scheme code"},
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			return db.ExportSchema(len(a) > 1 && scm.ToBool(a[1]))
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"rebuild", "rebuilds all main storages and returns the amount of time it took",
 		0, 2,
@@ -912,23 +1617,80 @@ func Init(en scm.Env) {
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
-		"loadCSV", "loads a CSV file into a table and returns the amount of time it took.\nThe first line of the file must be the headlines. The headlines must match the table's columns exactly.",
-		3, 4,
+		"loadCSV", "loads a CSV file into a table and returns the amount of time it took.\nWithout header, the fields are in the order of the table's columns. Fields in double quotes may contain the delimiter, line breaks and doubled quotes (RFC 4180, as written by exportCSV).\nFields are converted by the type of their column: integer and floating point columns are parsed (an empty field is NULL), string columns keep the text, other columns guess the type of the value.",
+		3, 7,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the table"},
-			scm.DeclarationParameter{"filename", "string", "filename of the CSV file (global path or relative to working directory of memcp)"},
+			scm.DeclarationParameter{"filename", "any", "filename of the CSV file (global path or relative to working directory of memcp) or a stream, e.g. (stream \"https://...\")"},
 			scm.DeclarationParameter{"delimiter", "string", "(optional) delimiter defaults to \";\""},
+			scm.DeclarationParameter{"nullToken", "string", "(optional) fields that are equal to this string become NULL, e.g. \"\\\\N\" or \"\" (nil: no NULL token)"},
+			scm.DeclarationParameter{"lenient", "bool", "(optional) if true, malformed numbers become NULL; otherwise loading fails with the line number"},
+			scm.DeclarationParameter{"header", "bool", "(optional) if true, the first line holds the names of the columns of the fields (as written by exportCSV)"},
 		}, "string",
 		func (a ...scm.Scmer) scm.Scmer {
-			// schema, table, filename, delimiter
+			// schema, table, filename, delimiter, nullToken, lenient, header
 			start := time.Now()
 
 			delimiter := ";"
-			if len(a) > 3 {
+			if len(a) > 3 && a[3] != nil {
 				delimiter = scm.String(a[3])
 			}
-			LoadCSV(scm.String(a[0]), scm.String(a[1]), scm.String(a[2]), delimiter)
+			var options csvOptions
+			if len(a) > 4 && a[4] != nil {
+				nullToken := scm.String(a[4])
+				options.nullToken = &nullToken
+			}
+			options.lenient = len(a) > 5 && scm.ToBool(a[5])
+			options.header = len(a) > 6 && scm.ToBool(a[6])
+			if stream, ok := a[2].(io.Reader); ok {
+				if c, ok := stream.(io.Closer); ok {
+					defer c.Close() // e.g. close the HTTP connection
+				}
+				LoadCSVStream(scm.String(a[0]), scm.String(a[1]), stream, delimiter, options)
+			} else {
+				LoadCSV(scm.String(a[0]), scm.String(a[1]), scm.String(a[2]), delimiter, options)
+			}
+
+			return fmt.Sprint(time.Since(start))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"exportCSV", "writes a table as CSV file and returns the amount of time it took. Fields that contain the delimiter, quotes or line breaks are quoted (RFC 4180), NULL is written as empty field.",
+		3, 6,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"filename", "string|any", "filename of the CSV file (global path or relative to working directory of memcp) or a writable stream"},
+			scm.DeclarationParameter{"delimiter", "string", "(optional) delimiter defaults to \";\""},
+			scm.DeclarationParameter{"columns", "list", "(optional) list of columns to export, defaults to all columns"},
+			scm.DeclarationParameter{"header", "bool", "(optional) write the column names as first line (default: true); load it with the header option of loadCSV"},
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, table, filename, delimiter, columns, header
+			start := time.Now()
+
+			delimiter := ";"
+			if len(a) > 3 && a[3] != nil {
+				delimiter = scm.String(a[3])
+			}
+			var cols []string
+			if len(a) > 4 && a[4] != nil {
+				for _, c := range a[4].([]scm.Scmer) {
+					cols = append(cols, scm.String(c))
+				}
+			}
+			header := len(a) <= 5 || scm.ToBool(a[5])
+			if f, ok := a[2].(io.Writer); ok {
+				ExportCSV(scm.String(a[0]), scm.String(a[1]), f, delimiter, cols, header)
+			} else {
+				f, err := os.Create(scm.String(a[2]))
+				if err != nil {
+					panic(err)
+				}
+				defer f.Close()
+				ExportCSV(scm.String(a[0]), scm.String(a[1]), f, delimiter, cols, header)
+			}
 
 			return fmt.Sprint(time.Since(start))
 		},
@@ -938,19 +1700,47 @@ func Init(en scm.Env) {
 		2, 2,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database where you want to put the tables in"},
-			scm.DeclarationParameter{"filename", "string", "filename of the .jsonl file (global path or relative to working directory of memcp)"},
+			scm.DeclarationParameter{"filename", "any", "filename of the .jsonl file (global path or relative to working directory of memcp) or a stream, e.g. (stream \"https://...\")"},
 		}, "string",
 		func (a ...scm.Scmer) scm.Scmer {
 			// schema, filename
 			start := time.Now()
 
-			LoadJSON(scm.String(a[0]), scm.String(a[1]))
+			if stream, ok := a[1].(io.Reader); ok {
+				if c, ok := stream.(io.Closer); ok {
+					defer c.Close() // e.g. close the HTTP connection
+				}
+				loadJSONStream(scm.String(a[0]), stream)
+			} else {
+				LoadJSON(scm.String(a[0]), scm.String(a[1]))
+			}
 
 			return fmt.Sprint(time.Since(start))
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
-		"settings", "reads or writes a global settings value. This modifies your data/settings.json.",
+		"loadJSONParallel", "loads several .jsonl streams (e.g. the parts of a split dump) concurrently into a database and returns an assoc list with the total duration and the number of inserted rows. The format is the same as for loadJSON; every stream must declare its own '#table <tablename>' before its rows.",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database where you want to put the tables in"},
+			scm.DeclarationParameter{"streams", "list", "list of input streams; at most GOMAXPROCS streams are read at the same time"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, streams
+			start := time.Now()
+
+			list := a[1].([]scm.Scmer)
+			streams := make([]io.Reader, len(list))
+			for i, stream := range list {
+				streams[i] = stream.(io.Reader)
+			}
+			rows := LoadJSONParallel(scm.String(a[0]), streams)
+
+			return []scm.Scmer{"duration", fmt.Sprint(time.Since(start)), "rows", int64(rows)}
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"settings", "reads or writes a global settings value. Setting a value validates it and immediately rewrites your data/settings.json. SyncInterval (milliseconds) trades latency for fewer fsyncs: the writes of all sessions to a safe table are synced together at most once per interval, but every statement waits for that sync, so a single session gets slower (10000 single-row inserts took 105 s at 10 instead of 1 s at 0, the default); it only saves disk load when many sessions write concurrently.",
 		1, 2,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"key", "string", "name of the key to set or get (for reference, rts)"},
@@ -981,10 +1771,7 @@ func (db *database) PrintMemUsage() string {
 	b.WriteString("Table                    \tColumns\tShards\tDims\tSize/Bytes\n")
 	var dsize uint
 	for _, t := range db.Tables.GetAll() {
-		var size uint = 10*8 + 32 * uint(len(t.Columns))
-		for _, s := range t.Shards {
-			size += s.Size()
-		}
+		size := t.Size()
 		b.WriteString(fmt.Sprintf("%-25s\t%d\t%d\t%d\t%s\n", t.Name, len(t.Columns), len(t.Shards) + len(t.PShards), len(t.PDimensions), units.BytesSize(float64(size))));
 		dsize += size
 	}
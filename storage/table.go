@@ -18,6 +18,7 @@ package storage
 
 import "fmt"
 import "sync"
+import "sync/atomic"
 import "errors"
 import "strings"
 import "encoding/json"
@@ -29,6 +30,7 @@ type column struct {
 	Typ string
 	Typdimensions []int // type dimensions for DECIMAL(10,3) and VARCHAR(5)
 	Computor scm.Scmer `json:"-"` // TODO: marshaljson -> serialize
+	ComputorCols []string `json:"-"` // input columns of Computor
 	PartitioningScore int // count this up to increase the chance of partitioning for this column
 	AutoIncrement bool
 	Default scm.Scmer
@@ -37,6 +39,10 @@ type column struct {
 	IsTemp bool // columns with IsTemp may be removed without consequences
 	Collation string
 	Comment string
+	StorageHint string // forces a storage type on rebuild instead of proposeCompression as long as the values fit (see storageHints)
+	Bloom bool // build a bloom filter over the main storage on rebuild, so equality scans can skip shards
+	EnumValues []string // members of an ENUM column (stored as StorageEnum)
+	EnumInvalidNull bool // store NULL for values that are not members instead of failing
 	// TODO: LRU statistics for computed columns
 }
 type PersistencyMode uint8
@@ -84,19 +90,40 @@ type table struct {
 	Columns []column
 	Unique []uniqueKey // unique keys
 	Foreign []foreignKey // foreign keys
+	Triggers []*trigger // see trigger.go
 	PersistencyMode PersistencyMode /* 0 = safe (default), 1 = sloppy, 2 = memory */
 	mu sync.Mutex // schema/sharding lock
 	uniquelock sync.Mutex // unique insert lock
 	Auto_increment uint64 // this dosen't scale over multiple cores, so assign auto_increment ranges to each shard
+	LogSequence uint64 // sequence number of the last write (monotonic, also across rebuilds)
+	LogCompacted uint64 // changes up to this sequence number were dropped from the change history (see changes.go)
+	LogCompactedTime int64 // wall-clock time (unix nanoseconds) of the newest dropped change; recover cannot go back before it
+	HistoryId string // name of the log that persists the change history; empty until the first change is moved there
+	history []changeEvent // changes whose shard was rebuilt or repartitioned
+	historyMu sync.Mutex
+	historyLog PersistenceLogfile
 	Collation string
 	Charset string
 	Comment string
+	Compress string // compression of the column files: "", "zstd" or "xz" (see compress.go)
+	histograms sync.Map // column -> *histogram of (analyze ...), see histogram.go
 
 	// storage: if both arrays Shards and PShards are present, Shards is the single point of truth
 	Shards []*storageShard // unordered shards; as long as this value is not nil, use shards instead of pshards
 	PShards []*storageShard // partitioned shards according to PDimensions
 	PDimensions []shardDimension
 	// TODO: move rows from Shards to PShards according to PDimensions
+
+	// repartitioning: INSERT holds insertMu shared from choosing its target shards until the rows are written; repartition switches the shard lists under the exclusive lock
+	insertMu sync.RWMutex
+	repartitionShards []*storageShard // new partitions that receive the inserts into old shards with dualWrite
+	repartitionDimensions []shardDimension
+	repartitionInserts uint64 // number of inserts that were written twice (each one has its own log sequence number)
+
+	// running snapshot scans; they are told about every later write (see scan.go)
+	snapshotMu sync.Mutex
+	snapshots []*scanSnapshot
+	activeSnapshots int32
 }
 
 func (t *table) Count() (result uint) {
@@ -110,6 +137,21 @@ func (t *table) Count() (result uint) {
 	return
 }
 
+// estimated main memory usage in bytes
+func (t *table) Size() uint {
+	var result uint = 10*8 + 32 * uint(len(t.Columns))
+	shards := t.Shards
+	if shards == nil {
+		shards = t.PShards
+	}
+	for _, s := range shards {
+		if s != nil {
+			result += s.Size()
+		}
+	}
+	return result
+}
+
 /* Implement NonLockingReadMap */
 func (t table) GetKey() string {
 	return t.Name
@@ -127,18 +169,21 @@ func (t *table) AddPartitioningScore(cols []string) {
 	}
 }
 
-func (m *PersistencyMode) MarshalJSON() ([]byte, error) {
-	if (*m == Memory) {
-		return []byte("\"memory\""), nil
-	}
-	if (*m == Sloppy) {
-		return []byte("\"sloppy\""), nil
-	}
-	if (*m == Logged) {
-		return []byte("\"logged\""), nil
+func (m PersistencyMode) String() string {
+	switch m {
+		case Memory:
+			return "memory"
+		case Sloppy: // Logged has the same value
+			return "sloppy"
+		case Safe:
+			return "safe"
 	}
-	if (*m == Safe) {
-		return []byte("\"safe\""), nil
+	return ""
+}
+
+func (m *PersistencyMode) MarshalJSON() ([]byte, error) {
+	if str := m.String(); str != "" {
+		return []byte("\"" + str + "\""), nil
 	}
 	return nil, errors.New("unknown persistency mode")
 }
@@ -195,10 +240,33 @@ func (t *table) ShowColumns() scm.Scmer {
 	return result
 }
 
+// table-level metadata; only reads counters, so it does not scan any data
+func (t *table) ShowMeta() scm.Scmer {
+	if t == nil {
+		return nil
+	}
+	shards := t.Shards
+	if shards == nil {
+		shards = t.PShards
+	}
+	dims := make([]scm.Scmer, len(t.PDimensions))
+	for i, d := range t.PDimensions {
+		dims[i] = d.Column
+	}
+	return []scm.Scmer{
+		"rows", int64(t.Count()),
+		"shards", int64(len(shards)),
+		"dimensions", dims,
+		"engine", t.PersistencyMode.String(),
+		"collation", t.Collation,
+		"auto_increment", int64(t.Auto_increment),
+	}
+}
+
 func (c *column) Show() scm.Scmer {
 	dims := make([]scm.Scmer, len(c.Typdimensions))
 	for i, v := range c.Typdimensions {
-		dims[i] = v
+		dims[i] = int64(v)
 	}
 	typ := c.Typ
 	if len(dims) > 0 {
@@ -235,6 +303,12 @@ func (c *column) Alter(key string, val scm.Scmer) scm.Scmer {
 		case "comment":
 			c.Comment = scm.String(val)
 			return c.Comment
+		case "storage":
+			c.StorageHint = checkStorageHint(scm.String(val))
+			return c.StorageHint
+		case "bloom":
+			c.Bloom = scm.ToBool(val)
+			return c.Bloom
 		default:
 			panic("unimplemented alter column operation: " + key)
 	}
@@ -302,6 +376,21 @@ func (t *table) CreateColumn(name string, typ string, typdimensions[] int, extra
 			c.Collation = scm.String(extrainfo[i+1])
 		} else if extrainfo[i] == "temp" {
 			c.IsTemp = scm.ToBool(extrainfo[i+1])
+		} else if extrainfo[i] == "storage" {
+			c.StorageHint = checkStorageHint(scm.String(extrainfo[i+1]))
+		} else if extrainfo[i] == "bloom" {
+			c.Bloom = scm.ToBool(extrainfo[i+1])
+		} else if extrainfo[i] == "enum" {
+			members := extrainfo[i+1].([]scm.Scmer)
+			c.EnumValues = make([]string, len(members))
+			for j, m := range members {
+				c.EnumValues[j] = scm.String(m)
+			}
+			if len(c.EnumValues) >= 65536 {
+				panic("ENUM column " + name + " has too many members")
+			}
+		} else if extrainfo[i] == "enumInvalidNull" {
+			c.EnumInvalidNull = scm.ToBool(extrainfo[i+1])
 		} else {
 			panic("unknown column attribute: " + scm.String(extrainfo[i]))
 		}
@@ -339,37 +428,240 @@ func (t *table) DropColumn(name string) bool {
 	panic("drop column does not exist: " + t.Name + "." + name)
 }
 
-func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols []string, onCollision scm.Scmer, mergeNull bool) int {
+func (t *table) RenameColumn(oldName string, newName string) bool {
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	for _, c := range t.Columns {
+		if c.Name == newName {
+			panic("column " + t.Name + "." + newName + " already exists")
+		}
+	}
+	idx := -1
+	for i, c := range t.Columns {
+		if c.Name == oldName {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		panic("rename column does not exist: " + t.Name + "." + oldName)
+	}
+	t.mu.Lock() // no rebuild or repartition while the shards are renamed
+	defer t.mu.Unlock()
+	t.Columns[idx].Name = newName
+	for i := range t.Columns {
+		if cols := renameInKey(t.Columns[i].ComputorCols, oldName, newName); cols != nil {
+			t.Columns[i].ComputorCols = cols
+		}
+	}
+	for i := range t.Unique {
+		if cols := renameInKey(t.Unique[i].Cols, oldName, newName); cols != nil {
+			t.Unique[i].Cols = cols
+		}
+	}
+	// foreign keys are stored in both tables
+	for _, t2 := range t.schema.Tables.GetAll() {
+		for i := range t2.Foreign {
+			fk := &t2.Foreign[i]
+			if fk.Tbl1 == t.Name {
+				if cols := renameInKey(fk.Cols1, oldName, newName); cols != nil {
+					fk.Cols1 = cols
+				}
+			}
+			if fk.Tbl2 == t.Name {
+				if cols := renameInKey(fk.Cols2, oldName, newName); cols != nil {
+					fk.Cols2 = cols
+				}
+			}
+		}
+	}
+	for i := range t.PDimensions {
+		if t.PDimensions[i].Column == oldName {
+			t.PDimensions[i].Column = newName
+		}
+	}
+	for _, s := range t.Shards {
+		s.renameColumn(oldName, newName)
+	}
+	for _, s := range t.PShards {
+		s.renameColumn(oldName, newName)
+	}
+	t.schema.save()
+	return true
+}
+
+// checks that each row references an existing row for every foreign key where t is the referencing table
+// NULL in any column of the key means that the row references nothing (SQL); keys to tables that are not created yet (forward declarations) are not checked
+func (t *table) checkForeignKeys(columns []string, values [][]scm.Scmer) {
+	for _, fk := range t.Foreign {
+		if fk.Tbl1 != t.Name {
+			continue // we are the referenced table
+		}
+		parent := t.schema.Tables.Get(fk.Tbl2)
+		if parent == nil {
+			continue
+		}
+		colidx := make([]int, len(fk.Cols1))
+		defaults := make([]scm.Scmer, len(fk.Cols1)) // value of a column that is not inserted
+		for i, col := range fk.Cols1 {
+			colidx[i] = -1
+			for j, col2 := range columns {
+				if col == col2 {
+					colidx[i] = j
+				}
+			}
+			for _, c := range t.Columns {
+				if c.Name == col {
+					defaults[i] = c.Default
+				}
+			}
+		}
+		cols := make([]scm.Scmer, len(fk.Cols2))
+		for i, c := range fk.Cols2 {
+			cols[i] = scm.Symbol(c)
+		}
+		checked := make(map[string]bool) // a batch often references the same row many times
+		for _, row := range values {
+			key := make([]scm.Scmer, len(colidx))
+			hasNull := false
+			for i, j := range colidx {
+				if j >= 0 && j < len(row) {
+					key[i] = row[j]
+				} else {
+					key[i] = defaults[i]
+				}
+				if key[i] == nil {
+					hasNull = true
+				}
+			}
+			if hasNull || checked[fmt.Sprint(key)] {
+				continue
+			}
+			conditionBody := make([]scm.Scmer, len(key) + 1)
+			conditionBody[0] = scm.Symbol("and")
+			for i, v := range key {
+				conditionBody[i + 1] = []scm.Scmer{scm.Symbol("equal?"), scm.NthLocalVar(i), v}
+			}
+			if !parent.scanExists(fk.Cols2, scm.Proc {cols, conditionBody, &scm.Globalenv, len(cols)}) && !(parent == t && batchContains(columns, values, fk.Cols2, key)) {
+				panic("Foreign key constraint violated in table " + t.Name + ": " + fk.Id + " (" + fmt.Sprint(key) + " is not present in " + fk.Tbl2 + ")")
+			}
+			checked[fmt.Sprint(key)] = true
+		}
+	}
+}
+
+// whether a row of the batch has the values key in cols (rows may reference each other with a self-referencing foreign key)
+func batchContains(columns []string, values [][]scm.Scmer, cols []string, key []scm.Scmer) bool {
+	colidx := make([]int, len(cols))
+	for i, col := range cols {
+		colidx[i] = -1
+		for j, col2 := range columns {
+			if col == col2 {
+				colidx[i] = j
+			}
+		}
+		if colidx[i] == -1 {
+			return false
+		}
+	}
+	for _, row := range values {
+		found := true
+		for i, j := range colidx {
+			if j >= len(row) || !scm.Equal(row[j], key[i]) {
+				found = false
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// ids: if not nil, it is filled with the auto_increment id of each row of values (nil for rows that collided)
+func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols []string, onCollision scm.Scmer, mergeNull bool, ids []scm.Scmer) int {
 	result := 0
-	// TODO: check foreign keys (new value of column must be present in referenced table)
+	for _, b := range t.fireBeforeInsert(columns, values) {
+		var batchIds []scm.Scmer
+		if ids != nil {
+			batchIds = ids[b.start:b.start + len(b.values)]
+		}
+		result += t.insert(b.columns, b.values, onCollisionCols, onCollision, mergeNull, batchIds)
+	}
+	return result
+}
+
+func (t *table) insert(columns []string, values [][]scm.Scmer, onCollisionCols []string, onCollision scm.Scmer, mergeNull bool, ids []scm.Scmer) int {
+	result := 0
+	// position of a row inside values; ProcessUniqueCollision passes subslices of values to the success callback
+	var rowPos map[*[]scm.Scmer]int
+	if ids != nil && len(t.Unique) > 0 {
+		rowPos = make(map[*[]scm.Scmer]int, len(values))
+		for i := range values {
+			rowPos[&values[i]] = i
+		}
+	}
+	// rows that were written and their ids for AFTER INSERT triggers
+	afterInsert := len(t.triggers("after", "insert")) > 0
+	var inserted [][]scm.Scmer
+	var insertedIds []scm.Scmer
+	collectIds := func(rows [][]scm.Scmer, newids []scm.Scmer, offset int) {
+		if afterInsert {
+			inserted = append(inserted, rows...)
+			if newids == nil {
+				newids = make([]scm.Scmer, len(rows))
+			}
+			insertedIds = append(insertedIds, newids...)
+		}
+		if ids != nil && newids != nil && len(rows) > 0 {
+			if rowPos != nil {
+				offset = rowPos[&rows[0]]
+			}
+			copy(ids[offset:], newids)
+		}
+	}
+	t.checkEnums(columns, values)
+	if foreignKeyChecks() {
+		t.checkForeignKeys(columns, values)
+	}
+
+	finished := false
+	if afterInsert {
+		defer func () {
+			if finished {
+				t.fireAfterInsert(columns, inserted, insertedIds) // runs after insertMu is released, so the triggers may insert into this table
+			}
+		}()
+	}
+	t.insertMu.RLock()
+	// load balance: if bucket is full, create new one; if bucket is busy (trylock), try another one
+	for t.Shards != nil && t.Shards[len(t.Shards)-1].Count() >= Settings.ShardSize {
+		t.insertMu.RUnlock() // rebuild holds t.mu while it waits for insertMu
+		t.mu.Lock()
+		// reload shard after lock to avoid race conditions
+		if t.Shards != nil && t.Shards[len(t.Shards)-1].Count() >= Settings.ShardSize {
+			go func(i int) {
+				// rebuild full shards in background
+				s := t.Shards[i]
+				t.Shards[i] = s.rebuild(false)
+				// write new uuids to disk
+				t.schema.save()
+			}(len(t.Shards)-1)
+			fmt.Println("started new shard for table", t.Name)
+			t.Shards = append(t.Shards, NewShard(t))
+		}
+		t.mu.Unlock()
+		t.insertMu.RLock() // the shard list may have been switched in the meantime
+	}
+	defer t.insertMu.RUnlock()
 
 	if t.Shards != nil { // unpartitioned sharding
 		shard := t.Shards[len(t.Shards)-1]
-		// load balance: if bucket is full, create new one; if bucket is busy (trylock), try another one
-		if shard.Count() >= Settings.ShardSize {
-			t.mu.Lock()
-			// reload shard after lock to avoid race conditions
-			shard = t.Shards[len(t.Shards)-1]
-			if shard.Count() >= Settings.ShardSize {
-				go func(i int) {
-					// rebuild full shards in background
-					s := t.Shards[i]
-					t.Shards[i] = s.rebuild(false)
-					// write new uuids to disk
-					t.schema.save()
-				}(len(t.Shards)-1)
-				shard = NewShard(t)
-				fmt.Println("started new shard for table", t.Name)
-				t.Shards = append(t.Shards, shard)
-			}
-			t.mu.Unlock()
-		}
 
 		// check unique constraints in a thread safe manner
 		if len(t.Unique) > 0 {
 			t.ProcessUniqueCollision(columns, values, mergeNull, func (values [][]scm.Scmer) {
 				// physically insert
-				shard.Insert(columns, values, false)
+				collectIds(values, shard.Insert(columns, values, false), 0)
 				result += len(values)
 			}, onCollisionCols, func (errmsg string, data []scm.Scmer) {
 				if onCollision != nil {
@@ -380,7 +672,7 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 			}, 0)
 		} else {
 			// physically insert (parallel)
-			shard.Insert(columns, values, false)
+			collectIds(values, shard.Insert(columns, values, false), 0)
 			result += len(values)
 		}
 	} else {
@@ -397,13 +689,13 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 			}
 		}
 
-		checkUniqueForShard := func(s *storageShard, values [][]scm.Scmer) {
+		checkUniqueForShard := func(s *storageShard, values [][]scm.Scmer, offset int) {
 			// check unique constraints in a thread safe manner
 			if len(t.Unique) > 0 {
 				// this function will do the locking for us
 				t.ProcessUniqueCollision(columns, values, mergeNull, func (values [][]scm.Scmer) {
 					// physically insert
-					s.Insert(columns, values, false)
+					collectIds(values, s.Insert(columns, values, false), 0)
 					result += len(values)
 				}, onCollisionCols, func (errmsg string, data []scm.Scmer) {
 					if onCollision != nil {
@@ -414,7 +706,7 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 				}, 0)
 			} else {
 				// physically insert (parallel)
-				s.Insert(columns, values, false)
+				collectIds(values, s.Insert(columns, values, false), offset)
 				result += len(values)
 			}
 		}
@@ -431,20 +723,98 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 			}
 			shard := t.PShards[computeShardIndex(dims, shardcols)]
 			if i > 0 && shard != last_shard {
-				checkUniqueForShard(last_shard, values[last_i:i]) // shard has changed: bulk insert all items that belong to this shard
+				checkUniqueForShard(last_shard, values[last_i:i], last_i) // shard has changed: bulk insert all items that belong to this shard
 				last_i = i
 			}
 			last_shard = shard
 		}
 		if last_i < len(values) { // bulk insert the rest
-			checkUniqueForShard(last_shard, values[last_i:])
+			checkUniqueForShard(last_shard, values[last_i:], last_i)
 		}
 	}
 
-	// TODO: Trigger after insert
+	finished = true
 	return result
 }
 
+/*
+	builds onCollisionCols and onCollision for ON DUPLICATE KEY UPDATE.
+	updates is an assoc list column -> value; a value may be a lambda whose
+	parameters name the existing row (old.col or col) or the inserted row (NEW.col).
+	With multiple unique keys, only the row of the first colliding key is updated.
+*/
+func onDuplicateUpdate(updates []scm.Scmer) ([]string, scm.Scmer) {
+	onCollisionCols := []string{"$update"}
+	keys := []scm.Scmer{"$update"}
+	for i := 1; i < len(updates); i += 2 {
+		if p, ok := updates[i].(scm.Proc); ok {
+			params, ok := p.Params.([]scm.Scmer)
+			if !ok {
+				panic("on duplicate update: lambda must have a parameter list")
+			}
+			for _, param := range params {
+				name := scm.String(param)
+				col := name
+				if len(name) >= 4 && name[:4] == "old." {
+					col = name[4:]
+				}
+				onCollisionCols = append(onCollisionCols, col)
+				keys = append(keys, name)
+			}
+		}
+	}
+	return onCollisionCols, func (a ...scm.Scmer) scm.Scmer {
+		// a is filled in the order of onCollisionCols
+		args := make([]scm.Scmer, 2 * len(a))
+		for i, v := range a {
+			args[2*i] = keys[i]
+			args[2*i+1] = v
+		}
+		changes := make([]scm.Scmer, len(updates))
+		for i := 0; i < len(updates); i += 2 {
+			changes[i] = updates[i]
+			if _, ok := updates[i+1].(scm.Proc); ok {
+				changes[i+1] = scm.ApplyAssoc(updates[i+1], args)
+			} else {
+				changes[i+1] = updates[i+1]
+			}
+		}
+		return scm.Apply(a[0], changes)
+	}
+}
+
+// during repartitioning, rows that were written into an old shard after it was copied are also inserted into the new partitions; the caller holds the lock of the old shard
+func (t *table) dualWrite(columns []string, values [][]scm.Scmer, seq uint64) {
+	newshards := t.repartitionShards
+	atomic.AddUint64(&t.repartitionInserts, 1)
+	dims := t.repartitionDimensions
+	shardcols := make([]scm.Scmer, len(dims))
+	translatable := make([]int, len(dims))
+	for i, cd := range dims {
+		translatable[i] = -1
+		for j, col := range columns {
+			if cd.Column == col {
+				translatable[i] = j
+			}
+		}
+	}
+	rows := make(map[int][][]scm.Scmer)
+	for _, row := range values {
+		for j, colidx := range translatable {
+			if colidx >= 0 && colidx < len(row) {
+				shardcols[j] = row[colidx]
+			} else {
+				shardcols[j] = nil
+			}
+		}
+		si := computeShardIndex(dims, shardcols)
+		rows[si] = append(rows[si], row)
+	}
+	for si, r := range rows {
+		newshards[si].insert(columns, r, false, seq) // same sequence number, so repartition can tell inserts from other writes
+	}
+}
+
 /*
 	checks a number of datasets for unique collisions.
 	For each block of datasets that pass, success is called.
@@ -501,9 +871,24 @@ func (t *table) ProcessUniqueCollision(columns []string, values [][]scm.Scmer, m
 		}
 
 		last_j := 0
+		pending := make(map[string]bool) // keys of values[last_j:j] that are not inserted yet
 		for j, row := range values {
+			hasNull := false
 			for i, colidx := range keyIdx {
 				key[i] = row[colidx]
+				if key[i] == nil {
+					hasNull = true
+				}
+			}
+			if mergeNull || !hasNull {
+				// the same key twice in one batch: insert the first one so the second one collides with it
+				pendingKey := scm.SerializeToString(key, &scm.Globalenv)
+				if pending[pendingKey] {
+					t.ProcessUniqueCollision(columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
+					last_j = j
+					pending = make(map[string]bool)
+				}
+				pending[pendingKey] = true
 			}
 			shardlist2 := shardlist
 			if allowPruning {
@@ -525,6 +910,7 @@ func (t *table) ProcessUniqueCollision(columns []string, values [][]scm.Scmer, m
 						t.ProcessUniqueCollision(columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
 					}
 					last_j = j+1
+					pending = make(map[string]bool)
 					lock.Unlock()
 					params := make([]scm.Scmer, len(onCollisionCols))
 					for i, p := range onCollisionCols {
@@ -576,7 +962,26 @@ func (t *table) ProcessUniqueCollision(columns []string, values [][]scm.Scmer, m
 		conditionBody := make([]scm.Scmer, len(uniq.Cols) + 1)
 		conditionBody[0] = scm.Symbol("and")
 		last_j := 0
+		pending := make(map[string]bool) // keys of values[last_j:j] that are not inserted yet
+		key := make([]scm.Scmer, len(uniq.Cols))
 		for j, row := range values {
+			hasNull := false
+			for i, colidx := range colidx {
+				key[i] = row[colidx]
+				if key[i] == nil {
+					hasNull = true
+				}
+			}
+			if mergeNull || !hasNull {
+				// the same key twice in one batch: insert the first one so the second one collides with it
+				pendingKey := scm.SerializeToString(key, &scm.Globalenv)
+				if pending[pendingKey] {
+					t.ProcessUniqueCollision(columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
+					last_j = j
+					pending = make(map[string]bool)
+				}
+				pending[pendingKey] = true
+			}
 			for i, colidx := range colidx {
 				value := row[colidx]
 				if !mergeNull && value == nil {
@@ -600,13 +1005,14 @@ func (t *table) ProcessUniqueCollision(columns []string, values [][]scm.Scmer, m
 				failure(uniq.Id, args) // call collision function
 				t.uniquelock.Lock()
 				return true // feedback that there was a collision
-			}, func(a ...scm.Scmer) scm.Scmer {return a[1]}, nil, nil, false)
+			}, func(a ...scm.Scmer) scm.Scmer {return a[1]}, nil, nil, false, scanOptions{})
 			if updatefn != nil {
 				// found a unique collision: flush the successing items and skip this one
 				if j != last_j {
 					t.ProcessUniqueCollision(columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
 				}
 				last_j = j+1
+				pending = make(map[string]bool)
 			}
 		}
 		if len(values) != last_j {
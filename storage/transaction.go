@@ -0,0 +1,175 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sync"
+import "time"
+import "github.com/jtolds/gls"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+transactions
+
+(transaction schema body) records an undo log of all rows that body inserts into or deletes
+from tables of schema. If body panics, the undo log is replayed backwards: inserted rows are
+deleted and deleted rows are made live again (an update is a delete plus an insert). A deleted
+row keeps its record id if its shard is still in use; if the shard was rebuilt or repartitioned in
+the meantime, the row is inserted again through the table. Both ways check the unique keys and
+foreign keys like an insert, and the undo writes are logged like any other write.
+
+This is atomic rollback only: there is no isolation between concurrent transactions, other
+sessions see the uncommitted rows, and a crash in the middle of body leaves the rows that were
+written so far. Inserted rows of a shard that is repartitioned during the transaction are not
+deleted again.
+
+*/
+
+var transactionContext = gls.NewContextManager()
+
+type undoEntry struct {
+	s *storageShard
+	idx uint
+	count uint // number of inserted rows starting at idx
+	deleted bool // idx was deleted
+	row []scm.Scmer // assoc list of the deleted row
+}
+
+type transaction struct {
+	schema *database
+	mu sync.Mutex // shard workers of parallel scans write into the same undo log
+	undo []undoEntry
+}
+
+func currentTransaction() *transaction {
+	if tx, ok := transactionContext.GetValue("transaction"); ok && tx != nil {
+		return tx.(*transaction)
+	}
+	return nil
+}
+
+// called by the write paths after a row was inserted or deleted
+// contract: must be called inside mu.RLock() or mu.Lock()
+func (t *storageShard) recordUndo(idx uint, count uint, deleted bool) {
+	tx := currentTransaction()
+	if tx == nil || tx.schema != t.t.schema {
+		return
+	}
+	var row []scm.Scmer
+	if deleted {
+		row = t.rowAssoc(idx).([]scm.Scmer) // the shard may be rebuilt before the rollback
+	}
+	tx.mu.Lock()
+	tx.undo = append(tx.undo, undoEntry{t, idx, count, deleted, row})
+	tx.mu.Unlock()
+}
+
+func (db *database) Transaction(body scm.Scmer) (result scm.Scmer) {
+	outer := currentTransaction()
+	tx := &transaction{schema: db}
+	defer func () {
+		if r := recover(); r != nil {
+			transactionContext.SetValues(gls.Values{"transaction": nil}, tx.rollback) // an outer transaction must not record the undo writes
+			panic(r)
+		}
+		if outer != nil && outer.schema == db {
+			// nested transaction: the outer transaction has to undo these writes, too
+			outer.mu.Lock()
+			outer.undo = append(outer.undo, tx.undo...)
+			outer.mu.Unlock()
+		}
+	}()
+	transactionContext.SetValues(gls.Values{"transaction": tx}, func () {
+		result = scm.Apply(body)
+	})
+	return
+}
+
+func (tx *transaction) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := tx.undo[i]
+		if u.deleted {
+			u.s.t.undelete(u.s, u.idx, u.row)
+		} else {
+			for idx := u.idx; idx < u.idx + u.count; idx++ {
+				if !u.s.deletions.Get(idx) {
+					u.s.updateFunction(idx, false, u.s.t.nextSequence())() // an own sequence number: the undo must not cascade into foreign keys
+				}
+			}
+		}
+	}
+}
+
+// makes the deleted row idx of shard s live again; row is its assoc list
+func (t *table) undelete(s *storageShard, idx uint, row []scm.Scmer) {
+	cols := make([]string, 0, len(row) / 2)
+	values := make([]scm.Scmer, 0, len(row) / 2)
+	for j := 0; j < len(row); j += 2 {
+		cols = append(cols, scm.String(row[j]))
+		values = append(values, row[j+1])
+	}
+	if foreignKeyChecks() {
+		t.checkForeignKeys(cols, [][]scm.Scmer{values})
+	}
+	restored := false
+	t.ProcessUniqueCollision(cols, [][]scm.Scmer{values}, false, func (values [][]scm.Scmer) {
+		restored = s.undelete(idx) // inside the unique lock, so no insert of the same key comes in between
+	}, nil, func (errmsg string, data []scm.Scmer) {
+		panic("Unique key constraint violated in table " + t.Name + ": " + errmsg)
+	}, 0)
+	if !restored {
+		// the shard was rebuilt or repartitioned and no longer holds the row
+		t.Insert(cols, [][]scm.Scmer{values}, nil, nil, false, nil)
+	}
+}
+
+// clears the deletion mark of idx; returns false if the shard is no longer in use
+func (t *storageShard) undelete(idx uint) bool {
+	t.mu.Lock()
+	if t.next != nil || !t.t.hasShard(t) {
+		t.mu.Unlock()
+		return false
+	}
+	if t.deletions.Get(idx) {
+		t.deletions.Set(idx, false) // mark as undeleted
+		seq := t.t.nextSequence() // also makes a running repartition start over
+		ts := time.Now().UnixNano()
+		t.recordChange(seq, ts, idx, 1)
+		if (t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged) && t.logfile != nil {
+			t.logfile.Write(LogEntryUndelete{seq, ts, idx})
+		}
+	}
+	t.mu.Unlock()
+	if logfile := t.logfile; t.t.PersistencyMode == Safe && logfile != nil {
+		logfile.Sync()
+	}
+	return true
+}
+
+func (t *table) hasShard(s *storageShard) bool {
+	for _, s2 := range t.Shards {
+		if s2 == s {
+			return true
+		}
+	}
+	for _, s2 := range t.PShards {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "sync"
+import "bytes"
+import "github.com/jtolds/gls"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+triggers
+
+a trigger is a lambda that is called for every row that is inserted, updated or deleted:
+ - insert: (handler NEW)
+ - update: (handler OLD NEW)
+ - delete: (handler OLD)
+OLD and NEW are assoc lists column -> value.
+
+BEFORE triggers may return a modified NEW assoc list (insert and update) or false to abort the
+statement; AFTER triggers run after the row has been written and their result is ignored.
+The handler is persisted as source in schema.json; it is serialized without its closure, so
+it may only refer to its parameters and global functions.
+
+*/
+
+const maxTriggerDepth = 16 // triggers that write into tables with triggers nest at most this deep
+
+var triggerContext = gls.NewContextManager()
+
+type trigger struct {
+	Timing string // "before" or "after"
+	Event string // "insert", "update" or "delete"
+	Cols []string // update: only fire if one of these columns changes (empty: any column)
+	Source string // serialized handler
+	handler scm.Scmer
+	compile sync.Once
+}
+
+func (t *table) CreateTrigger(timing string, event string, cols []string, handler scm.Scmer) {
+	if timing != "before" && timing != "after" {
+		panic("trigger timing must be before or after: " + timing)
+	}
+	if event != "insert" && event != "update" && event != "delete" {
+		panic("trigger event must be insert, update or delete: " + event)
+	}
+	proc, ok := handler.(scm.Proc)
+	if !ok {
+		panic("trigger handler must be a lambda")
+	}
+	var b bytes.Buffer
+	scm.SerializeEx(&b, proc, proc.En, proc.En, nil) // without the closure, so the source can be evaluated in the global environment
+	for _, col := range cols {
+		found := false
+		for _, c := range t.Columns {
+			if c.Name == col {
+				found = true
+			}
+		}
+		if !found {
+			panic("column " + t.Name + "." + col + " does not exist")
+		}
+	}
+	tr := &trigger{Timing: timing, Event: event, Cols: cols, Source: b.String()}
+	tr.handler = handler
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	t.Triggers = append(t.Triggers[:len(t.Triggers):len(t.Triggers)], tr) // copy on write: writes read the list without a lock
+	t.schema.save()
+}
+
+// triggers of one timing and event; nil if there are none
+func (t *table) triggers(timing string, event string) (result []*trigger) {
+	for _, tr := range t.Triggers {
+		if tr.Timing == timing && tr.Event == event {
+			result = append(result, tr)
+		}
+	}
+	return
+}
+
+func (t *table) hasTriggers(event string) bool {
+	for _, tr := range t.Triggers {
+		if tr.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// calls the handler; triggers loaded from schema.json are compiled on first use
+func (tr *trigger) call(args ...scm.Scmer) (result scm.Scmer) {
+	tr.compile.Do(func () {
+		if tr.handler == nil {
+			tr.handler = scm.Eval(scm.Read("trigger", tr.Source), &scm.Globalenv)
+		}
+	})
+	depth := 0
+	if d, ok := triggerContext.GetValue("depth"); ok {
+		depth = d.(int)
+	}
+	if depth >= maxTriggerDepth {
+		panic("trigger recursion depth exceeded")
+	}
+	triggerContext.SetValues(gls.Values{"depth": depth + 1}, func () {
+		result = scm.Apply(tr.handler, args...)
+	})
+	return
+}
+
+// update triggers with a column list only fire if one of these columns changes
+func (tr *trigger) affected(oldRow, newRow []scm.Scmer) bool {
+	if len(tr.Cols) == 0 {
+		return true
+	}
+	for _, col := range tr.Cols {
+		if !scm.Equal(assocGet(oldRow, col), assocGet(newRow, col)) {
+			return true
+		}
+	}
+	return false
+}
+
+// runs the BEFORE triggers: a returned assoc list replaces NEW, false aborts
+func (t *table) fireBefore(event string, oldRow, newRow []scm.Scmer) []scm.Scmer {
+	for _, tr := range t.triggers("before", event) {
+		var result scm.Scmer
+		switch event {
+			case "insert":
+				result = tr.call(newRow)
+			case "update":
+				if !tr.affected(oldRow, newRow) {
+					continue
+				}
+				result = tr.call(oldRow, newRow)
+			case "delete":
+				result = tr.call(oldRow)
+		}
+		switch r := result.(type) {
+			case []scm.Scmer:
+				if event != "delete" {
+					newRow = r
+				}
+			case bool:
+				if !r {
+					panic("trigger aborted " + event + " on table " + t.Name)
+				}
+		}
+	}
+	return newRow
+}
+
+// OLD row of a record for update and delete triggers
+func (s *storageShard) oldRow(idx uint) []scm.Scmer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rowAssoc(idx).([]scm.Scmer)
+}
+
+func (t *table) fireAfter(event string, oldRow, newRow []scm.Scmer) {
+	for _, tr := range t.triggers("after", event) {
+		switch event {
+			case "insert":
+				tr.call(newRow)
+			case "update":
+				if tr.affected(oldRow, newRow) {
+					tr.call(oldRow, newRow)
+				}
+			case "delete":
+				tr.call(oldRow)
+		}
+	}
+}
+
+// rows of an insert that have the same columns; start is the position of the first row in the insert
+type insertBatch struct {
+	columns []string
+	values [][]scm.Scmer
+	start int
+}
+
+// BEFORE INSERT: every row is passed as NEW; the triggers may add columns to single rows
+// consecutive rows with the same columns form a batch, so a column that a row does not have keeps its default
+func (t *table) fireBeforeInsert(columns []string, values [][]scm.Scmer) []insertBatch {
+	if len(t.triggers("before", "insert")) == 0 {
+		return []insertBatch{insertBatch{columns, values, 0}}
+	}
+	var batches []insertBatch
+	for i, row := range values {
+		newRow := t.fireBefore("insert", nil, rowAssoc(columns, row))
+		rowColumns := make([]string, 0, len(newRow) / 2)
+		rowValues := make([]scm.Scmer, 0, len(newRow) / 2)
+		for j := 0; j + 1 < len(newRow); j += 2 {
+			rowColumns = append(rowColumns, scm.String(newRow[j]))
+			rowValues = append(rowValues, newRow[j+1])
+		}
+		if last := len(batches) - 1; last >= 0 && sameColumns(batches[last].columns, rowColumns) {
+			batches[last].values = append(batches[last].values, rowValues)
+		} else {
+			batches = append(batches, insertBatch{rowColumns, [][]scm.Scmer{rowValues}, i})
+		}
+	}
+	return batches
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AFTER INSERT: NEW also contains the generated auto_increment id
+func (t *table) fireAfterInsert(columns []string, values [][]scm.Scmer, ids []scm.Scmer) {
+	aiCol := ""
+	for _, c := range t.Columns {
+		if c.AutoIncrement {
+			aiCol = c.Name
+		}
+	}
+	for _, c := range columns {
+		if c == aiCol {
+			aiCol = "" // given by the insert
+		}
+	}
+	for i, row := range values {
+		newRow := rowAssoc(columns, row)
+		if aiCol != "" && i < len(ids) && ids[i] != nil {
+			newRow = append(newRow, aiCol, ids[i])
+		}
+		t.fireAfter("insert", nil, newRow)
+	}
+}
+
+func rowAssoc(columns []string, row []scm.Scmer) []scm.Scmer {
+	result := make([]scm.Scmer, 0, 2 * len(columns))
+	for i, col := range columns {
+		var v scm.Scmer
+		if i < len(row) {
+			v = row[i]
+		}
+		result = append(result, col, v)
+	}
+	return result
+}
+
+// NEW = OLD with the changes of an update applied
+func applyChanges(oldRow []scm.Scmer, changes []scm.Scmer) []scm.Scmer {
+	result := append([]scm.Scmer{}, oldRow...)
+	for j := 0; j + 1 < len(changes); j += 2 {
+		found := false
+		for i := 0; i + 1 < len(result); i += 2 {
+			if scm.String(result[i]) == scm.String(changes[j]) {
+				result[i+1] = changes[j+1]
+				found = true
+			}
+		}
+		if !found {
+			result = append(result, changes[j], changes[j+1])
+		}
+	}
+	return result
+}
+
+func assocGet(assoc []scm.Scmer, key string) scm.Scmer {
+	for i := 0; i + 1 < len(assoc); i += 2 {
+		if scm.String(assoc[i]) == key {
+			return assoc[i+1]
+		}
+	}
+	return nil
+}
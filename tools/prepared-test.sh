@@ -0,0 +1,19 @@
+#!/bin/sh
+# prepared statement test: starts memcp on an empty data folder and runs tools/prepared-test against its MySQL port
+# usage: tools/prepared-test.sh [memcp binary, default ./memcp]
+memcp=$(realpath "${1:-./memcp}")
+dir=$(mktemp -d)
+trap 'kill $pid 2>/dev/null; rm -rf "$dir"' EXIT
+port=${MYSQL_PORT:-3399}
+
+(sleep 120 | MYSQL_PORT=$port PORT=$((port + 1)) "$memcp" -data "$dir/data" > "$dir/memcp.out" 2>&1) &
+pid=$!
+for i in $(seq 300); do # the unit tests run first
+	grep -q "MySQL server listening" "$dir/memcp.out" 2>/dev/null && break
+	sleep 0.2
+done
+go run ./tools/prepared-test -addr "127.0.0.1:$port"
+status=$?
+pkill -TERM -P $pid 2>/dev/null
+wait $pid 2>/dev/null
+exit $status
@@ -0,0 +1,91 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* prepared statement test: drives a running memcp over the binary protocol (COM_STMT_PREPARE/EXECUTE/CLOSE)
+usage: go run ./tools/prepared-test [-addr 127.0.0.1:3307] */
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "github.com/launix-de/go-mysqlstack/driver"
+import "github.com/launix-de/go-mysqlstack/sqlparser/depends/sqltypes"
+
+var failed bool
+
+func check(got, expected, msg string) {
+	if got != expected {
+		fmt.Println("failed: " + msg + " (got " + got + ", expected " + expected + ")")
+		failed = true
+	}
+}
+
+// prepares, executes and closes a statement; returns the first column of all result rows
+func execute(conn driver.Conn, query string, params ...sqltypes.Value) []string {
+	stmt, err := conn.ComStatementPrepare(query)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.ComStatementClose()
+	qr, err := stmt.ComStatementQuery(params)
+	if err != nil {
+		panic(err)
+	}
+	result := make([]string, len(qr.Rows))
+	for i, row := range qr.Rows {
+		result[i] = row[0].ToString()
+	}
+	return result
+}
+
+func main() {
+	var addr, user, password string
+	flag.StringVar(&addr, "addr", "127.0.0.1:3307", "address of the memcp MySQL port")
+	flag.StringVar(&user, "user", "root", "MySQL user")
+	flag.StringVar(&password, "password", "admin", "MySQL password")
+	flag.Parse()
+
+	conn, err := driver.NewConn(user, password, addr, "", "utf8")
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	if err = conn.Exec("CREATE DATABASE preparedtest"); err != nil {
+		panic(err)
+	}
+	if err = conn.InitDB("preparedtest"); err != nil {
+		panic(err)
+	}
+	if err = conn.Exec("CREATE TABLE t (id int, s text)"); err != nil {
+		panic(err)
+	}
+
+	execute(conn, "INSERT INTO t (id, s) VALUES (?, ?)", sqltypes.NewInt64(1), sqltypes.NewVarChar("it's a ?"))
+	// the driver announces one parameter per ?, also for the ? inside the literal; its value is ignored
+	execute(conn, "INSERT INTO t (s, id) VALUES ('?', ?)", sqltypes.NewVarChar("unused"), sqltypes.NewInt64(2))
+	check(fmt.Sprint(execute(conn, "SELECT s FROM t WHERE id = ?", sqltypes.NewInt64(1))), "[it's a ?]", "bound string with quote and ?")
+	check(fmt.Sprint(execute(conn, "SELECT s FROM t WHERE id = ?", sqltypes.NewInt64(2))), "[?]", "? inside a literal is kept")
+	check(fmt.Sprint(execute(conn, "SELECT id FROM t WHERE s = '?' AND id = ?", sqltypes.NewVarChar("unused"), sqltypes.NewInt64(2))), "[2]", "placeholder after a literal ?")
+
+	if err = conn.Exec("DROP DATABASE preparedtest"); err != nil {
+		panic(err)
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("prepared statement test passed")
+}
@@ -0,0 +1,68 @@
+#!/bin/sh
+# restart test: fills a table, restarts memcp on the same data folder and checks what was read back from disk
+# usage: tools/restart-test.sh [memcp binary, default ./memcp]
+memcp=$(realpath "${1:-./memcp}")
+dir=$(mktemp -d)
+trap 'rm -rf "$dir"' EXIT
+
+cat > "$dir/check.scm" <<'EOF'
+(define check (lambda (val expected msg) (if (equal? val expected) true (print "failed: " msg " (got " val ")"))))
+(define lookup (lambda (x) (scan "restart" "idx" '("id") (lambda (id) (equal? id x)) '("v") (lambda (v) v) + 0)))
+EOF
+
+cat > "$dir/phase1.scm" <<'EOF'
+(import "check.scm")
+(createdatabase "restart" true)
+(createtable "restart" "idx" '('("column" "id" "int" '() '()) '("column" "v" "int" '() '())) '("engine" "safe") true)
+(insert "restart" "idx" '("id" "v") (map (produceN 5000) (lambda (i) (list i (* i 2)))))
+(createtable "restart" "flags" '('("column" "id" "int" '() '()) '("column" "flag" "bool" '() '())) '("engine" "safe") true)
+(insert "restart" "flags" '("id" "flag") '('(1 true) '(2 false) '(3 nil)))
+(createdatabase "restartplain" true)
+(createtable "restartplain" "strings" '('("column" "s" "text" '() '())) '("engine" "safe") true)
+(insert "restartplain" "strings" '("s") (map (produceN 100000) (lambda (i) (list (concat "customer-" (floor (/ i 7)) "-entry")))))
+(createdatabase "restartzstd" true)
+(createtable "restartzstd" "strings" '('("column" "s" "text" '() '())) '("engine" "safe" "compress" "zstd") true)
+(insert "restartzstd" "strings" '("s") (map (produceN 100000) (lambda (i) (list (concat "customer-" (floor (/ i 7)) "-entry")))))
+(rebuild true false) /* flag is stored as bits with a NULL bitmap */
+(map (produceN 5) lookup) /* the index pays off and is materialized */
+(rebuild true false) /* the new shard builds the index on its first use */
+(check (lookup 4321) 8642 "index lookup after rebuild")
+(createtable "restart" "tx" '('("column" "id" "int" '() '()) '("column" "v" "text" '() '())) '("engine" "safe") true)
+(insert "restart" "tx" '("id" "v") '('(1 "a") '(2 "b")))
+(try (lambda () (transaction "restart" (lambda () (begin
+	(scan "restart" "tx" '("id") (lambda (id) (equal? id 1)) '("$update") (lambda ($update) ($update)) + 0)
+	(error "rollback"))))) (lambda (e) e)) /* the rollback is logged as an undelete */
+EOF
+
+cat > "$dir/phase2.scm" <<'EOF'
+(import "check.scm")
+(check (lookup 4321) 8642 "index lookup after restart")
+(check (lookup 5000) 0 "missing key after restart")
+(check (scan "restart" "tx" '() (lambda () true) '("id" "v") (lambda (id v) (concat id v)) concat "" nil false '("orderedWithinShard" true)) "1a2b" "rolled back delete after restart")
+(insert "restart" "idx" '("id" "v") '('(5000 1)))
+(check (lookup 5000) 1 "index lookup of a row inserted after restart")
+(check (scan "restart" "idx" '() (lambda () true) '() (lambda () 1) + 0) 5001 "row count after restart")
+(check (scan "restart" "flags" '() (lambda () true) '("id" "flag") (lambda (id flag) (concat id (if (nil? flag) "N" (if flag "T" "F")))) concat "" nil false '("orderedWithinShard" true)) "1T2F3N" "bit column after restart")
+(check (scan "restartzstd" "strings" '("s") (lambda (s) (equal? s "customer-777-entry")) '() (lambda () 1) + 0) 7 "zstd column after restart")
+(check (scan "restartzstd" "strings" '() (lambda () true) '("s") (lambda (s) (strlen s)) + 0) (scan "restartplain" "strings" '() (lambda () true) '("s") (lambda (s) (strlen s)) + 0) "zstd column reads the same values as the uncompressed one")
+EOF
+
+"$memcp" -data "$dir/data" -wd "$dir" phase1.scm < /dev/null > "$dir/phase1.out" 2>&1
+"$memcp" -data "$dir/data" -wd "$dir" phase2.scm < /dev/null > "$dir/phase2.out" 2>&1
+status=0
+if grep "failed\|panic" "$dir/phase1.out" "$dir/phase2.out"; then
+	status=1
+fi
+if ! grep -q "loading index on idx" "$dir/phase2.out"; then
+	echo "failed: the materialized index was not persisted"
+	status=1
+fi
+# compare the column files only (the logs are the same); every column file of a shard holds all 100000 rows
+plain=$(wc -c "$dir"/data/restartplain/*-s | grep -v total | sort -n | head -1 | awk '{print $1}')
+zstd=$(wc -c "$dir"/data/restartzstd/*-s | grep -v total | sort -n | tail -1 | awk '{print $1}')
+if [ "$zstd" -ge "$plain" ]; then
+	echo "failed: zstd column files ($zstd bytes) are not smaller than uncompressed ones ($plain bytes)"
+	status=1
+fi
+[ $status = 0 ] && echo "restart test passed"
+exit $status